@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+)
+
+// ansiPalette is the xterm palette for the 16 basic ANSI colours.
+var ansiPalette = [16]string{
+	"#000000", "#cd0000", "#00cd00", "#cdcd00", "#0000ee", "#cd00cd", "#00cdcd", "#e5e5e5",
+	"#7f7f7f", "#ff0000", "#00ff00", "#ffff00", "#5c5cff", "#ff00ff", "#00ffff", "#ffffff",
+}
+
+// ansiStyle is the text style set by ANSI SGR ("Select Graphic Rendition")
+// escape sequences.
+type ansiStyle struct {
+	fg, bg    string // CSS colours; empty for the default
+	bold      bool
+	dim       bool
+	italic    bool
+	underline bool
+}
+
+// css returns the style as the value of a CSS style attribute.
+func (st ansiStyle) css() string {
+	var decls []string
+	if st.fg != "" {
+		decls = append(decls, "color:"+st.fg)
+	}
+	if st.bg != "" {
+		decls = append(decls, "background-color:"+st.bg)
+	}
+	if st.bold {
+		decls = append(decls, "font-weight:bold")
+	}
+	if st.dim {
+		decls = append(decls, "opacity:0.7")
+	}
+	if st.italic {
+		decls = append(decls, "font-style:italic")
+	}
+	if st.underline {
+		decls = append(decls, "text-decoration:underline")
+	}
+	return strings.Join(decls, ";")
+}
+
+// ansiToHTML converts text containing ANSI escape sequences, such as the
+// output of a command that prints in colour, to HTML. Colours and text
+// attributes are converted to styled spans, and any other escape sequences
+// are removed.
+func ansiToHTML(s string) template.HTML {
+	var (
+		b   strings.Builder
+		st  ansiStyle
+		seg strings.Builder // text with the current style
+	)
+	flush := func() {
+		if seg.Len() == 0 {
+			return
+		}
+		text := template.HTMLEscapeString(seg.String())
+		if css := st.css(); css != "" {
+			fmt.Fprintf(&b, `<span style="%s">%s</span>`, css, text)
+		} else {
+			b.WriteString(text)
+		}
+		seg.Reset()
+	}
+
+	for i := 0; i < len(s); {
+		if s[i] != '\x1b' {
+			j := strings.IndexByte(s[i:], '\x1b')
+			if j < 0 {
+				j = len(s) - i
+			}
+			seg.WriteString(s[i : i+j])
+			i += j
+			continue
+		}
+		if i+1 >= len(s) {
+			break
+		}
+
+		switch s[i+1] {
+		case '[':
+			// CSI: parameter bytes, intermediate bytes, then a final
+			// byte; see ECMA-48.
+			j := i + 2
+			for j < len(s) && s[j] >= 0x30 && s[j] <= 0x3f {
+				j++
+			}
+			params := s[i+2 : j]
+			for j < len(s) && s[j] >= 0x20 && s[j] <= 0x2f {
+				j++
+			}
+			if j >= len(s) {
+				i = len(s)
+				continue
+			}
+			if s[j] == 'm' {
+				flush()
+				st = st.apply(params)
+			}
+			i = j + 1
+		case ']':
+			// OSC, e.g. for hyperlinks or window titles: terminated
+			// by BEL or ST.
+			j := i + 2
+			for j < len(s) && s[j] != '\a' && !strings.HasPrefix(s[j:], "\x1b\\") {
+				j++
+			}
+			if j < len(s) && s[j] == '\x1b' {
+				j++
+			}
+			i = j + 1
+		default:
+			// Other escape sequences: intermediate bytes, then a
+			// final byte, e.g. "\x1b(B" to select a character set.
+			j := i + 1
+			for j < len(s) && s[j] >= 0x20 && s[j] <= 0x2f {
+				j++
+			}
+			i = j + 1
+		}
+	}
+	flush()
+	return template.HTML(b.String())
+}
+
+// apply returns st updated with the semicolon-separated SGR parameters in
+// params.
+func (st ansiStyle) apply(params string) ansiStyle {
+	if params == "" {
+		return ansiStyle{}
+	}
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		code, err := strconv.Atoi(codes[i])
+		if err != nil && codes[i] != "" {
+			continue
+		}
+		switch {
+		case code == 0:
+			st = ansiStyle{}
+		case code == 1:
+			st.bold = true
+		case code == 2:
+			st.dim = true
+		case code == 3:
+			st.italic = true
+		case code == 4:
+			st.underline = true
+		case code == 22:
+			st.bold, st.dim = false, false
+		case code == 23:
+			st.italic = false
+		case code == 24:
+			st.underline = false
+		case code >= 30 && code <= 37:
+			st.fg = ansiPalette[code-30]
+		case code >= 90 && code <= 97:
+			st.fg = ansiPalette[code-90+8]
+		case code == 39:
+			st.fg = ""
+		case code >= 40 && code <= 47:
+			st.bg = ansiPalette[code-40]
+		case code >= 100 && code <= 107:
+			st.bg = ansiPalette[code-100+8]
+		case code == 49:
+			st.bg = ""
+		case code == 38 || code == 48:
+			color, n := extendedColor(codes[i+1:])
+			i += n
+			if code == 38 {
+				st.fg = color
+			} else {
+				st.bg = color
+			}
+		}
+	}
+	return st
+}
+
+// extendedColor parses the parameters of a 256-colour ("5;n") or true colour
+// ("2;r;g;b") SGR sequence, returning the colour and the number of parameters
+// used. The colour is empty if the parameters are invalid.
+func extendedColor(params []string) (string, int) {
+	num := func(i int) (int, bool) {
+		if i >= len(params) {
+			return 0, false
+		}
+		v, err := strconv.Atoi(params[i])
+		return v, err == nil && v >= 0 && v <= 255
+	}
+	mode, ok := num(0)
+	if !ok {
+		return "", 0
+	}
+	switch mode {
+	case 5:
+		n, ok := num(1)
+		if !ok {
+			return "", 1
+		}
+		return xterm256(n), 2
+	case 2:
+		r, okR := num(1)
+		g, okG := num(2)
+		b, okB := num(3)
+		if !okR || !okG || !okB {
+			return "", min(len(params), 4)
+		}
+		return fmt.Sprintf("#%02x%02x%02x", r, g, b), 4
+	}
+	return "", 1
+}
+
+// xterm256 returns the colour with index n in the xterm 256-colour palette.
+func xterm256(n int) string {
+	switch {
+	case n < 16:
+		return ansiPalette[n]
+	case n < 232:
+		levels := [6]int{0, 95, 135, 175, 215, 255}
+		n -= 16
+		return fmt.Sprintf("#%02x%02x%02x", levels[n/36], levels[n/6%6], levels[n%6])
+	default:
+		v := 8 + 10*(n-232)
+		return fmt.Sprintf("#%02x%02x%02x", v, v, v)
+	}
+}
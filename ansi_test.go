@@ -0,0 +1,32 @@
+package main
+
+import (
+	"html/template"
+	"testing"
+)
+
+func TestANSIToHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want template.HTML
+	}{
+		{"plain", "hello <world>", "hello &lt;world&gt;"},
+		{"color", "\x1b[31mred\x1b[0m plain", `<span style="color:#cd0000">red</span> plain`},
+		{"bold_bright", "\x1b[1;92mok\x1b[m", `<span style="color:#00ff00;font-weight:bold">ok</span>`},
+		{"partial_reset", "\x1b[1;4mA\x1b[24mB\x1b[22mC", `<span style="font-weight:bold;text-decoration:underline">A</span><span style="font-weight:bold">B</span>C`},
+		{"256_color", "\x1b[38;5;196mx\x1b[48;5;244my", `<span style="color:#ff0000">x</span><span style="color:#ff0000;background-color:#808080">y</span>`},
+		{"true_color", "\x1b[38;2;1;2;3mx", `<span style="color:#010203">x</span>`},
+		{"escaped_in_span", "\x1b[33m<b>", `<span style="color:#cdcd00">&lt;b&gt;</span>`},
+		{"other_sequences", "\x1b[2K\x1b]0;title\x07\x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\\x1b(Bdone", "linkdone"},
+		{"truncated", "text\x1b[31", "text"},
+		{"bad_extended", "\x1b[38;5mx", "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ansiToHTML(tt.in); got != tt.want {
+				t.Errorf("ansiToHTML(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
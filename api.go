@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-json-experiment/json"
+
+	"github.com/andrew-d/upchek/internal/runner"
+)
+
+// resultSchemaVersion is the version of the schema of results returned by
+// the v2 API. It is incremented whenever a change to [serviceResult] would
+// break existing clients, such as removing or changing the meaning of a
+// field; adding fields doesn't change it.
+const resultSchemaVersion = 1
+
+const (
+	// defaultPageSize and maxPageSize are the default and largest number
+	// of results returned in a single page by the v2 API.
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// instanceInfo identifies a running upchek instance.
+type instanceInfo struct {
+	// Hostname is the hostname of the machine that upchek runs on.
+	Hostname string
+
+	// ID is a random identifier for the instance, which is kept in the
+	// state directory so that it survives restarts.
+	ID string
+
+	// Version is the version of upchek.
+	Version string
+
+	// StartTime is when the instance started.
+	StartTime time.Time
+}
+
+// newInstanceInfo returns the info for this instance, reading its ID from
+// stateDir, or creating one if there isn't one yet. If stateDir is empty or
+// the ID can't be saved, a new ID is used for every run.
+func newInstanceInfo(stateDir string) (instanceInfo, error) {
+	hostname, _ := os.Hostname()
+	info := instanceInfo{
+		Hostname:  hostname,
+		Version:   upchekVersion(),
+		StartTime: time.Now(),
+	}
+
+	var b [16]byte
+	rand.Read(b[:])
+	info.ID = hex.EncodeToString(b[:])
+	if stateDir == "" {
+		return info, nil
+	}
+
+	idPath := filepath.Join(stateDir, "instance-id")
+	data, err := os.ReadFile(idPath)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		info.ID = strings.TrimSpace(string(data))
+		return info, nil
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return info, err
+	}
+	return info, writeFileAtomic(idPath, []byte(info.ID+"\n"))
+}
+
+// upchekVersion returns the version of upchek from its build info: the module
+// version if it was installed with "go install", or otherwise the VCS
+// revision it was built from.
+func upchekVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := bi.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var revision, modified string
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	revision = revision[:min(len(revision), 12)]
+	if modified == "true" {
+		revision += "-dirty"
+	}
+	return "devel-" + revision
+}
+
+// instanceResponse is the response to the v2 instance endpoint.
+type instanceResponse struct {
+	Instance      instanceInfo
+	SchemaVersion int
+}
+
+// resultsResponse is the response to the v2 results endpoint.
+type resultsResponse struct {
+	Instance      instanceInfo
+	SchemaVersion int
+	GeneratedAt   time.Time
+
+	// Total is the number of results matching the filters, across all
+	// pages.
+	Total int
+
+	// Results is a single page of results.
+	Results []serviceResult
+
+	// NextCursor, if set, is passed as the cursor parameter to fetch the
+	// next page of results.
+	NextCursor string `json:",omitzero"`
+}
+
+// resultQuery is a parsed query for the v2 results endpoint.
+type resultQuery struct {
+	statuses  []checkStatus
+	group     string
+	tag       string
+	name      string // glob, as for [path.Match]
+	namespace string
+	sort      string // one of resultSorts, optionally preceded by '-'
+	limit     int
+	cursor    *resultCursor
+}
+
+// resultSorts are the keys that results can be sorted by, each of which is
+// broken by name.
+var resultSorts = map[string]func(a, b *serviceResult) int{
+	"name": func(a, b *serviceResult) int {
+		return strings.Compare(a.Name, b.Name)
+	},
+	"last_run": func(a, b *serviceResult) int {
+		if c := a.LastRun.Compare(b.LastRun); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	},
+	"status": func(a, b *serviceResult) int {
+		if c := strings.Compare(string(a.State), string(b.State)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	},
+}
+
+// compare compares two results in the query's sort order.
+func (q *resultQuery) compare(a, b *serviceResult) int {
+	key, desc := strings.CutPrefix(q.sort, "-")
+	c := resultSorts[key](a, b)
+	if desc {
+		return -c
+	}
+	return c
+}
+
+// resultCursor is the position after the last result of a page, encoded as
+// an opaque string for clients. It holds the sort keys of that result, so
+// that pages stay consistent as results are added and removed.
+type resultCursor struct {
+	Sort    string      `json:"s"`
+	Name    string      `json:"n"`
+	LastRun time.Time   `json:"t,omitzero"`
+	State   checkStatus `json:"st,omitzero"`
+}
+
+func (c *resultCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*resultCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var c resultCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return &c, nil
+}
+
+// parseResultQuery parses the query parameters of a request to the v2
+// results endpoint:
+//
+//   - status: only results with one of the given comma-separated states
+//   - group, tag, namespace: only results with the given group, tag or
+//     namespace
+//   - name: only results whose names match a glob, e.g. "backup-*"
+//   - sort: "name" (the default), "last_run" or "status", optionally
+//     preceded by '-' to sort in descending order
+//   - limit: the number of results per page; at most 1000
+//   - cursor: the NextCursor of the previous page
+func parseResultQuery(v url.Values) (*resultQuery, error) {
+	q := &resultQuery{
+		group:     v.Get("group"),
+		tag:       v.Get("tag"),
+		name:      v.Get("name"),
+		namespace: v.Get("namespace"),
+		sort:      v.Get("sort"),
+		limit:     defaultPageSize,
+	}
+	for _, vals := range v["status"] {
+		for status := range strings.SplitSeq(vals, ",") {
+			switch st := checkStatus(status); st {
+			case statusOK, statusFailing, statusError, statusSkipped:
+				q.statuses = append(q.statuses, st)
+			default:
+				return nil, fmt.Errorf("unknown status %q", status)
+			}
+		}
+	}
+	if q.name != "" {
+		if _, err := path.Match(q.name, ""); err != nil {
+			return nil, fmt.Errorf("invalid name pattern %q", q.name)
+		}
+	}
+	if q.sort == "" {
+		q.sort = "name"
+	}
+	if _, ok := resultSorts[strings.TrimPrefix(q.sort, "-")]; !ok {
+		return nil, fmt.Errorf("unknown sort %q", q.sort)
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.limit = n
+	}
+	if s := v.Get("cursor"); s != "" {
+		c, err := decodeCursor(s)
+		if err != nil {
+			return nil, err
+		}
+		if c.Sort != q.sort {
+			return nil, errors.New("cursor is for a different sort order")
+		}
+		q.cursor = c
+	}
+	return q, nil
+}
+
+// matches reports whether r passes the query's filters.
+func (q *resultQuery) matches(r *serviceResult) bool {
+	if len(q.statuses) > 0 && !slices.Contains(q.statuses, r.State) {
+		return false
+	}
+	if q.group != "" && r.Group != q.group {
+		return false
+	}
+	if q.tag != "" && !slices.Contains(r.Tags, q.tag) {
+		return false
+	}
+	if q.namespace != "" && r.Namespace != q.namespace {
+		return false
+	}
+	if q.name != "" {
+		if ok, _ := path.Match(q.name, r.Name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// apply filters and sorts results, returning the page after the query's
+// cursor, the cursor for the next page if there is one, and the number of
+// results matching the filters.
+func (q *resultQuery) apply(results []serviceResult) (page []serviceResult, next string, total int) {
+	var matched []serviceResult
+	for i := range results {
+		if q.matches(&results[i]) {
+			matched = append(matched, results[i])
+		}
+	}
+	slices.SortStableFunc(matched, func(a, b serviceResult) int { return q.compare(&a, &b) })
+
+	start := 0
+	if c := q.cursor; c != nil {
+		after := serviceResult{Result: &runner.Result{Name: c.Name}, LastRun: c.LastRun, State: c.State}
+		start = len(matched)
+		for i := range matched {
+			if q.compare(&matched[i], &after) > 0 {
+				start = i
+				break
+			}
+		}
+	}
+
+	page = matched[start:min(start+q.limit, len(matched))]
+	if start+q.limit < len(matched) {
+		last := page[len(page)-1]
+		next = (&resultCursor{Sort: q.sort, Name: last.Name, LastRun: last.LastRun, State: last.State}).encode()
+	}
+	return page, next, len(matched)
+}
+
+func (s *service) handleInstanceAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, instanceResponse{
+		Instance:      s.instance,
+		SchemaVersion: resultSchemaVersion,
+	})
+}
+
+func (s *service) handleResultsAPIv2(w http.ResponseWriter, r *http.Request) {
+	q, err := parseResultQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if s.checkNotModified(w, r) {
+		return
+	}
+
+	page, next, total := q.apply(s.localResults())
+	writeCompressedJSON(w, r, http.StatusOK, resultsResponse{
+		Instance:      s.instance,
+		SchemaVersion: resultSchemaVersion,
+		GeneratedAt:   time.Now(),
+		Total:         total,
+		Results:       page,
+		NextCursor:    next,
+	})
+}
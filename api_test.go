@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/google/go-cmp/cmp"
+	"github.com/neilotoole/slogt"
+
+	"github.com/andrew-d/upchek/internal/runner"
+)
+
+func TestInstanceInfo(t *testing.T) {
+	dir := t.TempDir()
+	first, err := newInstanceInfo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == "" || first.Version == "" {
+		t.Fatalf("newInstanceInfo() = %+v, want ID and version", first)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "instance-id")); err != nil {
+		t.Errorf("instance ID not saved: %v", err)
+	}
+
+	// The ID should survive a restart.
+	second, err := newInstanceInfo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != first.ID {
+		t.Errorf("ID after restart = %q, want %q", second.ID, first.ID)
+	}
+}
+
+func TestResultQuery(t *testing.T) {
+	now := time.Now()
+	results := []serviceResult{
+		{Result: &runner.Result{Name: "web.sh"}, State: statusOK, Group: "web", LastRun: now.Add(-3 * time.Minute)},
+		{Result: &runner.Result{Name: "db.sh"}, State: statusFailing, Tags: []string{"db", "core"}, LastRun: now.Add(-time.Minute)},
+		{Result: &runner.Result{Name: "backup-db.sh"}, State: statusError, Group: "backups", Tags: []string{"db"}, LastRun: now.Add(-2 * time.Minute)},
+		{Result: &runner.Result{Name: "backup-web.sh"}, State: statusOK, Group: "backups", Namespace: "ops", LastRun: now},
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"all", "", []string{"backup-db.sh", "backup-web.sh", "db.sh", "web.sh"}},
+		{"status", "status=failing,error", []string{"backup-db.sh", "db.sh"}},
+		{"status_repeated", "status=ok&status=error", []string{"backup-db.sh", "backup-web.sh", "web.sh"}},
+		{"group", "group=backups", []string{"backup-db.sh", "backup-web.sh"}},
+		{"tag", "tag=db", []string{"backup-db.sh", "db.sh"}},
+		{"namespace", "namespace=ops", []string{"backup-web.sh"}},
+		{"name", "name=backup-*", []string{"backup-db.sh", "backup-web.sh"}},
+		{"combined", "tag=db&group=backups", []string{"backup-db.sh"}},
+		{"sort_desc", "sort=-name", []string{"web.sh", "db.sh", "backup-web.sh", "backup-db.sh"}},
+		{"sort_last_run", "sort=-last_run", []string{"backup-web.sh", "db.sh", "backup-db.sh", "web.sh"}},
+		{"sort_status", "sort=status", []string{"backup-db.sh", "db.sh", "backup-web.sh", "web.sh"}},
+		{"limit", "limit=2", []string{"backup-db.sh", "backup-web.sh"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q, err := parseResultQuery(v)
+			if err != nil {
+				t.Fatalf("parseResultQuery(%q) error = %v", tt.query, err)
+			}
+			page, _, _ := q.apply(results)
+			var got []string
+			for _, r := range page {
+				got = append(got, r.Name)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("results mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestResultQueryErrors(t *testing.T) {
+	nameCursor := (&resultCursor{Sort: "name", Name: "a"}).encode()
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"unknown_status", "status=ok,bogus"},
+		{"bad_name_pattern", "name=["},
+		{"unknown_sort", "sort=size"},
+		{"zero_limit", "limit=0"},
+		{"large_limit", "limit=1001"},
+		{"bad_limit", "limit=ten"},
+		{"bad_cursor", "cursor=!!!"},
+		{"cursor_other_sort", "sort=-last_run&cursor=" + nameCursor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := parseResultQuery(v); err == nil {
+				t.Errorf("parseResultQuery(%q) error = nil, want error", tt.query)
+			}
+		})
+	}
+}
+
+func TestResultsAPIv2(t *testing.T) {
+	now := time.Now()
+	s := &service{
+		logger:   slogt.New(t),
+		instance: instanceInfo{Hostname: "host", ID: "id", Version: "v1.0.0", StartTime: now},
+	}
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		s.results = append(s.results, serviceResult{
+			Result:  &runner.Result{Name: name},
+			State:   statusOK,
+			LastRun: now.Add(time.Duration(i) * time.Second),
+		})
+	}
+
+	get := func(query string) (int, resultsResponse) {
+		req := httptest.NewRequest("GET", "/api/v2/results?"+query, nil)
+		rec := httptest.NewRecorder()
+		s.handleResultsAPIv2(rec, req)
+		var resp resultsResponse
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, resp
+	}
+
+	if code, _ := get("sort=bogus"); code != http.StatusBadRequest {
+		t.Errorf("bad query = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	// Page through the results newest first; a result removed between
+	// pages shouldn't cause others to be skipped or repeated.
+	var got []string
+	query := "sort=-last_run&limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("too many pages")
+		}
+		code, resp := get(query)
+		if code != http.StatusOK {
+			t.Fatalf("get(%q) = %d", query, code)
+		}
+		if resp.Instance.ID != "id" || resp.SchemaVersion != resultSchemaVersion {
+			t.Errorf("response instance = %+v, schema %d", resp.Instance, resp.SchemaVersion)
+		}
+		for _, r := range resp.Results {
+			got = append(got, r.Name)
+		}
+		if pages == 0 {
+			if resp.Total != 5 {
+				t.Errorf("Total = %d, want 5", resp.Total)
+			}
+			s.results = s.results[1:] // remove "a"
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		query = "sort=-last_run&limit=2&cursor=" + resp.NextCursor
+	}
+	if diff := cmp.Diff([]string{"e", "d", "c", "b"}, got); diff != "" {
+		t.Errorf("paged results mismatch (-want +got):\n%s", diff)
+	}
+}
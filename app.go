@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thejerf/suture/v4"
+	"github.com/thejerf/sutureslog"
+
+	"github.com/andrew-d/upchek/internal/suturehttp"
+	"github.com/andrew-d/upchek/internal/ulog"
+)
+
+// newRemoteSupervisor returns the supervisor that remote fetchers run under.
+//
+// Fetchers don't return errors for failed fetches, so a failure here is a
+// panic or other bug; back off for longer than the default before restarting
+// them, rather than retrying in a tight loop.
+func newRemoteSupervisor(logger *slog.Logger) *suture.Supervisor {
+	return suture.New("remotes", suture.Spec{
+		EventHook:        (&sutureslog.Handler{Logger: logger}).MustHook(),
+		FailureThreshold: 3,
+		FailureDecay:     60,
+		FailureBackoff:   time.Minute,
+		Timeout:          removeTimeout,
+	})
+}
+
+// removeTimeout is how long to wait for a service to stop when it is
+// removed from the supervision tree during a reload.
+const removeTimeout = 10 * time.Second
+
+// app owns upchek's supervision tree, and reconciles it with the current
+// configuration whenever the configuration is (re)loaded.
+type app struct {
+	logger *slog.Logger
+
+	// configPath is the path to the configuration file, if any.
+	configPath string
+
+	// baseConfig is the configuration built from command-line flags,
+	// which the configuration file is applied on top of.
+	baseConfig config
+
+	supervisor       *suture.Supervisor
+	remoteSupervisor *suture.Supervisor // child of supervisor; runs remote fetchers
+	service          *service
+	notifier         *notifyService
+	pusher           *pushService
+
+	// The tokens of the services that [app.shutdown] stops before the
+	// rest of the supervision tree.
+	serviceToken    suture.ServiceToken
+	notifierToken   suture.ServiceToken
+	pusherToken     suture.ServiceToken
+	sdNotifierToken *suture.ServiceToken // nil unless run by systemd with Type=notify
+
+	// activated holds the sockets passed by systemd socket activation
+	// that no listener has used yet, keyed by name.
+	activated map[string]net.Listener
+
+	mu          sync.Mutex // serializes apply; protects following
+	cfg         config
+	listeners   map[string]*listenerEntry // keyed by address
+	remotes     map[string]*remoteEntry   // keyed by address
+	discoverers map[discoverySource]*discoveryEntry
+}
+
+// listenerEntry is a running HTTP listener.
+type listenerEntry struct {
+	cfg     listenerConfig
+	handler *switchHandler
+	server  *suturehttp.Server
+	token   suture.ServiceToken
+}
+
+// remoteEntry is a running fetchRemoteResultService.
+type remoteEntry struct {
+	cfg      remoteConfig
+	interval time.Duration
+	timeout  time.Duration
+	policy   remotePolicy
+	token    suture.ServiceToken
+}
+
+// discoveryEntry is a running discoveryService, and the remotes that it has
+// most recently found.
+type discoveryEntry struct {
+	service *discoveryService
+	token   suture.ServiceToken
+	targets []remoteConfig
+}
+
+// apply reconciles the running services with the provided configuration,
+// which must have been validated.
+//
+// Services are only restarted if their configuration changed. If the
+// configuration cannot be applied (e.g. because a new listener cannot bind to
+// its address), an error is returned and the running services are left
+// untouched.
+func (a *app) apply(cfg config) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	tokens, err := cfg.Auth.resolveTokens()
+	if err != nil {
+		return fmt.Errorf("resolving auth tokens: %w", err)
+	}
+	if err := cfg.resolveRemoteTokens(); err != nil {
+		return fmt.Errorf("resolving remote tokens: %w", err)
+	}
+
+	if a.cfg.StateDir != "" && cfg.StateDir != a.cfg.StateDir {
+		a.logger.Warn("state directory cannot be changed without a restart; ignoring",
+			slog.String("current", a.cfg.StateDir),
+			slog.String("new", cfg.StateDir))
+		cfg.StateDir = a.cfg.StateDir
+	}
+
+	pushTargets, err := newPushTargets(cfg.Push, cfg.StateDir, a.logger.With(ulog.Component("push")))
+	if err != nil {
+		return fmt.Errorf("configuring push: %w", err)
+	}
+
+	// Bind any new listeners before changing anything else, so that we
+	// can reject the configuration if we're unable to. Unix sockets that
+	// are already listening have their mode and owner updated in place.
+	newListeners := make(map[string]net.Listener)
+	unbind := func() {
+		for addr, ln := range newListeners {
+			if name, ok := strings.CutPrefix(addr, systemdPrefix); ok {
+				a.activated[name] = ln // so that it can be used again
+			} else {
+				ln.Close()
+			}
+		}
+	}
+	for _, l := range cfg.Listeners {
+		if entry, ok := a.listeners[l.Address]; ok {
+			if path, ok := strings.CutPrefix(l.Address, unixPrefix); ok && (l.Mode != entry.cfg.Mode || l.Owner != entry.cfg.Owner) {
+				if err := l.setSocketOwner(path); err != nil {
+					unbind()
+					return fmt.Errorf("listening on %q: %w", l.Address, err)
+				}
+			}
+			continue
+		}
+		ln, err := l.listen(a.activated)
+		if err != nil {
+			unbind()
+			return fmt.Errorf("listening on %q: %w", l.Address, err)
+		}
+		newListeners[l.Address] = ln
+	}
+
+	// Nothing below can fail; update our services in place.
+	a.service.setConfig(cfg, authState{
+		tokens:         tokens,
+		requireForRead: cfg.Auth.RequireForRead,
+	})
+
+	var notifiers []notifier
+	for _, n := range cfg.Notifiers {
+		notifiers = append(notifiers, newNotifier(n))
+	}
+	a.notifier.setNotifiers(notifiers)
+	a.pusher.setTargets(pushTargets)
+
+	// Reconcile listeners.
+	if a.listeners == nil {
+		a.listeners = make(map[string]*listenerEntry)
+	}
+	for addr, entry := range a.listeners {
+		if !slices.ContainsFunc(cfg.Listeners, func(l listenerConfig) bool { return l.Address == addr }) {
+			a.logger.Info("removing listener", slog.String("addr", addr))
+			a.remove(a.supervisor, entry.token)
+			delete(a.listeners, addr)
+		}
+	}
+	for _, l := range cfg.Listeners {
+		ln, ok := newListeners[l.Address]
+		if !ok {
+			// Already listening; only the routes and the shutdown
+			// timeout might have changed.
+			entry := a.listeners[l.Address]
+			if l.routeSet() != entry.cfg.routeSet() {
+				a.logger.Info("changing listener routes", slog.String("addr", l.Address), slog.String("routes", string(l.routeSet())))
+				entry.handler.set(a.routes(l.routeSet()))
+			}
+			entry.server.SetShutdownTimeout(cfg.Shutdown.timeout())
+			entry.cfg = l
+			continue
+		}
+		handler := newSwitchHandler(a.routes(l.routeSet()))
+		server := suturehttp.New(ln, handler)
+		server.Logger = a.logger.With(ulog.Component("http"), slog.String("addr", l.Address))
+		server.SetShutdownTimeout(cfg.Shutdown.timeout())
+		a.listeners[l.Address] = &listenerEntry{
+			cfg:     l,
+			handler: handler,
+			server:  server,
+			token:   a.supervisor.Add(server),
+		}
+		a.logger.Info("listening",
+			slog.String("addr", l.Address),
+			slog.String("bound", ln.Addr().String()),
+			slog.String("routes", string(l.routeSet())))
+	}
+
+	// Reconcile discovery providers. Providers are removed without
+	// waiting, since they may be blocked calling setDiscovered; any
+	// updates from them after this are ignored.
+	if a.discoverers == nil {
+		a.discoverers = make(map[discoverySource]*discoveryEntry)
+	}
+	for src, entry := range a.discoverers {
+		if !slices.ContainsFunc(cfg.Discovery, func(d discoveryConfig) bool { return d.discoverySource == src }) {
+			a.logger.Info("removing discovery provider", slog.String("source", src.String()))
+			if err := a.remoteSupervisor.Remove(entry.token); err != nil && !errors.Is(err, suture.ErrSupervisorNotStarted) {
+				a.logger.Warn("failed to remove service", ulog.Error(err))
+			}
+			delete(a.discoverers, src)
+		}
+	}
+	for _, d := range cfg.Discovery {
+		if _, ok := a.discoverers[d.discoverySource]; ok {
+			continue
+		}
+		ds := &discoveryService{
+			source: d.discoverySource,
+			logger: a.logger.With(ulog.Component("discovery"), slog.String("source", d.discoverySource.String())),
+			update: a.setDiscovered,
+		}
+		a.discoverers[d.discoverySource] = &discoveryEntry{
+			service: ds,
+			token:   a.remoteSupervisor.Add(ds),
+		}
+	}
+
+	a.reconcileRemotes(cfg)
+	a.cfg = cfg
+	return nil
+}
+
+// setDiscovered records the remotes found by a discovery provider, and
+// starts and stops fetchers to match.
+func (a *app) setDiscovered(ds *discoveryService, targets []remoteConfig) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry, ok := a.discoverers[ds.source]
+	if !ok || entry.service != ds {
+		return // removed by a reload
+	}
+	entry.targets = targets
+	a.reconcileRemotes(a.cfg)
+}
+
+// wantRemotes returns the remotes that should be running under cfg: the
+// configured remotes, followed by those found by each discovery provider in
+// turn. If an address is found more than once, the first wins.
+//
+// a.mu must be held.
+func (a *app) wantRemotes(cfg config) []remoteConfig {
+	remotes := slices.Clone(cfg.Remotes)
+	seen := make(map[string]bool, len(remotes))
+	for _, r := range remotes {
+		seen[r.Address] = true
+	}
+	for _, d := range cfg.Discovery {
+		entry, ok := a.discoverers[d.discoverySource]
+		if !ok {
+			continue
+		}
+		for _, r := range d.remotes(entry.targets) {
+			if !seen[r.Address] {
+				seen[r.Address] = true
+				remotes = append(remotes, r)
+			}
+		}
+	}
+	return remotes
+}
+
+// reconcileRemotes starts and stops remote fetchers to match cfg and the
+// remotes found by discovery; remotes whose settings changed are restarted.
+//
+// a.mu must be held.
+func (a *app) reconcileRemotes(cfg config) {
+	if a.remotes == nil {
+		a.remotes = make(map[string]*remoteEntry)
+	}
+	remotes := a.wantRemotes(cfg)
+	want := make(map[string]remoteConfig, len(remotes))
+	for _, r := range remotes {
+		want[r.Address] = r
+	}
+	for addr, entry := range a.remotes {
+		r, ok := want[addr]
+		if ok && cfg.remoteInterval(r) == entry.interval && cfg.remoteTimeout(r) == entry.timeout && cfg.remotePolicy(r) == entry.policy && r.token == entry.cfg.token {
+			entry.cfg = r
+			continue
+		}
+		a.logger.Info("removing remote", slog.String("addr", addr))
+		a.remove(a.remoteSupervisor, entry.token)
+		delete(a.remotes, addr)
+	}
+	a.service.setRemotes(remotes)
+	for _, r := range remotes {
+		if _, ok := a.remotes[r.Address]; ok {
+			continue
+		}
+		interval, timeout, policy := cfg.remoteInterval(r), cfg.remoteTimeout(r), cfg.remotePolicy(r)
+		a.remotes[r.Address] = &remoteEntry{
+			cfg:      r,
+			interval: interval,
+			timeout:  timeout,
+			policy:   policy,
+			token: a.remoteSupervisor.Add(&fetchRemoteResultService{
+				parent:   a.service,
+				addr:     r.Address,
+				interval: interval,
+				timeout:  timeout,
+				policy:   policy,
+				token:    r.token,
+				logger:   a.logger.With(ulog.Component("remote"), slog.String("addr", r.Address)),
+			}),
+		}
+	}
+}
+
+// remove removes a service from the given supervisor and waits for it to
+// stop.
+func (a *app) remove(sup *suture.Supervisor, token suture.ServiceToken) {
+	err := sup.RemoveAndWait(token, removeTimeout)
+	if err != nil && !errors.Is(err, suture.ErrSupervisorNotStarted) {
+		a.logger.Warn("failed to remove service", ulog.Error(err))
+	}
+}
+
+// shutdown stops upchek's services in order, before the rest of the
+// supervision tree, including the listeners, is stopped:
+//
+//  1. systemd is told that upchek is stopping.
+//  2. No more checks are started; checks that are running are sent SIGTERM,
+//     and killed if they haven't exited after the shutdown grace period.
+//  3. The history of checks is saved.
+//  4. Queued notifications and pushes are delivered, within the shutdown
+//     timeout.
+//
+// Listeners keep serving throughout, so that the last results can still be
+// read.
+func (a *app) shutdown() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	grace := time.Duration(a.cfg.Shutdown.GracePeriod)
+	timeout := a.cfg.Shutdown.timeout()
+	a.logger.Info("shutting down",
+		slog.Duration("grace_period", grace),
+		slog.Duration("timeout", timeout))
+
+	if a.sdNotifierToken != nil {
+		a.remove(a.supervisor, *a.sdNotifierToken)
+	}
+	err := a.supervisor.RemoveAndWait(a.serviceToken, grace+removeTimeout)
+	if err != nil && !errors.Is(err, suture.ErrSupervisorNotStarted) {
+		a.logger.Warn("checks did not stop in time", ulog.Error(err))
+	}
+	if err := a.service.history.save(time.Now()); err != nil {
+		a.logger.Error("failed to persist history", ulog.Error(err))
+	}
+
+	a.remove(a.supervisor, a.notifierToken)
+	a.remove(a.supervisor, a.pusherToken)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a.notifier.flush(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		a.pusher.flush(ctx)
+	}()
+	wg.Wait()
+}
+
+// reload re-reads the configuration file and applies it. If the new
+// configuration is invalid, an error is returned and the current
+// configuration is kept.
+func (a *app) reload() error {
+	if a.configPath == "" {
+		return errors.New("no configuration file specified")
+	}
+
+	cfg, err := loadConfig(a.configPath, a.baseConfig)
+	if err != nil {
+		return err
+	}
+	if err := a.apply(cfg); err != nil {
+		return err
+	}
+	a.logger.Info("reloaded configuration", slog.String("path", a.configPath))
+	return nil
+}
+
+func (a *app) handleReload(w http.ResponseWriter, r *http.Request) {
+	if err := a.reload(); err != nil {
+		a.logger.Error("failed to reload configuration; keeping previous configuration", ulog.Error(err))
+		http.Error(w, fmt.Sprintf("reload failed: %v", err), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
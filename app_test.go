@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/neilotoole/slogt"
+	"github.com/thejerf/suture/v4"
+)
+
+func newTestApp(t *testing.T) *app {
+	t.Helper()
+
+	logger := slogt.New(t)
+	supervisor := suture.NewSimple("test")
+	notifier := newNotifyService(logger)
+	notifierToken := supervisor.Add(notifier)
+	remoteSupervisor := newRemoteSupervisor(logger)
+	supervisor.Add(remoteSupervisor)
+	pusher := newPushService(logger)
+	pusherToken := supervisor.Add(pusher)
+
+	s := &service{
+		logger:   logger,
+		notifier: notifier,
+		wake:     make(chan struct{}, 1),
+	}
+	s.initMetrics()
+
+	a := &app{
+		logger:           logger,
+		supervisor:       supervisor,
+		remoteSupervisor: remoteSupervisor,
+		service:          s,
+		notifier:         notifier,
+		pusher:           pusher,
+		notifierToken:    notifierToken,
+		pusherToken:      pusherToken,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := supervisor.ServeBackground(ctx)
+	t.Cleanup(func() {
+		cancel()
+		<-errc
+	})
+	return a
+}
+
+func TestAppApply(t *testing.T) {
+	a := newTestApp(t)
+
+	cfg := testBaseConfig()
+	cfg.StateDir = t.TempDir()
+	cfg.Directories = []directoryConfig{{Path: t.TempDir()}}
+	cfg.Listeners = []listenerConfig{{Address: "127.0.0.1:0"}}
+	cfg.Remotes = []remoteConfig{
+		{Address: "127.0.0.1:1"},
+		{Address: "127.0.0.1:2"},
+	}
+	if err := a.apply(cfg); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+
+	remoteKeys := func() []string {
+		var keys []string
+		for k := range a.remotes {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	if diff := cmp.Diff([]string{"127.0.0.1:1", "127.0.0.1:2"}, remoteKeys()); diff != "" {
+		t.Errorf("remotes mismatch (-want +got):\n%s", diff)
+	}
+	listener := a.listeners["127.0.0.1:0"]
+	if listener == nil {
+		t.Fatal("expected listener to be added")
+	}
+	unchanged := a.remotes["127.0.0.1:1"].token
+
+	// Reorder the remotes, change the interval of one, and add another.
+	cfg.Remotes = []remoteConfig{
+		{Address: "127.0.0.1:2", Interval: duration(time.Minute)},
+		{Address: "127.0.0.1:3"},
+		{Address: "127.0.0.1:1"},
+	}
+	cfg.Defaults.Interval = duration(time.Hour)
+	if err := a.apply(cfg); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if diff := cmp.Diff([]string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}, remoteKeys()); diff != "" {
+		t.Errorf("remotes mismatch (-want +got):\n%s", diff)
+	}
+	if a.remotes["127.0.0.1:1"].token != unchanged {
+		t.Error("unchanged remote was restarted")
+	}
+	if got := a.remotes["127.0.0.1:2"].interval; got != time.Minute {
+		t.Errorf("changed remote interval = %v, want %v", got, time.Minute)
+	}
+	if a.listeners["127.0.0.1:0"] != listener {
+		t.Error("unchanged listener was restarted")
+	}
+
+	// A new shutdown timeout applies to listeners that are kept.
+	cfg.Shutdown.Timeout = duration(time.Minute)
+	if err := a.apply(cfg); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if a.listeners["127.0.0.1:0"] != listener {
+		t.Error("listener was restarted for a new shutdown timeout")
+	}
+	if got := listener.server.ShutdownTimeout(); got != time.Minute {
+		t.Errorf("listener shutdown timeout = %v, want %v", got, time.Minute)
+	}
+
+	a.service.mu.RLock()
+	interval := a.service.checkDefaults.Interval
+	remoteAddrs := a.service.remoteAddrs
+	a.service.mu.RUnlock()
+	if interval != time.Hour {
+		t.Errorf("service interval = %v, want %v", interval, time.Hour)
+	}
+	if diff := cmp.Diff([]string{"127.0.0.1:2", "127.0.0.1:3", "127.0.0.1:1"}, remoteAddrs); diff != "" {
+		t.Errorf("service remoteAddrs mismatch (-want +got):\n%s", diff)
+	}
+
+	// Changing a remote's token restarts it with the new token.
+	cfg.Remotes[2].Token = "secret"
+	if err := a.apply(cfg); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if a.remotes["127.0.0.1:1"].token == unchanged {
+		t.Error("remote with a new token was not restarted")
+	}
+	if got := a.remotes["127.0.0.1:1"].cfg.token; got != "secret" {
+		t.Errorf("remote token = %q, want %q", got, "secret")
+	}
+
+	cfg.Remotes = nil
+	if err := a.apply(cfg); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	if len(a.remotes) != 0 {
+		t.Errorf("remotes = %v, want none", remoteKeys())
+	}
+}
+
+func TestAppApplyRejectsUnbindableListener(t *testing.T) {
+	a := newTestApp(t)
+
+	// Occupy an address so that binding to it fails.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cfg := testBaseConfig()
+	cfg.StateDir = t.TempDir()
+	cfg.Directories = []directoryConfig{{Path: t.TempDir()}}
+	cfg.Listeners = []listenerConfig{{Address: "127.0.0.1:0"}}
+	if err := a.apply(cfg); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+
+	bad := cfg
+	bad.Listeners = []listenerConfig{{Address: ln.Addr().String()}}
+	bad.Remotes = []remoteConfig{{Address: "127.0.0.1:1"}}
+	if err := a.apply(bad); err == nil {
+		t.Fatal("apply() error = nil, want error")
+	}
+
+	// The previous configuration should still be in effect.
+	if _, ok := a.listeners["127.0.0.1:0"]; !ok || len(a.listeners) != 1 {
+		t.Errorf("listeners changed after failed apply")
+	}
+	if len(a.remotes) != 0 {
+		t.Errorf("remotes changed after failed apply")
+	}
+}
+
+func TestAppListeners(t *testing.T) {
+	a := newTestApp(t)
+
+	// Pretend that systemd passed a socket named "web".
+	activated, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.activated = map[string]net.Listener{"web": activated}
+
+	sock := filepath.Join(t.TempDir(), "upchek.sock")
+	cfg := testBaseConfig()
+	cfg.StateDir = t.TempDir()
+	cfg.Directories = []directoryConfig{{Path: t.TempDir()}}
+	cfg.Listeners = []listenerConfig{
+		{Address: "unix:" + sock, Routes: routesHealth, Mode: "0600"},
+		{Address: "systemd:web", Routes: routesAPI},
+	}
+	if err := a.apply(cfg); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	get := func(client *http.Client, url string) int {
+		t.Helper()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	checkMode := func(want fs.FileMode) {
+		t.Helper()
+		fi, err := os.Stat(sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); got != want {
+			t.Errorf("socket mode = %v, want %v", got, want)
+		}
+	}
+
+	checkMode(0o600)
+	if code := get(unixClient, "http://unix/healthz"); code == http.StatusNotFound {
+		t.Errorf("GET /healthz on health listener = %d", code)
+	}
+	if code := get(unixClient, "http://unix/api/v1/results"); code != http.StatusNotFound {
+		t.Errorf("GET /api/v1/results on health listener = %d, want %d", code, http.StatusNotFound)
+	}
+	web := "http://" + activated.Addr().String()
+	if code := get(http.DefaultClient, web+"/api/v1/results"); code != http.StatusOK {
+		t.Errorf("GET /api/v1/results on systemd listener = %d, want %d", code, http.StatusOK)
+	}
+	if code := get(http.DefaultClient, web+"/"); code != http.StatusNotFound {
+		t.Errorf("GET / on api listener = %d, want %d", code, http.StatusNotFound)
+	}
+
+	// Routes and permissions change without rebinding.
+	cfg.Listeners[0].Routes = routesAll
+	cfg.Listeners[0].Mode = "0660"
+	if err := a.apply(cfg); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	checkMode(0o660)
+	if code := get(unixClient, "http://unix/api/v1/results"); code != http.StatusOK {
+		t.Errorf("GET /api/v1/results after changing routes = %d, want %d", code, http.StatusOK)
+	}
+}
+
+// Verify that shutting down asks running checks to exit, doesn't record
+// their results, and leaves listeners serving.
+func TestAppShutdown(t *testing.T) {
+	a := newTestApp(t)
+
+	dir := t.TempDir()
+	started, stopped := filepath.Join(dir, "started"), filepath.Join(dir, "stopped")
+	script := "#!/bin/sh\n" +
+		"trap 'echo > " + stopped + "; exit 0' TERM\n" +
+		"echo > " + started + "\n" +
+		"sleep 10 >/dev/null 2>&1 3>&- &\n" +
+		"wait $!\n"
+	checks := filepath.Join(dir, "checks")
+	if err := os.Mkdir(checks, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(checks, "slow.sh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sock := filepath.Join(dir, "upchek.sock")
+	cfg := testBaseConfig()
+	cfg.StateDir = t.TempDir()
+	cfg.Directories = []directoryConfig{{Path: checks}}
+	cfg.Listeners = []listenerConfig{{Address: "unix:" + sock}}
+	cfg.Shutdown = shutdownConfig{GracePeriod: duration(5 * time.Second), Timeout: duration(time.Second)}
+	if err := a.apply(cfg); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	a.serviceToken = a.supervisor.Add(a.service)
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(started); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for check to start")
+		}
+	}
+
+	start := time.Now()
+	a.shutdown()
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("shutdown() took %v, want the check to exit promptly", elapsed)
+	}
+	if _, err := os.Stat(stopped); err != nil {
+		t.Errorf("check was not sent SIGTERM: %v", err)
+	}
+	if results := a.service.localResults(); len(results) != 0 {
+		t.Errorf("got %d results from a check stopped by shutdown, want 0", len(results))
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	resp, err := client.Get("http://unix/healthz")
+	if err != nil {
+		t.Fatalf("listener stopped by shutdown: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestAppReload(t *testing.T) {
+	a := newTestApp(t)
+	a.baseConfig = testBaseConfig()
+	a.baseConfig.StateDir = t.TempDir()
+	a.baseConfig.Listeners = []listenerConfig{{Address: "127.0.0.1:0"}}
+
+	if err := a.reload(); err == nil {
+		t.Error("reload() without config file: error = nil, want error")
+	}
+
+	a.configPath = writeConfig(t, `{"Directories": [{"Path": "`+t.TempDir()+`"}]}`)
+	if err := a.reload(); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+
+	// An invalid configuration is rejected, and the old one kept.
+	a.configPath = writeConfig(t, `{"Directories": []}`)
+	if err := a.reload(); err == nil {
+		t.Fatal("reload() with invalid config: error = nil, want error")
+	}
+	if len(a.cfg.Directories) != 1 {
+		t.Errorf("directories = %v, want previous configuration", a.cfg.Directories)
+	}
+}
+
+func TestAppDiscovery(t *testing.T) {
+	a := newTestApp(t)
+
+	cfg := testBaseConfig()
+	cfg.Directories = []directoryConfig{{Path: t.TempDir()}}
+	cfg.Remotes = []remoteConfig{{Address: "127.0.0.1:1"}}
+	cfg.Discovery = []discoveryConfig{{
+		// The file doesn't exist, so the provider itself finds nothing;
+		// targets are set directly below.
+		discoverySource: discoverySource{Type: discoveryFile, Path: t.TempDir() + "/targets.json"},
+		Remote:          remoteConfig{Interval: duration(time.Hour), Labels: map[string]string{"env": "prod"}},
+	}}
+	if err := a.apply(cfg); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	src := cfg.Discovery[0].discoverySource
+	ds := a.discoverers[src].service
+
+	remotes := func() map[string]map[string]string {
+		a.service.mu.RLock()
+		defer a.service.mu.RUnlock()
+		ret := make(map[string]map[string]string)
+		for _, addr := range a.service.remoteAddrs {
+			ret[addr] = a.service.remoteLabels[addr]
+		}
+		return ret
+	}
+
+	a.setDiscovered(ds, []remoteConfig{
+		{Address: "127.0.0.1:1"}, // also configured; the static remote wins
+		{Address: "127.0.0.1:2", Labels: map[string]string{"dc": "ams"}},
+		{Address: "127.0.0.1:3", Labels: map[string]string{"env": "staging"}},
+	})
+	want := map[string]map[string]string{
+		"127.0.0.1:1": nil,
+		"127.0.0.1:2": {"dc": "ams", "env": "prod"},
+		"127.0.0.1:3": {"env": "staging"},
+	}
+	if diff := cmp.Diff(want, remotes(), cmp.AllowUnexported(remoteConfig{})); diff != "" {
+		t.Errorf("remotes mismatch (-want +got):\n%s", diff)
+	}
+	if got := a.remotes["127.0.0.1:2"].interval; got != time.Hour {
+		t.Errorf("discovered remote interval = %v, want %v", got, time.Hour)
+	}
+	unchanged := a.remotes["127.0.0.1:2"].token
+
+	// A target going away stops its fetcher, and others are untouched.
+	a.setDiscovered(ds, []remoteConfig{{Address: "127.0.0.1:2", Labels: map[string]string{"dc": "ams"}}})
+	if _, ok := a.remotes["127.0.0.1:3"]; ok {
+		t.Error("remote that is no longer discovered is still running")
+	}
+	if a.remotes["127.0.0.1:2"].token != unchanged {
+		t.Error("unchanged discovered remote was restarted")
+	}
+
+	// Removing the provider removes its remotes, and ignores any further
+	// updates from it.
+	cfg.Discovery = nil
+	if err := a.apply(cfg); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	a.setDiscovered(ds, []remoteConfig{{Address: "127.0.0.1:4"}})
+	want = map[string]map[string]string{"127.0.0.1:1": nil}
+	if diff := cmp.Diff(want, remotes(), cmp.AllowUnexported(remoteConfig{})); diff != "" {
+		t.Errorf("remotes after removing discovery mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// authState is the resolved authentication configuration; see [authConfig].
+type authState struct {
+	// tokens maps from secret token value to its configuration. If empty,
+	// authentication is disabled.
+	tokens map[string]tokenConfig
+
+	// requireForRead is whether read-only endpoints require a token.
+	requireForRead bool
+}
+
+// authenticate returns the token presented in the request, and whether one
+// was presented and valid.
+func (a *authState) authenticate(r *http.Request) (tokenConfig, bool) {
+	header := r.Header.Get("Authorization")
+	secret, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || secret == "" {
+		return tokenConfig{}, false
+	}
+
+	// Compare against every token in constant time, to avoid leaking
+	// which tokens exist through timing.
+	var (
+		found tokenConfig
+		match bool
+	)
+	for candidate, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(secret)) == 1 {
+			found, match = t, true
+		}
+	}
+	return found, match
+}
+
+// roleGrants reports whether a token with the role have may call an endpoint
+// requiring the role want. Admin tokens may call anything, and push tokens
+// may only push.
+func roleGrants(have, want string) bool {
+	switch have {
+	case roleAdmin:
+		return true
+	case roleRead:
+		return want == roleRead
+	case rolePush:
+		return want == rolePush
+	}
+	return false
+}
+
+type authTokenKey struct{}
+
+// authTokenName returns the name of the token that authenticated the request
+// with the given context, or the empty string if there is none.
+func authTokenName(ctx context.Context) string {
+	name, _ := ctx.Value(authTokenKey{}).(string)
+	return name
+}
+
+// requestAuthor returns the author to record for a change made by r: the
+// name of the token that authenticated it, or, only if it wasn't
+// authenticated, claimed, as given by the client.
+func requestAuthor(r *http.Request, claimed string) string {
+	if name := authTokenName(r.Context()); name != "" {
+		return name
+	}
+	return claimed
+}
+
+// requireRole wraps h such that it can only be called with a token granting
+// at least the given role.
+//
+// If role is roleRead and reads don't require authentication, h is called
+// unconditionally. If authentication is disabled, endpoints requiring any
+// other role are forbidden, since they could otherwise be called by anyone
+// who can reach the server.
+func (s *service) requireRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		auth := s.auth
+		s.mu.RUnlock()
+
+		if role == roleRead && (len(auth.tokens) == 0 || !auth.requireForRead) {
+			h(w, r)
+			return
+		}
+		if len(auth.tokens) == 0 {
+			http.Error(w, "forbidden: no tokens are configured", http.StatusForbidden)
+			return
+		}
+
+		token, ok := auth.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="upchek"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !roleGrants(token.Role, role) {
+			s.logger.Warn("token lacks required role",
+				slog.String("token", token.Name),
+				slog.String("role", role),
+				slog.String("path", r.URL.Path))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), authTokenKey{}, token.Name)
+		h(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+)
+
+func TestRequireRole(t *testing.T) {
+	auth := authState{
+		tokens: map[string]tokenConfig{
+			"read-secret":  {Name: "reader", Role: roleRead},
+			"admin-secret": {Name: "admin", Role: roleAdmin},
+			"push-secret":  {Name: "agent", Role: rolePush},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		auth          authState
+		role          string
+		token         string
+		wantCode      int
+		wantTokenName string
+	}{
+		{"disabled_read", authState{}, roleRead, "", http.StatusOK, ""},
+		{"disabled_admin", authState{}, roleAdmin, "", http.StatusForbidden, ""},
+		{"disabled_push", authState{}, rolePush, "", http.StatusForbidden, ""},
+		{"read_not_required", auth, roleRead, "", http.StatusOK, ""},
+		{"admin_no_token", auth, roleAdmin, "", http.StatusUnauthorized, ""},
+		{"admin_bad_token", auth, roleAdmin, "wrong", http.StatusUnauthorized, ""},
+		{"admin_read_token", auth, roleAdmin, "read-secret", http.StatusForbidden, ""},
+		{"admin_admin_token", auth, roleAdmin, "admin-secret", http.StatusOK, "admin"},
+		{"read_required_no_token", authState{tokens: auth.tokens, requireForRead: true}, roleRead, "", http.StatusUnauthorized, ""},
+		{"read_required_read_token", authState{tokens: auth.tokens, requireForRead: true}, roleRead, "read-secret", http.StatusOK, "reader"},
+		{"read_required_admin_token", authState{tokens: auth.tokens, requireForRead: true}, roleRead, "admin-secret", http.StatusOK, "admin"},
+		{"read_required_push_token", authState{tokens: auth.tokens, requireForRead: true}, roleRead, "push-secret", http.StatusForbidden, ""},
+		{"admin_push_token", auth, roleAdmin, "push-secret", http.StatusForbidden, ""},
+		{"push_push_token", auth, rolePush, "push-secret", http.StatusOK, "agent"},
+		{"push_admin_token", auth, rolePush, "admin-secret", http.StatusOK, "admin"},
+		{"push_read_token", auth, rolePush, "read-secret", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &service{logger: slogt.New(t), auth: tt.auth}
+			h := s.requireRole(tt.role, func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, authTokenName(r.Context()))
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if rec.Code == http.StatusOK && rec.Body.String() != tt.wantTokenName {
+				t.Errorf("token name = %q, want %q", rec.Body.String(), tt.wantTokenName)
+			}
+		})
+	}
+}
+
+func TestRequestAuthor(t *testing.T) {
+	req := httptest.NewRequest("POST", "/", nil)
+	if got := requestAuthor(req, "alice"); got != "alice" {
+		t.Errorf("requestAuthor() without a token = %q, want the claimed author", got)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), authTokenKey{}, "ops"))
+	if got := requestAuthor(req, "alice"); got != "ops" {
+		t.Errorf("requestAuthor() with a token = %q, want the token's name", got)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// badgeMaxAge is how long clients and proxies may cache a badge. It is kept
+// short, since badges are usually embedded in pages that are viewed through
+// caching proxies such as GitHub's.
+const badgeMaxAge = 60 * time.Second
+
+// badgeColors are the named colours that badges accept, as used by
+// shields.io.
+var badgeColors = map[string]string{
+	"brightgreen": "#4c1",
+	"green":       "#97ca00",
+	"yellow":      "#dfb317",
+	"yellowgreen": "#a4a61d",
+	"orange":      "#fe7d37",
+	"red":         "#e05d44",
+	"blue":        "#007ec6",
+	"grey":        "#555",
+	"gray":        "#555",
+	"lightgrey":   "#9f9f9f",
+	"lightgray":   "#9f9f9f",
+}
+
+// hexColorRE matches colours given as hexadecimal RGB values, without the
+// leading "#".
+var hexColorRE = regexp.MustCompile(`^(?:[0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// parseBadgeColor returns the SVG fill for a named colour or hexadecimal RGB
+// value, with or without a leading "#".
+func parseBadgeColor(s string) (string, error) {
+	if c, ok := badgeColors[strings.ToLower(s)]; ok {
+		return c, nil
+	}
+	if hex := strings.TrimPrefix(s, "#"); hexColorRE.MatchString(hex) {
+		return "#" + hex, nil
+	}
+	return "", fmt.Errorf("unknown colour %q", s)
+}
+
+// parseWindow parses a window of time such as "24h" or "30d", which may be
+// given in days as well as anything accepted by [time.ParseDuration].
+func parseWindow(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid window %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := parsePositiveDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid window %q", s)
+	}
+	return d, nil
+}
+
+// badge is a shields.io-style badge, with a label on the left and a message
+// on the right.
+type badge struct {
+	Label, Message           string
+	LabelColor, MessageColor string
+}
+
+// checkBadge returns the badge for a single result, which must have had
+// silences applied.
+func checkBadge(r serviceResult) badge {
+	b := badge{Label: r.Name, Message: statusText(r)}
+	switch statusClass(r) {
+	case "success":
+		b.MessageColor = badgeColors["brightgreen"]
+	case "suppressed":
+		b.Message = "suppressed"
+		b.MessageColor = badgeColors["yellow"]
+	case "silenced":
+		b.Message = "silenced"
+		b.MessageColor = badgeColors["lightgrey"]
+	default:
+		b.MessageColor = badgeColors["red"]
+	}
+	return b
+}
+
+// summaryBadge returns the badge for a set of results, which must have had
+// silences applied, counting them as on the status page.
+func summaryBadge(label string, results []serviceResult) badge {
+	var up, down int
+	for _, r := range results {
+		switch historyStatusOf(r) {
+		case historyUp:
+			up++
+		case historyDown:
+			down++
+		}
+	}
+
+	b := badge{Label: label, Message: "ok"}
+	switch state := componentStateOf(up, down); {
+	case len(results) == 0:
+		b.Message = "no checks"
+		b.MessageColor = badgeColors["lightgrey"]
+	case state == componentOperational:
+		b.MessageColor = badgeColors["brightgreen"]
+	case state == componentDegraded:
+		b.Message = fmt.Sprintf("%d/%d failing", down, up+down)
+		b.MessageColor = badgeColors["orange"]
+	default:
+		b.Message = "failing"
+		b.MessageColor = badgeColors["red"]
+	}
+	return b
+}
+
+// badgeFontSize is the size of the text on badges, in pixels.
+const badgeFontSize = 11
+
+// verdanaWidths are the advance widths of the printable ASCII characters in
+// Verdana, in units of 1/2048 em, which are used to size badges.
+var verdanaWidths = [...]int{
+	720, 821, 1067, 1835, 1423, 2429, 1627, 550, 1015, 1015, 1423, 1835, 724, 1020, 724, 1015, // ' ' to '/'
+	1423, 1423, 1423, 1423, 1423, 1423, 1423, 1423, 1423, 1423, // '0' to '9'
+	1015, 1015, 1835, 1835, 1835, 1220, 2249, // ':' to '@'
+	1567, 1544, 1569, 1774, 1421, 1300, 1743, 1732, 862, 1015, 1580, 1276, 1934, // 'A' to 'M'
+	1720, 1800, 1377, 1800, 1589, 1423, 1389, 1694, 1567, 2290, 1571, 1389, 1575, // 'N' to 'Z'
+	1015, 1015, 1015, 1835, 1423, 1423, // '[' to '`'
+	1223, 1276, 1098, 1276, 1219, 720, 1276, 1296, 562, 686, 1186, 562, 1985, // 'a' to 'm'
+	1296, 1237, 1276, 1276, 874, 1044, 807, 1296, 1186, 1673, 1186, 1186, 1051, // 'n' to 'z'
+	1300, 1015, 1300, 1835, // '{' to '~'
+}
+
+// textWidth returns the approximate width of s in pixels when set in the
+// badge font. Characters outside of printable ASCII are assumed to be as
+// wide as a digit.
+func textWidth(s string) int {
+	units := 0
+	for _, r := range s {
+		if r >= ' ' && r <= '~' {
+			units += verdanaWidths[r-' ']
+		} else {
+			units += verdanaWidths['0'-' ']
+		}
+	}
+	return (units*badgeFontSize + 2047) / 2048
+}
+
+// svg renders the badge in the flat style of shields.io.
+func (b badge) svg() []byte {
+	const padding = 10
+	lw := textWidth(b.Label) + padding
+	mw := textWidth(b.Message) + padding
+	w := lw + mw
+	label, message := html.EscapeString(b.Label), html.EscapeString(b.Message)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">`, w, label, message)
+	fmt.Fprintf(&sb, `<title>%s: %s</title>`, label, message)
+	sb.WriteString(`<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`)
+	fmt.Fprintf(&sb, `<clipPath id="r"><rect width="%d" height="20" rx="3" fill="#fff"/></clipPath>`, w)
+	fmt.Fprintf(&sb, `<g clip-path="url(#r)"><rect width="%d" height="20" fill="%s"/><rect x="%d" width="%d" height="20" fill="%s"/><rect width="%d" height="20" fill="url(#s)"/></g>`,
+		lw, b.LabelColor, lw, mw, b.MessageColor, w)
+	fmt.Fprintf(&sb, `<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="%d">`, badgeFontSize)
+	for _, t := range []struct {
+		x    float64
+		text string
+	}{{float64(lw) / 2, label}, {float64(lw) + float64(mw)/2, message}} {
+		fmt.Fprintf(&sb, `<text x="%g" y="15" fill="#010101" fill-opacity=".3">%s</text><text x="%g" y="14">%s</text>`, t.x, t.text, t.x, t.text)
+	}
+	sb.WriteString(`</g></svg>`)
+	return []byte(sb.String())
+}
+
+// uptime returns the percentage of the window before now during which none
+// of the checks whose history matches were failing, or nil if there is no
+// history.
+func (s *service) uptime(window time.Duration, now time.Time, match func(name, group string) bool) *float64 {
+	var spans [][]historySpan
+	for name, group := range s.history.groups() {
+		if match(name, group) {
+			spans = append(spans, s.history.spans(name, now.Add(-window), now))
+		}
+	}
+	return uptimePercent(availability(timeline(spans)))
+}
+
+// handleBadge renders an SVG badge for a check, the checks in a group, or
+// all local checks. Its query parameters are:
+//
+//   - label: the text on the left of the badge, which defaults to the name
+//     of the check or group, or the instance's hostname.
+//   - color and labelColor: the colours of the message and label, either
+//     named as on shields.io or as hexadecimal RGB.
+//   - uptime: a window, such as "7d", over which to show uptime from the
+//     history of the checks after their current state.
+func (s *service) handleBadge(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	results := s.localResults()
+	now := time.Now()
+
+	var (
+		b     badge
+		match func(name, group string) bool
+	)
+	switch {
+	case r.PathValue("group") != "":
+		group, ok := strings.CutSuffix(r.PathValue("group"), ".svg")
+		var matched []serviceResult
+		for _, res := range results {
+			if res.Group == group {
+				matched = append(matched, res)
+			}
+		}
+		if !ok || len(matched) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		b = summaryBadge(group, matched)
+		match = func(_, g string) bool { return g == group }
+	case r.PathValue("check") != "":
+		name, ok := strings.CutSuffix(r.PathValue("check"), ".svg")
+		i := slices.IndexFunc(results, func(res serviceResult) bool { return res.Name == name })
+		if !ok || i < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		b = checkBadge(results[i])
+		match = func(n, _ string) bool { return n == name }
+	default:
+		b = summaryBadge(cmp.Or(s.instance.Hostname, "upchek"), results)
+		match = func(string, string) bool { return true }
+	}
+
+	if v := q.Get("uptime"); v != "" {
+		window, err := parseWindow(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if window > historyRetention {
+			http.Error(w, fmt.Sprintf("uptime window must be at most %dd", historyRetention/(24*time.Hour)), http.StatusBadRequest)
+			return
+		}
+		if pct := s.uptime(window, now, match); pct != nil {
+			b.Message += " | " + formatPercent(*pct)
+		}
+	}
+
+	b.Label = cmp.Or(q.Get("label"), b.Label)
+	b.LabelColor = badgeColors["grey"]
+	for param, dst := range map[string]*string{"color": &b.MessageColor, "labelColor": &b.LabelColor} {
+		if v := q.Get(param); v != "" {
+			c, err := parseBadgeColor(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			*dst = c
+		}
+	}
+
+	// Badges that required a token mustn't be cached by shared caches.
+	cache := "public"
+	if authTokenName(r.Context()) != "" {
+		cache = "private"
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", cache, int(badgeMaxAge.Seconds())))
+	w.Write(b.svg())
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+
+	"github.com/andrew-d/upchek/internal/runner"
+)
+
+func TestParseBadgeColor(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "blue", want: "#007ec6"},
+		{in: "LightGrey", want: "#9f9f9f"},
+		{in: "fc0", want: "#fc0"},
+		{in: "#00ff7f", want: "#00ff7f"},
+		{in: "00ff7", wantErr: true},
+		{in: `red"/><script>`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseBadgeColor(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseBadgeColor(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "24h", want: 24 * time.Hour},
+		{in: "30d", want: 30 * 24 * time.Hour},
+		{in: "90m", want: 90 * time.Minute},
+		{in: "0d", wantErr: true},
+		{in: "-1h", wantErr: true},
+		{in: "1.5d", wantErr: true},
+		{in: "week", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseWindow(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseWindow(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestBadge(t *testing.T) {
+	history, err := loadHistory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	silences, err := loadSilences("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := func(name, group string, ok bool) serviceResult {
+		r := serviceResult{Result: &runner.Result{Name: name}, Group: group, State: statusOK}
+		if !ok {
+			r.ExitCode = 1
+			r.State = statusFailing
+		}
+		return r
+	}
+	s := &service{
+		logger:   slogt.New(t),
+		history:  history,
+		silences: silences,
+		instance: instanceInfo{Hostname: "web1"},
+		results: []serviceResult{
+			result("api-1.sh", "api", true),
+			result("api-2.sh", "api", false),
+			result("db<1>.sh", "db", true),
+			result("disk.sh", "", false),
+		},
+		auth: authState{
+			tokens: map[string]tokenConfig{"secret": {Name: "ops", Role: roleRead}},
+		},
+	}
+	if _, err := silences.add(silence{
+		Matchers:  []silenceMatcher{{Label: "check", Pattern: "disk.sh"}},
+		EndsAt:    time.Now().Add(time.Hour),
+		CreatedBy: "alice",
+		Comment:   "replacing disk",
+	}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// api-1.sh was down for a quarter of the last four hours.
+	now := time.Now()
+	history.record([]serviceResult{result("api-1.sh", "api", false)}, now.Add(-4*time.Hour))
+	history.record([]serviceResult{result("api-1.sh", "api", true)}, now.Add(-3*time.Hour))
+	history.record([]serviceResult{result("api-1.sh", "api", true)}, now)
+
+	mux := (&app{logger: s.logger, service: s}).routes(routesAll)
+	get := func(target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		target string
+		want   []string
+	}{
+		{"/badge/api-1.sh.svg", []string{">api-1.sh<", ">ok<", `fill="#4c1"`}},
+		{"/badge/api-2.sh.svg", []string{">failing<", `fill="#e05d44"`}},
+		{"/badge/disk.sh.svg", []string{">silenced<", `fill="#9f9f9f"`}},
+		{"/badge/db%3C1%3E.sh.svg", []string{">db&lt;1&gt;.sh<"}},
+		{"/badge/group/api.svg", []string{">api<", ">1/2 failing<", `fill="#fe7d37"`}},
+		{"/badge/group/db.svg", []string{">ok<"}},
+		{"/badge/instance.svg", []string{">web1<", ">1/3 failing<"}},
+		{"/badge/api-1.sh.svg?uptime=1d", []string{">ok | 75%<"}},
+		{"/badge/api-1.sh.svg?label=API&color=blue&labelColor=333", []string{">API<", `fill="#007ec6"`, `fill="#333"`}},
+	}
+	for _, tt := range tests {
+		rec := get(tt.target, nil)
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s = %d, want %d: %s", tt.target, rec.Code, http.StatusOK, rec.Body)
+			continue
+		}
+		if got := rec.Header().Get("Content-Type"); got != "image/svg+xml" {
+			t.Errorf("GET %s: Content-Type = %q", tt.target, got)
+		}
+		if got := rec.Header().Get("Cache-Control"); got != "public, max-age=60" {
+			t.Errorf("GET %s: Cache-Control = %q", tt.target, got)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("GET %s doesn't contain %q:\n%s", tt.target, want, rec.Body)
+			}
+		}
+	}
+
+	for target, want := range map[string]int{
+		"/badge/api-1.sh":                   http.StatusNotFound,
+		"/badge/nonexistent.svg":            http.StatusNotFound,
+		"/badge/group/nonexistent.svg":      http.StatusNotFound,
+		"/badge/api-1.sh.svg?uptime=500d":   http.StatusBadRequest,
+		"/badge/api-1.sh.svg?color=invalid": http.StatusBadRequest,
+	} {
+		if rec := get(target, nil); rec.Code != want {
+			t.Errorf("GET %s = %d, want %d", target, rec.Code, want)
+		}
+	}
+
+	// Badges that need a token may only be cached privately.
+	s.auth.requireForRead = true
+	if rec := get("/badge/instance.svg", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /badge/instance.svg without token = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	rec := get("/badge/instance.svg", http.Header{"Authorization": {"Bearer secret"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /badge/instance.svg with token = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "private, max-age=60" {
+		t.Errorf("Cache-Control with token = %q", got)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrew-d/upchek/internal/runner"
+)
+
+// checkConfig holds the settings for a single check.
+//
+// Defaults come from command-line flags, and can be overridden for a single
+// script with directives in the script header; see [parseDirectives].
+type checkConfig struct {
+	// Interval is how often the check is run while in a hard state.
+	Interval time.Duration
+
+	// Timeout is how long the check may run before it is killed; zero
+	// means no timeout.
+	Timeout time.Duration
+
+	// FailAfter is the number of consecutive failed runs required before a
+	// check is considered failing.
+	FailAfter int
+
+	// RecoverAfter is the number of consecutive successful runs required
+	// before a failing check is considered ok again.
+	RecoverAfter int
+
+	// RetryInterval is how often a check is run while it is in a soft
+	// state, instead of the usual interval.
+	RetryInterval time.Duration
+
+	// FlapWindow is the window over which state changes are counted for
+	// flap detection.
+	FlapWindow time.Duration
+
+	// FlapThreshold is the number of state changes within FlapWindow at
+	// which a check is considered flapping. Zero disables flap detection.
+	FlapThreshold int
+
+	// Depends is the list of checks that this check depends on; see
+	// [splitDependency] for the format.
+	Depends []string
+
+	// OnParentFailure is what to do with this check while one of its
+	// dependencies is failing. The zero value is the same as
+	// parentFailureRun.
+	OnParentFailure parentFailure
+
+	// Group is the name of the group that this check belongs to, if any.
+	Group string
+
+	// Tags are free-form tags for the check, which the API can filter
+	// results by.
+	Tags []string
+
+	// User is the user to run the check as, in the format accepted by
+	// [runner.Options]; if empty, the check runs as the same user as
+	// upchek.
+	User string
+
+	// Limits are the resource limits applied to each run of the check.
+	Limits runner.Limits
+
+	// Sandbox, if non-nil, is the sandbox that the check runs in. It
+	// can't be changed by directives, so that a script can't opt out.
+	Sandbox *runner.Sandbox
+
+	// Args are the arguments passed to the script.
+	Args []string
+
+	// Env are environment variables set for the script, in addition to
+	// those that it inherits; see [buildEnv].
+	Env map[string]string
+
+	// EnvFiles are files of environment variables for the script; see
+	// [parseEnvFile]. Relative paths are relative to the directory of the
+	// script.
+	EnvFiles []string
+
+	// InheritEnv are the patterns for the variables that the script
+	// inherits from upchek's environment; see [matchEnvPattern]. If nil,
+	// [defaultInheritEnv] is used.
+	InheritEnv []string
+
+	// WorkDir is the working directory of the script, relative to the
+	// directory of the script. If empty, it is upchek's working
+	// directory.
+	WorkDir string
+
+	// StdinFile, if set, is a file whose contents are passed to the
+	// script on standard input. Relative paths are relative to the
+	// directory of the script.
+	StdinFile string
+
+	// Secrets is a map from environment variable name to the name of a
+	// secret in the secrets directory. Secrets are set in the script's
+	// environment, and redacted from its output.
+	Secrets map[string]string
+
+	// MaxOutput is the maximum number of bytes of each of stdout and
+	// stderr that are kept; if zero, [runner.DefaultMaxOutput] is used.
+	MaxOutput int
+
+	// Interleave is whether stdout and stderr are also captured as a
+	// single stream of timestamped lines, for the check's detail page.
+	Interleave bool
+
+	// OutputFormat is the format of the script's stdout, which determines
+	// whether sub-results are parsed from it; see [outputFormat].
+	OutputFormat outputFormat
+
+	// OnStale is whether sub-results that the script no longer reports
+	// count as failing. Unlike for remotes, the zero value is the same as
+	// staleActionIgnore, since a renamed or removed test would otherwise
+	// fail until it is forgotten.
+	OnStale staleAction
+}
+
+// privilegedDirectives returns the names of the privileged settings in cfg
+// that differ from those in defaults, i.e. that were changed by directives.
+// These settings could be used to gain access to another user or to secrets,
+// including those in upchek's own environment, and so are only honoured in
+// trusted scripts; see [isTrustedScript].
+func privilegedDirectives(cfg, defaults checkConfig) []string {
+	var changed []string
+	if cfg.User != defaults.User {
+		changed = append(changed, "user")
+	}
+	if !maps.Equal(cfg.Secrets, defaults.Secrets) {
+		changed = append(changed, "secret")
+	}
+	if !slices.Equal(cfg.EnvFiles, defaults.EnvFiles) {
+		changed = append(changed, "env-file")
+	}
+	if !slices.Equal(cfg.InheritEnv, defaults.InheritEnv) {
+		changed = append(changed, "inherit-env")
+	}
+	if cfg.StdinFile != defaults.StdinFile {
+		changed = append(changed, "stdin-file")
+	}
+	return changed
+}
+
+// dropPrivileged returns cfg with its privileged settings reset to those in
+// defaults; see [privilegedDirectives].
+func dropPrivileged(cfg, defaults checkConfig) checkConfig {
+	cfg.User = defaults.User
+	cfg.Secrets = defaults.Secrets
+	cfg.EnvFiles = defaults.EnvFiles
+	cfg.InheritEnv = defaults.InheritEnv
+	cfg.StdinFile = defaults.StdinFile
+	return cfg
+}
+
+// directivePrefix is the marker that identifies a directive line in a script
+// header.
+const directivePrefix = "upchek:"
+
+// maxDirectiveLines is the number of lines at the start of a script that are
+// searched for directives.
+const maxDirectiveLines = 50
+
+// parseDirectives reads directives from the header of the script at path and
+// applies them on top of the provided defaults.
+//
+// A directive is a comment line in the first few lines of the script
+// containing "upchek:" followed by one or more space-separated key=value
+// pairs, e.g.:
+//
+//	# upchek: fail-after=3 retry-interval=5s
+//
+// Values can't contain spaces. Directives that take a list, such as "arg"
+// and "env", may be repeated to add to the list.
+//
+// Any comment leader made up of '#', '/', ';' or '-' characters is accepted,
+// so that directives work in most scripting languages.
+func parseDirectives(path string, defaults checkConfig) (checkConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return defaults, err
+	}
+	defer f.Close()
+
+	cfg := defaults
+	sc := bufio.NewScanner(f)
+	for lineNum := 1; lineNum <= maxDirectiveLines && sc.Scan(); lineNum++ {
+		args, ok := directiveArgs(sc.Text())
+		if !ok {
+			continue
+		}
+		for _, arg := range strings.Fields(args) {
+			key, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				return defaults, fmt.Errorf("line %d: directive %q is not of the form key=value", lineNum, arg)
+			}
+			if err := cfg.set(key, value); err != nil {
+				return defaults, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+		}
+	}
+
+	// Ignore errors from lines that are too long; scripts may contain
+	// arbitrary data after the header.
+	if err := sc.Err(); err != nil && err != bufio.ErrTooLong {
+		return defaults, err
+	}
+	return cfg, nil
+}
+
+// directiveArgs returns the arguments of a directive line, and whether the
+// line is a directive at all.
+func directiveArgs(line string) (string, bool) {
+	leader, args, ok := strings.Cut(line, directivePrefix)
+	if !ok {
+		return "", false
+	}
+	leader = strings.TrimSpace(leader)
+	if leader == "" || strings.Trim(leader, "#/;-") != "" {
+		return "", false
+	}
+	return args, true
+}
+
+// set sets the configuration value for the given directive key.
+func (c *checkConfig) set(key, value string) (err error) {
+	switch key {
+	case "interval":
+		c.Interval, err = parsePositiveDuration(value)
+	case "timeout":
+		c.Timeout, err = parsePositiveDuration(value)
+	case "fail-after":
+		c.FailAfter, err = parsePositiveInt(value)
+	case "recover-after":
+		c.RecoverAfter, err = parsePositiveInt(value)
+	case "retry-interval":
+		c.RetryInterval, err = parsePositiveDuration(value)
+	case "flap-window":
+		c.FlapWindow, err = parsePositiveDuration(value)
+	case "flap-threshold":
+		c.FlapThreshold, err = strconv.Atoi(value)
+		if err == nil && c.FlapThreshold < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	case "depends":
+		c.Depends = nil
+		for dep := range strings.SplitSeq(value, ",") {
+			if dep == "" {
+				continue
+			}
+			if _, name := splitDependency(dep); name == "" {
+				return fmt.Errorf("invalid value for %q: dependency %q has no check name", key, dep)
+			}
+			c.Depends = append(c.Depends, dep)
+		}
+	case "on-parent-failure":
+		switch pf := parentFailure(value); pf {
+		case parentFailureRun, parentFailureSkip:
+			c.OnParentFailure = pf
+		default:
+			err = fmt.Errorf("must be %q or %q", parentFailureRun, parentFailureSkip)
+		}
+	case "group":
+		c.Group = value
+	case "tags":
+		c.Tags = nil
+		for tag := range strings.SplitSeq(value, ",") {
+			if tag != "" {
+				c.Tags = append(c.Tags, tag)
+			}
+		}
+	case "user":
+		c.User = value
+		if value == "" || strings.HasPrefix(value, ":") {
+			err = fmt.Errorf("must be a user name or ID")
+		}
+	case "arg":
+		c.Args = append(slices.Clip(c.Args), value)
+	case "env":
+		k, v, _ := strings.Cut(value, "=")
+		if err = validateEnvName(k); err == nil {
+			c.Env = withEntry(c.Env, k, v)
+		}
+	case "env-file":
+		if value == "" {
+			err = fmt.Errorf("must not be empty")
+		}
+		c.EnvFiles = append(slices.Clip(c.EnvFiles), value)
+	case "inherit-env":
+		c.InheritEnv = []string{}
+		for pattern := range strings.SplitSeq(value, ",") {
+			if pattern != "" {
+				c.InheritEnv = append(c.InheritEnv, pattern)
+			}
+		}
+	case "workdir":
+		c.WorkDir = value
+	case "stdin-file":
+		c.StdinFile = value
+	case "max-output":
+		// Like limits, this can only be lowered by a script.
+		var n int64
+		if n, err = parseByteSize(value); err == nil {
+			current := c.MaxOutput
+			if current == 0 {
+				current = runner.DefaultMaxOutput
+			}
+			c.MaxOutput = int(min(int64(current), n))
+		}
+	case "interleave":
+		c.Interleave, err = strconv.ParseBool(value)
+	case "output-format":
+		switch f := outputFormat(value); f {
+		case formatText, formatJSONLines, formatTAP, formatJUnit:
+			c.OutputFormat = f
+		default:
+			err = fmt.Errorf("must be one of %q, %q, %q or %q", formatText, formatJSONLines, formatTAP, formatJUnit)
+		}
+	case "on-stale":
+		switch a := staleAction(value); a {
+		case staleActionIgnore, staleActionFail:
+			c.OnStale = a
+		default:
+			err = fmt.Errorf("must be %q or %q", staleActionIgnore, staleActionFail)
+		}
+	case "secret":
+		// Either NAME, which sets the variable NAME from the secret of the
+		// same name, or VAR=NAME.
+		k, name, ok := strings.Cut(value, "=")
+		if !ok {
+			name = k
+		}
+		if err = validateEnvName(k); err == nil {
+			err = validateSecretName(name)
+		}
+		c.Secrets = withEntry(c.Secrets, k, name)
+
+	// Limits can only be made stricter by a script, so that a script can't
+	// escape the limits set for its directory.
+	case "limit-cpu":
+		var d time.Duration
+		d, err = parsePositiveDuration(value)
+		c.Limits = c.Limits.Tighten(runner.Limits{CPUTime: d})
+	case "limit-as":
+		var n int64
+		n, err = parseByteSize(value)
+		c.Limits = c.Limits.Tighten(runner.Limits{AddressSpace: n})
+	case "limit-nofile":
+		var n int
+		n, err = parsePositiveInt(value)
+		c.Limits = c.Limits.Tighten(runner.Limits{OpenFiles: int64(n)})
+	case "limit-nproc":
+		var n int
+		n, err = parsePositiveInt(value)
+		c.Limits = c.Limits.Tighten(runner.Limits{Processes: int64(n)})
+	case "memory-max":
+		var n int64
+		n, err = parseByteSize(value)
+		c.Limits = c.Limits.Tighten(runner.Limits{MemoryMax: n})
+	case "cpu-max":
+		var f float64
+		f, err = strconv.ParseFloat(value, 64)
+		if err == nil && f <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+		c.Limits = c.Limits.Tighten(runner.Limits{CPUMax: f})
+	default:
+		return fmt.Errorf("unknown directive %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value for %q: %w", key, err)
+	}
+	return nil
+}
+
+// withEntry returns a copy of m with k set to v, leaving m unchanged, since
+// it may be shared with other checks.
+func withEntry(m map[string]string, k, v string) map[string]string {
+	m = maps.Clone(m)
+	if m == nil {
+		m = make(map[string]string)
+	}
+	m[k] = v
+	return m
+}
+
+func parsePositiveInt(s string) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if i < 1 {
+		return 0, fmt.Errorf("must be at least 1")
+	}
+	return i, nil
+}
+
+func parsePositiveDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return d, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andrew-d/upchek/internal/runner"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseDirectives(t *testing.T) {
+	defaults := checkConfig{
+		FailAfter:     1,
+		RecoverAfter:  1,
+		RetryInterval: 5 * time.Second,
+		FlapWindow:    10 * time.Minute,
+		FlapThreshold: 5,
+	}
+
+	tests := []struct {
+		name    string
+		script  string
+		want    checkConfig
+		wantErr bool
+	}{
+		{
+			name:   "no_directives",
+			script: "#!/bin/sh\nexit 0\n",
+			want:   defaults,
+		},
+		{
+			name:   "shell",
+			script: "#!/bin/sh\n# upchek: fail-after=3 recover-after=2\n# upchek: retry-interval=1s\nexit 0\n",
+			want: checkConfig{
+				FailAfter:     3,
+				RecoverAfter:  2,
+				RetryInterval: time.Second,
+				FlapWindow:    10 * time.Minute,
+				FlapThreshold: 5,
+			},
+		},
+		{
+			name:   "other_comment_leaders",
+			script: "// upchek: flap-window=1h\n-- upchek: flap-threshold=0\n",
+			want: checkConfig{
+				FailAfter:     1,
+				RecoverAfter:  1,
+				RetryInterval: 5 * time.Second,
+				FlapWindow:    time.Hour,
+				FlapThreshold: 0,
+			},
+		},
+		{
+			name:   "not_a_comment",
+			script: "#!/bin/sh\necho upchek: fail-after=3\n",
+			want:   defaults,
+		},
+		{
+			name:   "dependencies",
+			script: "#!/bin/sh\n# upchek: depends=router.sh,10.0.0.1:8080/ping.sh on-parent-failure=skip\n# upchek: group=network tags=core,,lan\n",
+			want: checkConfig{
+				FailAfter:       1,
+				RecoverAfter:    1,
+				RetryInterval:   5 * time.Second,
+				FlapWindow:      10 * time.Minute,
+				FlapThreshold:   5,
+				Depends:         []string{"router.sh", "10.0.0.1:8080/ping.sh"},
+				OnParentFailure: parentFailureSkip,
+				Group:           "network",
+				Tags:            []string{"core", "lan"},
+			},
+		},
+		{
+			name:   "interval_and_timeout",
+			script: "#!/bin/sh\n# upchek: interval=5m timeout=30s\n",
+			want: checkConfig{
+				Interval:      5 * time.Minute,
+				Timeout:       30 * time.Second,
+				FailAfter:     1,
+				RecoverAfter:  1,
+				RetryInterval: 5 * time.Second,
+				FlapWindow:    10 * time.Minute,
+				FlapThreshold: 5,
+			},
+		},
+		{
+			name:    "invalid_parent_failure",
+			script:  "# upchek: on-parent-failure=ignore\n",
+			want:    defaults,
+			wantErr: true,
+		},
+		{
+			name:    "invalid_on_stale",
+			script:  "# upchek: on-stale=forget\n",
+			want:    defaults,
+			wantErr: true,
+		},
+		{
+			name:    "unknown_key",
+			script:  "# upchek: bogus=1\n",
+			want:    defaults,
+			wantErr: true,
+		},
+		{
+			name:    "invalid_value",
+			script:  "# upchek: fail-after=0\n",
+			want:    defaults,
+			wantErr: true,
+		},
+		{
+			name:    "missing_value",
+			script:  "# upchek: fail-after\n",
+			want:    defaults,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "check.sh")
+			if err := os.WriteFile(path, []byte(tt.script), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := parseDirectives(path, defaults)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDirectives() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("parseDirectives() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseDirectivesLimits(t *testing.T) {
+	defaults := checkConfig{
+		User:   "nobody",
+		Limits: runner.Limits{OpenFiles: 256, MemoryMax: 1 << 30},
+	}
+	script := "#!/bin/sh\n# upchek: user=daemon:daemon limit-nofile=1024 memory-max=64M\n# upchek: limit-cpu=10s cpu-max=0.5\n"
+	path := filepath.Join(t.TempDir(), "check.sh")
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := parseDirectives(path, defaults)
+	if err != nil {
+		t.Fatalf("parseDirectives() error = %v", err)
+	}
+	want := checkConfig{
+		User: "daemon:daemon",
+		Limits: runner.Limits{
+			CPUTime:   10 * time.Second,
+			OpenFiles: 256, // a script can't loosen its limits
+			MemoryMax: 64 << 20,
+			CPUMax:    0.5,
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseDirectives() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseDirectivesEnv(t *testing.T) {
+	defaults := checkConfig{
+		Env:     map[string]string{"A": "1"},
+		Secrets: map[string]string{"TOKEN": "token"},
+	}
+	script := `#!/bin/sh
+# upchek: arg=--verbose arg=/srv env=B=2 env=EMPTY=
+# upchek: env-file=check.env inherit-env=PATH,LC_* workdir=/srv stdin-file=input.txt
+# upchek: secret=API_KEY secret=DB_PASSWORD=db
+`
+	path := filepath.Join(t.TempDir(), "check.sh")
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := parseDirectives(path, defaults)
+	if err != nil {
+		t.Fatalf("parseDirectives() error = %v", err)
+	}
+	want := checkConfig{
+		Args:       []string{"--verbose", "/srv"},
+		Env:        map[string]string{"A": "1", "B": "2", "EMPTY": ""},
+		EnvFiles:   []string{"check.env"},
+		InheritEnv: []string{"PATH", "LC_*"},
+		WorkDir:    "/srv",
+		StdinFile:  "input.txt",
+		Secrets:    map[string]string{"TOKEN": "token", "API_KEY": "API_KEY", "DB_PASSWORD": "db"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseDirectives() mismatch (-want +got):\n%s", diff)
+	}
+	if len(defaults.Env) != 1 || len(defaults.Secrets) != 1 {
+		t.Errorf("parseDirectives() modified the defaults: %+v", defaults)
+	}
+
+	wantPrivileged := []string{"secret", "env-file", "inherit-env", "stdin-file"}
+	if diff := cmp.Diff(wantPrivileged, privilegedDirectives(got, defaults)); diff != "" {
+		t.Errorf("privilegedDirectives() mismatch (-want +got):\n%s", diff)
+	}
+	if dropped := dropPrivileged(got, defaults); len(privilegedDirectives(dropped, defaults)) != 0 {
+		t.Errorf("dropPrivileged() = %+v, want privileged settings reset", dropped)
+	}
+}
+
+func TestParseDirectivesEnvErrors(t *testing.T) {
+	for _, directive := range []string{"env==x", "secret=../etc/shadow", "secret=X=a/b", "env-file="} {
+		t.Run(directive, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "check.sh")
+			if err := os.WriteFile(path, []byte("#!/bin/sh\n# upchek: "+directive+"\n"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := parseDirectives(path, checkConfig{}); err == nil {
+				t.Errorf("parseDirectives() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestParseDirectivesOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "check.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n# upchek: max-output=4K interleave=true output-format=jsonl on-stale=fail\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := parseDirectives(path, checkConfig{MaxOutput: 64 << 10})
+	if err != nil {
+		t.Fatalf("parseDirectives() error = %v", err)
+	}
+	if got.MaxOutput != 4<<10 || !got.Interleave || got.OutputFormat != formatJSONLines || got.OnStale != staleActionFail {
+		t.Errorf("parseDirectives() = %+v, want MaxOutput 4K, Interleave, jsonl output and failing stale sub-results", got)
+	}
+
+	// A script can't raise its maximum output, including above the
+	// default.
+	got, err = parseDirectives(path, checkConfig{MaxOutput: 1 << 10})
+	if err != nil {
+		t.Fatalf("parseDirectives() error = %v", err)
+	}
+	if got.MaxOutput != 1<<10 {
+		t.Errorf("parseDirectives().MaxOutput = %d, want %d", got.MaxOutput, 1<<10)
+	}
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n# upchek: max-output=1G\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	got, err = parseDirectives(path, checkConfig{})
+	if err != nil {
+		t.Fatalf("parseDirectives() error = %v", err)
+	}
+	if got.MaxOutput != runner.DefaultMaxOutput {
+		t.Errorf("parseDirectives().MaxOutput = %d, want %d", got.MaxOutput, runner.DefaultMaxOutput)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"1024", 1024, false},
+		{"4K", 4 << 10, false},
+		{"512M", 512 << 20, false},
+		{"2g", 2 << 30, false},
+		{"0", 0, true},
+		{"-1M", 0, true},
+		{"lots", 0, true},
+		{"9999999999T", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
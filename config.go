@@ -0,0 +1,1053 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrew-d/upchek/internal/runner"
+	"github.com/andrew-d/upchek/internal/suturehttp"
+
+	"github.com/go-json-experiment/json"
+)
+
+// config is the configuration for upchek.
+//
+// A base configuration is built from command-line flags; if a configuration
+// file is provided, its contents override the base configuration. Lists in
+// the file replace, rather than extend, those from flags.
+type config struct {
+	// StateDir is the directory for persistent state. It cannot be
+	// changed by reloading the configuration.
+	StateDir string `json:",omitzero"`
+
+	// Listeners are the addresses to serve HTTP on.
+	Listeners []listenerConfig `json:",omitzero"`
+
+	// Directories are the directories containing healthcheck scripts.
+	Directories []directoryConfig `json:",omitzero"`
+
+	// Remotes are other upchek instances to aggregate results from.
+	Remotes []remoteConfig `json:",omitzero"`
+
+	// Discovery finds further remotes at runtime; see [discoveryConfig].
+	Discovery []discoveryConfig `json:",omitzero"`
+
+	// Push lists central upchek instances that local results are sent
+	// to; see [pushConfig].
+	Push []pushConfig `json:",omitzero"`
+
+	// Notifiers are notified when a local check starts or stops
+	// alerting.
+	Notifiers []notifierConfig `json:",omitzero"`
+
+	// Auth configures authentication for the HTTP API.
+	Auth authConfig `json:",omitzero"`
+
+	// Defaults holds the default settings for checks and remotes.
+	Defaults defaultsConfig `json:",omitzero"`
+
+	// CgroupParent, if set, is a cgroup v2 directory under which each run
+	// of a check is placed in its own cgroup. It is required for memory
+	// and CPU limits.
+	CgroupParent string `json:",omitzero"`
+
+	// SecretsDir is the directory containing secrets for checks, with one
+	// file per secret, such as systemd's $CREDENTIALS_DIRECTORY.
+	SecretsDir string `json:",omitzero"`
+
+	// TemplateDir, if set, is a directory of templates that replace the
+	// built-in ones, such as "index.html.tmpl", and of static assets
+	// that are served under /static/ from its "static" subdirectory.
+	TemplateDir string `json:",omitzero"`
+
+	// Shutdown configures how upchek stops; see [app.shutdown].
+	Shutdown shutdownConfig `json:",omitzero"`
+
+	// StatusPage configures the public status page; see
+	// [statusPageConfig].
+	StatusPage statusPageConfig `json:",omitzero"`
+
+	// SLOs are availability objectives for local checks and groups; see
+	// [sloConfig].
+	SLOs []sloConfig `json:",omitzero"`
+}
+
+// statusPageConfig configures the public status page at /status, which shows
+// the state of named components made up of local checks, without any details
+// of the checks themselves.
+type statusPageConfig struct {
+	// Title is the title of the page. If empty, "Status" is used.
+	Title string `json:",omitzero"`
+
+	// Components are shown on the page in order. If there are none, the
+	// status page is disabled.
+	Components []componentConfig `json:",omitzero"`
+}
+
+// componentConfig configures a single component of the status page. A check
+// belongs to the component if it matches any of Checks or Groups.
+type componentConfig struct {
+	// Name is the name shown for the component.
+	Name string
+
+	// Description is shown alongside the name, if set.
+	Description string `json:",omitzero"`
+
+	// Checks are glob patterns matching the qualified names of checks,
+	// using the syntax of [path.Match].
+	Checks []string `json:",omitzero"`
+
+	// Groups are glob patterns matching the groups of checks.
+	Groups []string `json:",omitzero"`
+}
+
+// sloConfig is a service level objective for the availability of local
+// checks, or of groups of them, over the last [sloWindow]. The first SLO that
+// matches a check or group applies to it.
+type sloConfig struct {
+	// Check is a glob pattern matching the qualified names of checks, each
+	// of which has the objective on its own.
+	Check string `json:",omitzero"`
+
+	// Group is a glob pattern matching groups, each of which has the
+	// objective as a whole; a group is down whenever any of its checks
+	// are. Exactly one of Check and Group must be set.
+	Group string `json:",omitzero"`
+
+	// Target is the percentage of time that the checks must be up, such
+	// as 99.9.
+	Target float64
+}
+
+// shutdownConfig configures how upchek stops on SIGTERM or SIGINT.
+type shutdownConfig struct {
+	// GracePeriod is how long checks that are running when upchek stops
+	// have to exit after they are sent SIGTERM, before they're killed.
+	GracePeriod duration `json:",omitzero"`
+
+	// Timeout is how long pending notifications and pushes, and then
+	// in-flight HTTP requests, have to finish. Listeners that are
+	// already running keep the timeout they were started with.
+	Timeout duration `json:",omitzero"`
+}
+
+// timeout returns c.Timeout, or the default if it isn't set.
+func (c shutdownConfig) timeout() time.Duration {
+	return cmp.Or(time.Duration(c.Timeout), suturehttp.DefaultShutdownTimeout)
+}
+
+// listenerConfig configures a single HTTP listener.
+type listenerConfig struct {
+	// Address is the address to listen on: a TCP address such as
+	// ":8080", "unix:" followed by the path of a Unix socket, or
+	// "systemd:" followed by the name of a socket passed by systemd
+	// socket activation (its FileDescriptorName=).
+	Address string
+
+	// Routes is the set of endpoints served: "all" (the default), "api",
+	// "status" or "health"; see [routeSet].
+	Routes routeSet `json:",omitzero"`
+
+	// Mode is the permissions of a Unix socket, in octal, e.g. "0660".
+	Mode string `json:",omitzero"`
+
+	// Owner is the "user[:group]" that owns a Unix socket; either may be
+	// a name or a numeric ID.
+	Owner string `json:",omitzero"`
+}
+
+// directoryConfig configures a single directory of healthcheck scripts.
+type directoryConfig struct {
+	// Path is the path to the directory.
+	Path string
+
+	// Namespace is prefixed to the names of checks in this directory, so
+	// that scripts with the same name in different directories don't
+	// collide; see [qualifiedName]. Each directory must have a distinct
+	// namespace, and at most one directory may use the empty namespace.
+	Namespace string `json:",omitzero"`
+
+	// Interval and Timeout override the corresponding defaults for
+	// checks in this directory.
+	Interval duration `json:",omitzero"`
+	Timeout  duration `json:",omitzero"`
+
+	// User overrides the default user that checks in this directory run
+	// as.
+	User string `json:",omitzero"`
+
+	// Limits overrides the default resource limits for checks in this
+	// directory; only the limits that are set are overridden.
+	Limits limitsConfig `json:",omitzero"`
+
+	// Sandbox, if set, overrides the default sandbox settings for checks
+	// in this directory.
+	Sandbox *sandboxConfig `json:",omitzero"`
+
+	// Env are environment variables set for checks, merged with those
+	// from the defaults.
+	Env map[string]string `json:",omitzero"`
+
+	// EnvFiles are files of environment variables for checks, in the
+	// format described by [parseEnvFile]. If set, they replace those from
+	// the defaults.
+	EnvFiles []string `json:",omitzero"`
+
+	// InheritEnv are the variables that checks inherit from upchek's
+	// environment; each is a name, a prefix followed by "*", or "*" for
+	// every variable. If set, they replace those from the defaults.
+	InheritEnv []string `json:",omitzero"`
+
+	// WorkDir overrides the default working directory of checks.
+	WorkDir string `json:",omitzero"`
+
+	// Secrets maps environment variable names to the names of secrets in
+	// the secrets directory, merged with those from the defaults.
+	Secrets map[string]string `json:",omitzero"`
+
+	// MaxOutput overrides the default maximum output of checks.
+	MaxOutput byteSize `json:",omitzero"`
+
+	// Interleave, if set, overrides whether checks capture their output
+	// as a single stream.
+	Interleave *bool `json:",omitzero"`
+}
+
+// checkDefaults returns the default [checkConfig] for checks in the
+// directory, given the global defaults.
+func (d directoryConfig) checkDefaults(defaults checkConfig) checkConfig {
+	if d.Interval > 0 {
+		defaults.Interval = time.Duration(d.Interval)
+	}
+	if d.Timeout > 0 {
+		defaults.Timeout = time.Duration(d.Timeout)
+	}
+	if d.User != "" {
+		defaults.User = d.User
+	}
+	defaults.Limits = d.Limits.apply(defaults.Limits)
+	if d.Sandbox != nil {
+		defaults.Sandbox = d.Sandbox.sandbox()
+	}
+	defaults.Env = mergeMaps(defaults.Env, d.Env)
+	if d.EnvFiles != nil {
+		defaults.EnvFiles = d.EnvFiles
+	}
+	if d.InheritEnv != nil {
+		defaults.InheritEnv = d.InheritEnv
+	}
+	if d.WorkDir != "" {
+		defaults.WorkDir = d.WorkDir
+	}
+	defaults.Secrets = mergeMaps(defaults.Secrets, d.Secrets)
+	if d.MaxOutput > 0 {
+		defaults.MaxOutput = int(d.MaxOutput)
+	}
+	if d.Interleave != nil {
+		defaults.Interleave = *d.Interleave
+	}
+	return defaults
+}
+
+// mergeMaps returns base with the entries of override added, without
+// modifying base.
+func mergeMaps(base, override map[string]string) map[string]string {
+	if len(override) == 0 {
+		return base
+	}
+	m := maps.Clone(base)
+	if m == nil {
+		m = make(map[string]string, len(override))
+	}
+	maps.Copy(m, override)
+	return m
+}
+
+// validateEnv returns an error if any of the environment variables or
+// secrets are invalid.
+func validateEnv(env, secrets map[string]string) error {
+	var errs []error
+	for k := range env {
+		errs = append(errs, validateEnvName(k))
+	}
+	for k, name := range secrets {
+		errs = append(errs, validateEnvName(k), validateSecretName(name))
+	}
+	return errors.Join(errs...)
+}
+
+// limitsConfig configures resource limits for checks; see [runner.Limits]
+// for details. Zero values mean no limit.
+type limitsConfig struct {
+	CPUTime      duration `json:",omitzero"`
+	AddressSpace byteSize `json:",omitzero"`
+	OpenFiles    int64    `json:",omitzero"`
+	Processes    int64    `json:",omitzero"`
+	MemoryMax    byteSize `json:",omitzero"`
+	CPUMax       float64  `json:",omitzero"`
+}
+
+// apply returns base with every limit that is set in l overriding the
+// corresponding limit.
+func (l limitsConfig) apply(base runner.Limits) runner.Limits {
+	if l.CPUTime > 0 {
+		base.CPUTime = time.Duration(l.CPUTime)
+	}
+	if l.AddressSpace > 0 {
+		base.AddressSpace = int64(l.AddressSpace)
+	}
+	if l.OpenFiles > 0 {
+		base.OpenFiles = l.OpenFiles
+	}
+	if l.Processes > 0 {
+		base.Processes = l.Processes
+	}
+	if l.MemoryMax > 0 {
+		base.MemoryMax = int64(l.MemoryMax)
+	}
+	if l.CPUMax > 0 {
+		base.CPUMax = l.CPUMax
+	}
+	return base
+}
+
+// sandboxConfig configures the sandbox for checks; see [runner.Sandbox].
+type sandboxConfig struct {
+	// Enabled is whether checks run in a sandbox.
+	Enabled bool
+
+	// IsolateNetwork is whether checks have their own network namespace,
+	// with only a loopback interface.
+	IsolateNetwork bool `json:",omitzero"`
+
+	// Writable are absolute paths that checks can write to.
+	Writable []string `json:",omitzero"`
+}
+
+// sandbox returns the sandbox for checks, or nil if it's disabled.
+func (s sandboxConfig) sandbox() *runner.Sandbox {
+	if !s.Enabled {
+		return nil
+	}
+	return &runner.Sandbox{
+		IsolateNetwork: s.IsolateNetwork,
+		Writable:       s.Writable,
+	}
+}
+
+// isRootUser reports whether checks run as user, in the format accepted by
+// [runner.Options.User], would run as root. Checks run as upchek's own user,
+// which must be root to use a sandbox, if user is empty.
+func isRootUser(user string) bool {
+	name, _, _ := strings.Cut(user, ":")
+	return name == "" || name == "root" || name == "0"
+}
+
+// validate returns an error if the sandbox configuration is invalid.
+func (s sandboxConfig) validate() error {
+	for _, p := range s.Writable {
+		if !filepath.IsAbs(p) || p == "/" {
+			return fmt.Errorf("sandbox: writable path %q must be absolute and not the root directory", p)
+		}
+	}
+	return nil
+}
+
+// validate returns an error if any limit is negative.
+func (l limitsConfig) validate() error {
+	if l.CPUTime < 0 || l.AddressSpace < 0 || l.OpenFiles < 0 || l.Processes < 0 || l.MemoryMax < 0 || l.CPUMax < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+// remoteConfig configures a single remote upchek instance.
+type remoteConfig struct {
+	// Address is the address of the remote, e.g. "10.0.0.1:8080".
+	Address string
+
+	// Interval is how often to fetch results from the remote. If zero,
+	// Defaults.RemoteInterval is used.
+	Interval duration `json:",omitzero"`
+
+	// Timeout is how long a single fetch from the remote may take. If
+	// zero, Defaults.RemoteTimeout is used.
+	Timeout duration `json:",omitzero"`
+
+	// StaleAfter and OnStale override the corresponding defaults for
+	// this remote.
+	StaleAfter duration    `json:",omitzero"`
+	OnStale    staleAction `json:",omitzero"`
+
+	// MaxClockSkew, if set, overrides Defaults.RemoteMaxClockSkew for
+	// this remote. It's a pointer so that an explicit zero, which
+	// disables the check for this remote, can be told apart from unset.
+	MaxClockSkew *duration `json:",omitzero"`
+
+	// Labels are attached to the remote's results, and can be matched by
+	// silences as "remote.<name>".
+	Labels map[string]string `json:",omitzero"`
+
+	// Token is a bearer token for the remote, for remotes that require
+	// one to read results; it needs the "read" or "admin" role. At most
+	// one of Token and TokenFile may be set.
+	Token string `json:",omitzero"`
+
+	// TokenFile is the path to a file containing the token. Leading and
+	// trailing whitespace is ignored.
+	TokenFile string `json:",omitzero"`
+
+	// token is the token sent to the remote, from Token or TokenFile; see
+	// [config.resolveRemoteTokens].
+	token string
+}
+
+// Types of remote discovery.
+const (
+	discoveryFile = "file" // a JSON or text file listing remotes
+	discoveryDNS  = "dns"  // DNS SRV or address records
+	discoveryHTTP = "http" // an HTTP endpoint returning a JSON target list
+)
+
+// discoverySource is where a discovery provider finds remotes, and how often
+// it looks. It is comparable, so that a provider is only restarted when its
+// source changes.
+type discoverySource struct {
+	// Type is the type of discovery: "file", "dns" or "http".
+	Type string
+
+	// Path is the file to read remotes from, for "file" discovery.
+	Path string `json:",omitzero"`
+
+	// URL is the endpoint to fetch remotes from, for "http" discovery.
+	URL string `json:",omitzero"`
+
+	// Name is the DNS name to look up, for "dns" discovery.
+	Name string `json:",omitzero"`
+
+	// RecordType is the type of DNS record to look up: "SRV" (the
+	// default), or "A" for address records, which requires Port.
+	RecordType string `json:",omitzero"`
+
+	// Port is the port of remotes found from DNS address records.
+	Port int `json:",omitzero"`
+
+	// RefreshInterval is how often to look for remotes. File discovery
+	// also rereads its file when it changes, where that can be watched,
+	// so for it this is a fallback. If zero, a default of one minute is
+	// used.
+	RefreshInterval duration `json:",omitzero"`
+}
+
+// discoveryConfig configures a single remote discovery provider.
+type discoveryConfig struct {
+	discoverySource `json:",inline"`
+
+	// Remote holds the settings for discovered remotes, whose labels
+	// are added to any that the provider discovers. Its Address must be
+	// empty.
+	Remote remoteConfig `json:",omitzero"`
+}
+
+// pushConfig configures pushing local results to a central upchek instance,
+// for hosts that the central instance can't reach.
+type pushConfig struct {
+	// URL is the base URL of the central instance, e.g.
+	// "https://upchek.example.com".
+	URL string
+
+	// Source is the name that results are shown under on the central
+	// instance. It must not contain ':', '/' or whitespace. If empty, the
+	// hostname is used.
+	Source string `json:",omitzero"`
+
+	// Token is a bearer token for the central instance with the "push"
+	// or "admin" role. At most one of Token and TokenFile may be set.
+	Token string `json:",omitzero"`
+
+	// TokenFile is the path to a file containing the token. Leading and
+	// trailing whitespace is ignored.
+	TokenFile string `json:",omitzero"`
+
+	// OnChange is whether to push only when the state of a check
+	// changes, rather than after every run. Results are still pushed
+	// every third of TTL, so that the central instance doesn't consider
+	// them stale.
+	OnChange bool `json:",omitzero"`
+
+	// BatchInterval is the shortest time between pushes; results from
+	// runs in between are sent together. If zero, a default of five
+	// seconds is used.
+	BatchInterval duration `json:",omitzero"`
+
+	// TTL is how long the central instance considers pushed results
+	// current. If zero, a default of five minutes is used.
+	TTL duration `json:",omitzero"`
+
+	// Timeout is how long a single push may take. If zero, a default of
+	// ten seconds is used.
+	Timeout duration `json:",omitzero"`
+
+	// Labels are attached to the pushed results on the central
+	// instance, like the labels of a remote.
+	Labels map[string]string `json:",omitzero"`
+}
+
+// notifierConfig configures a single notifier.
+type notifierConfig struct {
+	// Type is the type of notifier; currently only "webhook" is
+	// supported.
+	Type string
+
+	// URL is the URL that webhook notifications are POSTed to.
+	URL string `json:",omitzero"`
+
+	// Timeout is the timeout for sending a single notification. If zero,
+	// a default of 10 seconds is used.
+	Timeout duration `json:",omitzero"`
+}
+
+// Roles that an API token can have.
+const (
+	// roleRead can read results and silences.
+	roleRead = "read"
+
+	// roleAdmin can do everything that roleRead and rolePush can, as
+	// well as manage silences and reload the configuration.
+	roleAdmin = "admin"
+
+	// rolePush can only push results; see [pushConfig].
+	rolePush = "push"
+)
+
+// authConfig configures authentication for the HTTP API.
+//
+// If no tokens are configured, authentication is disabled entirely.
+type authConfig struct {
+	// Tokens are the bearer tokens that are accepted by the API.
+	Tokens []tokenConfig `json:",omitzero"`
+
+	// RequireForRead is whether reading results requires a token. If
+	// false, only administrative endpoints require a token. The /healthz
+	// endpoint never requires a token.
+	RequireForRead bool `json:",omitzero"`
+}
+
+// tokenConfig configures a single API token.
+type tokenConfig struct {
+	// Name identifies the token in logs and silences.
+	Name string
+
+	// Token is the secret token value. Exactly one of Token and
+	// TokenFile must be set.
+	Token string `json:",omitzero"`
+
+	// TokenFile is the path to a file containing the secret token
+	// value. Leading and trailing whitespace is ignored.
+	TokenFile string `json:",omitzero"`
+
+	// Role is the role granted by the token: "read", "push" or
+	// "admin".
+	Role string
+}
+
+// maxMaxOutput is the largest allowed value of MaxOutput.
+const maxMaxOutput = 64 << 20
+
+// defaultsConfig holds default settings.
+type defaultsConfig struct {
+	// Interval is how often each check is run while in a hard state.
+	Interval duration `json:",omitzero"`
+
+	// Timeout is how long a check may run before it is killed; zero
+	// means no timeout.
+	Timeout duration `json:",omitzero"`
+
+	// RemoteInterval is how often results are fetched from remotes.
+	RemoteInterval duration `json:",omitzero"`
+
+	// RemoteTimeout is how long a single fetch from a remote may take; if
+	// zero, it is the remote's interval.
+	RemoteTimeout duration `json:",omitzero"`
+
+	// RemoteStaleAfter is how long after the last successful fetch the
+	// results of a remote are considered stale. If zero, it is three
+	// times the remote's interval.
+	RemoteStaleAfter duration `json:",omitzero"`
+
+	// RemoteOnStale is whether a stale remote counts as failing; the
+	// zero value is the same as staleActionFail.
+	RemoteOnStale staleAction `json:",omitzero"`
+
+	// RemoteMaxClockSkew is the largest difference between the clocks of
+	// upchek and a remote that is tolerated before a warning is shown;
+	// zero disables the check.
+	RemoteMaxClockSkew duration `json:",omitzero"`
+
+	// PushExpireAfter is how long after its last push a pushed source is
+	// forgotten; until then, it is shown as stale once its TTL passes.
+	// If zero, a default of 24 hours is used.
+	PushExpireAfter duration `json:",omitzero"`
+
+	// The following fields are the defaults for the corresponding fields
+	// in [checkConfig].
+	FailAfter     int      `json:",omitzero"`
+	RecoverAfter  int      `json:",omitzero"`
+	RetryInterval duration `json:",omitzero"`
+	FlapWindow    duration `json:",omitzero"`
+	FlapThreshold int      `json:",omitzero"`
+
+	// User is the user that checks run as; if empty, checks run as the
+	// same user as upchek.
+	User string `json:",omitzero"`
+
+	// Limits are the resource limits applied to checks.
+	Limits limitsConfig `json:",omitzero"`
+
+	// Sandbox configures the sandbox that checks run in, if any.
+	Sandbox sandboxConfig `json:",omitzero"`
+
+	// Env are environment variables set for checks.
+	Env map[string]string `json:",omitzero"`
+
+	// EnvFiles are files of environment variables for checks, in the
+	// format described by [parseEnvFile].
+	EnvFiles []string `json:",omitzero"`
+
+	// InheritEnv are the variables that checks inherit from upchek's
+	// environment; each is a name, a prefix followed by "*", or "*" for
+	// every variable. If unset, a small set of variables such as PATH
+	// and HOME is inherited.
+	InheritEnv []string `json:",omitzero"`
+
+	// WorkDir is the working directory of checks. Relative paths are
+	// relative to the directory of each script.
+	WorkDir string `json:",omitzero"`
+
+	// Secrets maps environment variable names to the names of secrets in
+	// the secrets directory.
+	Secrets map[string]string `json:",omitzero"`
+
+	// MaxOutput is the maximum number of bytes of each of stdout and
+	// stderr that are kept for each run of a check; beyond it, only the
+	// start and end of the output are kept. If zero, 256K is used.
+	MaxOutput byteSize `json:",omitzero"`
+
+	// Interleave is whether checks also capture stdout and stderr as a
+	// single stream of timestamped lines, shown on their detail page.
+	Interleave bool `json:",omitzero"`
+}
+
+// checkConfig returns the default [checkConfig] for checks.
+func (d defaultsConfig) checkConfig() checkConfig {
+	return checkConfig{
+		Interval:      time.Duration(d.Interval),
+		Timeout:       time.Duration(d.Timeout),
+		FailAfter:     d.FailAfter,
+		RecoverAfter:  d.RecoverAfter,
+		RetryInterval: time.Duration(d.RetryInterval),
+		FlapWindow:    time.Duration(d.FlapWindow),
+		FlapThreshold: d.FlapThreshold,
+		User:          d.User,
+		Limits:        d.Limits.apply(runner.Limits{}),
+		Sandbox:       d.Sandbox.sandbox(),
+		Env:           d.Env,
+		EnvFiles:      d.EnvFiles,
+		InheritEnv:    d.InheritEnv,
+		WorkDir:       d.WorkDir,
+		Secrets:       d.Secrets,
+		MaxOutput:     int(d.MaxOutput),
+		Interleave:    d.Interleave,
+	}
+}
+
+// duration is a [time.Duration] that is represented in JSON as a string
+// such as "30s".
+type duration time.Duration
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// byteSize is a size in bytes that is represented in JSON as a string such
+// as "512M"; see [parseByteSize].
+type byteSize int64
+
+func (b byteSize) MarshalText() ([]byte, error) {
+	return []byte(strconv.FormatInt(int64(b), 10)), nil
+}
+
+func (b *byteSize) UnmarshalText(text []byte) error {
+	v, err := parseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+	*b = byteSize(v)
+	return nil
+}
+
+// parseByteSize parses a positive size in bytes, with an optional K, M, G
+// or T suffix for powers of 1024.
+func parseByteSize(s string) (int64, error) {
+	shift := 0
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K', 'k':
+			shift = 10
+		case 'M', 'm':
+			shift = 20
+		case 'G', 'g':
+			shift = 30
+		case 'T', 't':
+			shift = 40
+		}
+		if shift > 0 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if v <= 0 {
+		return 0, errors.New("size must be positive")
+	}
+	if v > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return v << shift, nil
+}
+
+// loadConfig reads the configuration file at path on top of the provided
+// base configuration, and validates the result.
+func loadConfig(path string, base config) (config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config{}, fmt.Errorf("reading config: %w", err)
+	}
+
+	cfg := base
+	if err := json.Unmarshal(data, &cfg, json.RejectUnknownMembers(true)); err != nil {
+		return config{}, fmt.Errorf("parsing config %q: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return config{}, fmt.Errorf("invalid config %q: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// validate checks that the configuration is well-formed.
+func (c *config) validate() error {
+	var errs []error
+
+	if len(c.Listeners) == 0 {
+		errs = append(errs, errors.New("at least one listener is required"))
+	}
+	seen := make(map[string]bool)
+	for _, l := range c.Listeners {
+		if err := l.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("listener %q: %w", l.Address, err))
+		} else if seen[l.Address] {
+			errs = append(errs, fmt.Errorf("duplicate listener %q", l.Address))
+		}
+		seen[l.Address] = true
+	}
+
+	if len(c.Directories) == 0 {
+		errs = append(errs, errors.New("at least one script directory is required"))
+	}
+	clear(seen)
+	namespaces := make(map[string]bool)
+	for _, d := range c.Directories {
+		if d.Path == "" {
+			errs = append(errs, errors.New("directory path must not be empty"))
+		} else if seen[d.Path] {
+			errs = append(errs, fmt.Errorf("duplicate directory %q", d.Path))
+		}
+		seen[d.Path] = true
+
+		if err := validateNamespace(d.Namespace); err != nil {
+			errs = append(errs, fmt.Errorf("directory %q: %w", d.Path, err))
+		} else if namespaces[d.Namespace] {
+			errs = append(errs, fmt.Errorf("directory %q: duplicate namespace %q", d.Path, d.Namespace))
+		}
+		namespaces[d.Namespace] = true
+
+		if d.Interval < 0 || d.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("directory %q: interval and timeout must not be negative", d.Path))
+		}
+		if err := d.Limits.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("directory %q: %w", d.Path, err))
+		}
+		if d.Sandbox != nil {
+			if err := d.Sandbox.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("directory %q: %w", d.Path, err))
+			}
+		}
+		if sb := cmp.Or(d.Sandbox, &c.Defaults.Sandbox); sb.Enabled && isRootUser(cmp.Or(d.User, c.Defaults.User)) {
+			errs = append(errs, fmt.Errorf("directory %q: sandbox requires a non-root User", d.Path))
+		}
+		if err := validateEnv(d.Env, d.Secrets); err != nil {
+			errs = append(errs, fmt.Errorf("directory %q: %w", d.Path, err))
+		}
+		if len(d.Secrets) > 0 && c.SecretsDir == "" {
+			errs = append(errs, fmt.Errorf("directory %q: secrets require SecretsDir to be set", d.Path))
+		}
+		if d.MaxOutput > maxMaxOutput {
+			errs = append(errs, fmt.Errorf("directory %q: MaxOutput must be at most %d bytes", d.Path, maxMaxOutput))
+		}
+	}
+
+	clear(seen)
+	for _, r := range c.Remotes {
+		if r.Address == "" {
+			errs = append(errs, errors.New("remote address must not be empty"))
+		} else if seen[r.Address] {
+			errs = append(errs, fmt.Errorf("duplicate remote %q", r.Address))
+		}
+		seen[r.Address] = true
+		if r.Interval < 0 || r.Timeout < 0 || r.StaleAfter < 0 || (r.MaxClockSkew != nil && *r.MaxClockSkew < 0) {
+			errs = append(errs, fmt.Errorf("remote %q: interval, timeout, stale-after and max clock skew must not be negative", r.Address))
+		}
+		if err := r.OnStale.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("remote %q: %w", r.Address, err))
+		}
+		if r.Token != "" && r.TokenFile != "" {
+			errs = append(errs, fmt.Errorf("remote %q: at most one of Token and TokenFile may be set", r.Address))
+		}
+		if err := validateLabels(r.Labels); err != nil {
+			errs = append(errs, fmt.Errorf("remote %q: %w", r.Address, err))
+		}
+	}
+
+	clear(seen)
+	for i, comp := range c.StatusPage.Components {
+		if comp.Name == "" {
+			errs = append(errs, fmt.Errorf("status page component %d: name is required", i))
+		} else if seen[comp.Name] {
+			errs = append(errs, fmt.Errorf("duplicate status page component %q", comp.Name))
+		}
+		seen[comp.Name] = true
+		if err := comp.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("status page component %q: %w", comp.Name, err))
+		}
+	}
+	for i, slo := range c.SLOs {
+		if err := slo.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("SLO %d: %w", i, err))
+		}
+	}
+
+	if c.Shutdown.GracePeriod < 0 || c.Shutdown.Timeout < 0 {
+		errs = append(errs, errors.New("shutdown grace period and timeout must not be negative"))
+	}
+
+	type pushKey struct{ url, source string }
+	pushes := make(map[pushKey]bool)
+	for i, p := range c.Push {
+		if err := p.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("push %d: %w", i, err))
+		} else if k := (pushKey{p.URL, p.Source}); pushes[k] {
+			errs = append(errs, fmt.Errorf("push %d: duplicate URL and source", i))
+		} else {
+			pushes[k] = true
+		}
+	}
+
+	sources := make(map[discoverySource]bool)
+	for i, d := range c.Discovery {
+		if err := d.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("discovery %d: %w", i, err))
+		} else if sources[d.discoverySource] {
+			errs = append(errs, fmt.Errorf("discovery %d: duplicate provider", i))
+		}
+		sources[d.discoverySource] = true
+	}
+
+	for i, n := range c.Notifiers {
+		switch n.Type {
+		case "webhook":
+			if n.URL == "" {
+				errs = append(errs, fmt.Errorf("notifier %d: webhook URL is required", i))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("notifier %d: unknown type %q", i, n.Type))
+		}
+	}
+
+	for i, t := range c.Auth.Tokens {
+		if t.Name == "" {
+			errs = append(errs, fmt.Errorf("token %d: name is required", i))
+		}
+		if (t.Token == "") == (t.TokenFile == "") {
+			errs = append(errs, fmt.Errorf("token %q: exactly one of Token and TokenFile is required", t.Name))
+		}
+		if t.Role != roleRead && t.Role != roleAdmin && t.Role != rolePush {
+			errs = append(errs, fmt.Errorf("token %q: role must be %q, %q or %q", t.Name, roleRead, rolePush, roleAdmin))
+		}
+	}
+	if c.Auth.RequireForRead && len(c.Auth.Tokens) == 0 {
+		errs = append(errs, errors.New("auth: RequireForRead is set but no tokens are configured"))
+	}
+
+	d := c.Defaults
+	if d.Interval <= 0 {
+		errs = append(errs, errors.New("defaults: interval must be positive"))
+	}
+	if d.Timeout < 0 {
+		errs = append(errs, errors.New("defaults: timeout must not be negative"))
+	}
+	if d.RemoteInterval <= 0 {
+		errs = append(errs, errors.New("defaults: remote interval must be positive"))
+	}
+	if d.RemoteTimeout < 0 || d.RemoteStaleAfter < 0 || d.RemoteMaxClockSkew < 0 {
+		errs = append(errs, errors.New("defaults: remote timeout, stale-after and max clock skew must not be negative"))
+	}
+	if d.PushExpireAfter < 0 {
+		errs = append(errs, errors.New("defaults: push expire-after must not be negative"))
+	}
+	if err := d.RemoteOnStale.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("defaults: %w", err))
+	}
+	if d.FailAfter < 1 || d.RecoverAfter < 1 {
+		errs = append(errs, errors.New("defaults: fail-after and recover-after must be at least 1"))
+	}
+	if d.RetryInterval <= 0 {
+		errs = append(errs, errors.New("defaults: retry interval must be positive"))
+	}
+	if d.FlapThreshold < 0 {
+		errs = append(errs, errors.New("defaults: flap threshold must not be negative"))
+	}
+	if err := d.Limits.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("defaults: %w", err))
+	}
+	if err := d.Sandbox.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("defaults: %w", err))
+	}
+	if d.Sandbox.Enabled && isRootUser(d.User) {
+		errs = append(errs, errors.New("defaults: sandbox requires a non-root User"))
+	}
+	if err := validateEnv(d.Env, d.Secrets); err != nil {
+		errs = append(errs, fmt.Errorf("defaults: %w", err))
+	}
+	if len(d.Secrets) > 0 && c.SecretsDir == "" {
+		errs = append(errs, errors.New("defaults: secrets require SecretsDir to be set"))
+	}
+	if d.MaxOutput > maxMaxOutput {
+		errs = append(errs, fmt.Errorf("defaults: MaxOutput must be at most %d bytes", maxMaxOutput))
+	}
+	if c.CgroupParent == "" {
+		needsCgroup := d.Limits.MemoryMax > 0 || d.Limits.CPUMax > 0
+		for _, dir := range c.Directories {
+			needsCgroup = needsCgroup || dir.Limits.MemoryMax > 0 || dir.Limits.CPUMax > 0
+		}
+		if needsCgroup {
+			errs = append(errs, errors.New("memory and CPU limits require CgroupParent to be set"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resolveTokens returns a map from secret token value to token
+// configuration, reading any token files.
+func (a *authConfig) resolveTokens() (map[string]tokenConfig, error) {
+	tokens := make(map[string]tokenConfig, len(a.Tokens))
+	for _, t := range a.Tokens {
+		secret := t.Token
+		if t.TokenFile != "" {
+			data, err := os.ReadFile(t.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("token %q: %w", t.Name, err)
+			}
+			secret = strings.TrimSpace(string(data))
+		}
+		if secret == "" {
+			return nil, fmt.Errorf("token %q: token is empty", t.Name)
+		}
+		tokens[secret] = t
+	}
+	return tokens, nil
+}
+
+// resolveRemoteTokens reads the token files of the configured remotes and of
+// the remotes found by discovery, so that a missing file is reported when the
+// configuration is applied. c's remotes and discovery providers are copied
+// rather than modified in place.
+func (c *config) resolveRemoteTokens() error {
+	c.Remotes = slices.Clone(c.Remotes)
+	for i := range c.Remotes {
+		if err := c.Remotes[i].resolveToken(); err != nil {
+			return fmt.Errorf("remote %q: %w", c.Remotes[i].Address, err)
+		}
+	}
+	c.Discovery = slices.Clone(c.Discovery)
+	for i := range c.Discovery {
+		if err := c.Discovery[i].Remote.resolveToken(); err != nil {
+			return fmt.Errorf("discovery %s: %w", c.Discovery[i].discoverySource, err)
+		}
+	}
+	return nil
+}
+
+// resolveToken sets r.token from Token or TokenFile.
+func (r *remoteConfig) resolveToken() error {
+	r.token = r.Token
+	if r.TokenFile != "" {
+		data, err := os.ReadFile(r.TokenFile)
+		if err != nil {
+			return fmt.Errorf("token: %w", err)
+		}
+		r.token = strings.TrimSpace(string(data))
+	}
+	return nil
+}
+
+// remoteInterval returns the interval at which to fetch results from r.
+func (c *config) remoteInterval(r remoteConfig) time.Duration {
+	if r.Interval > 0 {
+		return time.Duration(r.Interval)
+	}
+	return time.Duration(c.Defaults.RemoteInterval)
+}
+
+// remoteTimeout returns the timeout for a single fetch from r.
+func (c *config) remoteTimeout(r remoteConfig) time.Duration {
+	if t := cmp.Or(r.Timeout, c.Defaults.RemoteTimeout); t > 0 {
+		return time.Duration(t)
+	}
+	return c.remoteInterval(r)
+}
+
+// remotePolicy returns the staleness and clock skew settings for r.
+func (c *config) remotePolicy(r remoteConfig) remotePolicy {
+	p := remotePolicy{
+		StaleAfter:   time.Duration(cmp.Or(r.StaleAfter, c.Defaults.RemoteStaleAfter)),
+		OnStale:      cmp.Or(r.OnStale, c.Defaults.RemoteOnStale, staleActionFail),
+		MaxClockSkew: time.Duration(c.Defaults.RemoteMaxClockSkew),
+	}
+	if r.MaxClockSkew != nil {
+		p.MaxClockSkew = time.Duration(*r.MaxClockSkew)
+	}
+	if p.StaleAfter == 0 {
+		p.StaleAfter = 3 * c.remoteInterval(r)
+	}
+	return p
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrew-d/upchek/internal/runner"
+	"github.com/go-json-experiment/json"
+	"github.com/google/go-cmp/cmp"
+)
+
+func testBaseConfig() config {
+	return config{
+		StateDir:    "/var/lib/upchek",
+		Listeners:   []listenerConfig{{Address: ":8080"}},
+		Directories: []directoryConfig{{Path: "/etc/upchek"}},
+		Defaults: defaultsConfig{
+			Interval:       duration(30 * time.Second),
+			RemoteInterval: duration(30 * time.Second),
+			FailAfter:      1,
+			RecoverAfter:   1,
+			RetryInterval:  duration(5 * time.Second),
+			FlapWindow:     duration(10 * time.Minute),
+			FlapThreshold:  5,
+		},
+	}
+}
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `{
+		"Listeners": [{"Address": "127.0.0.1:9090"}, {"Address": ":9091"}],
+		"Directories": [{"Path": "/etc/upchek"}, {"Path": "/usr/share/upchek", "Namespace": "pkg", "Timeout": "5s"}],
+		"Remotes": [{"Address": "10.0.0.1:8080", "Interval": "1m"}],
+		"Notifiers": [{"Type": "webhook", "URL": "http://example.com/hook"}],
+		"Auth": {"Tokens": [{"Name": "ops", "Token": "secret", "Role": "admin"}]},
+		"Defaults": {"Interval": "10s", "FailAfter": 3}
+	}`)
+
+	got, err := loadConfig(path, testBaseConfig())
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	want := testBaseConfig()
+	want.Listeners = []listenerConfig{{Address: "127.0.0.1:9090"}, {Address: ":9091"}}
+	want.Directories = []directoryConfig{
+		{Path: "/etc/upchek"},
+		{Path: "/usr/share/upchek", Namespace: "pkg", Timeout: duration(5 * time.Second)},
+	}
+	want.Remotes = []remoteConfig{{Address: "10.0.0.1:8080", Interval: duration(time.Minute)}}
+	want.Notifiers = []notifierConfig{{Type: "webhook", URL: "http://example.com/hook"}}
+	want.Auth = authConfig{Tokens: []tokenConfig{{Name: "ops", Token: "secret", Role: roleAdmin}}}
+	want.Defaults.Interval = duration(10 * time.Second)
+	want.Defaults.FailAfter = 3
+
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(remoteConfig{})); diff != "" {
+		t.Errorf("loadConfig() mismatch (-want +got):\n%s", diff)
+	}
+
+	if got := got.remoteInterval(got.Remotes[0]); got != time.Minute {
+		t.Errorf("remoteInterval() = %v, want %v", got, time.Minute)
+	}
+	if got := got.remoteInterval(remoteConfig{Address: "other"}); got != 30*time.Second {
+		t.Errorf("remoteInterval() = %v, want default %v", got, 30*time.Second)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{"invalid_json", `{`, "parsing config"},
+		{"unknown_field", `{"Listners": []}`, "unknown"},
+		{"no_listeners", `{"Listeners": []}`, "at least one listener"},
+		{"duplicate_listener", `{"Listeners": [{"Address": ":1"}, {"Address": ":1"}]}`, "duplicate listener"},
+		{"unknown_routes", `{"Listeners": [{"Address": ":1", "Routes": "admin"}]}`, "unknown route set"},
+		{"tcp_socket_mode", `{"Listeners": [{"Address": ":1", "Mode": "0600"}]}`, "only be set for unix sockets"},
+		{"bad_socket_mode", `{"Listeners": [{"Address": "unix:/run/upchek.sock", "Mode": "rw-rw----"}]}`, "invalid mode"},
+		{"empty_systemd_name", `{"Listeners": [{"Address": "systemd:"}]}`, "name must not be empty"},
+		{"no_directories", `{"Directories": []}`, "at least one script directory"},
+		{"duplicate_namespace", `{"Directories": [{"Path": "/a"}, {"Path": "/b"}]}`, "duplicate namespace"},
+		{"invalid_namespace", `{"Directories": [{"Path": "/a", "Namespace": "a:b"}]}`, "must not contain"},
+		{"duplicate_remote", `{"Remotes": [{"Address": "a"}, {"Address": "a"}]}`, "duplicate remote"},
+		{"bad_duration", `{"Defaults": {"Interval": "forever"}}`, "parsing config"},
+		{"bad_notifier", `{"Notifiers": [{"Type": "carrier-pigeon"}]}`, "unknown type"},
+		{"webhook_no_url", `{"Notifiers": [{"Type": "webhook"}]}`, "webhook URL is required"},
+		{"token_no_secret", `{"Auth": {"Tokens": [{"Name": "a", "Role": "read"}]}}`, "exactly one of"},
+		{"token_bad_role", `{"Auth": {"Tokens": [{"Name": "a", "Token": "x", "Role": "root"}]}}`, "role must be"},
+		{"negative_limit", `{"Defaults": {"Interval": "1s", "Limits": {"OpenFiles": -1}}}`, "must not be negative"},
+		{"memory_without_cgroup", `{"Directories": [{"Path": "/a", "Limits": {"MemoryMax": "64M"}}]}`, "require CgroupParent"},
+		{"sandbox_relative_path", `{"Defaults": {"Interval": "1s", "Sandbox": {"Enabled": true, "Writable": ["var/lib"]}}}`, "must be absolute"},
+		{"sandbox_without_user", `{"Defaults": {"Interval": "1s", "Sandbox": {"Enabled": true}}}`, "requires a non-root User"},
+		{"sandbox_as_root", `{"Directories": [{"Path": "/a", "User": "root", "Sandbox": {"Enabled": true}}]}`, "requires a non-root User"},
+		{"secrets_without_dir", `{"Directories": [{"Path": "/a", "Secrets": {"TOKEN": "token"}}]}`, "require SecretsDir"},
+		{"bad_secret_name", `{"SecretsDir": "/run/secrets", "Defaults": {"Interval": "1s", "Secrets": {"TOKEN": "../token"}}}`, "invalid secret name"},
+		{"bad_env_name", `{"Directories": [{"Path": "/a", "Env": {"A=B": "c"}}]}`, "invalid environment variable"},
+		{"read_without_tokens", `{"Auth": {"RequireForRead": true}}`, "no tokens"},
+		{"bad_on_stale", `{"Remotes": [{"Address": "a:1", "OnStale": "panic"}]}`, "OnStale must be"},
+		{"negative_stale_after", `{"Defaults": {"Interval": "1s", "RemoteStaleAfter": "-1s"}}`, "must not be negative"},
+		{"discovery_without_path", `{"Discovery": [{"Type": "file"}]}`, "requires Path"},
+		{"discovery_bad_type", `{"Discovery": [{"Type": "consul"}]}`, "unknown type"},
+		{"discovery_a_without_port", `{"Discovery": [{"Type": "dns", "Name": "upchek.example.com", "RecordType": "A"}]}`, "require a Port"},
+		{"discovery_with_address", `{"Discovery": [{"Type": "file", "Path": "/x", "Remote": {"Address": "a:1"}}]}`, "Address must be empty"},
+		{"duplicate_discovery", `{"Discovery": [{"Type": "file", "Path": "/x"}, {"Type": "file", "Path": "/x"}]}`, "duplicate provider"},
+		{"bad_remote_label", `{"Remotes": [{"Address": "a:1", "Labels": {"1dc": "ams"}}]}`, "invalid label name"},
+		{"remote_two_tokens", `{"Remotes": [{"Address": "a:1", "Token": "a", "TokenFile": "/b"}]}`, "at most one of Token"},
+		{"discovery_two_tokens", `{"Discovery": [{"Type": "file", "Path": "/x", "Remote": {"Token": "a", "TokenFile": "/b"}}]}`, "at most one of Remote.Token"},
+		{"push_bad_url", `{"Push": [{"URL": "central:8080"}]}`, "http or https URL"},
+		{"push_two_tokens", `{"Push": [{"URL": "http://central:8080", "Token": "a", "TokenFile": "/b"}]}`, "at most one of Token"},
+		{"push_bad_source", `{"Push": [{"URL": "http://central:8080", "Source": "a/b"}]}`, "invalid source name"},
+		{"bad_token_role", `{"Auth": {"Tokens": [{"Name": "a", "Token": "a", "Role": "write"}]}}`, "role must be"},
+		{"negative_remote_timeout", `{"Remotes": [{"Address": "a:1", "Timeout": "-1s"}]}`, "must not be negative"},
+		{"negative_shutdown_grace", `{"Shutdown": {"GracePeriod": "-1s"}}`, "shutdown grace period and timeout must not be negative"},
+		{"component_no_checks", `{"StatusPage": {"Components": [{"Name": "API"}]}}`, "at least one of Checks or Groups is required"},
+		{"component_bad_pattern", `{"StatusPage": {"Components": [{"Name": "API", "Checks": ["[api"]}]}}`, "invalid pattern"},
+		{"duplicate_component", `{"StatusPage": {"Components": [{"Name": "API", "Groups": ["api"]}, {"Name": "API", "Groups": ["web"]}]}}`, "duplicate status page component"},
+		{"slo_check_and_group", `{"SLOs": [{"Check": "*", "Group": "*", "Target": 99.9}]}`, "exactly one of Check or Group is required"},
+		{"slo_target", `{"SLOs": [{"Group": "api", "Target": 100}]}`, "Target must be between 0 and 100"},
+		{"slo_bad_pattern", `{"SLOs": [{"Check": "[api", "Target": 99}]}`, "invalid pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(writeConfig(t, tt.config), testBaseConfig())
+			if err == nil {
+				t.Fatal("loadConfig() error = nil, want error")
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfig() error = %q, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveTokens(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	auth := authConfig{Tokens: []tokenConfig{
+		{Name: "inline", Token: "inline-secret", Role: roleRead},
+		{Name: "file", TokenFile: tokenFile, Role: roleAdmin},
+	}}
+	tokens, err := auth.resolveTokens()
+	if err != nil {
+		t.Fatalf("resolveTokens() error = %v", err)
+	}
+	if got := tokens["inline-secret"].Name; got != "inline" {
+		t.Errorf("inline token name = %q, want %q", got, "inline")
+	}
+	if got := tokens["from-file"].Name; got != "file" {
+		t.Errorf("file token name = %q, want %q", got, "file")
+	}
+
+	auth.Tokens[1].TokenFile = filepath.Join(t.TempDir(), "missing")
+	if _, err := auth.resolveTokens(); err == nil {
+		t.Error("resolveTokens() with missing file: error = nil, want error")
+	}
+}
+
+func TestResolveRemoteTokens(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	remotes := []remoteConfig{{Address: "a:1", Token: "inline"}, {Address: "b:1", TokenFile: tokenFile}}
+	cfg := config{
+		Remotes:   remotes,
+		Discovery: []discoveryConfig{{Remote: remoteConfig{TokenFile: tokenFile}}},
+	}
+	if err := cfg.resolveRemoteTokens(); err != nil {
+		t.Fatalf("resolveRemoteTokens() error = %v", err)
+	}
+	if got := cfg.Remotes[0].token; got != "inline" {
+		t.Errorf("inline remote token = %q, want %q", got, "inline")
+	}
+	if got := cfg.Remotes[1].token; got != "from-file" {
+		t.Errorf("file remote token = %q, want %q", got, "from-file")
+	}
+	if got := cfg.Discovery[0].remotes([]remoteConfig{{Address: "c:1"}})[0].token; got != "from-file" {
+		t.Errorf("discovered remote token = %q, want %q", got, "from-file")
+	}
+	if remotes[1].token != "" {
+		t.Error("resolveRemoteTokens() modified the original remotes")
+	}
+
+	cfg.Remotes[1].TokenFile = filepath.Join(t.TempDir(), "missing")
+	if err := cfg.resolveRemoteTokens(); err == nil {
+		t.Error("resolveRemoteTokens() with missing file: error = nil, want error")
+	}
+}
+
+func TestDirectoryCheckDefaults(t *testing.T) {
+	defaults := testBaseConfig().Defaults
+	defaults.User = "nobody"
+	defaults.Limits = limitsConfig{OpenFiles: 256, CPUTime: duration(time.Minute)}
+
+	d := directoryConfig{
+		Path:     "/etc/upchek",
+		Interval: duration(time.Hour),
+		User:     "daemon",
+		Limits:   limitsConfig{OpenFiles: 1024, MemoryMax: 64 << 20},
+	}
+	got := d.checkDefaults(defaults.checkConfig())
+	if got.Interval != time.Hour || got.Timeout != 0 || got.User != "daemon" {
+		t.Errorf("checkDefaults() = %+v, want interval, user overridden", got)
+	}
+	want := runner.Limits{CPUTime: time.Minute, OpenFiles: 1024, MemoryMax: 64 << 20}
+	if got.Limits != want {
+		t.Errorf("checkDefaults().Limits = %+v, want %+v", got.Limits, want)
+	}
+
+	// Environment variables and secrets are merged with the defaults,
+	// without modifying them.
+	defaults.Env = map[string]string{"A": "1", "B": "1"}
+	defaults.InheritEnv = []string{"PATH"}
+	d.Env = map[string]string{"B": "2"}
+	d.InheritEnv = []string{}
+	got = d.checkDefaults(defaults.checkConfig())
+	if diff := cmp.Diff(map[string]string{"A": "1", "B": "2"}, got.Env); diff != "" {
+		t.Errorf("checkDefaults().Env mismatch (-want +got):\n%s", diff)
+	}
+	if defaults.Env["B"] != "1" {
+		t.Errorf("checkDefaults() modified the default environment")
+	}
+	if got.InheritEnv == nil || len(got.InheritEnv) != 0 {
+		t.Errorf("checkDefaults().InheritEnv = %#v, want empty", got.InheritEnv)
+	}
+
+	// Sandboxing can be enabled and disabled per directory.
+	defaults.Sandbox = sandboxConfig{Enabled: true}
+	if got := d.checkDefaults(defaults.checkConfig()); got.Sandbox == nil {
+		t.Error("checkDefaults().Sandbox = nil, want default sandbox")
+	}
+	d.Sandbox = &sandboxConfig{Enabled: false}
+	if got := d.checkDefaults(defaults.checkConfig()); got.Sandbox != nil {
+		t.Errorf("checkDefaults().Sandbox = %+v, want disabled", got.Sandbox)
+	}
+}
+
+func TestRemotePolicy(t *testing.T) {
+	cfg := testBaseConfig()
+	cfg.Defaults.RemoteInterval = duration(time.Minute)
+	cfg.Defaults.RemoteMaxClockSkew = duration(30 * time.Second)
+
+	got := cfg.remotePolicy(remoteConfig{Address: "a:1", Interval: duration(10 * time.Second)})
+	want := remotePolicy{StaleAfter: 30 * time.Second, OnStale: staleActionFail, MaxClockSkew: 30 * time.Second}
+	if got != want {
+		t.Errorf("remotePolicy() = %+v, want %+v", got, want)
+	}
+
+	cfg.Defaults.RemoteStaleAfter = duration(5 * time.Minute)
+	cfg.Defaults.RemoteOnStale = staleActionIgnore
+	skew := duration(time.Second)
+	got = cfg.remotePolicy(remoteConfig{Address: "a:1", OnStale: staleActionFail, MaxClockSkew: &skew})
+	want = remotePolicy{StaleAfter: 5 * time.Minute, OnStale: staleActionFail, MaxClockSkew: time.Second}
+	if got != want {
+		t.Errorf("remotePolicy() = %+v, want %+v", got, want)
+	}
+
+	// An explicit zero disables the clock skew check for the remote.
+	var r remoteConfig
+	if err := json.Unmarshal([]byte(`{"Address": "a:1", "MaxClockSkew": "0s"}`), &r); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.remotePolicy(r); got.MaxClockSkew != 0 {
+		t.Errorf("remotePolicy().MaxClockSkew = %v with explicit zero, want 0", got.MaxClockSkew)
+	}
+}
+
+func TestRemoteTimeout(t *testing.T) {
+	cfg := testBaseConfig()
+	cfg.Defaults.RemoteInterval = duration(time.Minute)
+	cfg.Defaults.RemoteTimeout = 0
+
+	if got := cfg.remoteTimeout(remoteConfig{Address: "a:1"}); got != time.Minute {
+		t.Errorf("remoteTimeout() = %v, want the interval", got)
+	}
+	cfg.Defaults.RemoteTimeout = duration(10 * time.Second)
+	if got := cfg.remoteTimeout(remoteConfig{Address: "a:1"}); got != 10*time.Second {
+		t.Errorf("remoteTimeout() = %v, want the default", got)
+	}
+	if got := cfg.remoteTimeout(remoteConfig{Address: "a:1", Timeout: duration(time.Second)}); got != time.Second {
+		t.Errorf("remoteTimeout() = %v, want the remote's timeout", got)
+	}
+}
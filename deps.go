@@ -0,0 +1,239 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// parentFailure is the behaviour of a check when one of its dependencies is
+// failing.
+type parentFailure string
+
+const (
+	// parentFailureRun runs the check as normal, but marks its result as
+	// suppressed.
+	parentFailureRun parentFailure = "run"
+
+	// parentFailureSkip skips running the check entirely while a
+	// dependency is failing.
+	parentFailureSkip parentFailure = "skip"
+)
+
+// splitDependency splits a dependency into the address of the remote that it
+// refers to and the name of the check. Local dependencies have an empty
+// address.
+//
+// Remote dependencies are written as "addr/name", e.g. "10.0.0.1:8080/ping.sh";
+// since script names cannot contain a slash, everything before the last slash
+// is the remote address.
+func splitDependency(dep string) (addr, name string) {
+	i := strings.LastIndexByte(dep, '/')
+	if i < 0 {
+		return "", dep
+	}
+	return dep[:i], dep[i+1:]
+}
+
+// dependencyOrder returns the provided names ordered such that every name
+// comes after all of its local dependencies, as returned by deps. Otherwise,
+// the original order of names is preserved.
+//
+// Names that are part of a dependency cycle cannot be ordered; they are
+// appended to the end in their original order, and also returned as cycle.
+func dependencyOrder(names []string, deps func(string) []string) (order, cycle []string) {
+	known := make(map[string]bool, len(names))
+	for _, name := range names {
+		known[name] = true
+	}
+
+	// Count the number of unsatisfied local dependencies per name.
+	pending := make(map[string]int, len(names))
+	for _, name := range names {
+		for _, dep := range deps(name) {
+			if addr, _ := splitDependency(dep); addr == "" && known[dep] && dep != name {
+				pending[name]++
+			}
+		}
+	}
+
+	// Repeatedly take the first name whose dependencies are all ordered;
+	// the number of scripts is small, so the quadratic behaviour here
+	// doesn't matter.
+	done := make(map[string]bool, len(names))
+	for len(order) < len(names) {
+		progress := false
+		for _, name := range names {
+			if done[name] || pending[name] > 0 {
+				continue
+			}
+			done[name] = true
+			order = append(order, name)
+			progress = true
+
+			for _, other := range names {
+				if done[other] {
+					continue
+				}
+				for _, dep := range deps(other) {
+					if dep == name {
+						pending[other]--
+					}
+				}
+			}
+			break
+		}
+		if !progress {
+			break
+		}
+	}
+
+	for _, name := range names {
+		if !done[name] {
+			cycle = append(cycle, name)
+		}
+	}
+	return append(order, cycle...), cycle
+}
+
+// failingParents returns the dependencies in deps that are currently failing.
+//
+// A local dependency is failing if its confirmed state is not ok or it is
+// itself suppressed. A remote dependency is failing if the remote could not
+// be fetched, or if the named check on that remote is failing. Dependencies
+// that don't exist or haven't run yet are not considered failing.
+//
+// This must only be called from the Serve goroutine.
+func (s *service) failingParents(deps []string) []string {
+	var failing []string
+	for _, dep := range deps {
+		addr, name := splitDependency(dep)
+		if addr == "" {
+			r := s.localResult(name)
+			if r != nil && (!r.IsHealthy() || r.Suppressed) {
+				failing = append(failing, dep)
+			}
+			continue
+		}
+
+		s.mu.RLock()
+		st := s.remoteStates[addr]
+		results := s.remoteResults[addr]
+		s.mu.RUnlock()
+
+		// The last good results are used until they become stale,
+		// regardless of the remote's policy, since the dependency
+		// can't be checked.
+		if st.isStale(time.Now()) {
+			failing = append(failing, dep)
+			continue
+		}
+		for _, result := range results {
+			if result.Name == name && (!result.IsHealthy() || result.Suppressed) {
+				failing = append(failing, dep)
+				break
+			}
+		}
+	}
+	return failing
+}
+
+// localResult returns the most recent result of the local check or
+// sub-result with the given name, or nil if there is none.
+//
+// This must only be called from the Serve goroutine.
+func (s *service) localResult(name string) *serviceResult {
+	if c := s.checks[name]; c != nil {
+		return c.result
+	}
+	if parent, sub, ok := cutSubResult(name); ok {
+		if c := s.checks[parent]; c != nil && c.subs[sub] != nil {
+			return c.subs[sub].result
+		}
+	}
+	return nil
+}
+
+// dependencyChecks returns deps with each dependency on a local sub-result
+// replaced by a dependency on the check that reports it, for ordering checks
+// with [dependencyOrder].
+//
+// This must only be called from the Serve goroutine.
+func (s *service) dependencyChecks(deps []string) []string {
+	mapped := make([]string, len(deps))
+	for i, dep := range deps {
+		if parent, _, ok := cutSubResult(dep); ok && s.checks[dep] == nil && s.checks[parent] != nil {
+			dep = parent
+		}
+		mapped[i] = dep
+	}
+	return mapped
+}
+
+// dependencyNode is a node in the dependency tree shown in the web interface.
+type dependencyNode struct {
+	// Name is the name of the check; for remote checks, this is of the
+	// form "addr/name".
+	Name string
+
+	// Result is the result of the check, or nil if it is not a local
+	// check or hasn't yet run.
+	Result *serviceResult
+
+	// Children are the checks that depend on this one.
+	Children []*dependencyNode
+}
+
+// dependencyTree builds a tree of the provided results from their
+// dependencies. The roots of the tree are checks that have dependents but no
+// dependencies of their own, as well as any remote checks depended upon.
+//
+// Checks that take no part in any dependency relationship are omitted, and a
+// check with multiple dependencies appears under each of them.
+func dependencyTree(results []serviceResult) []*dependencyNode {
+	byName := make(map[string]*serviceResult, len(results))
+	children := make(map[string][]string)
+	for i := range results {
+		r := &results[i]
+		byName[r.Name] = r
+		for _, dep := range r.DependsOn {
+			children[dep] = append(children[dep], r.Name)
+		}
+	}
+
+	// build constructs the node for name; path guards against cycles.
+	var build func(name string, path []string) *dependencyNode
+	build = func(name string, path []string) *dependencyNode {
+		node := &dependencyNode{Name: name, Result: byName[name]}
+		if slices.Contains(path, name) {
+			return node
+		}
+		path = append(path, name)
+		for _, child := range children[name] {
+			node.Children = append(node.Children, build(child, path))
+		}
+		return node
+	}
+
+	var roots []*dependencyNode
+	seen := make(map[string]bool)
+	addRoot := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			roots = append(roots, build(name, nil))
+		}
+	}
+	for _, r := range results {
+		if len(r.DependsOn) == 0 && len(children[r.Name]) > 0 {
+			addRoot(r.Name)
+		}
+		for _, dep := range r.DependsOn {
+			// Dependencies that aren't local checks (i.e. remote
+			// or unknown checks) are roots of their own.
+			if byName[dep] == nil {
+				addRoot(dep)
+			}
+		}
+	}
+	return roots
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/neilotoole/slogt"
+)
+
+func TestSplitDependency(t *testing.T) {
+	tests := []struct {
+		dep      string
+		wantAddr string
+		wantName string
+	}{
+		{"router.sh", "", "router.sh"},
+		{"10.0.0.1:8080/ping.sh", "10.0.0.1:8080", "ping.sh"},
+		{"host/", "host", ""},
+	}
+	for _, tt := range tests {
+		addr, name := splitDependency(tt.dep)
+		if addr != tt.wantAddr || name != tt.wantName {
+			t.Errorf("splitDependency(%q) = (%q, %q), want (%q, %q)",
+				tt.dep, addr, name, tt.wantAddr, tt.wantName)
+		}
+	}
+}
+
+func TestDependencyOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		names     []string
+		deps      map[string][]string
+		wantOrder []string
+		wantCycle []string
+	}{
+		{
+			name:      "no_deps",
+			names:     []string{"a", "b", "c"},
+			wantOrder: []string{"a", "b", "c"},
+		},
+		{
+			name:  "chain",
+			names: []string{"a", "b", "c"},
+			deps: map[string][]string{
+				"a": {"b"},
+				"b": {"c"},
+			},
+			wantOrder: []string{"c", "b", "a"},
+		},
+		{
+			name:  "remote_and_unknown_ignored",
+			names: []string{"a", "b"},
+			deps: map[string][]string{
+				"a": {"host:8080/x", "missing", "b", "b"},
+			},
+			wantOrder: []string{"b", "a"},
+		},
+		{
+			name:  "cycle",
+			names: []string{"a", "b", "c"},
+			deps: map[string][]string{
+				"a": {"b"},
+				"b": {"a"},
+			},
+			wantOrder: []string{"c", "a", "b"},
+			wantCycle: []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, cycle := dependencyOrder(tt.names, func(name string) []string {
+				return tt.deps[name]
+			})
+			if diff := cmp.Diff(tt.wantOrder, order); diff != "" {
+				t.Errorf("order mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantCycle, cycle); diff != "" {
+				t.Errorf("cycle mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDependencyTree(t *testing.T) {
+	results := []serviceResult{
+		{Result: successResult()},
+		{Result: failureResult(), DependsOn: []string{"good.sh", "host:8080/router.sh"}},
+	}
+	results[0].Name = "good.sh"
+	results[1].Name = "bad.sh"
+
+	// Flatten the tree to names for easy comparison.
+	type flatNode struct {
+		Name     string
+		Children []flatNode
+	}
+	var flatten func([]*dependencyNode) []flatNode
+	flatten = func(nodes []*dependencyNode) []flatNode {
+		var out []flatNode
+		for _, n := range nodes {
+			out = append(out, flatNode{n.Name, flatten(n.Children)})
+		}
+		return out
+	}
+
+	got := flatten(dependencyTree(results))
+	want := []flatNode{
+		{"good.sh", []flatNode{{"bad.sh", nil}}},
+		{"host:8080/router.sh", []flatNode{{"bad.sh", nil}}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("dependencyTree() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunScriptsSuppression(t *testing.T) {
+	dir := t.TempDir()
+	scripts := map[string]string{
+		"parent.sh":  "#!/bin/sh\nexit 1\n",
+		"child.sh":   "#!/bin/sh\n# upchek: depends=parent.sh\nexit 1\n",
+		"skipped.sh": "#!/bin/sh\n# upchek: depends=child.sh on-parent-failure=skip\nexit 0\n",
+	}
+	for name, content := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &service{
+		logger:        slogt.New(t),
+		dirs:          []directoryConfig{{Path: dir}},
+		checkDefaults: checkConfig{Interval: time.Minute},
+	}
+	s.initMetrics()
+	if err := s.runScripts(context.Background()); err != nil {
+		t.Fatalf("runScripts() error = %v", err)
+	}
+
+	byName := make(map[string]serviceResult)
+	for _, r := range s.results {
+		byName[r.Name] = r
+	}
+
+	if r := byName["parent.sh"]; !r.IsAlerting() {
+		t.Errorf("parent.sh: IsAlerting() = false, want true")
+	}
+	if r := byName["child.sh"]; r.IsAlerting() || !r.Suppressed {
+		t.Errorf("child.sh: IsAlerting() = %v, Suppressed = %v; want suppressed", r.IsAlerting(), r.Suppressed)
+	}
+	if r := byName["skipped.sh"]; !r.Suppressed || r.ExitCode != -1 {
+		t.Errorf("skipped.sh: Suppressed = %v, ExitCode = %d; want skipped", r.Suppressed, r.ExitCode)
+	}
+
+	data := s.getTemplateData()
+	if data.LocalOk() {
+		t.Errorf("LocalOk() = true, want false")
+	}
+}
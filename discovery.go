@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-json-experiment/json"
+
+	"github.com/andrew-d/upchek/internal/ulog"
+)
+
+const (
+	// defaultDiscoveryInterval is how often discovery providers look for
+	// remotes, unless configured otherwise.
+	defaultDiscoveryInterval = time.Minute
+
+	// discoveryTimeout bounds a single DNS lookup or HTTP request made by
+	// a discovery provider.
+	discoveryTimeout = 30 * time.Second
+
+	// maxTargetListSize is the largest target list that is read from a
+	// file or HTTP endpoint.
+	maxTargetListSize = 10 << 20
+
+	// watchDelay is how long file discovery waits after a change to its
+	// file before rereading it, so that a burst of changes, such as a
+	// file being written in several steps, causes few reads.
+	watchDelay = 100 * time.Millisecond
+)
+
+// remoteLabelPrefix is prefixed to the names of a remote's labels when
+// silences match on them.
+const remoteLabelPrefix = labelRemote + "."
+
+// validateLabelName returns an error if name can't be used as the name of a
+// remote's label. Names are the same as Prometheus label names.
+func validateLabelName(name string) error {
+	if name == "" {
+		return errors.New("label name must not be empty")
+	}
+	for i, r := range name {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9') {
+			continue
+		}
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	return nil
+}
+
+// validateLabels returns an error if any of the names in labels are invalid.
+func validateLabels(labels map[string]string) error {
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(labels)) {
+		errs = append(errs, validateLabelName(name))
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks that the discovery provider is well-formed.
+func (d discoveryConfig) validate() error {
+	var errs []error
+	switch d.Type {
+	case discoveryFile:
+		if d.Path == "" {
+			errs = append(errs, errors.New("file discovery requires Path"))
+		}
+	case discoveryHTTP:
+		if u, err := url.Parse(d.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("http discovery requires an http or https URL, not %q", d.URL))
+		}
+	case discoveryDNS:
+		if d.Name == "" {
+			errs = append(errs, errors.New("dns discovery requires Name"))
+		}
+		switch d.RecordType {
+		case "", "SRV":
+			if d.Port != 0 {
+				errs = append(errs, errors.New("Port is only valid for A records"))
+			}
+		case "A":
+			if d.Port <= 0 || d.Port > 65535 {
+				errs = append(errs, errors.New("A records require a Port between 1 and 65535"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("RecordType must be %q or %q", "SRV", "A"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown type %q", d.Type))
+	}
+	if d.RefreshInterval < 0 {
+		errs = append(errs, errors.New("refresh interval must not be negative"))
+	}
+
+	r := d.Remote
+	if r.Address != "" {
+		errs = append(errs, errors.New("Remote.Address must be empty"))
+	}
+	if r.Interval < 0 || r.Timeout < 0 || r.StaleAfter < 0 || (r.MaxClockSkew != nil && *r.MaxClockSkew < 0) {
+		errs = append(errs, errors.New("remote interval, timeout, stale-after and max clock skew must not be negative"))
+	}
+	if err := r.OnStale.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if r.Token != "" && r.TokenFile != "" {
+		errs = append(errs, errors.New("at most one of Remote.Token and Remote.TokenFile may be set"))
+	}
+	if err := validateLabels(r.Labels); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// String returns a short description of the provider's source, for logging.
+func (src discoverySource) String() string {
+	switch src.Type {
+	case discoveryFile:
+		return "file:" + src.Path
+	case discoveryHTTP:
+		return "http:" + src.URL
+	case discoveryDNS:
+		return "dns:" + cmp.Or(src.RecordType, "SRV") + ":" + src.Name
+	}
+	return src.Type
+}
+
+// remotes returns the remotes that d found at the given discovered targets,
+// with the settings and labels from d.Remote. Discovered labels take
+// precedence over configured ones.
+func (d discoveryConfig) remotes(targets []remoteConfig) []remoteConfig {
+	ret := make([]remoteConfig, 0, len(targets))
+	for _, t := range targets {
+		r := d.Remote
+		r.Address = t.Address
+		if len(r.Labels) > 0 || len(t.Labels) > 0 {
+			r.Labels = maps.Clone(r.Labels)
+			if r.Labels == nil {
+				r.Labels = make(map[string]string, len(t.Labels))
+			}
+			maps.Copy(r.Labels, t.Labels)
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// targetGroup is a group of remotes sharing a set of labels, in the format
+// used by Prometheus's file-based and HTTP service discovery.
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitzero"`
+}
+
+// parseTargets parses a list of remotes, either as a JSON array of target
+// groups:
+//
+//	[{"targets": ["10.0.0.1:8080", "10.0.0.2:8080"], "labels": {"dc": "ams"}}]
+//
+// or as text, with one address per line. Blank lines and lines starting with
+// '#' are ignored in text lists.
+func parseTargets(data []byte) ([]remoteConfig, error) {
+	var groups []targetGroup
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &groups); err != nil {
+			return nil, fmt.Errorf("parsing target groups: %w", err)
+		}
+	} else {
+		var g targetGroup
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				g.Targets = append(g.Targets, line)
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+
+	var (
+		targets []remoteConfig
+		errs    []error
+	)
+	for i, g := range groups {
+		if err := validateLabels(g.Labels); err != nil {
+			errs = append(errs, fmt.Errorf("group %d: %w", i, err))
+			continue
+		}
+		for _, addr := range g.Targets {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				errs = append(errs, fmt.Errorf("group %d: invalid target %q: %w", i, addr, err))
+				continue
+			}
+			targets = append(targets, remoteConfig{Address: addr, Labels: g.Labels})
+		}
+	}
+	return targets, errors.Join(errs...)
+}
+
+// resolver is the subset of [net.Resolver] used for DNS discovery.
+type resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// discoveryService periodically looks for remotes from a single source, and
+// reports each new set of remotes it finds.
+//
+// If a lookup fails, the error is logged and the last remotes found are
+// kept, so that a transient failure doesn't drop every remote.
+type discoveryService struct {
+	source discoverySource
+	logger *slog.Logger
+
+	// update is called with the remotes found by each lookup that
+	// changes them, including the first.
+	update func(ds *discoveryService, targets []remoteConfig)
+
+	// resolver is used for DNS lookups; if nil, [net.DefaultResolver] is
+	// used.
+	resolver resolver
+}
+
+func (ds *discoveryService) String() string {
+	return fmt.Sprintf("discoveryService(%s)", ds.source)
+}
+
+// Serve looks up remotes immediately and then every RefreshInterval. File
+// discovery also watches its file where the platform supports it, and rereads
+// it shortly after it changes; polling remains as a fallback, e.g. for
+// changes that can't be watched, such as on network filesystems.
+func (ds *discoveryService) Serve(ctx context.Context) error {
+	interval := cmp.Or(time.Duration(ds.source.RefreshInterval), defaultDiscoveryInterval)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	next := time.Now() // when timer fires
+
+	var changed <-chan struct{}
+	if ds.source.Type == discoveryFile {
+		var err error
+		changed, err = watchFile(ctx, ds.source.Path)
+		if err != nil {
+			ds.logger.Warn("failed to watch file; polling it instead",
+				slog.Duration("interval", interval),
+				ulog.Error(err))
+		}
+	}
+
+	var (
+		last  []remoteConfig
+		found bool
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+			// Bring the next lookup forward, but don't put it off,
+			// so that a directory that changes constantly doesn't
+			// stop the file from being read.
+			if time.Until(next) > watchDelay {
+				timer.Reset(watchDelay)
+				next = time.Now().Add(watchDelay)
+			}
+			continue
+		case <-timer.C:
+		}
+
+		targets, err := ds.discover(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			ds.logger.Error("failed to discover remotes", ulog.Error(err))
+		}
+		// A file or endpoint with some invalid entries still reports
+		// the valid ones; anything else keeps the last remotes.
+		if (err == nil || targets != nil) && (!found || !slices.EqualFunc(last, targets, remoteConfigEqual)) {
+			ds.logger.Info("discovered remotes", slog.Int("count", len(targets)))
+			ds.update(ds, targets)
+			last, found = targets, true
+		}
+		timer.Reset(interval)
+		next = time.Now().Add(interval)
+	}
+}
+
+// remoteConfigEqual reports whether two discovered remotes are the same.
+func remoteConfigEqual(a, b remoteConfig) bool {
+	return a.Address == b.Address && maps.Equal(a.Labels, b.Labels)
+}
+
+// discover looks up the current remotes.
+func (ds *discoveryService) discover(ctx context.Context) ([]remoteConfig, error) {
+	ctx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+
+	switch ds.source.Type {
+	case discoveryFile:
+		f, err := os.Open(ds.source.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		data, err := io.ReadAll(io.LimitReader(f, maxTargetListSize))
+		if err != nil {
+			return nil, err
+		}
+		return parseTargets(data)
+
+	case discoveryHTTP:
+		req, err := http.NewRequestWithContext(ctx, "GET", ds.source.URL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("creating request: %w", err)
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("making request: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxTargetListSize))
+		if err != nil {
+			return nil, fmt.Errorf("reading response: %w", err)
+		}
+		return parseTargets(data)
+
+	case discoveryDNS:
+		res := ds.resolver
+		if res == nil {
+			res = net.DefaultResolver
+		}
+		return lookupTargets(ctx, res, ds.source)
+	}
+	return nil, fmt.Errorf("unknown discovery type %q", ds.source.Type)
+}
+
+// lookupTargets finds remotes from the DNS records described by src. The
+// results are sorted, so that the order in which a server returns records
+// doesn't matter.
+func lookupTargets(ctx context.Context, res resolver, src discoverySource) ([]remoteConfig, error) {
+	var addrs []string
+	if src.RecordType == "A" {
+		hosts, err := res.LookupHost(ctx, src.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hosts {
+			addrs = append(addrs, net.JoinHostPort(h, strconv.Itoa(src.Port)))
+		}
+	} else {
+		_, srvs, err := res.LookupSRV(ctx, "", "", src.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+	}
+	slices.Sort(addrs)
+
+	targets := make([]remoteConfig, 0, len(addrs))
+	for _, addr := range slices.Compact(addrs) {
+		targets = append(targets, remoteConfig{Address: addr})
+	}
+	return targets, nil
+}
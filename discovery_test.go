@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/neilotoole/slogt"
+)
+
+func TestParseTargets(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []remoteConfig
+		wantErr bool
+	}{
+		{
+			name: "json",
+			data: `[
+				{"targets": ["10.0.0.1:8080", "10.0.0.2:8080"], "labels": {"dc": "ams"}},
+				{"targets": ["[::1]:8080"]}
+			]`,
+			want: []remoteConfig{
+				{Address: "10.0.0.1:8080", Labels: map[string]string{"dc": "ams"}},
+				{Address: "10.0.0.2:8080", Labels: map[string]string{"dc": "ams"}},
+				{Address: "[::1]:8080"},
+			},
+		},
+		{
+			name: "text",
+			data: "# fleet\n10.0.0.1:8080\n\n  host.example.com:8080  \n",
+			want: []remoteConfig{
+				{Address: "10.0.0.1:8080"},
+				{Address: "host.example.com:8080"},
+			},
+		},
+		{
+			name:    "invalid_target",
+			data:    "10.0.0.1\n10.0.0.2:8080\n",
+			want:    []remoteConfig{{Address: "10.0.0.2:8080"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid_label",
+			data:    `[{"targets": ["10.0.0.1:8080"], "labels": {"data-center": "ams"}}]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid_json",
+			data:    `[{"targets": "10.0.0.1:8080"}]`,
+			wantErr: true,
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTargets([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseTargets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(remoteConfig{})); diff != "" {
+				t.Errorf("parseTargets() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// fakeResolver is a resolver with fixed records.
+type fakeResolver struct {
+	srv   map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (r fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	srvs, ok := r.srv[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return name, srvs, nil
+}
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func TestLookupTargets(t *testing.T) {
+	res := fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_upchek._tcp.example.com": {
+				{Target: "b.example.com.", Port: 8080},
+				{Target: "a.example.com.", Port: 8080},
+				{Target: "a.example.com.", Port: 8080},
+			},
+		},
+		hosts: map[string][]string{
+			"upchek.example.com": {"10.0.0.2", "10.0.0.1", "::1"},
+		},
+	}
+	tests := []struct {
+		name    string
+		src     discoverySource
+		want    []remoteConfig
+		wantErr bool
+	}{
+		{
+			name: "srv",
+			src:  discoverySource{Type: discoveryDNS, Name: "_upchek._tcp.example.com"},
+			want: []remoteConfig{{Address: "a.example.com:8080"}, {Address: "b.example.com:8080"}},
+		},
+		{
+			name: "a",
+			src:  discoverySource{Type: discoveryDNS, Name: "upchek.example.com", RecordType: "A", Port: 9000},
+			want: []remoteConfig{{Address: "10.0.0.1:9000"}, {Address: "10.0.0.2:9000"}, {Address: "[::1]:9000"}},
+		},
+		{
+			name:    "not_found",
+			src:     discoverySource{Type: discoveryDNS, Name: "_missing._tcp.example.com"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := lookupTargets(t.Context(), res, tt.src)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("lookupTargets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(remoteConfig{})); diff != "" {
+				t.Errorf("lookupTargets() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// Verify that the discovery service reports changes to a file, and keeps the
+// last remotes when the file can't be read.
+func TestDiscoveryServiceFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.txt")
+	// Replace the file atomically, so that the service never reads it
+	// half-written.
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path+".tmp", []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("10.0.0.1:8080\n")
+
+	updates := make(chan []remoteConfig, 10)
+	ds := &discoveryService{
+		source: discoverySource{Type: discoveryFile, Path: path, RefreshInterval: duration(10 * time.Millisecond)},
+		logger: slogt.New(t),
+		update: func(_ *discoveryService, targets []remoteConfig) { updates <- targets },
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	errc := make(chan error, 1)
+	go func() { errc <- ds.Serve(ctx) }()
+
+	next := func() []remoteConfig {
+		t.Helper()
+		select {
+		case targets := <-updates:
+			return targets
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for discovery update")
+			return nil
+		}
+	}
+	if diff := cmp.Diff([]remoteConfig{{Address: "10.0.0.1:8080"}}, next(), cmp.AllowUnexported(remoteConfig{})); diff != "" {
+		t.Errorf("first update mismatch (-want +got):\n%s", diff)
+	}
+
+	// Removing the file keeps the last remotes, so the next update is
+	// from the rewritten file.
+	os.Remove(path)
+	time.Sleep(50 * time.Millisecond)
+	write("10.0.0.1:8080\n10.0.0.2:8080\n")
+	want := []remoteConfig{{Address: "10.0.0.1:8080"}, {Address: "10.0.0.2:8080"}}
+	if diff := cmp.Diff(want, next(), cmp.AllowUnexported(remoteConfig{})); diff != "" {
+		t.Errorf("second update mismatch (-want +got):\n%s", diff)
+	}
+
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("Serve() = %v, want context.Canceled", err)
+	}
+	select {
+	case targets := <-updates:
+		t.Errorf("unexpected update %v", targets)
+	default:
+	}
+}
+
+func TestDiscoveryServiceFileWatch(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := watchFile(t.Context(), dir); err != nil {
+		t.Skipf("watching files is unsupported: %v", err)
+	}
+	path := filepath.Join(dir, "targets.txt")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path+".tmp", []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("10.0.0.1:8080\n")
+
+	// The interval is long enough that only watching the file can pick
+	// up the change in time.
+	updates := make(chan []remoteConfig, 10)
+	ds := &discoveryService{
+		source: discoverySource{Type: discoveryFile, Path: path, RefreshInterval: duration(time.Hour)},
+		logger: slogt.New(t),
+		update: func(_ *discoveryService, targets []remoteConfig) { updates <- targets },
+	}
+	go ds.Serve(t.Context())
+
+	next := func() []remoteConfig {
+		t.Helper()
+		select {
+		case targets := <-updates:
+			return targets
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for discovery update")
+			return nil
+		}
+	}
+	if diff := cmp.Diff([]remoteConfig{{Address: "10.0.0.1:8080"}}, next(), cmp.AllowUnexported(remoteConfig{})); diff != "" {
+		t.Errorf("first update mismatch (-want +got):\n%s", diff)
+	}
+
+	write("10.0.0.2:8080\n")
+	if diff := cmp.Diff([]remoteConfig{{Address: "10.0.0.2:8080"}}, next(), cmp.AllowUnexported(remoteConfig{})); diff != "" {
+		t.Errorf("second update mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrew-d/upchek/internal/runner"
+)
+
+// defaultInheritEnv is the list of variables that checks inherit from
+// upchek's environment, unless configured otherwise.
+var defaultInheritEnv = []string{"PATH", "HOME", "LANG", "LC_*", "TZ", "USER", "LOGNAME", "TMPDIR"}
+
+// runSettings holds the service-wide settings used to run every check.
+type runSettings struct {
+	// cgroupParent is passed to [runner.Options].
+	cgroupParent string
+
+	// stateDir is upchek's state directory; each check gets its own
+	// directory below it. If empty, checks get no state directory.
+	stateDir string
+
+	// secretsDir is the directory that secrets are read from.
+	secretsDir string
+
+	// gracePeriod is passed to [runner.Options].
+	gracePeriod time.Duration
+}
+
+// runOptions returns the options for a single run of the check c, reading
+// any env files, secrets and stdin file that it uses.
+func (c *check) runOptions(name string, rs runSettings) (runner.Options, error) {
+	cfg := c.cfg
+	opts := runner.Options{
+		Args:         cfg.Args,
+		Dir:          c.resolvePath(cfg.WorkDir),
+		User:         cfg.User,
+		Limits:       cfg.Limits,
+		Sandbox:      cfg.Sandbox,
+		CgroupParent: rs.cgroupParent,
+		GracePeriod:  rs.gracePeriod,
+		MaxOutput:    cfg.MaxOutput,
+		Interleave:   cfg.Interleave,
+	}
+
+	injected := map[string]string{
+		"UPCHEK_CHECK":       name,
+		"UPCHEK_NAMESPACE":   c.namespace,
+		"UPCHEK_ATTEMPT":     strconv.Itoa(c.state.nextAttempt()),
+		"UPCHEK_LAST_STATUS": string(c.state.last),
+		"UPCHEK_METADATA_FD": strconv.Itoa(runner.MetadataFD),
+	}
+	if rs.stateDir != "" {
+		opts.StateDir = filepath.Join(rs.stateDir, "checks", name)
+		injected["UPCHEK_STATE_DIR"] = opts.StateDir
+	}
+
+	envFiles := make([]string, len(cfg.EnvFiles))
+	for i, f := range cfg.EnvFiles {
+		envFiles[i] = c.resolvePath(f)
+	}
+	var err error
+	opts.Env, opts.Redact, err = buildEnv(os.Environ(), cfg.InheritEnv, envFiles, cfg.Env, cfg.Secrets, rs.secretsDir, injected)
+	if err != nil {
+		return runner.Options{}, err
+	}
+
+	if cfg.StdinFile != "" {
+		data, err := os.ReadFile(c.resolvePath(cfg.StdinFile))
+		if err != nil {
+			return runner.Options{}, fmt.Errorf("reading stdin file: %w", err)
+		}
+		opts.Stdin = bytes.NewReader(data)
+	}
+	return opts, nil
+}
+
+// resolvePath returns path resolved relative to the directory containing
+// the check's script.
+func (c *check) resolvePath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(c.path), path)
+}
+
+// buildEnv returns the environment for a check, along with the secret values
+// in it, which must be redacted from the check's output.
+//
+// Variables are taken from the following sources, with later sources taking
+// precedence: the variables in environ that match the inherit patterns (or
+// [defaultInheritEnv], if inherit is nil), each of envFiles in order, env,
+// secrets (a map from variable name to the name of a file in secretsDir) and
+// finally injected.
+func buildEnv(environ, inherit, envFiles []string, env, secrets map[string]string, secretsDir string, injected map[string]string) (_, redact []string, _ error) {
+	if inherit == nil {
+		inherit = defaultInheritEnv
+	}
+	vars := make(map[string]string)
+	for _, kv := range environ {
+		k, v, ok := strings.Cut(kv, "=")
+		if ok && slices.ContainsFunc(inherit, func(pattern string) bool { return matchEnvPattern(pattern, k) }) {
+			vars[k] = v
+		}
+	}
+
+	for _, path := range envFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading env file: %w", err)
+		}
+		fileVars, err := parseEnvFile(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("env file %q: %w", path, err)
+		}
+		maps.Copy(vars, fileVars)
+	}
+	maps.Copy(vars, env)
+
+	for _, k := range slices.Sorted(maps.Keys(secrets)) {
+		v, err := readSecret(secretsDir, secrets[k])
+		if err != nil {
+			return nil, nil, err
+		}
+		vars[k] = v
+		redact = append(redact, v)
+	}
+	maps.Copy(vars, injected)
+
+	result := make([]string, 0, len(vars))
+	for _, k := range slices.Sorted(maps.Keys(vars)) {
+		result = append(result, k+"="+vars[k])
+	}
+	return result, redact, nil
+}
+
+// matchEnvPattern returns whether the variable name matches pattern, which
+// is either a variable name, a prefix followed by "*", or "*" alone to match
+// every variable.
+func matchEnvPattern(pattern, name string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(name, prefix)
+	}
+	return pattern == name
+}
+
+// readSecret reads the secret with the provided name from dir. Leading and
+// trailing whitespace is ignored.
+func readSecret(dir, name string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("secret %q: no secrets directory is configured", name)
+	}
+	if err := validateSecretName(name); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("reading secret: %w", err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("secret %q is empty", name)
+	}
+	return secret, nil
+}
+
+// validateSecretName returns an error if name isn't the name of a file
+// directly within the secrets directory.
+func validateSecretName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid secret name %q", name)
+	}
+	return nil
+}
+
+// validateEnvName returns an error if name can't be used as the name of an
+// environment variable.
+func validateEnvName(name string) error {
+	if name == "" || strings.ContainsAny(name, "=\x00") {
+		return fmt.Errorf("invalid environment variable name %q", name)
+	}
+	return nil
+}
+
+// parseEnvFile parses the contents of an env file: lines of the form
+// KEY=VALUE, optionally preceded by "export ". Blank lines and lines starting
+// with '#' are ignored, and values may be enclosed in single or double quotes,
+// which are removed. No other shell syntax is supported.
+func parseEnvFile(data []byte) (map[string]string, error) {
+	vars := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; sc.Scan(); lineNum++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", lineNum)
+		}
+		k = strings.TrimSpace(k)
+		if err := validateEnvName(k); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		vars[k] = v
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
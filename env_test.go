@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/neilotoole/slogt"
+)
+
+func TestBuildEnv(t *testing.T) {
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, "check.env")
+	if err := os.WriteFile(envFile, []byte("# comment\n\nexport FROM_FILE=\"file value\"\nOVERRIDDEN=file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secretsDir := filepath.Join(dir, "secrets")
+	if err := os.Mkdir(secretsDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(secretsDir, "token"), []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	environ := []string{"PATH=/bin", "HOME=/root", "LC_ALL=C", "SECRET_STUFF=x", "UPCHEK_CHECK=outer"}
+	env, redact, err := buildEnv(environ, nil, []string{envFile},
+		map[string]string{"OVERRIDDEN": "env"},
+		map[string]string{"TOKEN": "token"}, secretsDir,
+		map[string]string{"UPCHEK_CHECK": "check.sh"})
+	if err != nil {
+		t.Fatalf("buildEnv() error = %v", err)
+	}
+	want := []string{
+		"FROM_FILE=file value",
+		"HOME=/root",
+		"LC_ALL=C",
+		"OVERRIDDEN=env",
+		"PATH=/bin",
+		"TOKEN=hunter2",
+		"UPCHEK_CHECK=check.sh",
+	}
+	if diff := cmp.Diff(want, env); diff != "" {
+		t.Errorf("buildEnv() env mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"hunter2"}, redact); diff != "" {
+		t.Errorf("buildEnv() redact mismatch (-want +got):\n%s", diff)
+	}
+
+	// An empty allowlist inherits nothing, and "*" inherits everything.
+	env, _, err = buildEnv(environ, []string{}, nil, nil, nil, "", nil)
+	if err != nil || len(env) != 0 {
+		t.Errorf("buildEnv() with empty allowlist = %v, %v; want empty", env, err)
+	}
+	env, _, err = buildEnv(environ, []string{"*"}, nil, nil, nil, "", nil)
+	if err != nil || len(env) != len(environ) {
+		t.Errorf("buildEnv() with \"*\" = %v, %v; want everything", env, err)
+	}
+
+	// Missing secrets and env files are errors.
+	if _, _, err := buildEnv(nil, nil, nil, nil, map[string]string{"X": "missing"}, secretsDir, nil); err == nil {
+		t.Error("buildEnv() with missing secret: error = nil")
+	}
+	if _, _, err := buildEnv(nil, nil, nil, nil, map[string]string{"X": "token"}, "", nil); err == nil {
+		t.Error("buildEnv() without secrets directory: error = nil")
+	}
+	if _, _, err := buildEnv(nil, nil, []string{filepath.Join(dir, "missing.env")}, nil, nil, "", nil); err == nil {
+		t.Error("buildEnv() with missing env file: error = nil")
+	}
+}
+
+func TestParseEnvFile(t *testing.T) {
+	got, err := parseEnvFile([]byte("A=1\n  B = 'two words' \nC=\"unterminated\nD=a=b\n"))
+	if err != nil {
+		t.Fatalf("parseEnvFile() error = %v", err)
+	}
+	want := map[string]string{"A": "1", "B": "two words", "C": "\"unterminated", "D": "a=b"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseEnvFile() mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := parseEnvFile([]byte("NOT A VARIABLE\n")); err == nil {
+		t.Error("parseEnvFile() error = nil, want error for line without =")
+	}
+}
+
+func TestRunScriptsEnv(t *testing.T) {
+	dir, stateDir, secretsDir := t.TempDir(), t.TempDir(), t.TempDir()
+	script := `#!/bin/sh
+# upchek: arg=hello secret=TOKEN=token workdir=.
+echo "$1 $UPCHEK_CHECK $UPCHEK_NAMESPACE $UPCHEK_ATTEMPT $UPCHEK_METADATA_FD $(pwd)"
+echo "state=$UPCHEK_STATE_DIR"
+echo "token=$TOKEN"
+echo "outer=${OUTER:-unset}"
+`
+	if err := os.WriteFile(filepath.Join(dir, "env.sh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(secretsDir, "token"), []byte("hunter2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OUTER", "leaked")
+
+	s := &service{
+		logger:        slogt.New(t),
+		dirs:          []directoryConfig{{Path: dir, Namespace: "ns"}},
+		checkDefaults: checkConfig{Interval: time.Minute},
+		runSettings:   runSettings{stateDir: stateDir, secretsDir: secretsDir},
+	}
+	s.initMetrics()
+	if err := s.runScripts(t.Context()); err != nil {
+		t.Fatalf("runScripts() error = %v", err)
+	}
+	if len(s.results) != 1 {
+		t.Fatalf("got %d results, want 1", len(s.results))
+	}
+	wantStateDir := filepath.Join(stateDir, "checks", "ns:env.sh")
+	want := "hello ns:env.sh ns 1 3 " + dir + "\n" +
+		"state=" + wantStateDir + "\n" +
+		"token=[REDACTED]\n" +
+		"outer=unset\n"
+	if r := s.results[0]; r.Stdout != want {
+		t.Errorf("stdout = %q, want %q (stderr %q, error %q)", r.Stdout, want, r.Stderr, r.Error)
+	}
+	if st, err := os.Stat(wantStateDir); err != nil || !st.IsDir() {
+		t.Errorf("state directory was not created: %v", err)
+	}
+}
@@ -12,3 +12,5 @@ require (
 require github.com/go-json-experiment/json v0.0.0-20250223041408-d3c622f1b874
 
 require github.com/neilotoole/slogt v1.1.0
+
+require github.com/klauspost/compress v1.18.0
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-json-experiment/json"
+)
+
+// historyRetention is how long the history of a check is kept: long enough
+// for the status page, and for availability reports on every month of the
+// last year.
+const historyRetention = 400 * 24 * time.Hour
+
+// historySaveInterval is how often the history is saved to disk while
+// checks are running. It is also saved when upchek stops.
+const historySaveInterval = 5 * time.Minute
+
+// historyStatus is the status of a check as recorded in its history.
+type historyStatus string
+
+const (
+	// historyUp means that the check was healthy.
+	historyUp historyStatus = "up"
+
+	// historyDown means that the check was failing, including if it was
+	// suppressed by a failing dependency.
+	historyDown historyStatus = "down"
+
+	// historyMaintenance means that the check was failing, but silenced;
+	// such periods don't count towards uptime.
+	historyMaintenance historyStatus = "maintenance"
+)
+
+// historyStatusOf returns the status to record for a result, which must have
+// had silences applied.
+func historyStatusOf(r serviceResult) historyStatus {
+	switch {
+	case r.IsHealthy():
+		return historyUp
+	case r.Silenced:
+		return historyMaintenance
+	default:
+		return historyDown
+	}
+}
+
+// historySpan is a period during which a check had the same status.
+type historySpan struct {
+	Start  time.Time `json:",format:unix"`
+	End    time.Time `json:",format:unix"`
+	Status historyStatus
+}
+
+// checkHistory is the history of a single check.
+type checkHistory struct {
+	// Group is the group of the check as of the last time it was
+	// recorded.
+	Group string `json:",omitzero"`
+
+	// Spans are the periods for which the status of the check is known,
+	// oldest first. Times between spans, such as while upchek wasn't
+	// running, have no data.
+	Spans []historySpan
+}
+
+// historyStore records the status of each local check over time, and
+// persists it to disk.
+type historyStore struct {
+	// path is the file that history is persisted to; if empty, history
+	// is not persisted.
+	path string
+
+	mu       sync.RWMutex // protects following
+	checks   map[string]*checkHistory
+	open     map[string]bool // checks whose last span is still being extended
+	dirty    bool            // whether there are changes since the last save
+	lastSave time.Time
+}
+
+// loadHistory returns a historyStore persisted at the given path. It is not
+// an error for the file to not exist.
+func loadHistory(path string) (*historyStore, error) {
+	h := &historyStore{
+		path:   path,
+		checks: make(map[string]*checkHistory),
+		open:   make(map[string]bool),
+	}
+	if path == "" {
+		return h, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return h, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading history: %w", err)
+	}
+	if err := json.Unmarshal(data, &h.checks); err != nil {
+		return nil, fmt.Errorf("parsing history from %q: %w", path, err)
+	}
+	return h, nil
+}
+
+// record records the status of each of the given results as of time now.
+// The results must have had silences applied.
+//
+// A check's current span is extended for as long as its status stays the
+// same; when it changes, a new span starts at now. Spans loaded from disk
+// are never extended, so the time during which upchek wasn't running has no
+// data.
+//
+// It is safe to call record on a nil historyStore.
+func (h *historyStore) record(results []serviceResult, now time.Time) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	seen := make(map[string]bool, len(results))
+	for _, r := range results {
+		seen[r.Name] = true
+		status := historyStatusOf(r)
+
+		ch := h.checks[r.Name]
+		if ch == nil {
+			ch = &checkHistory{}
+			h.checks[r.Name] = ch
+		}
+		ch.Group = r.Group
+
+		if h.open[r.Name] {
+			last := &ch.Spans[len(ch.Spans)-1]
+			last.End = now
+			if last.Status == status {
+				continue
+			}
+		}
+		ch.Spans = append(ch.Spans, historySpan{Start: now, End: now, Status: status})
+		h.open[r.Name] = true
+	}
+
+	// Checks that weren't recorded have been removed, and any gap until
+	// they reappear has no data.
+	for name := range h.open {
+		if !seen[name] {
+			delete(h.open, name)
+		}
+	}
+
+	// Drop spans that have passed out of retention.
+	cutoff := now.Add(-historyRetention)
+	for name, ch := range h.checks {
+		i := 0
+		for i < len(ch.Spans) && ch.Spans[i].End.Before(cutoff) {
+			i++
+		}
+		ch.Spans = ch.Spans[i:]
+		if len(ch.Spans) == 0 {
+			delete(h.checks, name)
+		}
+	}
+	h.dirty = true
+}
+
+// groups returns the group of every check with history, keyed by the name
+// of the check.
+//
+// It is safe to call groups on a nil historyStore.
+func (h *historyStore) groups() map[string]string {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	groups := make(map[string]string, len(h.checks))
+	for name, ch := range h.checks {
+		groups[name] = ch.Group
+	}
+	return groups
+}
+
+// spans returns the spans of the named check that overlap [from, to),
+// clipped to that interval.
+//
+// It is safe to call spans on a nil historyStore.
+func (h *historyStore) spans(name string, from, to time.Time) []historySpan {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ch := h.checks[name]
+	if ch == nil {
+		return nil
+	}
+	var ret []historySpan
+	for _, sp := range ch.Spans {
+		if !sp.End.After(from) || !sp.Start.Before(to) {
+			continue
+		}
+		if sp.Start.Before(from) {
+			sp.Start = from
+		}
+		if sp.End.After(to) {
+			sp.End = to
+		}
+		ret = append(ret, sp)
+	}
+	return ret
+}
+
+// save persists the history to disk, if it has changed since the last save.
+//
+// It is safe to call save on a nil historyStore.
+func (h *historyStore) save(now time.Time) error {
+	if h == nil || h.path == "" {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.dirty {
+		return nil
+	}
+	data, err := json.Marshal(h.checks, json.Deterministic(true))
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(h.path, data); err != nil {
+		return err
+	}
+	h.dirty = false
+	h.lastSave = now
+	return nil
+}
+
+// saveDue reports whether the history should be saved as of now; see
+// [historySaveInterval].
+func (h *historyStore) saveDue(now time.Time) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.dirty && now.Sub(h.lastSave) >= historySaveInterval
+}
+
+// timelineSegment is a period during which none of a set of checks changed
+// status, and how many of them had each status. Checks without data for the
+// period aren't counted.
+type timelineSegment struct {
+	Start, End  time.Time
+	Up, Down    int
+	Maintenance int
+}
+
+// timeline merges the spans of several checks, as returned by
+// [historyStore.spans], into segments during which none of them changed
+// status. Periods for which none of the checks have data are omitted.
+func timeline(checks [][]historySpan) []timelineSegment {
+	var bounds []time.Time
+	for _, spans := range checks {
+		for _, sp := range spans {
+			bounds = append(bounds, sp.Start, sp.End)
+		}
+	}
+	slices.SortFunc(bounds, func(a, b time.Time) int { return a.Compare(b) })
+	bounds = slices.CompactFunc(bounds, time.Time.Equal)
+
+	// Spans are sorted and don't overlap, so keep an index into each
+	// check's spans that only moves forward.
+	next := make([]int, len(checks))
+	var segs []timelineSegment
+	for i := 1; i < len(bounds); i++ {
+		seg := timelineSegment{Start: bounds[i-1], End: bounds[i]}
+		for c, spans := range checks {
+			for next[c] < len(spans) && !spans[next[c]].End.After(seg.Start) {
+				next[c]++
+			}
+			if next[c] == len(spans) || spans[next[c]].Start.After(seg.Start) {
+				continue
+			}
+			switch spans[next[c]].Status {
+			case historyUp:
+				seg.Up++
+			case historyDown:
+				seg.Down++
+			case historyMaintenance:
+				seg.Maintenance++
+			}
+		}
+		if seg.Up+seg.Down+seg.Maintenance == 0 {
+			continue
+		}
+		if n := len(segs); n > 0 && segs[n-1].End.Equal(seg.Start) && segs[n-1].Up == seg.Up && segs[n-1].Down == seg.Down && segs[n-1].Maintenance == seg.Maintenance {
+			segs[n-1].End = seg.End
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	return segs
+}
+
+// clipSegments returns the parts of segs that fall within [from, to).
+func clipSegments(segs []timelineSegment, from, to time.Time) []timelineSegment {
+	var ret []timelineSegment
+	for _, seg := range segs {
+		if !seg.End.After(from) || !seg.Start.Before(to) {
+			continue
+		}
+		if seg.Start.Before(from) {
+			seg.Start = from
+		}
+		if seg.End.After(to) {
+			seg.End = to
+		}
+		ret = append(ret, seg)
+	}
+	return ret
+}
+
+// availability returns how long, across the segments, none of the checks
+// were down, and how long at least one of them was. Periods during which the
+// checks were only up or in maintenance count as neither.
+func availability(segs []timelineSegment) (up, down time.Duration) {
+	for _, seg := range segs {
+		d := seg.End.Sub(seg.Start)
+		switch {
+		case seg.Down > 0:
+			down += d
+		case seg.Up > 0:
+			up += d
+		}
+	}
+	return up, down
+}
+
+// uptimePercent returns the percentage of time that was up, or nil if there
+// is no data.
+func uptimePercent(up, down time.Duration) *float64 {
+	if up+down <= 0 {
+		return nil
+	}
+	pct := 100 * float64(up) / float64(up+down)
+	return &pct
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/andrew-d/upchek/internal/runner"
+)
+
+func TestHistoryRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	h, err := loadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Unix(1741397010, 0)
+	at := func(min int) time.Time { return t0.Add(time.Duration(min) * time.Minute) }
+	ok := serviceResult{Result: &runner.Result{Name: "web.sh"}, State: statusOK, Group: "web"}
+	failing := serviceResult{Result: failureResult(), State: statusFailing, Group: "web"}
+	failing.Name = "web.sh"
+	silenced := failing
+	silenced.Silenced = true
+
+	h.record([]serviceResult{ok}, at(0))
+	h.record([]serviceResult{ok}, at(1))
+	h.record([]serviceResult{failing}, at(2))
+	h.record([]serviceResult{silenced}, at(3))
+	h.record([]serviceResult{ok}, at(4))
+	if err := h.save(at(4)); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart, the time that upchek wasn't running has no data.
+	h, err = loadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.record([]serviceResult{ok}, at(10))
+	h.record([]serviceResult{ok}, at(11))
+
+	want := []historySpan{
+		{Start: at(0), End: at(2), Status: historyUp},
+		{Start: at(2), End: at(3), Status: historyDown},
+		{Start: at(3), End: at(4), Status: historyMaintenance},
+		{Start: at(4), End: at(4), Status: historyUp},
+		{Start: at(10), End: at(11), Status: historyUp},
+	}
+	if diff := cmp.Diff(want, h.spans("web.sh", at(0), at(20))); diff != "" {
+		t.Errorf("spans() mismatch (-want +got):\n%s", diff)
+	}
+	if got := h.groups(); !cmp.Equal(got, map[string]string{"web.sh": "web"}) {
+		t.Errorf("groups() = %v", got)
+	}
+
+	// Spans are clipped to the requested interval.
+	want = []historySpan{
+		{Start: at(1), End: at(2), Status: historyUp},
+		{Start: at(2), End: at(3), Status: historyDown},
+	}
+	if diff := cmp.Diff(want, h.spans("web.sh", at(1), at(3))); diff != "" {
+		t.Errorf("clipped spans() mismatch (-want +got):\n%s", diff)
+	}
+
+	// Old spans pass out of retention.
+	h.record([]serviceResult{ok}, at(10).Add(historyRetention))
+	if got := h.spans("web.sh", time.Time{}, at(20).Add(historyRetention)); len(got) != 1 {
+		t.Errorf("spans after retention = %v, want one span", got)
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	t0 := time.Unix(1741397010, 0)
+	at := func(min int) time.Time { return t0.Add(time.Duration(min) * time.Minute) }
+
+	a := []historySpan{
+		{Start: at(0), End: at(10), Status: historyUp},
+		{Start: at(10), End: at(20), Status: historyDown},
+		{Start: at(20), End: at(30), Status: historyUp},
+	}
+	b := []historySpan{
+		{Start: at(5), End: at(15), Status: historyDown},
+		{Start: at(15), End: at(25), Status: historyMaintenance},
+		// No data between 25 and 40.
+		{Start: at(40), End: at(50), Status: historyUp},
+	}
+
+	segs := timeline([][]historySpan{a, b})
+	want := []timelineSegment{
+		{Start: at(0), End: at(5), Up: 1},
+		{Start: at(5), End: at(10), Up: 1, Down: 1},
+		{Start: at(10), End: at(15), Down: 2},
+		{Start: at(15), End: at(20), Down: 1, Maintenance: 1},
+		{Start: at(20), End: at(25), Up: 1, Maintenance: 1},
+		{Start: at(25), End: at(30), Up: 1},
+		{Start: at(40), End: at(50), Up: 1},
+	}
+	if diff := cmp.Diff(want, segs); diff != "" {
+		t.Errorf("timeline() mismatch (-want +got):\n%s", diff)
+	}
+
+	up, down := availability(segs)
+	if up != 25*time.Minute || down != 15*time.Minute {
+		t.Errorf("availability() = %v, %v; want 25m, 15m", up, down)
+	}
+	if got := *uptimePercent(up, down); got != 62.5 {
+		t.Errorf("uptimePercent() = %v, want 62.5", got)
+	}
+	if got := uptimePercent(0, 0); got != nil {
+		t.Errorf("uptimePercent() without data = %v, want nil", *got)
+	}
+
+	want = []timelineSegment{
+		{Start: at(12), End: at(15), Down: 2},
+		{Start: at(15), End: at(20), Down: 1, Maintenance: 1},
+		{Start: at(20), End: at(22), Up: 1, Maintenance: 1},
+	}
+	if diff := cmp.Diff(want, clipSegments(segs, at(12), at(22))); diff != "" {
+		t.Errorf("clipSegments() mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// minCompressSize is the smallest response body that is compressed; smaller
+// bodies aren't worth the overhead.
+const minCompressSize = 1024
+
+// Content codings that responses can be compressed with.
+const (
+	encodingZstd = "zstd"
+	encodingGzip = "gzip"
+)
+
+// zstdEncoder compresses responses with zstd. Its EncodeAll method is safe
+// for concurrent use, so a single encoder is shared by all responses.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+// resultsVersion tracks changes to the local results, so that clients of the
+// results API can make conditional requests.
+type resultsVersion struct {
+	// generation is incremented whenever the results change.
+	generation uint64
+
+	// modified is when the results last changed.
+	modified time.Time
+
+	// silences is a hash of the IDs of the silences that were active
+	// when the version was last checked. Silences change which results
+	// are marked silenced without the results themselves changing, e.g.
+	// when a recurring silence's window starts.
+	silences uint64
+}
+
+// changed records a change to the results at time now.
+func (v *resultsVersion) changed(now time.Time) {
+	v.generation++
+	v.modified = now
+}
+
+// localVersion returns the entity tag and modification time of the local
+// results as returned by [service.localResults] at time now.
+func (s *service) localVersion(now time.Time) (etag string, modified time.Time) {
+	h := fnv.New64a()
+	for _, id := range s.silences.active(now) {
+		fmt.Fprintf(h, "%s\x00", id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := &s.resultsVersion
+	if sum := h.Sum64(); sum != v.silences {
+		v.silences = sum
+		v.changed(now)
+	}
+
+	// The generation starts again from zero when upchek restarts, so
+	// the start time is included to tell generations apart. The tag is
+	// weak, since the v2 API includes the time of each response.
+	return fmt.Sprintf(`W/"%x-%x"`, uint64(s.instance.StartTime.UnixNano()), v.generation), v.modified
+}
+
+// checkNotModified sets the ETag and Last-Modified headers of a response
+// from the results API and, if the request's conditional headers show that
+// the client already has the current results, responds with 304 Not
+// Modified and returns true.
+//
+// The version must be checked before the results are read, so that the
+// results sent are never older than their ETag.
+func (s *service) checkNotModified(w http.ResponseWriter, r *http.Request) bool {
+	etag, modified := s.localVersion(time.Now())
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Vary", "Accept-Encoding")
+	if !modified.IsZero() {
+		h.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if !isNotModified(r, etag, modified) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// isNotModified reports whether the conditional headers of r match a resource
+// with the given entity tag and modification time. As in RFC 9110,
+// If-Modified-Since is ignored if If-None-Match is present.
+func isNotModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for tag := range strings.SplitSeq(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if modified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// acceptedEncoding returns the content coding to compress a response to r
+// with: whichever of zstd and gzip has the highest q-value in the request's
+// Accept-Encoding, preferring zstd if both are equally acceptable, or the
+// empty string if neither is acceptable.
+func acceptedEncoding(r *http.Request) string {
+	var (
+		best  string
+		bestQ float64
+	)
+	for coding := range strings.SplitSeq(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != encodingZstd && name != encodingGzip {
+			continue
+		}
+		q := 1.0
+		for param := range strings.SplitSeq(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				var err error
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		if q > bestQ || (q > 0 && q == bestQ && name == encodingZstd) {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// writeCompressedJSON is like [writeJSON], but compresses the response with
+// zstd or gzip if the client accepts either and the response is large enough
+// to benefit; see [acceptedEncoding].
+func writeCompressedJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	b, err := marshalResponse(v)
+	if err != nil {
+		http.Error(w, "failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("Vary", "Accept-Encoding")
+	encoding := acceptedEncoding(r)
+	if len(b) < minCompressSize || encoding == "" {
+		w.WriteHeader(status)
+		w.Write(b)
+		return
+	}
+
+	h.Set("Content-Encoding", encoding)
+	w.WriteHeader(status)
+	switch encoding {
+	case encodingZstd:
+		w.Write(zstdEncoder.EncodeAll(b, nil))
+	case encodingGzip:
+		gw := gzip.NewWriter(w)
+		gw.Write(b)
+		gw.Close()
+	}
+}
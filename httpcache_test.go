@@ -0,0 +1,162 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/klauspost/compress/zstd"
+	"github.com/neilotoole/slogt"
+
+	"github.com/andrew-d/upchek/internal/runner"
+)
+
+func TestResultsConditional(t *testing.T) {
+	silences, err := loadSilences("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &service{
+		logger:   slogt.New(t),
+		silences: silences,
+		instance: instanceInfo{StartTime: time.Now()},
+		results:  []serviceResult{{Result: failureResult()}},
+	}
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header = header
+		rec := httptest.NewRecorder()
+		if strings.HasPrefix(path, "/api/v2/") {
+			s.handleResultsAPIv2(rec, req)
+		} else {
+			s.handleResultsAPI(rec, req)
+		}
+		return rec
+	}
+
+	for _, path := range []string{"/api/v1/results", "/api/v2/results"} {
+		t.Run(path, func(t *testing.T) {
+			rec := get(path, http.Header{})
+			etag, lastModified := rec.Header().Get("ETag"), rec.Header().Get("Last-Modified")
+			if rec.Code != http.StatusOK || etag == "" || lastModified == "" {
+				t.Fatalf("got %d with ETag %q and Last-Modified %q", rec.Code, etag, lastModified)
+			}
+
+			tests := []struct {
+				name   string
+				header http.Header
+				want   int
+			}{
+				{"if_none_match", http.Header{"If-None-Match": {etag}}, http.StatusNotModified},
+				{"if_none_match_list", http.Header{"If-None-Match": {`W/"other", ` + etag}}, http.StatusNotModified},
+				{"if_none_match_other", http.Header{"If-None-Match": {`W/"other"`}}, http.StatusOK},
+				{"if_modified_since", http.Header{"If-Modified-Since": {lastModified}}, http.StatusNotModified},
+				{"if_modified_since_earlier", http.Header{"If-Modified-Since": {time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}}, http.StatusOK},
+				// If-None-Match takes precedence.
+				{"both", http.Header{"If-None-Match": {`W/"other"`}, "If-Modified-Since": {lastModified}}, http.StatusOK},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					rec := get(path, tt.header)
+					if rec.Code != tt.want {
+						t.Errorf("got %d, want %d", rec.Code, tt.want)
+					}
+					if rec.Code == http.StatusNotModified && rec.Body.Len() > 0 {
+						t.Errorf("304 response has a body: %s", rec.Body)
+					}
+				})
+			}
+		})
+	}
+
+	// New results and new silences both change the tag.
+	etag := get("/api/v1/results", http.Header{}).Header().Get("ETag")
+	s.mu.Lock()
+	s.resultsVersion.changed(time.Now())
+	s.mu.Unlock()
+	if rec := get("/api/v1/results", http.Header{"If-None-Match": {etag}}); rec.Code != http.StatusOK {
+		t.Errorf("after results changed: got %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	etag = get("/api/v1/results", http.Header{}).Header().Get("ETag")
+	now := time.Now()
+	if _, err := silences.add(silence{
+		Matchers:  []silenceMatcher{{Label: labelCheck, Pattern: "*"}},
+		EndsAt:    now.Add(time.Hour),
+		CreatedBy: "alice",
+		Comment:   "testing",
+	}, now); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get("/api/v1/results", http.Header{"If-None-Match": {etag}}); rec.Code != http.StatusOK {
+		t.Errorf("after silence added: got %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestResultsCompression(t *testing.T) {
+	s := &service{logger: slogt.New(t)}
+	for range 20 {
+		s.results = append(s.results, serviceResult{
+			Result: &runner.Result{Name: "check.sh", Stdout: strings.Repeat("all is well\n", 10)},
+		})
+	}
+
+	tests := []struct {
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"zstd", "zstd"},
+		{"gzip, zstd", "zstd"},
+		{"zstd, gzip;q=0.5", "zstd"},
+		{"zstd;q=0.5, gzip", "gzip"},
+		{"zstd;q=0, gzip;q=0.1", "gzip"},
+		{"br, GZIP", "gzip"},
+		{"gzip;q=0", ""},
+		{"gzip; q=0.000", ""},
+		{"deflate", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/v1/results", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := httptest.NewRecorder()
+			s.handleResultsAPI(rec, req)
+
+			body := io.Reader(rec.Body)
+			got := rec.Header().Get("Content-Encoding")
+			if got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			switch got {
+			case "gzip":
+				gr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = gr
+			case "zstd":
+				zr, err := zstd.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer zr.Close()
+				body = zr
+			}
+			var results []serviceResult
+			if err := json.UnmarshalRead(body, &results); err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != len(s.results) {
+				t.Errorf("got %d results, want %d", len(results), len(s.results))
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-json-experiment/json"
+
+	"github.com/andrew-d/upchek/internal/ulog"
+)
+
+// incidentRetention is how long a resolved incident is kept, and shown on
+// the status page, after it is resolved.
+const incidentRetention = statusPageDays * 24 * time.Hour
+
+// incidentStatus is the status of an incident as posted by an operator.
+type incidentStatus string
+
+const (
+	incidentInvestigating incidentStatus = "investigating"
+	incidentIdentified    incidentStatus = "identified"
+	incidentMonitoring    incidentStatus = "monitoring"
+	incidentResolved      incidentStatus = "resolved"
+)
+
+// validate returns an error if s is not a known incident status.
+func (s incidentStatus) validate() error {
+	switch s {
+	case incidentInvestigating, incidentIdentified, incidentMonitoring, incidentResolved:
+		return nil
+	}
+	return fmt.Errorf("unknown incident status %q", s)
+}
+
+// incident is a note about a problem that operators post on the status page,
+// and update until it is resolved.
+type incident struct {
+	// ID uniquely identifies the incident.
+	ID string
+
+	// Title is a short description of the incident.
+	Title string
+
+	// Components are the names of the affected components; see
+	// [componentConfig].
+	Components []string `json:",omitzero"`
+
+	// CreatedAt is the time that the incident was posted.
+	CreatedAt time.Time
+
+	// ResolvedAt is the time of the update that resolved the incident, or
+	// zero if it is ongoing.
+	ResolvedAt time.Time `json:",omitzero"`
+
+	// Updates are the updates posted about the incident, oldest first.
+	// The first is posted with the incident.
+	Updates []incidentUpdate
+}
+
+// incidentUpdate is a single update to an incident.
+type incidentUpdate struct {
+	// Status is the status of the incident as of this update.
+	Status incidentStatus
+
+	// Message describes the update.
+	Message string
+
+	// CreatedBy is the author of the update: the name of the token used
+	// to post it, if any. It isn't shown on the status page.
+	CreatedBy string `json:",omitzero"`
+
+	// CreatedAt is the time that the update was posted.
+	CreatedAt time.Time
+}
+
+// Status returns the status of the incident as of its latest update.
+func (inc incident) Status() incidentStatus {
+	if len(inc.Updates) == 0 {
+		return incidentInvestigating
+	}
+	return inc.Updates[len(inc.Updates)-1].Status
+}
+
+// public returns a copy of the incident that is safe to show to anyone,
+// without the authors of its updates.
+func (inc incident) public() incident {
+	inc.Updates = slices.Clone(inc.Updates)
+	for i := range inc.Updates {
+		inc.Updates[i].CreatedBy = ""
+	}
+	return inc
+}
+
+// validate checks that the update is well-formed.
+func (u *incidentUpdate) validate() error {
+	if err := u.Status.validate(); err != nil {
+		return err
+	}
+	if u.Message == "" {
+		return errors.New("Message is required")
+	}
+	return nil
+}
+
+// newIncident is the body of a request to create an incident.
+type newIncident struct {
+	Title      string
+	Components []string `json:",omitzero"`
+
+	// The first update is inline, and its Status defaults to
+	// incidentInvestigating.
+	incidentUpdate `json:",inline"`
+}
+
+// incidentStore holds the set of incidents, and persists them to disk.
+type incidentStore struct {
+	// path is the file that incidents are persisted to; if empty,
+	// incidents are not persisted.
+	path string
+
+	mu        sync.RWMutex // protects following
+	incidents []*incident  // oldest first
+}
+
+// loadIncidents returns an incidentStore persisted at the given path. It is
+// not an error for the file to not exist.
+func loadIncidents(path string) (*incidentStore, error) {
+	st := &incidentStore{path: path}
+	if path == "" {
+		return st, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading incidents: %w", err)
+	}
+	if err := json.Unmarshal(data, &st.incidents); err != nil {
+		return nil, fmt.Errorf("parsing incidents from %q: %w", path, err)
+	}
+	return st, nil
+}
+
+// save persists the incidents to disk. The caller must hold st.mu.
+func (st *incidentStore) save() error {
+	if st.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(st.incidents)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(st.path, data)
+}
+
+// list returns a copy of all incidents, newest first.
+//
+// It is safe to call list on a nil incidentStore.
+func (st *incidentStore) list() []incident {
+	if st == nil {
+		return nil
+	}
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	ret := make([]incident, 0, len(st.incidents))
+	for _, inc := range slices.Backward(st.incidents) {
+		c := *inc
+		c.Updates = slices.Clone(inc.Updates)
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// add validates and adds a new incident, assigning it an ID, and returns it.
+func (st *incidentStore) add(n newIncident, now time.Time) (incident, error) {
+	if n.Title == "" {
+		return incident{}, errors.New("Title is required")
+	}
+	if n.Status == "" {
+		n.Status = incidentInvestigating
+	}
+	n.CreatedAt = now
+	if err := n.incidentUpdate.validate(); err != nil {
+		return incident{}, err
+	}
+	inc := incident{
+		ID:         newID(),
+		Title:      n.Title,
+		Components: n.Components,
+		CreatedAt:  now,
+		Updates:    []incidentUpdate{n.incidentUpdate},
+	}
+	if n.Status == incidentResolved {
+		inc.ResolvedAt = now
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	// Drop incidents that were resolved long ago while we're here.
+	st.incidents = slices.DeleteFunc(st.incidents, func(old *incident) bool {
+		return !old.ResolvedAt.IsZero() && old.ResolvedAt.Before(now.Add(-incidentRetention))
+	})
+	st.incidents = append(st.incidents, &inc)
+	return inc, st.save()
+}
+
+// update validates and appends an update to the incident with the given ID,
+// and returns the incident. An update with the status incidentResolved
+// resolves the incident, and any other reopens it.
+//
+// It returns false if no such incident exists.
+func (st *incidentStore) update(id string, u incidentUpdate, now time.Time) (incident, bool, error) {
+	u.CreatedAt = now
+	if err := u.validate(); err != nil {
+		return incident{}, true, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	i := slices.IndexFunc(st.incidents, func(inc *incident) bool { return inc.ID == id })
+	if i < 0 {
+		return incident{}, false, nil
+	}
+	inc := st.incidents[i]
+	inc.Updates = append(inc.Updates, u)
+	if u.Status == incidentResolved {
+		inc.ResolvedAt = now
+	} else {
+		inc.ResolvedAt = time.Time{}
+	}
+	ret := *inc
+	ret.Updates = slices.Clone(inc.Updates)
+	return ret, true, st.save()
+}
+
+// remove deletes the incident with the given ID, e.g. if it was posted by
+// mistake. It returns false if no such incident exists.
+func (st *incidentStore) remove(id string) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	i := slices.IndexFunc(st.incidents, func(inc *incident) bool { return inc.ID == id })
+	if i < 0 {
+		return false, nil
+	}
+	st.incidents = slices.Delete(st.incidents, i, i+1)
+	return true, st.save()
+}
+
+func (s *service) handleListIncidents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.incidents.list())
+}
+
+func (s *service) handleCreateIncident(w http.ResponseWriter, r *http.Request) {
+	var n newIncident
+	if err := json.UnmarshalRead(r.Body, &n); err != nil {
+		http.Error(w, fmt.Sprintf("invalid incident: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.validateComponents(n.Components); err != nil {
+		http.Error(w, fmt.Sprintf("invalid incident: %v", err), http.StatusBadRequest)
+		return
+	}
+	n.CreatedBy = requestAuthor(r, n.CreatedBy)
+
+	created, err := s.incidents.add(n, time.Now())
+	if err != nil && created.ID == "" {
+		http.Error(w, fmt.Sprintf("invalid incident: %v", err), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		s.logger.Error("failed to persist incidents", ulog.Error(err))
+	}
+	s.invalidateStatusPage()
+
+	s.logger.Info("created incident",
+		slog.String("id", created.ID),
+		slog.String("title", created.Title),
+		slog.String("created_by", n.CreatedBy))
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (s *service) handleUpdateIncident(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var u incidentUpdate
+	if err := json.UnmarshalRead(r.Body, &u); err != nil {
+		http.Error(w, fmt.Sprintf("invalid update: %v", err), http.StatusBadRequest)
+		return
+	}
+	u.CreatedBy = requestAuthor(r, u.CreatedBy)
+
+	updated, found, err := s.incidents.update(id, u, time.Now())
+	if !found {
+		http.Error(w, "incident not found", http.StatusNotFound)
+		return
+	} else if err != nil && updated.ID == "" {
+		http.Error(w, fmt.Sprintf("invalid update: %v", err), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		s.logger.Error("failed to persist incidents", ulog.Error(err))
+	}
+	s.invalidateStatusPage()
+
+	s.logger.Info("updated incident",
+		slog.String("id", id),
+		slog.String("status", string(u.Status)),
+		slog.String("created_by", u.CreatedBy))
+	writeJSON(w, http.StatusOK, updated)
+}
+
+func (s *service) handleDeleteIncident(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	found, err := s.incidents.remove(id)
+	if err != nil {
+		s.logger.Error("failed to persist incidents", ulog.Error(err))
+	}
+	if !found {
+		http.Error(w, "incident not found", http.StatusNotFound)
+		return
+	}
+	s.invalidateStatusPage()
+
+	s.logger.Info("deleted incident", slog.String("id", id))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/neilotoole/slogt"
+)
+
+func TestIncidentStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "incidents.json")
+	st, err := loadIncidents(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if _, err := st.add(newIncident{Title: "API errors"}, now); err == nil {
+		t.Error("add() without a message succeeded")
+	}
+	old, err := st.add(newIncident{
+		Title:          "Old outage",
+		incidentUpdate: incidentUpdate{Status: incidentResolved, Message: "Fixed", CreatedBy: "alice"},
+	}, now.Add(-incidentRetention-time.Hour))
+	if err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+	if old.ResolvedAt.IsZero() {
+		t.Error("incident created as resolved has no ResolvedAt")
+	}
+	created, err := st.add(newIncident{
+		Title:          "API errors",
+		Components:     []string{"API"},
+		incidentUpdate: incidentUpdate{Message: "Looking into it", CreatedBy: "alice"},
+	}, now)
+	if err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+	if created.Status() != incidentInvestigating {
+		t.Errorf("new incident status = %q, want %q", created.Status(), incidentInvestigating)
+	}
+
+	// Incidents resolved long ago are dropped, and the rest survive a
+	// reload.
+	st, err = loadIncidents(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := st.list(); len(got) != 1 || got[0].ID != created.ID {
+		t.Fatalf("reloaded incidents = %+v, want one incident with ID %q", got, created.ID)
+	}
+
+	if _, found, err := st.update(created.ID, incidentUpdate{Status: "fixed", Message: "Done"}, now); !found || err == nil {
+		t.Errorf("update() with unknown status = %v, %v; want an error", found, err)
+	}
+	updated, found, err := st.update(created.ID, incidentUpdate{Status: incidentResolved, Message: "Done"}, now.Add(time.Hour))
+	if !found || err != nil {
+		t.Fatalf("update() = %v, %v", found, err)
+	}
+	if len(updated.Updates) != 2 || !updated.ResolvedAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("resolved incident = %+v", updated)
+	}
+	updated, _, _ = st.update(created.ID, incidentUpdate{Status: incidentMonitoring, Message: "It's back"}, now.Add(2*time.Hour))
+	if !updated.ResolvedAt.IsZero() {
+		t.Error("update with status monitoring didn't reopen incident")
+	}
+	if _, found, _ := st.update("nonexistent", incidentUpdate{Status: incidentResolved, Message: "Done"}, now); found {
+		t.Error("update() of nonexistent incident returned true")
+	}
+
+	if found, err := st.remove(created.ID); !found || err != nil {
+		t.Fatalf("remove() = %v, %v", found, err)
+	}
+	if got := st.list(); len(got) != 0 {
+		t.Errorf("incidents after remove() = %+v", got)
+	}
+}
+
+func TestIncidentAPI(t *testing.T) {
+	st, err := loadIncidents("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &service{
+		logger:     slogt.New(t),
+		incidents:  st,
+		statusPage: statusPageConfig{Components: []componentConfig{{Name: "API", Groups: []string{"api"}}}},
+		auth:       authState{tokens: map[string]tokenConfig{"secret": {Name: "ops", Role: roleAdmin}}},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/incidents", s.handleListIncidents)
+	mux.HandleFunc("POST /api/v1/incidents", s.requireRole(roleAdmin, s.handleCreateIncident))
+	mux.HandleFunc("POST /api/v1/incidents/{id}/updates", s.requireRole(roleAdmin, s.handleUpdateIncident))
+	mux.HandleFunc("DELETE /api/v1/incidents/{id}", s.requireRole(roleAdmin, s.handleDeleteIncident))
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Incidents must name configured components.
+	if rec := do("POST", "/api/v1/incidents", `{"Title": "Down", "Components": ["Web"], "Message": "Down"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("create incident with unknown component = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	rec := do("POST", "/api/v1/incidents", `{"Title": "API errors", "Components": ["API"], "Message": "Looking into it", "CreatedBy": "alice"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create incident = %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	var created incident
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	// The author is always the token used, whatever the client claims.
+	rec = do("POST", "/api/v1/incidents/"+created.ID+"/updates", `{"Status": "resolved", "Message": "Fixed", "CreatedBy": "bob"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update incident = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if rec := do("POST", "/api/v1/incidents/"+created.ID+"/updates", `{"Status": "resolved"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("update incident without message = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if rec := do("POST", "/api/v1/incidents/nonexistent/updates", `{"Status": "resolved", "Message": "Fixed"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("update nonexistent incident = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	var listed []incident
+	if err := json.Unmarshal(do("GET", "/api/v1/incidents", "").Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].Status() != incidentResolved {
+		t.Fatalf("listed incidents = %+v", listed)
+	}
+	for _, u := range listed[0].Updates {
+		if u.CreatedBy != "ops" {
+			t.Errorf("update %+v created by %q, want the token's name", u, u.CreatedBy)
+		}
+	}
+
+	if rec := do("DELETE", "/api/v1/incidents/"+created.ID, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete incident = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec := do("DELETE", "/api/v1/incidents/"+created.ID, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("delete deleted incident = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-json-experiment/json"
+)
+
+const (
+	// maxPushSize is the largest push request body that is accepted.
+	maxPushSize = 32 << 20
+
+	// defaultPushExpireAfter is the default for
+	// [defaultsConfig.PushExpireAfter].
+	defaultPushExpireAfter = 24 * time.Hour
+
+	// maxPushedSources is how many pushed sources are kept at once.
+	// Pushes from new sources beyond this are rejected until others
+	// expire, so that a misbehaving or compromised agent can't use up
+	// memory by pushing under ever-changing names.
+	maxPushedSources = 1000
+)
+
+// errTooManyPushedSources is returned by [service.ingest] when a batch is
+// from a new source and there are already [maxPushedSources].
+var errTooManyPushedSources = fmt.Errorf("too many pushed sources; at most %d are kept", maxPushedSources)
+
+// pushedSource is an instance that has pushed results to this one. Its
+// results, errors and state are kept alongside those of remotes, keyed by its
+// source name.
+type pushedSource struct {
+	// lastPush is when the source last pushed, by our clock.
+	lastPush time.Time
+
+	// latest is the time of the newest snapshot received, by the
+	// source's clock.
+	latest time.Time
+}
+
+// validate checks that a pushed batch is well-formed.
+func (b *pushBatch) validate() error {
+	var errs []error
+	if err := validatePushSource(b.Source); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateLabels(b.Labels); err != nil {
+		errs = append(errs, err)
+	}
+	if b.TTL <= 0 {
+		errs = append(errs, errors.New("TTL must be positive"))
+	}
+	if len(b.Snapshots) == 0 {
+		errs = append(errs, errors.New("at least one snapshot is required"))
+	}
+	for i, snap := range b.Snapshots {
+		for _, r := range snap.Results {
+			if r.Result == nil || r.Name == "" {
+				errs = append(errs, fmt.Errorf("snapshot %d: result without a name", i))
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *service) handlePush(w http.ResponseWriter, r *http.Request) {
+	var batch pushBatch
+	if err := json.UnmarshalRead(http.MaxBytesReader(w, r.Body, maxPushSize), &batch); err != nil {
+		http.Error(w, fmt.Sprintf("invalid push: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := batch.validate(); err != nil {
+		http.Error(w, fmt.Sprintf("invalid push: %v", err), http.StatusBadRequest)
+		return
+	}
+	if s.isRemote(batch.Source) {
+		http.Error(w, fmt.Sprintf("source %q is a configured remote", batch.Source), http.StatusConflict)
+		return
+	}
+
+	if err := s.ingest(&batch, time.Now()); err != nil {
+		s.logger.Warn("rejected pushed results",
+			slog.String("source", batch.Source),
+			slog.String("token", authTokenName(r.Context())),
+			slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	s.logger.Debug("accepted pushed results",
+		slog.String("source", batch.Source),
+		slog.String("token", authTokenName(r.Context())),
+		slog.Int("snapshots", len(batch.Snapshots)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isRemote reports whether name is the address of a configured remote.
+func (s *service) isRemote(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Contains(s.remoteAddrs, name)
+}
+
+// ingest records a batch of pushed results received at now. Only the newest
+// snapshot is kept; snapshots older than one already received, such as those
+// spooled by the source while it couldn't reach us, only count as contact.
+// Batches from new sources are rejected if there are already
+// [maxPushedSources].
+func (s *service) ingest(batch *pushBatch, now time.Time) error {
+	latest := slices.MaxFunc(batch.Snapshots, func(a, b pushSnapshot) int {
+		return a.Time.Compare(b.Time)
+	})
+	skew := clockSkew(batch.SentAt, now, now, latest.Results)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pushed == nil {
+		s.pushed = make(map[string]*pushedSource)
+	}
+	if s.remoteResults == nil {
+		s.remoteResults = make(map[string][]serviceResult)
+	}
+	if s.remoteErrors == nil {
+		s.remoteErrors = make(map[string]error)
+	}
+	if s.remoteStates == nil {
+		s.remoteStates = make(map[string]remoteState)
+	}
+	if s.remoteLabels == nil {
+		s.remoteLabels = make(map[string]map[string]string)
+	}
+
+	src := s.pushed[batch.Source]
+	if src == nil {
+		if len(s.pushed) >= maxPushedSources {
+			return errTooManyPushedSources
+		}
+		s.logger.Info("new pushed source", slog.String("source", batch.Source))
+		src = &pushedSource{}
+		s.pushed[batch.Source] = src
+	}
+	src.lastPush = now
+
+	st := s.remoteStates[batch.Source]
+	st.Pushed = true
+	st.policy = s.pushPolicy
+	st.policy.StaleAfter = batch.TTL
+	st.LastAttempt = now
+	if latest.Time.After(src.latest) {
+		src.latest = latest.Time
+		s.remoteResults[batch.Source] = latest.Results
+		st.ClockSkew = skew
+		// The results are as of when the snapshot was taken, by
+		// our clock.
+		st.LastSuccess = latest.Time.Add(-skew)
+		if st.LastSuccess.After(now) {
+			st.LastSuccess = now
+		}
+	}
+	st.Stale = st.isStale(now)
+	s.remoteStates[batch.Source] = st
+	s.remoteErrors[batch.Source] = nil
+	if len(batch.Labels) > 0 {
+		s.remoteLabels[batch.Source] = maps.Clone(batch.Labels)
+	} else {
+		delete(s.remoteLabels, batch.Source)
+	}
+
+	s.setRemoteMetrics(batch.Source, st, now)
+	return nil
+}
+
+// expirePushed forgets pushed sources that haven't pushed for longer than
+// the configured expiry, and updates the staleness of the rest.
+func (s *service) expirePushed(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expireAfter := cmp.Or(s.pushExpireAfter, defaultPushExpireAfter)
+	for name, src := range s.pushed {
+		if now.Sub(src.lastPush) > expireAfter {
+			s.logger.Info("forgetting pushed source", slog.String("source", name), slog.Time("last_push", src.lastPush))
+			delete(s.pushed, name)
+			delete(s.remoteResults, name)
+			delete(s.remoteErrors, name)
+			delete(s.remoteStates, name)
+			delete(s.remoteLabels, name)
+			continue
+		}
+		st := s.remoteStates[name]
+		st.Stale = st.isStale(now)
+		s.remoteStates[name] = st
+		s.setRemoteMetrics(name, st, now)
+	}
+}
+
+// pushedSources returns the names of the pushed sources, sorted.
+//
+// s.mu must be held.
+func (s *service) pushedSources() []string {
+	return slices.Sorted(maps.Keys(s.pushed))
+}
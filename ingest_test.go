@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/google/go-cmp/cmp"
+	"github.com/neilotoole/slogt"
+
+	"github.com/andrew-d/upchek/internal/runner"
+)
+
+func TestHandlePush(t *testing.T) {
+	s := &service{
+		logger:      slogt.New(t),
+		remoteAddrs: []string{"10.0.0.1:8080"},
+		pushPolicy:  remotePolicy{OnStale: staleActionFail},
+	}
+	s.initMetrics()
+
+	post := func(batch pushBatch) int {
+		t.Helper()
+		body, err := json.Marshal(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		s.handlePush(rec, httptest.NewRequest("POST", "/api/v1/push", bytes.NewReader(body)))
+		return rec.Code
+	}
+
+	now := time.Now()
+	failing := serviceResult{Result: &runner.Result{Name: "disk.sh", ExitCode: 1}, State: statusFailing, LastRun: now}
+	ok := serviceResult{Result: &runner.Result{Name: "disk.sh"}, State: statusOK, LastRun: now.Add(-time.Minute)}
+	batch := pushBatch{
+		Source: "agent-1",
+		Labels: map[string]string{"dc": "ams"},
+		TTL:    time.Minute,
+		SentAt: now,
+		Snapshots: []pushSnapshot{
+			{Time: now.Add(-time.Minute), Results: []serviceResult{ok}},
+			{Time: now, Results: []serviceResult{failing}},
+		},
+	}
+	if code := post(batch); code != http.StatusNoContent {
+		t.Fatalf("push status = %d, want %d", code, http.StatusNoContent)
+	}
+
+	data := s.getTemplateData()
+	if diff := cmp.Diff([]string{"10.0.0.1:8080", "agent-1"}, data.RemoteAddrs); diff != "" {
+		t.Errorf("RemoteAddrs mismatch (-want +got):\n%s", diff)
+	}
+	if got := data.RemoteResults["agent-1"]; len(got) != 1 || got[0].State != statusFailing {
+		t.Errorf("pushed results = %+v, want the newest snapshot", got)
+	}
+	if st := data.RemoteStates["agent-1"]; !st.Pushed || st.Stale {
+		t.Errorf("pushed state = %+v, want pushed and fresh", st)
+	}
+	if data.RemoteStatus()["agent-1"] || data.RemoteOk() {
+		t.Error("failing pushed source should count towards the remote status")
+	}
+	if got := data.RemoteLabels["agent-1"]["dc"]; got != "ams" {
+		t.Errorf("pushed labels = %v, want dc=ams", data.RemoteLabels["agent-1"])
+	}
+
+	// Older snapshots, such as those spooled by a source that was
+	// unreachable, don't replace newer results.
+	batch.Snapshots = batch.Snapshots[:1]
+	if code := post(batch); code != http.StatusNoContent {
+		t.Fatalf("push status = %d, want %d", code, http.StatusNoContent)
+	}
+	if got := s.getTemplateData().RemoteResults["agent-1"]; got[0].State != statusFailing {
+		t.Errorf("pushed results = %+v, want the newest snapshot to be kept", got)
+	}
+
+	// Reconfiguring remotes keeps pushed sources.
+	s.setRemotes(nil)
+	if got := s.getTemplateData().RemoteAddrs; !cmp.Equal(got, []string{"agent-1"}) {
+		t.Errorf("RemoteAddrs after setRemotes = %v, want pushed source kept", got)
+	}
+
+	// Past the TTL the source is stale, and past the expiry forgotten.
+	s.expirePushed(now.Add(2 * time.Minute))
+	if st := s.remoteStates["agent-1"]; !st.Stale {
+		t.Error("pushed source not stale after TTL")
+	}
+	s.expirePushed(now.Add(defaultPushExpireAfter + time.Hour))
+	if got := s.getTemplateData().RemoteAddrs; len(got) != 0 {
+		t.Errorf("RemoteAddrs after expiry = %v, want none", got)
+	}
+
+	// Once there are too many sources, new ones are rejected but existing
+	// ones can still push.
+	for i := range maxPushedSources - 1 {
+		s.pushed[fmt.Sprintf("filler-%d", i)] = &pushedSource{lastPush: now}
+	}
+	batch.Snapshots = []pushSnapshot{{Time: now, Results: []serviceResult{ok}}}
+	if code := post(batch); code != http.StatusNoContent {
+		t.Fatalf("push status = %d, want %d", code, http.StatusNoContent)
+	}
+	batch.Source = "agent-3"
+	if code := post(batch); code != http.StatusTooManyRequests {
+		t.Errorf("push from new source over the limit = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	batch.Source = "agent-1"
+	if code := post(batch); code != http.StatusNoContent {
+		t.Errorf("push from existing source at the limit = %d, want %d", code, http.StatusNoContent)
+	}
+	s.expirePushed(now.Add(defaultPushExpireAfter + time.Hour))
+
+	tests := []struct {
+		name   string
+		modify func(b *pushBatch)
+		want   int
+	}{
+		{"bad_source", func(b *pushBatch) { b.Source = "agent:1" }, http.StatusBadRequest},
+		{"no_ttl", func(b *pushBatch) { b.TTL = 0 }, http.StatusBadRequest},
+		{"no_snapshots", func(b *pushBatch) { b.Snapshots = nil }, http.StatusBadRequest},
+		{"unnamed_result", func(b *pushBatch) { b.Snapshots[0].Results = []serviceResult{{}} }, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := pushBatch{
+				Source:    "agent-2",
+				TTL:       time.Minute,
+				SentAt:    now,
+				Snapshots: []pushSnapshot{{Time: now, Results: []serviceResult{ok}}},
+			}
+			tt.modify(&b)
+			if code := post(b); code != tt.want {
+				t.Errorf("push status = %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultMaxOutput is the maximum number of bytes captured from each of a
+// script's output streams if [Options.MaxOutput] is zero.
+const DefaultMaxOutput = 256 << 10
+
+// maxOutputLines is the maximum number of lines captured in a script's
+// interleaved output, and maxLineLength the maximum length of each; see
+// [Options.Interleave]. Longer lines are cut short.
+const (
+	maxOutputLines = 2000
+	maxLineLength  = 4 << 10
+)
+
+// Streams that an [OutputLine] can come from.
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// OutputLine is a single line of a script's interleaved output.
+type OutputLine struct {
+	// Time is when the first byte of the line was read from the script.
+	Time time.Time `json:",format:unix"`
+
+	// Stream is the stream that the line was written to: [StreamStdout]
+	// or [StreamStderr]. It is empty for a line that marks where lines
+	// were dropped because there were too many.
+	Stream string `json:",omitzero"`
+
+	// Text is the line, without its trailing newline.
+	Text string
+}
+
+// headTail is an [io.Writer] that keeps the first and last bytes written to
+// it, up to a total of limit bytes, and counts the bytes in between.
+type headTail struct {
+	limit   int
+	head    []byte
+	tail    []byte // a ring buffer once full, starting at tailPos
+	tailPos int
+	dropped int64
+}
+
+func newHeadTail(limit int) *headTail {
+	return &headTail{limit: limit}
+}
+
+func (h *headTail) Write(p []byte) (int, error) {
+	n := len(p)
+	headLimit := h.limit / 2
+	if len(h.head) < headLimit {
+		k := min(len(p), headLimit-len(h.head))
+		h.head = append(h.head, p[:k]...)
+		p = p[k:]
+	}
+
+	tailLimit := h.limit - headLimit
+	for len(p) > 0 {
+		if len(h.tail) < tailLimit {
+			k := min(len(p), tailLimit-len(h.tail))
+			h.tail = append(h.tail, p[:k]...)
+			p = p[k:]
+			continue
+		}
+		if tailLimit == 0 {
+			h.dropped += int64(len(p))
+			break
+		}
+
+		// Overwrite the oldest bytes of the tail.
+		if len(p) > tailLimit {
+			h.dropped += int64(len(p) - tailLimit)
+			p = p[len(p)-tailLimit:]
+		}
+		k := copy(h.tail[h.tailPos:], p)
+		copy(h.tail, p[k:])
+		h.tailPos = (h.tailPos + len(p)) % tailLimit
+		h.dropped += int64(len(p))
+		p = nil
+	}
+	return n, nil
+}
+
+// String returns the captured output, with a marker in place of any bytes
+// that were dropped, as valid UTF-8.
+func (h *headTail) String() string {
+	tail := append(bytes.Clone(h.tail[h.tailPos:]), h.tail[:h.tailPos]...)
+	if h.dropped == 0 {
+		return toValidUTF8(append(bytes.Clone(h.head), tail...))
+	}
+	head := trimPartialRuneEnd(h.head)
+	tail = trimPartialRuneStart(tail)
+	dropped := h.dropped + int64(len(h.head)-len(head)) + int64(len(h.tail)-len(tail))
+	return toValidUTF8(head) + truncationMarker(dropped) + toValidUTF8(tail)
+}
+
+// truncationMarker returns the marker that replaces n bytes of dropped
+// output.
+func truncationMarker(n int64) string {
+	return fmt.Sprintf("\n[... %d bytes truncated ...]\n", n)
+}
+
+// toValidUTF8 returns b as a string, with invalid UTF-8 replaced by the
+// replacement character.
+func toValidUTF8(b []byte) string {
+	return strings.ToValidUTF8(string(b), string(utf8.RuneError))
+}
+
+// trimPartialRuneEnd removes an incomplete UTF-8 sequence, such as one cut
+// short by truncation, from the end of b.
+func trimPartialRuneEnd(b []byte) []byte {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i]
+			}
+			break
+		}
+	}
+	return b
+}
+
+// trimPartialRuneStart removes the continuation bytes of a UTF-8 sequence
+// whose start was cut off by truncation from the start of b.
+func trimPartialRuneStart(b []byte) []byte {
+	for i := 0; i < len(b) && i < utf8.UTFMax; i++ {
+		if utf8.RuneStart(b[i]) {
+			return b[i:]
+		}
+	}
+	return b
+}
+
+// interleaver records the lines written to a script's stdout and stderr in
+// the order in which they were written.
+type interleaver struct {
+	maxLine int // maximum length of a single line
+	now     func() time.Time
+
+	mu      sync.Mutex
+	head    []OutputLine
+	tail    []OutputLine // a ring buffer once full, starting at tailPos
+	tailPos int
+	dropped int
+	partial [2]*OutputLine // incomplete last line of each stream
+}
+
+func newInterleaver(maxLine int) *interleaver {
+	return &interleaver{maxLine: maxLine, now: time.Now}
+}
+
+// writer returns a writer for the provided stream.
+func (il *interleaver) writer(stream string) *streamWriter {
+	idx := 0
+	if stream == StreamStderr {
+		idx = 1
+	}
+	return &streamWriter{il: il, stream: stream, idx: idx}
+}
+
+type streamWriter struct {
+	il     *interleaver
+	stream string
+	idx    int
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	il := w.il
+	il.mu.Lock()
+	defer il.mu.Unlock()
+
+	n := len(p)
+	for len(p) > 0 {
+		line := il.partial[w.idx]
+		if line == nil {
+			line = &OutputLine{Time: il.now(), Stream: w.stream}
+			il.partial[w.idx] = line
+		}
+		chunk, rest, complete := bytes.Cut(p, []byte("\n"))
+		if room := il.maxLine - len(line.Text); room > 0 {
+			line.Text += string(chunk[:min(len(chunk), room)])
+		}
+		if complete {
+			il.add(*line)
+			il.partial[w.idx] = nil
+		}
+		p = rest
+	}
+	return n, nil
+}
+
+// add records a complete line; il.mu must be held.
+func (il *interleaver) add(line OutputLine) {
+	line.Text = toValidUTF8([]byte(line.Text))
+	headLimit := maxOutputLines / 2
+	switch {
+	case len(il.head) < headLimit:
+		il.head = append(il.head, line)
+	case len(il.tail) < maxOutputLines-headLimit:
+		il.tail = append(il.tail, line)
+	default:
+		il.tail[il.tailPos] = line
+		il.tailPos = (il.tailPos + 1) % len(il.tail)
+		il.dropped++
+	}
+}
+
+// lines returns the recorded lines, including any incomplete last lines,
+// ordered by the time at which each line started.
+func (il *interleaver) lines() []OutputLine {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+
+	for i, line := range il.partial {
+		if line != nil {
+			il.add(*line)
+			il.partial[i] = nil
+		}
+	}
+	// Lines are recorded when they're complete, so a line from one
+	// stream may be recorded after a later one from the other.
+	byTime := func(a, b OutputLine) int { return a.Time.Compare(b.Time) }
+	lines := slices.Clone(il.head)
+	slices.SortStableFunc(lines, byTime)
+	tail := append(slices.Clone(il.tail[il.tailPos:]), il.tail[:il.tailPos]...)
+	slices.SortStableFunc(tail, byTime)
+	if il.dropped > 0 {
+		lines = append(lines, OutputLine{
+			Time: tail[0].Time,
+			Text: fmt.Sprintf("[... %d lines truncated ...]", il.dropped),
+		})
+	}
+	return append(lines, tail...)
+}
+
+// redactor is an [io.Writer] that replaces secrets in what is written to it
+// before passing it on to w. Since a secret may be split across writes, it
+// holds back anything that could be the start of a secret until the next
+// write or flush.
+type redactor struct {
+	w       io.Writer
+	secrets [][]byte
+	pending []byte
+}
+
+func newRedactor(w io.Writer, secrets []string) *redactor {
+	r := &redactor{w: w}
+	for _, s := range secrets {
+		if s != "" {
+			r.secrets = append(r.secrets, []byte(s))
+		}
+	}
+	return r
+}
+
+func (r *redactor) Write(p []byte) (int, error) {
+	buf := r.redact(append(r.pending, p...))
+
+	// Hold back the longest suffix that is a prefix of a secret.
+	keep := 0
+	for _, s := range r.secrets {
+		for k := min(len(s)-1, len(buf)); k > keep; k-- {
+			if bytes.HasSuffix(buf, s[:k]) {
+				keep = k
+				break
+			}
+		}
+	}
+	r.pending = bytes.Clone(buf[len(buf)-keep:])
+	if _, err := r.w.Write(buf[:len(buf)-keep]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes anything that was held back.
+func (r *redactor) flush() error {
+	_, err := r.w.Write(r.pending)
+	r.pending = nil
+	return err
+}
+
+func (r *redactor) redact(b []byte) []byte {
+	for _, s := range r.secrets {
+		b = bytes.ReplaceAll(b, s, []byte(redacted))
+	}
+	return b
+}
@@ -0,0 +1,139 @@
+package runner
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHeadTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		writes []string
+		want   string
+	}{
+		{"under_limit", 10, []string{"hello", "world"}, "helloworld"},
+		{"one_write", 6, []string{"abcdefghij"}, "abc" + truncationMarker(4) + "hij"},
+		{"many_writes", 6, []string{"ab", "cd", "ef", "gh", "ij"}, "abc" + truncationMarker(4) + "hij"},
+		{"large_write", 4, []string{"a", "bcdefghijklmnop", "q"}, "ab" + truncationMarker(13) + "pq"},
+		{"invalid_utf8", 10, []string{"ok\xff"}, "ok�"},
+
+		// Truncation doesn't leave partial runes behind: "é" is two
+		// bytes, and is cut in half at both ends.
+		{"split_runes", 6, []string{"abéxyzé12"}, "ab" + truncationMarker(7) + "12"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHeadTail(tt.limit)
+			for _, w := range tt.writes {
+				h.Write([]byte(w))
+			}
+			if got := h.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInterleaver(t *testing.T) {
+	il := newInterleaver(8)
+	start := time.Unix(1000, 0)
+	now := start
+	il.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	stdout, stderr := il.writer(StreamStdout), il.writer(StreamStderr)
+
+	stdout.Write([]byte("one\ntw"))
+	stderr.Write([]byte("err\n"))
+	stdout.Write([]byte("o\nthis line is too long\n"))
+	stderr.Write([]byte("partial"))
+
+	want := []OutputLine{
+		{Time: start.Add(1 * time.Second), Stream: StreamStdout, Text: "one"},
+		{Time: start.Add(2 * time.Second), Stream: StreamStdout, Text: "two"},
+		{Time: start.Add(3 * time.Second), Stream: StreamStderr, Text: "err"},
+		{Time: start.Add(4 * time.Second), Stream: StreamStdout, Text: "this lin"},
+		{Time: start.Add(5 * time.Second), Stream: StreamStderr, Text: "partial"},
+	}
+	if diff := cmp.Diff(want, il.lines()); diff != "" {
+		t.Errorf("lines() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestInterleaverTruncation(t *testing.T) {
+	il := newInterleaver(maxLineLength)
+	w := il.writer(StreamStdout)
+	for range maxOutputLines + 10 {
+		w.Write([]byte("line\n"))
+	}
+	w.Write([]byte("last\n"))
+
+	lines := il.lines()
+	if len(lines) != maxOutputLines+1 {
+		t.Fatalf("got %d lines, want %d", len(lines), maxOutputLines+1)
+	}
+	if got, want := lines[maxOutputLines/2].Text, "[... 11 lines truncated ...]"; got != want {
+		t.Errorf("marker = %q, want %q", got, want)
+	}
+	if got := lines[len(lines)-1].Text; got != "last" {
+		t.Errorf("last line = %q, want %q", got, "last")
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	var out strings.Builder
+	r := newRedactor(&out, []string{"hunter2", "", "swordfish"})
+	for _, w := range []string{"pass: hun", "ter2 and sword", "fish, hunt", "ing"} {
+		r.Write([]byte(w))
+	}
+	r.Write([]byte(" hun"))
+	r.flush()
+
+	want := "pass: [REDACTED] and [REDACTED], hunting hun"
+	if got := out.String(); got != want {
+		t.Errorf("redacted output = %q, want %q", got, want)
+	}
+}
+
+func TestRunOutputLimits(t *testing.T) {
+	t.Parallel()
+	scriptPath := filepath.Join(t.TempDir(), "noisy.sh")
+	// Lines written to stdout and stderr at nearly the same time may be
+	// read in either order, so pause between streams.
+	script := "#!/bin/sh\necho start\nsleep 0.1\nsecret=hunter2\necho \"$secret\" >&2\nsleep 0.1\nhead -c 100000 /dev/zero | tr '\\0' x\necho\necho end\n"
+	if err := os.WriteFile(scriptPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Run(context.Background(), scriptPath, Options{
+		MaxOutput:  64,
+		Interleave: true,
+		Redact:     []string{"hunter2"},
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if !strings.HasPrefix(result.Stdout, "start\n") || !strings.HasSuffix(result.Stdout, "\nend\n") || !strings.Contains(result.Stdout, "bytes truncated") {
+		t.Errorf("Run() stdout = %q, want head, tail and truncation marker", result.Stdout)
+	}
+	if result.Stderr != "[REDACTED]\n" {
+		t.Errorf("Run() stderr = %q, want redacted secret", result.Stderr)
+	}
+
+	var streams []string
+	for _, line := range result.Output {
+		streams = append(streams, line.Stream+":"+line.Text[:min(len(line.Text), 10)])
+	}
+	want := []string{"stdout:start", "stderr:[REDACTED]", "stdout:xxxxxxxxxx", "stdout:end"}
+	if diff := cmp.Diff(want, streams); diff != "" {
+		t.Errorf("Run() output mismatch (-want +got):\n%s", diff)
+	}
+}
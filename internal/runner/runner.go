@@ -7,9 +7,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // Result represents the result of running a healthcheck script.
@@ -25,6 +29,18 @@ type Result struct {
 
 	// Stderr is the standard error of the script.
 	Stderr string
+
+	// Usage is the resources used by the script, if known.
+	Usage *Usage `json:",omitzero"`
+
+	// Output is the script's stdout and stderr as a single stream of
+	// lines, in the order in which they were written, if requested with
+	// [Options.Interleave].
+	Output []OutputLine `json:",omitzero"`
+
+	// Metadata is what the script wrote to its metadata file descriptor;
+	// see [MetadataFD].
+	Metadata string `json:"-"`
 }
 
 // IsSuccess returns true if the script exited successfully.
@@ -32,7 +48,185 @@ func (r *Result) IsSuccess() bool {
 	return r.ExitCode == 0
 }
 
-func Run(ctx context.Context, scriptPath string) (*Result, error) {
+// Usage is the resources used by a single run of a script, including any
+// children that it waited for.
+type Usage struct {
+	// UserTime and SystemTime are the CPU time spent in user and kernel
+	// mode, respectively.
+	UserTime   time.Duration
+	SystemTime time.Duration
+
+	// MaxRSS is the maximum resident set size, in bytes. For scripts
+	// that are run with rlimits, it is at least that of the helper
+	// process that sets them, since the script replaces it.
+	MaxRSS int64
+}
+
+// MetadataFD is the file descriptor that scripts can write structured
+// metadata about their results to.
+const MetadataFD = 3
+
+// maxMetadata is the maximum amount of metadata that is captured from a
+// single run of a script; anything past it is discarded.
+const maxMetadata = 1 << 20
+
+// redacted replaces secrets in a script's output.
+const redacted = "[REDACTED]"
+
+// Options controls how a script is run. The zero value runs the script as
+// the current user, without any limits, in upchek's working directory and
+// environment.
+type Options struct {
+	// Args are the arguments passed to the script.
+	Args []string
+
+	// Env is the environment of the script, in the format of
+	// [os.Environ]. If nil, the script inherits the current
+	// environment.
+	Env []string
+
+	// Dir is the working directory of the script. If empty, the script
+	// runs in the current directory.
+	Dir string
+
+	// Stdin, if non-nil, is the standard input of the script.
+	Stdin io.Reader
+
+	// Redact are strings, such as secrets, that are replaced in the
+	// script's output and metadata before they are returned.
+	Redact []string
+
+	// MaxOutput is the maximum number of bytes captured from each of the
+	// script's stdout and stderr. If more is written, the first and last
+	// MaxOutput/2 bytes are kept, with a marker in between. If zero,
+	// DefaultMaxOutput is used.
+	MaxOutput int
+
+	// Interleave also captures stdout and stderr as a single stream of
+	// timestamped lines, in Result.Output.
+	Interleave bool
+
+	// StateDir, if set, is a directory that the script can write to. It
+	// is created if needed, owned by the script's user and writable in
+	// the sandbox.
+	StateDir string
+
+	// User is the user to run the script as, either a name or a numeric
+	// ID, optionally followed by ":group". If the group is omitted, the
+	// user's primary group is used. If empty, the script runs as the
+	// current user.
+	User string
+
+	// Limits are the resource limits to apply to the script.
+	Limits Limits
+
+	// Sandbox, if non-nil, runs the script in a sandbox. User must then
+	// be set to a user other than root.
+	Sandbox *Sandbox
+
+	// CgroupParent, if set, is the path to a cgroup v2 directory under
+	// which a new leaf cgroup is created for each run of the script. The
+	// cgroup is removed, and any processes left in it killed, when the
+	// script exits.
+	CgroupParent string
+
+	// GracePeriod is how long the script has to exit after it is sent
+	// SIGTERM because the context was cancelled, before it is killed. If
+	// zero, or if the context's deadline is exceeded, the script is
+	// killed straight away.
+	GracePeriod time.Duration
+}
+
+// Limits are resource limits for a script. Zero values mean no limit.
+type Limits struct {
+	// CPUTime is the maximum CPU time the script may use (RLIMIT_CPU).
+	CPUTime time.Duration `json:",omitzero"`
+
+	// AddressSpace is the maximum size of the script's virtual memory,
+	// in bytes (RLIMIT_AS).
+	AddressSpace int64 `json:",omitzero"`
+
+	// OpenFiles is the maximum number of open files (RLIMIT_NOFILE).
+	OpenFiles int64 `json:",omitzero"`
+
+	// Processes is the maximum number of processes for the user that the
+	// script runs as (RLIMIT_NPROC). It has no effect on scripts that run
+	// as root.
+	Processes int64 `json:",omitzero"`
+
+	// MemoryMax is the maximum memory usage of the script's cgroup, in
+	// bytes. It requires Options.CgroupParent to be set.
+	MemoryMax int64 `json:",omitzero"`
+
+	// CPUMax is the maximum CPU bandwidth of the script's cgroup, as a
+	// number of CPUs. It requires Options.CgroupParent to be set.
+	CPUMax float64 `json:",omitzero"`
+}
+
+// Sandbox configures a script to run in its own mount, PID and IPC
+// namespaces, with a read-only view of the host's filesystem, a private /tmp,
+// no capabilities and no way to gain privileges, e.g. through setuid
+// binaries. It requires running as root. The script is run by a minimal init
+// process in the PID namespace, which forwards SIGTERM and SIGINT to it; if
+// the script is killed by a signal, its exit code is 128 plus the signal's
+// number.
+type Sandbox struct {
+	// IsolateNetwork also runs the script in its own network namespace,
+	// with only a loopback interface.
+	IsolateNetwork bool `json:",omitzero"`
+
+	// Writable are absolute paths that remain writable in the sandbox.
+	Writable []string `json:",omitzero"`
+}
+
+// hasRlimits returns whether any of the limits are enforced with rlimits.
+func (l Limits) hasRlimits() bool {
+	return l.CPUTime > 0 || l.AddressSpace > 0 || l.OpenFiles > 0 || l.Processes > 0
+}
+
+// hasCgroupLimits returns whether any of the limits are enforced with a
+// cgroup.
+func (l Limits) hasCgroupLimits() bool {
+	return l.MemoryMax > 0 || l.CPUMax > 0
+}
+
+// Tighten returns l with each limit set in other replacing the corresponding
+// limit in l if it is unset or looser.
+func (l Limits) Tighten(other Limits) Limits {
+	l.CPUTime = tighter(l.CPUTime, other.CPUTime)
+	l.AddressSpace = tighter(l.AddressSpace, other.AddressSpace)
+	l.OpenFiles = tighter(l.OpenFiles, other.OpenFiles)
+	l.Processes = tighter(l.Processes, other.Processes)
+	l.MemoryMax = tighter(l.MemoryMax, other.MemoryMax)
+	l.CPUMax = tighter(l.CPUMax, other.CPUMax)
+	return l
+}
+
+func tighter[T time.Duration | int64 | float64](a, b T) T {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// SetupError is returned by Run when the environment for a script could
+// not be set up, as opposed to the script itself failing.
+type SetupError struct {
+	Err error
+}
+
+func (e *SetupError) Error() string { return "setting up script: " + e.Err.Error() }
+func (e *SetupError) Unwrap() error { return e.Err }
+
+// waitDelay is how long to wait for a script's output to be closed after
+// the script has exited or been killed, in case it left behind a process
+// that still holds it open.
+const waitDelay = time.Second
+
+// Run runs the script at scriptPath with the provided options.
+//
+// Programs that set any rlimits must call [Init] at the start of main.
+func Run(ctx context.Context, scriptPath string, opts Options) (*Result, error) {
 	// First, make sure the script is executable.
 	st, err := os.Stat(scriptPath)
 	if err != nil {
@@ -44,16 +238,136 @@ func Run(ctx context.Context, scriptPath string) (*Result, error) {
 
 	resultName := filepath.Base(scriptPath)
 
-	// Next, wire up the buffers for stdout and stderr.
-	var stdout, stderr bytes.Buffer
-	cmd := exec.CommandContext(ctx, scriptPath)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	// A relative path would otherwise be resolved from opts.Dir.
+	if opts.Dir != "" {
+		if scriptPath, err = filepath.Abs(scriptPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.StateDir != "" {
+		if err := os.MkdirAll(opts.StateDir, 0700); err != nil {
+			return nil, &SetupError{Err: fmt.Errorf("creating state directory: %w", err)}
+		}
+	}
+
+	// Next, wire up the buffers for stdout and stderr. Secrets are
+	// redacted before the output is truncated or split into lines, so
+	// that they can't be split.
+	maxOutput := opts.MaxOutput
+	if maxOutput <= 0 {
+		maxOutput = DefaultMaxOutput
+	}
+	stdout, stderr := newHeadTail(maxOutput), newHeadTail(maxOutput)
+	var il *interleaver
+	stdoutW, stderrW := io.Writer(stdout), io.Writer(stderr)
+	if opts.Interleave {
+		il = newInterleaver(min(maxOutput, maxLineLength))
+		stdoutW = io.MultiWriter(stdout, il.writer(StreamStdout))
+		stderrW = io.MultiWriter(stderr, il.writer(StreamStderr))
+	}
+	var redactors []*redactor
+	if len(opts.Redact) > 0 {
+		redactors = []*redactor{newRedactor(stdoutW, opts.Redact), newRedactor(stderrW, opts.Redact)}
+		stdoutW, stderrW = redactors[0], redactors[1]
+	}
+
+	// With a grace period, the script is killed through cmdCtx once it
+	// has had a chance to exit; see below.
+	cmdCtx, kill := ctx, context.CancelFunc(func() {})
+	if opts.GracePeriod > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		cmdCtx, kill = context.WithCancel(context.WithoutCancel(ctx))
+	}
+	defer kill()
+
+	cmd := exec.CommandContext(cmdCtx, scriptPath, opts.Args...)
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+	cmd.Stdin = opts.Stdin
+	cmd.Env = opts.Env
+	cmd.Dir = opts.Dir
 
-	// TODO: additional file descriptor for structured metadata.
+	// Pass a pipe for metadata as MetadataFD.
+	metaR, metaW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("creating metadata pipe: %w", err)
+	}
+	defer metaR.Close()
+	defer metaW.Close()
+	cmd.ExtraFiles = []*os.File{metaW}
+
+	// Don't wait forever for any children of the script that are still
+	// holding its output open.
+	cmd.WaitDelay = waitDelay
+
+	// Apply the options; this may run the script via a helper process.
+	sp, err := prepare(cmd, resultName, opts)
+	if err != nil {
+		return nil, &SetupError{Err: err}
+	}
+	defer sp.cleanup()
 
 	// Run the script.
-	err = cmd.Run()
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run script: %w", err)
+	}
+	sp.started()
+	metaW.Close()
+
+	// A script that is cancelled, e.g. because upchek is shutting down,
+	// is asked to exit with SIGTERM first; one that has run out of time
+	// is killed straight away.
+	if opts.GracePeriod > 0 {
+		stop := context.AfterFunc(ctx, func() {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				kill()
+				return
+			}
+			cmd.Process.Signal(syscall.SIGTERM)
+			time.AfterFunc(opts.GracePeriod, kill)
+		})
+		defer stop()
+	}
+
+	var metadata bytes.Buffer
+	metaDone := make(chan struct{})
+	go func() {
+		defer close(metaDone)
+		io.Copy(&metadata, io.LimitReader(metaR, maxMetadata))
+		io.Copy(io.Discard, metaR)
+	}()
+
+	err = cmd.Wait()
+
+	// As with stdout and stderr, don't wait forever for processes left
+	// behind by the script.
+	select {
+	case <-metaDone:
+	case <-time.After(waitDelay):
+		metaR.Close()
+		<-metaDone
+	}
+
+	for _, r := range redactors {
+		r.flush()
+	}
+	var output []OutputLine
+	if il != nil {
+		output = il.lines()
+	}
+
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// The script exited successfully, but left behind a process that
+		// is holding its output open; ignore it.
+		err = nil
+	}
+	if serr := sp.err(); serr != nil {
+		return nil, &SetupError{Err: serr}
+	}
 	if err != nil {
 		var exitErr *exec.ExitError
 		if errors.As(err, &exitErr) {
@@ -62,6 +376,9 @@ func Run(ctx context.Context, scriptPath string) (*Result, error) {
 				ExitCode: exitErr.ExitCode(),
 				Stdout:   stdout.String(),
 				Stderr:   stderr.String(),
+				Usage:    usage(cmd.ProcessState),
+				Output:   output,
+				Metadata: redact(metadata.String(), opts.Redact),
 			}, nil
 		}
 		return nil, fmt.Errorf("failed to run script: %w", err)
@@ -73,5 +390,30 @@ func Run(ctx context.Context, scriptPath string) (*Result, error) {
 		ExitCode: 0,
 		Stdout:   stdout.String(),
 		Stderr:   stderr.String(),
+		Usage:    usage(cmd.ProcessState),
+		Output:   output,
+		Metadata: redact(metadata.String(), opts.Redact),
 	}, nil
 }
+
+// redact replaces every occurrence of the provided secrets in s.
+func redact(s string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	return s
+}
+
+// usage returns the resources used by a process, or nil if unknown.
+func usage(ps *os.ProcessState) *Usage {
+	if ps == nil {
+		return nil
+	}
+	return &Usage{
+		UserTime:   ps.UserTime(),
+		SystemTime: ps.SystemTime(),
+		MaxRSS:     maxRSS(ps),
+	}
+}
@@ -0,0 +1,415 @@
+package runner
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-json-experiment/json"
+)
+
+const (
+	// helperEnv is the environment variable that tells Init that the
+	// process is a helper; its value is the JSON-encoded helperSpec.
+	helperEnv = "UPCHEK_RUNNER_HELPER"
+
+	// helperArg0 is the argv[0] of helper processes, to make them easier
+	// to identify in process listings.
+	helperArg0 = "upchek-runner-helper"
+
+	// helperErrFD is the file descriptor in the helper that setup errors
+	// are written to. It is closed on a successful exec of the script. It
+	// comes after MetadataFD, which is passed through to the script.
+	helperErrFD = MetadataFD + 1
+
+	// rlimitNproc is RLIMIT_NPROC, which isn't defined by package
+	// syscall.
+	rlimitNproc = 6
+)
+
+// helperSpec is passed from Run to the helper process.
+type helperSpec struct {
+	Limits  Limits
+	Sandbox *Sandbox `json:",omitzero"`
+
+	// Credential is the user to switch to once the sandbox is set up,
+	// which requires privileges. It's only used with a sandbox; otherwise
+	// the helper is started as the user directly.
+	Credential *syscall.Credential `json:",omitzero"`
+}
+
+// Init must be called at the start of main, before any other goroutines are
+// started. If the current process is a helper started by [Run], Init sets up
+// the environment for the script and executes it; it does not return.
+// Otherwise, Init does nothing.
+func Init() {
+	spec, ok := os.LookupEnv(helperEnv)
+	if !ok {
+		return
+	}
+
+	// runHelper only returns if something went wrong; report it to the
+	// parent and exit.
+	err := runHelper(spec)
+	f := os.NewFile(helperErrFD, "setup-errors")
+	fmt.Fprint(f, err)
+	os.Exit(127)
+}
+
+// runHelper applies the provided spec to the current process and then
+// executes the script named by the process's arguments. In a sandbox, the
+// script is instead run as a child of the helper; see [runInit].
+func runHelper(encoded string) error {
+	// Capabilities are per-thread, so they must be dropped on the thread
+	// that executes the script.
+	runtime.LockOSThread()
+	os.Unsetenv(helperEnv)
+	syscall.CloseOnExec(helperErrFD)
+
+	var spec helperSpec
+	if err := json.Unmarshal([]byte(encoded), &spec); err != nil {
+		return fmt.Errorf("decoding helper spec: %w", err)
+	}
+	if spec.Sandbox != nil && spec.Limits.Processes > 0 {
+		// The helper stays behind as the sandbox's init, and counts
+		// towards the limit as a process of the same user.
+		spec.Limits.Processes++
+	}
+	if err := setRlimits(spec.Limits); err != nil {
+		return err
+	}
+	if len(os.Args) < 2 {
+		return errors.New("helper: no script provided")
+	}
+	argv := os.Args[1:]
+
+	if spec.Sandbox != nil {
+		if err := enterSandbox(spec.Sandbox, argv[0]); err != nil {
+			return fmt.Errorf("sandbox: %w", err)
+		}
+		if err := dropPrivileges(spec.Credential); err != nil {
+			return fmt.Errorf("sandbox: %w", err)
+		}
+		return runInit(argv)
+	}
+
+	err := syscall.Exec(argv[0], argv, os.Environ())
+	return fmt.Errorf("executing script: %w", err)
+}
+
+// setRlimits sets both the soft and hard rlimits of the current process.
+func setRlimits(l Limits) error {
+	set := func(name string, resource int, soft, hard uint64) error {
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: soft, Max: hard}); err != nil {
+			return fmt.Errorf("setting %s limit: %w", name, err)
+		}
+		return nil
+	}
+
+	if l.CPUTime > 0 {
+		// Give the script a second between the soft limit, which sends
+		// SIGXCPU, and the hard limit, which sends SIGKILL.
+		secs := uint64(math.Ceil(l.CPUTime.Seconds()))
+		if err := set("CPU time", syscall.RLIMIT_CPU, secs, secs+1); err != nil {
+			return err
+		}
+	}
+	if l.AddressSpace > 0 {
+		if err := set("address space", syscall.RLIMIT_AS, uint64(l.AddressSpace), uint64(l.AddressSpace)); err != nil {
+			return err
+		}
+	}
+	if l.OpenFiles > 0 {
+		if err := set("open files", syscall.RLIMIT_NOFILE, uint64(l.OpenFiles), uint64(l.OpenFiles)); err != nil {
+			return err
+		}
+	}
+	if l.Processes > 0 {
+		if err := set("processes", rlimitNproc, uint64(l.Processes), uint64(l.Processes)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setup holds the state needed to run a single script with a set of
+// options.
+type setup struct {
+	errR, errW *os.File // pipe for errors from the helper, if any
+	cgroupDir  string   // leaf cgroup directory, if any
+	cgroupFD   *os.File // open handle to cgroupDir
+}
+
+// prepare configures cmd to run with the provided options.
+func prepare(cmd *exec.Cmd, name string, opts Options) (*setup, error) {
+	sp := new(setup)
+	ok := false
+	defer func() {
+		if !ok {
+			sp.cleanup()
+		}
+	}()
+
+	var err error
+	attr := new(syscall.SysProcAttr)
+	if opts.User != "" {
+		attr.Credential, err = lookupCredential(opts.User)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.StateDir != "" && attr.Credential != nil {
+		if err := os.Chown(opts.StateDir, int(attr.Credential.Uid), int(attr.Credential.Gid)); err != nil {
+			return nil, fmt.Errorf("chowning state directory: %w", err)
+		}
+	}
+
+	spec := helperSpec{Limits: opts.Limits}
+	if opts.Sandbox != nil {
+		if err := validateSandbox(opts.Sandbox); err != nil {
+			return nil, fmt.Errorf("sandbox: %w", err)
+		}
+		// The helper sets up the sandbox as root, so it must have a
+		// user to switch to before running the script.
+		if attr.Credential == nil || attr.Credential.Uid == 0 {
+			return nil, errors.New("sandbox: a non-root user is required")
+		}
+		sb := *opts.Sandbox
+		if opts.StateDir != "" {
+			sb.Writable = append(slices.Clip(sb.Writable), opts.StateDir)
+		}
+		spec.Sandbox = &sb
+		spec.Credential, attr.Credential = attr.Credential, nil
+		attr.Cloneflags = sandboxCloneflags(opts.Sandbox)
+	}
+
+	if opts.Limits.hasCgroupLimits() && opts.CgroupParent == "" {
+		return nil, errors.New("memory and CPU limits require a cgroup parent")
+	}
+	if opts.CgroupParent != "" {
+		sp.cgroupDir, err = newCgroup(opts.CgroupParent, name, opts.Limits)
+		if err != nil {
+			return nil, err
+		}
+		sp.cgroupFD, err = os.Open(sp.cgroupDir)
+		if err != nil {
+			return nil, fmt.Errorf("opening cgroup: %w", err)
+		}
+		attr.UseCgroupFD = true
+		attr.CgroupFD = int(sp.cgroupFD.Fd())
+	}
+
+	// Neither rlimits nor the sandbox can be set up for a child process
+	// before it starts, so run ourselves as a helper that sets them up and
+	// then executes the script.
+	if opts.Limits.hasRlimits() || opts.Sandbox != nil {
+		spec, err := json.Marshal(spec)
+		if err != nil {
+			return nil, fmt.Errorf("encoding helper spec: %w", err)
+		}
+		sp.errR, sp.errW, err = os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("creating pipe: %w", err)
+		}
+
+		cmd.Path = "/proc/self/exe"
+		cmd.Args = append([]string{helperArg0}, cmd.Args...)
+		env := cmd.Env
+		if env == nil {
+			env = os.Environ()
+		}
+		cmd.Env = append(slices.Clip(env), helperEnv+"="+string(spec))
+		cmd.ExtraFiles = append(cmd.ExtraFiles, sp.errW)
+	}
+
+	cmd.SysProcAttr = attr
+	ok = true
+	return sp, nil
+}
+
+// started is called once the command has been started, and closes the
+// parent's copies of files that were passed to the child.
+func (sp *setup) started() {
+	if sp.errW != nil {
+		sp.errW.Close()
+		sp.errW = nil
+	}
+}
+
+// err returns the error reported by the helper process, if any. It must
+// only be called once the command has exited.
+func (sp *setup) err() error {
+	if sp.errR == nil {
+		return nil
+	}
+	msg, err := io.ReadAll(sp.errR)
+	if err != nil {
+		return fmt.Errorf("reading helper errors: %w", err)
+	}
+	if len(msg) > 0 {
+		return errors.New(string(msg))
+	}
+	return nil
+}
+
+// cleanup releases all resources held by sp, including killing any
+// processes that remain in the script's cgroup and removing it.
+func (sp *setup) cleanup() {
+	for _, f := range []*os.File{sp.errR, sp.errW, sp.cgroupFD} {
+		if f != nil {
+			f.Close()
+		}
+	}
+	if sp.cgroupDir != "" {
+		removeCgroup(sp.cgroupDir)
+	}
+}
+
+// lookupCredential returns the credentials for a "user[:group]" string,
+// where both user and group may be names or numeric IDs.
+func lookupCredential(spec string) (*syscall.Credential, error) {
+	userName, groupName, hasGroup := strings.Cut(spec, ":")
+
+	cred := new(syscall.Credential)
+	u, err := user.Lookup(userName)
+	if err != nil {
+		u, err = user.LookupId(userName)
+	}
+	switch {
+	case err == nil:
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: invalid uid %q", userName, u.Uid)
+		}
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: invalid gid %q", userName, u.Gid)
+		}
+		cred.Uid, cred.Gid = uint32(uid), uint32(gid)
+
+		groups, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("user %q: looking up groups: %w", userName, err)
+		}
+		for _, g := range groups {
+			if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+				cred.Groups = append(cred.Groups, uint32(id))
+			}
+		}
+	default:
+		// Allow numeric IDs that don't correspond to a named user; the
+		// group defaults to the same ID.
+		id, perr := strconv.ParseUint(userName, 10, 32)
+		if perr != nil {
+			return nil, fmt.Errorf("looking up user %q: %w", userName, err)
+		}
+		cred.Uid, cred.Gid = uint32(id), uint32(id)
+	}
+
+	if hasGroup {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			g, err = user.LookupGroupId(groupName)
+		}
+		var gid uint64
+		if err == nil {
+			gid, err = strconv.ParseUint(g.Gid, 10, 32)
+		} else {
+			gid, err = strconv.ParseUint(groupName, 10, 32)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("looking up group %q: %w", groupName, err)
+		}
+		cred.Gid = uint32(gid)
+	}
+	return cred, nil
+}
+
+// newCgroup creates a new leaf cgroup for a run of the named script under
+// parent, with the provided limits, and returns its path.
+func newCgroup(parent, name string, l Limits) (string, error) {
+	var controllers []string
+	if l.MemoryMax > 0 {
+		controllers = append(controllers, "+memory")
+	}
+	if l.CPUMax > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	if len(controllers) > 0 {
+		control := filepath.Join(parent, "cgroup.subtree_control")
+		if err := os.WriteFile(control, []byte(strings.Join(controllers, " ")), 0); err != nil {
+			return "", fmt.Errorf("enabling cgroup controllers: %w", err)
+		}
+	}
+
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	dir := filepath.Join(parent, "upchek-"+name+"-"+hex.EncodeToString(suffix[:]))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", fmt.Errorf("creating cgroup: %w", err)
+	}
+
+	write := func(file, value string) error {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0); err != nil {
+			os.Remove(dir)
+			return fmt.Errorf("setting cgroup %s: %w", file, err)
+		}
+		return nil
+	}
+	if l.MemoryMax > 0 {
+		if err := write("memory.max", strconv.FormatInt(l.MemoryMax, 10)); err != nil {
+			return "", err
+		}
+		// Don't let the script use swap to get around the limit.
+		if err := write("memory.swap.max", "0"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	if l.CPUMax > 0 {
+		const period = 100000 // microseconds
+		quota := max(int64(l.CPUMax*period), 1000)
+		if err := write("cpu.max", fmt.Sprintf("%d %d", quota, period)); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// removeCgroup kills any processes remaining in the cgroup at dir, and then
+// removes it.
+func removeCgroup(dir string) {
+	// cgroup.kill is only available on Linux 5.14 and later; without it,
+	// leftover processes will prevent the cgroup from being removed.
+	os.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0)
+
+	// Killed processes take a moment to leave the cgroup.
+	for range 20 {
+		err := syscall.Rmdir(dir)
+		if err == nil || errors.Is(err, syscall.ENOENT) || !errors.Is(err, syscall.EBUSY) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// maxRSS returns the maximum resident set size of the process, in bytes.
+func maxRSS(ps *os.ProcessState) int64 {
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+		return ru.Maxrss * 1024
+	}
+	return 0
+}
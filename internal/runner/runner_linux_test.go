@@ -0,0 +1,227 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScript(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "script.sh")
+	if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+		t.Fatalf("failed to write test script: %v", err)
+	}
+	return path
+}
+
+func TestRunWithRlimits(t *testing.T) {
+	t.Parallel()
+	scriptPath := writeScript(t, "#!/bin/sh\nulimit -n\nulimit -t\necho \"$0\"\nenv | grep -c UPCHEK_ || true\n")
+
+	result, err := Run(context.Background(), scriptPath, Options{
+		Limits: Limits{OpenFiles: 64, CPUTime: 5e9},
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	want := "64\n5\n" + scriptPath + "\n0\n"
+	if result.Stdout != want {
+		t.Errorf("Run() stdout = %q, want %q", result.Stdout, want)
+	}
+}
+
+func TestRunHelperWithOptions(t *testing.T) {
+	t.Parallel()
+	scriptPath := writeScript(t, `#!/bin/sh
+echo "foo=$FOO"
+echo meta >&3
+echo fd4 >&4 2>/dev/null || echo fd4-closed
+`)
+
+	result, err := Run(context.Background(), scriptPath, Options{
+		Env:    []string{"FOO=bar"},
+		Limits: Limits{OpenFiles: 64},
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if want := "foo=bar\nfd4-closed\n"; result.Stdout != want {
+		t.Errorf("Run() stdout = %q, want %q", result.Stdout, want)
+	}
+	if want := "meta\n"; result.Metadata != want {
+		t.Errorf("Run() metadata = %q, want %q", result.Metadata, want)
+	}
+}
+
+func TestRunSetupError(t *testing.T) {
+	t.Parallel()
+	scriptPath := writeScript(t, "#!/bin/sh\nexit 0\n")
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"unknown_user", Options{User: "no-such-user-upchek"}},
+		{"cgroup_limits_without_parent", Options{Limits: Limits{MemoryMax: 1 << 20}}},
+		{"rlimit_too_high", Options{Limits: Limits{OpenFiles: 1 << 40}}},
+		{"sandbox_without_user", Options{Sandbox: &Sandbox{}}},
+		{"sandbox_as_root", Options{User: "0:0", Sandbox: &Sandbox{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Run(context.Background(), scriptPath, tt.opts)
+			var serr *SetupError
+			if !errors.As(err, &serr) {
+				t.Errorf("Run() error = %v, want a SetupError", err)
+			}
+		})
+	}
+}
+
+func TestRunAsUser(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skip("must be run as root")
+	}
+	// The script must be readable by the target user.
+	dir, err := os.MkdirTemp("", "upchek-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Chmod(dir, 0755)
+	scriptPath := filepath.Join(dir, "id.sh")
+	if err := os.WriteFile(scriptPath, []byte("#!/bin/sh\nid -u\nid -g\nulimit -n\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Run(context.Background(), scriptPath, Options{
+		User:   "65534:65534",
+		Limits: Limits{OpenFiles: 32},
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if got := strings.Fields(result.Stdout); len(got) != 3 || got[0] != "65534" || got[1] != "65534" || got[2] != "32" {
+		t.Errorf("Run() stdout = %q, want uid, gid 65534 and 32 open files", result.Stdout)
+	}
+}
+
+func TestRunInCgroup(t *testing.T) {
+	t.Parallel()
+	parent := os.Getenv("UPCHEK_TEST_CGROUP_PARENT")
+	if parent == "" {
+		t.Skip("UPCHEK_TEST_CGROUP_PARENT is not set")
+	}
+	scriptPath := writeScript(t, "#!/bin/sh\ncat /proc/self/cgroup\nsleep 60 &\n")
+
+	result, err := Run(context.Background(), scriptPath, Options{CgroupParent: parent})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if !strings.Contains(result.Stdout, "/upchek-script.sh-") {
+		t.Errorf("script was not run in its own cgroup: %q", result.Stdout)
+	}
+
+	// The leaf cgroup should have been removed, even though the script
+	// left a process behind.
+	entries, err := filepath.Glob(filepath.Join(parent, "upchek-script.sh-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("leaf cgroups were not removed: %v", entries)
+	}
+}
+
+func TestRunInSandbox(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skip("must be run as root")
+	}
+	writable := t.TempDir()
+	os.Chmod(writable, 0777)
+	readOnly := t.TempDir()
+	os.Chmod(readOnly, 0777)
+	scriptPath := writeScript(t, `#!/bin/sh
+echo ppid=$PPID uid=$(id -u)
+touch `+readOnly+`/file 2>/dev/null && echo readonly-writable
+touch `+writable+`/file && echo writable-ok
+touch /tmp/private && echo tmp-ok
+ls /proc | grep -c '^[0-9]'
+awk '/^Cap/ && $2 != "0000000000000000"' /proc/self/status
+touch "$1/file" && echo state-ok
+`)
+
+	stateDir := filepath.Join(t.TempDir(), "state")
+	sb := &Sandbox{IsolateNetwork: true, Writable: []string{writable}}
+	result, err := Run(context.Background(), scriptPath, Options{
+		Args:     []string{stateDir},
+		User:     "65534:65534",
+		Sandbox:  sb,
+		StateDir: stateDir,
+	})
+	if err != nil {
+		var serr *SetupError
+		if errors.As(err, &serr) {
+			t.Skipf("sandboxing is not supported here: %v", err)
+		}
+		t.Fatalf("Run() error = %v", err)
+	}
+	want := "ppid=1 uid=65534\nwritable-ok\ntmp-ok\n"
+	if !strings.HasPrefix(result.Stdout, want) {
+		t.Errorf("Run() stdout = %q, want prefix %q (stderr %q)", result.Stdout, want, result.Stderr)
+	}
+	if !strings.HasSuffix(result.Stdout, "state-ok\n") {
+		t.Errorf("Run() stdout = %q, want state directory to be writable", result.Stdout)
+	}
+	if strings.Contains(result.Stdout, "Cap") {
+		t.Errorf("Run() stdout = %q, want all capabilities to be cleared", result.Stdout)
+	}
+	if len(sb.Writable) != 1 {
+		t.Errorf("Run() modified the sandbox's writable paths: %v", sb.Writable)
+	}
+	if _, err := os.Stat(filepath.Join(writable, "file")); err != nil {
+		t.Errorf("file in writable path was not created on the host: %v", err)
+	}
+	if _, err := os.Stat("/tmp/private"); err == nil {
+		t.Errorf("file in sandbox's /tmp was created on the host")
+	}
+}
+
+func TestRunInSandboxGracePeriod(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() != 0 {
+		t.Skip("must be run as root")
+	}
+	// The script doesn't handle SIGTERM itself, and leaves a child behind
+	// that would otherwise hold its output open.
+	scriptPath := writeScript(t, "#!/bin/sh\nsleep 60 &\nsleep 60\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(500*time.Millisecond, cancel)
+	start := time.Now()
+	result, err := Run(ctx, scriptPath, Options{
+		User:        "65534:65534",
+		Sandbox:     &Sandbox{},
+		GracePeriod: 30 * time.Second,
+	})
+	if err != nil {
+		var serr *SetupError
+		if errors.As(err, &serr) {
+			t.Skipf("sandboxing is not supported here: %v", err)
+		}
+		t.Fatalf("Run() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Run() took %v, want the script to exit on SIGTERM", elapsed)
+	}
+	if want := 128 + 15; result.ExitCode != want {
+		t.Errorf("Run() exit code = %d, want %d", result.ExitCode, want)
+	}
+}
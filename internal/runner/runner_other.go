@@ -0,0 +1,33 @@
+//go:build !linux
+
+package runner
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// Init must be called at the start of main. It does nothing on this
+// platform.
+func Init() {}
+
+// setup holds the state needed to run a single script with a set of
+// options. It is empty on this platform, since no options are supported.
+type setup struct{}
+
+// prepare configures cmd to run with the provided options.
+func prepare(cmd *exec.Cmd, name string, opts Options) (*setup, error) {
+	if opts.User != "" || opts.Limits != (Limits{}) || opts.Sandbox != nil || opts.CgroupParent != "" {
+		return nil, errors.New("running scripts as another user or with limits is only supported on Linux")
+	}
+	return new(setup), nil
+}
+
+func (sp *setup) started()   {}
+func (sp *setup) err() error { return nil }
+func (sp *setup) cleanup()   {}
+
+// maxRSS returns the maximum resident set size of the process; it is not
+// known on this platform.
+func maxRSS(ps *os.ProcessState) int64 { return 0 }
@@ -4,11 +4,21 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
+func TestMain(m *testing.M) {
+	// Scripts that are run with rlimits are started via a helper, which
+	// is this test binary.
+	Init()
+	os.Exit(m.Run())
+}
+
 func TestRunScriptExecution(t *testing.T) {
 	t.Parallel()
 
@@ -55,7 +65,7 @@ func TestRunScriptExecution(t *testing.T) {
 			}
 
 			// Run the script
-			result, err := Run(context.Background(), scriptPath)
+			result, err := Run(context.Background(), scriptPath, Options{})
 			if err != nil {
 				t.Fatalf("Run() error = %v", err)
 			}
@@ -68,8 +78,12 @@ func TestRunScriptExecution(t *testing.T) {
 				Stderr:   tt.wantStderr,
 			}
 
-			if !cmp.Equal(result, want) {
-				t.Errorf("Run() result mismatch (-got +want):\n%s", cmp.Diff(result, want))
+			ignoreUsage := cmpopts.IgnoreFields(Result{}, "Usage")
+			if !cmp.Equal(result, want, ignoreUsage) {
+				t.Errorf("Run() result mismatch (-got +want):\n%s", cmp.Diff(result, want, ignoreUsage))
+			}
+			if result.Usage == nil {
+				t.Error("Run() result has no resource usage")
 			}
 		})
 	}
@@ -81,7 +95,7 @@ func TestRunScriptNotFound(t *testing.T) {
 	tempDir := t.TempDir()
 	scriptPath := filepath.Join(tempDir, "nonexistent.sh")
 
-	_, err := Run(context.Background(), scriptPath)
+	_, err := Run(context.Background(), scriptPath, Options{})
 	if err == nil {
 		t.Error("Run() error = nil, want error for nonexistent script")
 	}
@@ -98,7 +112,7 @@ func TestRunScriptNotExecutable(t *testing.T) {
 		t.Fatalf("failed to write test script: %v", err)
 	}
 
-	_, err = Run(context.Background(), scriptPath)
+	_, err = Run(context.Background(), scriptPath, Options{})
 	if err == nil {
 		t.Error("Run() error = nil, want error for non-executable script")
 	}
@@ -119,8 +133,132 @@ func TestRunWithCanceledContext(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel() // Cancel immediately
 
-	_, err = Run(ctx, scriptPath)
+	_, err = Run(ctx, scriptPath, Options{})
 	if err == nil {
 		t.Error("Run() error = nil, want error for canceled context")
 	}
 }
+
+func TestRunGracePeriod(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	scriptPath := filepath.Join(dir, "graceful.sh")
+	// The script waits on a background sleep, so that the trap runs as
+	// soon as the signal arrives; the sleep doesn't hold the script's
+	// output open once it has exited.
+	script := `#!/bin/sh
+trap 'echo terminated; exit 3' TERM
+sleep 10 >/dev/null 2>&1 3>&- &
+wait $!
+`
+	if err := os.WriteFile(scriptPath, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to write test script: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		deadline     bool
+		wantExitCode int
+		wantStdout   string
+	}{
+		{"cancelled", false, 3, "terminated\n"},
+		{"deadline", true, -1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var (
+				ctx    context.Context
+				cancel context.CancelFunc
+			)
+			if tt.deadline {
+				ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+			} else {
+				ctx, cancel = context.WithCancel(context.Background())
+				time.AfterFunc(200*time.Millisecond, cancel)
+			}
+			defer cancel()
+
+			start := time.Now()
+			result, err := Run(ctx, scriptPath, Options{GracePeriod: 5 * time.Second})
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("Run() took %v, want the script to exit promptly", elapsed)
+			}
+			if result.ExitCode != tt.wantExitCode || result.Stdout != tt.wantStdout {
+				t.Errorf("Run() = exit code %d, stdout %q; want %d, %q", result.ExitCode, result.Stdout, tt.wantExitCode, tt.wantStdout)
+			}
+		})
+	}
+}
+
+func TestLimitsTighten(t *testing.T) {
+	base := Limits{CPUTime: 10 * time.Second, OpenFiles: 100, MemoryMax: 1 << 20}
+	got := base.Tighten(Limits{CPUTime: 20 * time.Second, OpenFiles: 50, Processes: 10})
+	want := Limits{CPUTime: 10 * time.Second, OpenFiles: 50, Processes: 10, MemoryMax: 1 << 20}
+	if got != want {
+		t.Errorf("Tighten() = %+v, want %+v", got, want)
+	}
+}
+
+func TestRunWithOptions(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	scriptPath := filepath.Join(dir, "options.sh")
+	script := `#!/bin/sh
+echo "args=$*"
+echo "env=$FOO home=${HOME:-unset}"
+echo "pwd=$(pwd)"
+echo "stdin=$(cat)"
+echo "token is hunter2" >&2
+echo '{"status":"hunter2"}' >&3
+`
+	if err := os.WriteFile(scriptPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+
+	result, err := Run(context.Background(), scriptPath, Options{
+		Args:   []string{"a", "b c"},
+		Env:    []string{"PATH=" + os.Getenv("PATH"), "FOO=bar"},
+		Dir:    workDir,
+		Stdin:  strings.NewReader("input"),
+		Redact: []string{"hunter2"},
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	want := &Result{
+		Name:     "options.sh",
+		Stdout:   "args=a b c\nenv=bar home=unset\npwd=" + workDir + "\nstdin=input\n",
+		Stderr:   "token is [REDACTED]\n",
+		Metadata: "{\"status\":\"[REDACTED]\"}\n",
+	}
+	ignoreUsage := cmpopts.IgnoreFields(Result{}, "Usage")
+	if diff := cmp.Diff(result, want, ignoreUsage); diff != "" {
+		t.Errorf("Run() result mismatch (-got +want):\n%s", diff)
+	}
+}
+
+func TestRunStateDir(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	scriptPath := filepath.Join(dir, "state.sh")
+	if err := os.WriteFile(scriptPath, []byte("#!/bin/sh\necho hello > \"$1/out\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stateDir := filepath.Join(dir, "state", "check")
+
+	if _, err := Run(context.Background(), scriptPath, Options{Args: []string{stateDir}, StateDir: stateDir}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(stateDir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello\n" {
+		t.Errorf("state file = %q, want %q", got, "hello\n")
+	}
+}
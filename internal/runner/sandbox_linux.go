@@ -0,0 +1,424 @@
+package runner
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// prSetNoNewPrivs is PR_SET_NO_NEW_PRIVS, which isn't defined by package
+// syscall.
+const prSetNoNewPrivs = 38
+
+// sandboxStaging is where the sandbox's root filesystem is assembled. A
+// private tmpfs is mounted here in the sandbox's mount namespace, so it
+// doesn't need to exist on the host beyond being a directory.
+const sandboxStaging = "/tmp"
+
+// sandboxCloneflags returns the namespaces to create for a sandbox.
+func sandboxCloneflags(sb *Sandbox) uintptr {
+	flags := uintptr(syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC)
+	if sb.IsolateNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+	return flags
+}
+
+// validateSandbox returns an error if sb can't be used.
+func validateSandbox(sb *Sandbox) error {
+	if os.Geteuid() != 0 {
+		return errors.New("sandboxing requires running as root")
+	}
+	for _, p := range sb.Writable {
+		if !filepath.IsAbs(p) || filepath.Clean(p) != p {
+			return fmt.Errorf("writable path %q must be absolute and clean", p)
+		}
+		if p == "/" {
+			return errors.New("the root directory can't be writable")
+		}
+		if _, err := os.Stat(p); err != nil {
+			return fmt.Errorf("writable path: %w", err)
+		}
+	}
+	return nil
+}
+
+// enterSandbox is called by the helper process, which is already in new
+// namespaces, to set up its filesystem. On return, the helper's root is a
+// read-only view of the host's, with a private /tmp, a /proc for the new
+// PID namespace and sb.Writable bind-mounted read-write. The script at
+// scriptPath is made visible, even if it is in /tmp on the host.
+func enterSandbox(sb *Sandbox, scriptPath string) error {
+	scriptPath, err := filepath.Abs(scriptPath)
+	if err != nil {
+		return err
+	}
+	script, err := os.Open(scriptPath)
+	if err != nil {
+		return fmt.Errorf("opening script: %w", err)
+	}
+	defer script.Close()
+
+	// Open the writable paths first, since they may be hidden by the
+	// staging tmpfs; they're mounted from /proc/self/fd below.
+	writable := make([]*os.File, 0, len(sb.Writable))
+	defer func() {
+		for _, f := range writable {
+			f.Close()
+		}
+	}()
+	for _, p := range sb.Writable {
+		f, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("opening writable path: %w", err)
+		}
+		writable = append(writable, f)
+	}
+
+	// Don't propagate any mounts back to the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+
+	if err := syscall.Mount("tmpfs", sandboxStaging, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0700"); err != nil {
+		return fmt.Errorf("mounting staging tmpfs: %w", err)
+	}
+	root := filepath.Join(sandboxStaging, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("/", root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("binding root: %w", err)
+	}
+	if err := remountReadOnly(root); err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(root, "tmp")
+	if err := syscall.Mount("tmpfs", tmp, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mounting /tmp: %w", err)
+	}
+	proc := filepath.Join(root, "proc")
+	if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting /proc: %w", err)
+	}
+
+	for i, f := range writable {
+		target := filepath.Join(root, sb.Writable[i])
+		if err := ensureMountpoint(target, f); err != nil {
+			return fmt.Errorf("writable path %q: %w", sb.Writable[i], err)
+		}
+		source := "/proc/self/fd/" + strconv.Itoa(int(f.Fd()))
+		if err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("binding writable path %q: %w", sb.Writable[i], err)
+		}
+	}
+
+	target := filepath.Join(root, scriptPath)
+	if _, err := os.Stat(target); err != nil {
+		if err := ensureMountpoint(target, script); err != nil {
+			return fmt.Errorf("script: %w", err)
+		}
+		if err := bindReadOnly(script, target); err != nil {
+			return fmt.Errorf("binding script: %w", err)
+		}
+	}
+
+	if sb.IsolateNetwork {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("bringing up loopback: %w", err)
+		}
+	}
+
+	// Switch to the new root, and detach the old one; see pivot_root(2)
+	// for why this works without a separate directory for the old root.
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivoting root: %w", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching old root: %w", err)
+	}
+	if err := os.Chdir(wd); err != nil {
+		return os.Chdir("/")
+	}
+	return nil
+}
+
+// bindReadOnly bind-mounts f read-only onto target.
+func bindReadOnly(f *os.File, target string) error {
+	source := "/proc/self/fd/" + strconv.Itoa(int(f.Fd()))
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND, ""); err != nil {
+		return err
+	}
+	return syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, "")
+}
+
+// remountReadOnly makes every mount at or below root read-only, keeping
+// their other flags.
+func remountReadOnly(root string) error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// See proc(5) for the format of mountinfo.
+	type mount struct {
+		point string
+		flags uintptr
+	}
+	var mounts []mount
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		point := unescapeMountinfo(fields[4])
+		if point != root && !strings.HasPrefix(point, root+"/") {
+			continue
+		}
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+		for opt := range strings.SplitSeq(fields[5], ",") {
+			switch opt {
+			case "nosuid":
+				flags |= syscall.MS_NOSUID
+			case "nodev":
+				flags |= syscall.MS_NODEV
+			case "noexec":
+				flags |= syscall.MS_NOEXEC
+			case "noatime":
+				flags |= syscall.MS_NOATIME
+			case "nodiratime":
+				flags |= syscall.MS_NODIRATIME
+			case "relatime":
+				flags |= syscall.MS_RELATIME
+			}
+		}
+		mounts = append(mounts, mount{point, flags})
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range mounts {
+		if err := syscall.Mount("", m.point, "", m.flags, ""); err != nil {
+			// Mounts below a shadowed mount point can't be reached,
+			// and so don't need to be read-only.
+			if errors.Is(err, syscall.ENOENT) {
+				continue
+			}
+			return fmt.Errorf("remounting %q read-only: %w", m.point, err)
+		}
+	}
+	return nil
+}
+
+// unescapeMountinfo undoes the octal escaping of whitespace and backslashes
+// in /proc/self/mountinfo.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// ensureMountpoint creates target, if it doesn't exist, so that f can be
+// bind-mounted onto it.
+func ensureMountpoint(target string, f *os.File) error {
+	if _, err := os.Stat(target); err == nil {
+		return nil
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		return os.MkdirAll(target, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(target, nil, 0644)
+}
+
+// loopbackUp brings up the loopback interface in the current network
+// namespace.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// struct ifreq, with just the name and flags.
+	var req struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(req.name[:], "lo")
+	req.flags = syscall.IFF_UP | syscall.IFF_LOOPBACK | syscall.IFF_RUNNING
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Constants for prctl and capset that aren't defined by package syscall.
+const (
+	prCapbsetDrop           = 24
+	prCapAmbient            = 47
+	prCapAmbientClearAll    = 4
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+// dropPrivileges switches to the provided credentials, which must not be
+// root's, clears all of the process's capabilities, including the bounding
+// and ambient sets, and prevents the process and its children from gaining
+// privileges through exec.
+func dropPrivileges(cred *syscall.Credential) error {
+	if cred == nil || cred.Uid == 0 {
+		return errors.New("a non-root user is required")
+	}
+
+	// Dropping from the bounding set needs CAP_SETPCAP, so do it before
+	// switching users.
+	lastCap, err := lastCapability()
+	if err != nil {
+		return err
+	}
+	for c := 0; c <= lastCap; c++ {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, uintptr(c), 0); errno != 0 {
+			return fmt.Errorf("dropping capability %d from bounding set: %w", c, errno)
+		}
+	}
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("clearing ambient capabilities: %w", errno)
+	}
+
+	groups := make([]int, len(cred.Groups))
+	for i, g := range cred.Groups {
+		groups[i] = int(g)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setting groups: %w", err)
+	}
+	if err := syscall.Setgid(int(cred.Gid)); err != nil {
+		return fmt.Errorf("setting gid: %w", err)
+	}
+	if err := syscall.Setuid(int(cred.Uid)); err != nil {
+		return fmt.Errorf("setting uid: %w", err)
+	}
+
+	// Switching away from root clears the permitted and effective sets,
+	// but clear them explicitly, along with the inheritable set, rather
+	// than relying on the securebits.
+	hdr := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion3}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("clearing capabilities: %w", errno)
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("setting no_new_privs: %w", errno)
+	}
+	return nil
+}
+
+// lastCapability returns the highest capability known to the kernel.
+func lastCapability() (int, error) {
+	b, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return 0, fmt.Errorf("reading last capability: %w", err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("parsing last capability: %w", err)
+	}
+	return n, nil
+}
+
+// runInit runs the script as a child of the helper, which is PID 1 of the
+// sandbox's PID namespace. The kernel only delivers signals to PID 1 for which
+// it has installed a handler, and reparents orphaned processes in the
+// namespace to it, so the helper stays behind as a minimal init: it forwards
+// SIGTERM and SIGINT to the script and reaps orphans. When the script exits,
+// the helper exits with its exit code, or 128 plus the number of the signal
+// that killed it, and the kernel kills anything left in the namespace.
+//
+// runInit only returns if the script can't be started.
+func runInit(argv []string) error {
+	// Start handling signals before the script exists, so that none are
+	// dropped in between.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	// This must run on the thread that dropped privileges, which
+	// runHelper has locked the goroutine to, since the script inherits
+	// that thread's capabilities.
+	metadata := os.NewFile(MetadataFD, "metadata")
+	p, err := os.StartProcess(argv[0], argv, &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, metadata},
+	})
+	if err != nil {
+		return fmt.Errorf("executing script: %w", err)
+	}
+	metadata.Close()
+	syscall.Close(helperErrFD)
+
+	go func() {
+		for sig := range sigs {
+			p.Signal(sig)
+		}
+	}()
+
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, 0, nil)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			// The script is our child until it has been reaped, so
+			// this can't happen.
+			os.Exit(127)
+		}
+		if pid != p.Pid {
+			continue
+		}
+		if ws.Signaled() {
+			os.Exit(128 + int(ws.Signal()))
+		}
+		os.Exit(ws.ExitStatus())
+	}
+}
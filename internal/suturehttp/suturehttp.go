@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/thejerf/suture/v4"
@@ -14,6 +15,9 @@ import (
 	"github.com/andrew-d/upchek/internal/ulog"
 )
 
+// DefaultShutdownTimeout is the default for [Server.SetShutdownTimeout].
+const DefaultShutdownTimeout = 5 * time.Second
+
 // Server is a [suture.Service] that manages a [http.Server].
 type Server struct {
 	// Logger is the logger that the server will use to log messages.
@@ -23,6 +27,10 @@ type Server struct {
 
 	ln      net.Listener
 	handler http.Handler
+
+	// shutdownTimeout is the timeout set by SetShutdownTimeout, which can
+	// change while the server is running.
+	shutdownTimeout atomic.Int64
 }
 
 var _ suture.Service = (*Server)(nil)
@@ -36,6 +44,23 @@ func New(ln net.Listener, handler http.Handler) *Server {
 	}
 }
 
+// SetShutdownTimeout sets how long in-flight requests have to finish when the
+// server is stopped, before their connections are closed. If it is zero,
+// DefaultShutdownTimeout is used. It may be called while the server is
+// running.
+func (s *Server) SetShutdownTimeout(d time.Duration) {
+	s.shutdownTimeout.Store(int64(d))
+}
+
+// ShutdownTimeout returns the timeout set by SetShutdownTimeout, or
+// DefaultShutdownTimeout if none is set.
+func (s *Server) ShutdownTimeout() time.Duration {
+	if d := time.Duration(s.shutdownTimeout.Load()); d > 0 {
+		return d
+	}
+	return DefaultShutdownTimeout
+}
+
 // Serve implements the suture.Service interface.
 func (s *Server) Serve(ctx context.Context) error {
 	if s.Logger == nil {
@@ -65,9 +90,7 @@ func (s *Server) Serve(ctx context.Context) error {
 
 	// If we get here, we know that the context we were provided has been
 	// cancelled. We need to shut down the server gracefully.
-	//
-	// Give ourselves a few seconds to do that.
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout())
 	defer cancel()
 
 	s.Logger.Info("shutting down API")
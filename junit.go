@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// junitSuite is a <testsuites> or <testsuite> element of a JUnit XML report.
+// Suites may be nested.
+type junitSuite struct {
+	XMLName xml.Name
+	Suites  []junitSuite    `xml:"testsuite"`
+	Cases   []junitTestCase `xml:"testcase"`
+}
+
+// junitTestCase is a <testcase> element of a JUnit XML report.
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitOutcome `xml:"failure"`
+	Error     *junitOutcome `xml:"error"`
+	Skipped   *junitOutcome `xml:"skipped"`
+	SystemOut string        `xml:"system-out"`
+	SystemErr string        `xml:"system-err"`
+}
+
+// junitOutcome is a <failure>, <error> or <skipped> element of a test case.
+type junitOutcome struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// parseJUnit parses a JUnit XML report, as written by tools such as bats
+// (with --formatter junit) or go-junit-report, into one sub-result per test
+// case. Anything before the start of the XML is ignored.
+//
+// A test case is named after the last element of its class name and its own
+// name, e.g. "disk.bats.has_free_space", made into a sub-result name with
+// [testNames]. Test cases with a failure or error are failing, with the
+// failure's message as their message; their output is the failure's text,
+// followed by anything they wrote to stdout or stderr.
+func parseJUnit(data string) ([]subResult, error) {
+	i := strings.Index(data, "<")
+	if i < 0 {
+		return nil, fmt.Errorf("no JUnit XML report in output")
+	}
+	var root junitSuite
+	if err := xml.Unmarshal([]byte(data[i:]), &root); err != nil {
+		return nil, fmt.Errorf("parsing JUnit XML report: %w", err)
+	}
+	if name := root.XMLName.Local; name != "testsuites" && name != "testsuite" {
+		return nil, fmt.Errorf("parsing JUnit XML report: unexpected root element <%s>", name)
+	}
+
+	var (
+		subs []subResult
+		walk func(s junitSuite)
+	)
+	walk = func(s junitSuite) {
+		for _, tc := range s.Cases {
+			subs = append(subs, tc.subResult())
+		}
+		for _, child := range s.Suites {
+			walk(child)
+		}
+	}
+	walk(root)
+	return testNames(subs), nil
+}
+
+// subResult returns the sub-result for the test case.
+func (tc junitTestCase) subResult() subResult {
+	sub := subResult{
+		Name:   tc.Name,
+		Status: statusOK,
+	}
+	if tc.ClassName != "" {
+		sub.Name = path.Base(tc.ClassName) + "." + tc.Name
+	}
+	if secs, err := strconv.ParseFloat(tc.Time, 64); err == nil && secs >= 0 {
+		sub.Duration = time.Duration(secs * float64(time.Second))
+	}
+
+	var output []string
+	failure := tc.Failure
+	if failure == nil {
+		failure = tc.Error
+	}
+	switch {
+	case failure != nil:
+		sub.Status = statusFailing
+		sub.Message = failure.Message
+		text := strings.TrimSpace(failure.Text)
+		if sub.Message == "" {
+			sub.Message, _, _ = strings.Cut(text, "\n")
+		}
+		output = append(output, text)
+	case tc.Skipped != nil:
+		sub.Status = statusSkipped
+		sub.Message = tc.Skipped.Message
+	}
+
+	output = append(output, strings.TrimSpace(tc.SystemOut), strings.TrimSpace(tc.SystemErr))
+	output = slices.DeleteFunc(output, func(s string) bool { return s == "" })
+	sub.Output = strings.Join(output, "\n")
+	return sub
+}
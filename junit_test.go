@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseJUnit(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []subResult
+		wantErr bool
+	}{
+		{
+			name: "go_junit_report",
+			data: `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="example.com/smoke" tests="3">
+    <testcase classname="example.com/smoke" name="TestLogin" time="0.250"></testcase>
+    <testcase classname="example.com/smoke" name="TestSearch/empty query" time="1.5">
+      <failure message="Failed" type="">search_test.go:12: got 500, want 200</failure>
+      <system-out>retrying</system-out>
+    </testcase>
+    <testcase classname="example.com/smoke" name="TestSlow" time="0">
+      <skipped message="skipping in short mode"></skipped>
+    </testcase>
+  </testsuite>
+</testsuites>`,
+			want: []subResult{
+				{Name: "smoke.TestLogin", Status: statusOK, Duration: 250 * time.Millisecond},
+				{
+					Name:     "smoke.TestSearch_empty_query",
+					Status:   statusFailing,
+					Message:  "Failed",
+					Output:   "search_test.go:12: got 500, want 200\nretrying",
+					Duration: 1500 * time.Millisecond,
+				},
+				{Name: "smoke.TestSlow", Status: statusSkipped, Message: "skipping in short mode"},
+			},
+		},
+		{
+			name: "single_suite",
+			data: "running tests...\n" +
+				`<testsuite name="disk.bats"><testcase name="has free space"><error>df: not found</error></testcase></testsuite>`,
+			want: []subResult{
+				{Name: "has_free_space", Status: statusFailing, Message: "df: not found", Output: "df: not found"},
+			},
+		},
+		{
+			name: "nested_suites",
+			data: `<testsuites><testsuite><testsuite><testcase name="inner"/></testsuite></testsuite></testsuites>`,
+			want: []subResult{{Name: "inner", Status: statusOK}},
+		},
+		{name: "no_xml", data: "all tests passed\n", wantErr: true},
+		{name: "truncated", data: `<testsuites><testsuite><testcase name="a">`, wantErr: true},
+		{name: "wrong_root", data: `<html></html>`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseJUnit(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseJUnit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("parseJUnit() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
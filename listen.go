@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// unixPrefix marks a listener address as the path of a Unix socket.
+	unixPrefix = "unix:"
+
+	// systemdPrefix marks a listener address as the name of a socket
+	// passed by systemd socket activation.
+	systemdPrefix = "systemd:"
+)
+
+// routeSet names a set of HTTP endpoints that a listener serves.
+type routeSet string
+
+const (
+	// routesAll is every endpoint, including the web interface; it is
+	// the default.
+	routesAll routeSet = "all"
+
+	// routesAPI is the HTTP API and /healthz, without the web interface
+	// or metrics.
+	routesAPI routeSet = "api"
+
+	// routesHealth is only /healthz, e.g. for a public port used by a
+	// load balancer.
+	routesHealth routeSet = "health"
+
+	// routesStatus is the public status page and its API, its static
+	// assets, and /healthz, e.g. for a port exposed to the internet.
+	routesStatus routeSet = "status"
+)
+
+// validate checks that the listener configuration is well-formed.
+func (l *listenerConfig) validate() error {
+	var errs []error
+	switch {
+	case l.Address == "":
+		errs = append(errs, errors.New("address must not be empty"))
+	case strings.HasPrefix(l.Address, unixPrefix):
+		if strings.TrimPrefix(l.Address, unixPrefix) == "" {
+			errs = append(errs, errors.New("unix socket path must not be empty"))
+		}
+	case strings.HasPrefix(l.Address, systemdPrefix):
+		if strings.TrimPrefix(l.Address, systemdPrefix) == "" {
+			errs = append(errs, errors.New("systemd socket name must not be empty"))
+		}
+	}
+
+	switch l.Routes {
+	case "", routesAll, routesAPI, routesHealth, routesStatus:
+	default:
+		errs = append(errs, fmt.Errorf("unknown route set %q", l.Routes))
+	}
+
+	if l.Mode != "" || l.Owner != "" {
+		if !strings.HasPrefix(l.Address, unixPrefix) {
+			errs = append(errs, errors.New("Mode and Owner can only be set for unix sockets"))
+		}
+		if _, err := l.fileMode(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fileMode returns the permissions to give a Unix socket, or zero if they
+// aren't set.
+func (l *listenerConfig) fileMode() (fs.FileMode, error) {
+	if l.Mode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(l.Mode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid mode %q: must be octal permissions such as \"0660\"", l.Mode)
+	}
+	return fs.FileMode(mode), nil
+}
+
+// routeSet returns the set of routes that the listener serves.
+func (l *listenerConfig) routeSet() routeSet {
+	if l.Routes == "" {
+		return routesAll
+	}
+	return l.Routes
+}
+
+// listen binds the listener's address. Sockets passed by systemd are taken
+// from activated, and can only be used once.
+func (l *listenerConfig) listen(activated map[string]net.Listener) (net.Listener, error) {
+	if name, ok := strings.CutPrefix(l.Address, systemdPrefix); ok {
+		ln, ok := activated[name]
+		if !ok {
+			return nil, fmt.Errorf("no socket named %q was passed by systemd, or it was already used", name)
+		}
+		delete(activated, name)
+		return ln, nil
+	}
+
+	path, ok := strings.CutPrefix(l.Address, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", l.Address)
+	}
+
+	removeStaleSocket(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.setSocketOwner(path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes a Unix socket left behind at path by a process
+// that exited without cleaning up, so that it can be listened on again. A
+// socket that's still being listened on is left alone.
+func removeStaleSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode().Type() != fs.ModeSocket {
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
+
+// setSocketOwner applies the configured mode and owner to the Unix socket at
+// path.
+func (l *listenerConfig) setSocketOwner(path string) error {
+	if mode, err := l.fileMode(); err != nil {
+		return err
+	} else if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if l.Owner == "" {
+		return nil
+	}
+	uid, gid, err := lookupOwner(l.Owner)
+	if err != nil {
+		return err
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// lookupOwner returns the IDs for a "user[:group]" string, where both user
+// and group may be names or numeric IDs. An empty user or group is returned
+// as -1, which leaves it unchanged in [os.Chown].
+func lookupOwner(spec string) (uid, gid int, err error) {
+	userName, groupName, _ := strings.Cut(spec, ":")
+
+	uid, gid = -1, -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			u, err = user.LookupId(userName)
+		}
+		id := userName
+		if err == nil {
+			id = u.Uid
+		}
+		if uid, err = strconv.Atoi(id); err != nil {
+			return 0, 0, fmt.Errorf("looking up user %q: no such user", userName)
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			g, err = user.LookupGroupId(groupName)
+		}
+		id := groupName
+		if err == nil {
+			id = g.Gid
+		}
+		if gid, err = strconv.Atoi(id); err != nil {
+			return 0, 0, fmt.Errorf("looking up group %q: no such group", groupName)
+		}
+	}
+	return uid, gid, nil
+}
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFDsStart = 3
+
+// parseListenFDs returns the file descriptors passed to the process with the
+// given PID by systemd socket activation, keyed by their names, from the
+// LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES environment variables as looked up
+// by getenv. See sd_listen_fds(3).
+func parseListenFDs(pid int, getenv func(string) string) (map[string]int, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", getenv("LISTEN_FDS"))
+	}
+
+	var names []string
+	if s := getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+	}
+	fds := make(map[string]int, n)
+	for i := range n {
+		// systemd names sockets "unknown" if it isn't told otherwise.
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		if _, ok := fds[name]; ok {
+			return nil, fmt.Errorf("more than one socket named %q; set FileDescriptorName= to tell them apart", name)
+		}
+		fds[name] = listenFDsStart + i
+	}
+	return fds, nil
+}
+
+// activatedListeners returns the sockets passed to upchek by systemd socket
+// activation, keyed by their names. It removes the environment variables
+// describing them, so that they aren't passed on to checks, and so must
+// only be called once.
+func activatedListeners() (map[string]net.Listener, error) {
+	fds, err := parseListenFDs(os.Getpid(), os.Getenv)
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil {
+		return nil, err
+	}
+
+	lns := make(map[string]net.Listener, len(fds))
+	for name, fd := range fds {
+		// FileListener duplicates the descriptor with close-on-exec
+		// set; the original, which systemd passed without it, is
+		// closed so that checks don't inherit it.
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %q: %w", name, err)
+		}
+		lns[name] = ln
+	}
+	return lns, nil
+}
+
+// switchHandler is an [http.Handler] that can be changed while serving, so
+// that a listener's routes can change without rebinding it.
+type switchHandler struct {
+	h atomic.Pointer[http.Handler]
+}
+
+func newSwitchHandler(h http.Handler) *switchHandler {
+	sh := new(switchHandler)
+	sh.set(h)
+	return sh
+}
+
+func (sh *switchHandler) set(h http.Handler) {
+	sh.h.Store(&h)
+}
+
+func (sh *switchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*sh.h.Load()).ServeHTTP(w, r)
+}
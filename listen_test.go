@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestParseListenFDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    map[string]int
+		wantErr bool
+	}{
+		{
+			name: "not_activated",
+			env:  map[string]string{},
+		},
+		{
+			name: "other_process",
+			env:  map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"},
+		},
+		{
+			name: "named",
+			env:  map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "web:health"},
+			want: map[string]int{"web": 3, "health": 4},
+		},
+		{
+			name: "unnamed",
+			env:  map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "1"},
+			want: map[string]int{"unknown": 3},
+		},
+		{
+			name:    "duplicate_names",
+			env:     map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "2"},
+			wantErr: true,
+		},
+		{
+			name:    "bad_count",
+			env:     map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "many"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseListenFDs(42, func(k string) string { return tt.env[k] })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseListenFDs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("parseListenFDs() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	_ "embed"
 	"errors"
@@ -10,12 +11,14 @@ import (
 	"html/template"
 	"io"
 	"log/slog"
-	"net"
+	"maps"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"slices"
 	"sync"
 	"syscall"
 	"time"
@@ -29,17 +32,68 @@ import (
 	"github.com/andrew-d/upchek/internal/buildtags"
 	"github.com/andrew-d/upchek/internal/lazy"
 	"github.com/andrew-d/upchek/internal/runner"
-	"github.com/andrew-d/upchek/internal/suturehttp"
 	"github.com/andrew-d/upchek/internal/ulog"
 )
 
 var (
+	flagConfig  = pflag.StringP("config", "c", "", "path to a JSON configuration file; reloaded on SIGHUP")
 	flagVerbose = pflag.BoolP("verbose", "v", false, "verbose output")
-	flagListen  = pflag.StringP("listen", "l", ":8080", "address to listen on")
-	flagDir     = pflag.StringP("directory", "d", defaultDir(), "directory for healthcheck scripts")
+	flagListen  = pflag.StringArrayP("listen", "l", []string{":8080"}, "address to listen on: host:port, unix:path or systemd:name")
+	flagDir     = pflag.StringArrayP("directory", "d", []string{defaultDir()}, "directory for healthcheck scripts, optionally as namespace=path")
 	flagRemote  = pflag.StringArray("remote", nil, "list of other upchek instances to aggregate results from")
+	flagState   = pflag.String("state-dir", defaultStateDir(), "directory for persistent state such as silences")
+	flagTimeout = pflag.Duration("timeout", 0, "how long a check may run before it is killed (0 for no timeout)")
+	flagUser    = pflag.String("user", "", "user[:group] to run checks as (default: the user running upchek)")
+	flagSecrets = pflag.String("secrets-dir", os.Getenv("CREDENTIALS_DIRECTORY"), "directory containing secrets for checks, one per file")
+	flagTmplDir = pflag.String("template-dir", "", "directory of templates that replace the built-in web pages, and of static assets in its static subdirectory")
+
+	flagFailAfter     = pflag.Int("fail-after", 1, "number of consecutive failed runs before a check is considered failing")
+	flagRecoverAfter  = pflag.Int("recover-after", 1, "number of consecutive successful runs before a failing check is considered ok")
+	flagRetryInterval = pflag.Duration("retry-interval", 5*time.Second, "how often to re-run a check that is in a soft state")
+	flagFlapWindow    = pflag.Duration("flap-window", 10*time.Minute, "window over which state changes are counted for flap detection")
+	flagFlapThreshold = pflag.Int("flap-threshold", 5, "number of state changes within the flap window at which a check is flapping (0 to disable)")
+
+	flagShutdownGrace   = pflag.Duration("shutdown-grace-period", 10*time.Second, "how long running checks have to exit after SIGTERM when upchek stops, before they're killed")
+	flagShutdownTimeout = pflag.Duration("shutdown-timeout", 5*time.Second, "how long pending notifications and in-flight HTTP requests have to finish when upchek stops")
 )
 
+// configFromFlags returns the base configuration built from command-line
+// flags.
+func configFromFlags() config {
+	cfg := config{
+		StateDir:    *flagState,
+		SecretsDir:  *flagSecrets,
+		TemplateDir: *flagTmplDir,
+		Defaults: defaultsConfig{
+			Interval:           duration(30 * time.Second),
+			Timeout:            duration(*flagTimeout),
+			RemoteInterval:     duration(30 * time.Second),
+			RemoteTimeout:      duration(10 * time.Second),
+			RemoteMaxClockSkew: duration(30 * time.Second),
+			FailAfter:          *flagFailAfter,
+			RecoverAfter:       *flagRecoverAfter,
+			RetryInterval:      duration(*flagRetryInterval),
+			FlapWindow:         duration(*flagFlapWindow),
+			FlapThreshold:      *flagFlapThreshold,
+			User:               *flagUser,
+		},
+		Shutdown: shutdownConfig{
+			GracePeriod: duration(*flagShutdownGrace),
+			Timeout:     duration(*flagShutdownTimeout),
+		},
+	}
+	for _, dir := range *flagDir {
+		cfg.Directories = append(cfg.Directories, parseDirectoryFlag(dir))
+	}
+	for _, addr := range *flagListen {
+		cfg.Listeners = append(cfg.Listeners, listenerConfig{Address: addr})
+	}
+	for _, addr := range *flagRemote {
+		cfg.Remotes = append(cfg.Remotes, remoteConfig{Address: addr})
+	}
+	return cfg
+}
+
 func defaultDir() string {
 	if buildtags.IsDev {
 		// Run from the project root in dev mode, if it exists.
@@ -75,13 +129,44 @@ func defaultDir() string {
 	return filepath.Join(homedir, ".upchek", "scripts")
 }
 
+func defaultStateDir() string {
+	if buildtags.IsDev {
+		return filepath.Join(os.TempDir(), "upchek-dev")
+	}
+	if os.Geteuid() == 0 {
+		return "/var/lib/upchek"
+	}
+
+	homedir, _ := os.UserHomeDir()
+	if homedir == "" {
+		homedir = "/unknown-home"
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return filepath.Join(homedir, "Library", "Application Support", "upchek", "state")
+	case "linux":
+		return filepath.Join(homedir, ".local", "state", "upchek")
+	}
+	return filepath.Join(homedir, ".upchek", "state")
+}
+
 // Templates
 var (
 	//go:embed index.html.tmpl
 	embeddedIndex []byte
+
+	//go:embed check.html.tmpl
+	embeddedCheck []byte
+
+	//go:embed status.html.tmpl
+	embeddedStatus []byte
 )
 
 func main() {
+	// This must come first, since it may replace the process with a
+	// script; see runner.Init.
+	runner.Init()
+
 	pflag.Parse()
 
 	// We're using slog for logging.
@@ -93,63 +178,146 @@ func main() {
 		logger = logger.With(slog.Bool("dev", true))
 	}
 
-	// Listen on provided address.
-	ln, err := net.Listen("tcp", *flagListen)
+	// Load our configuration; command-line flags provide the defaults
+	// for anything not set in the configuration file.
+	baseConfig := configFromFlags()
+	cfg := baseConfig
+	if *flagConfig != "" {
+		var err error
+		cfg, err = loadConfig(*flagConfig, baseConfig)
+		if err != nil {
+			ulog.Fatal(logger, "failed to load configuration", ulog.Error(err))
+		}
+	} else if err := cfg.validate(); err != nil {
+		ulog.Fatal(logger, "invalid configuration", ulog.Error(err))
+	}
+
+	// Take any sockets passed by systemd before anything else can
+	// inherit them.
+	activated, err := activatedListeners()
 	if err != nil {
-		logger.Error("failed to listen", ulog.Error(err))
-		os.Exit(1)
+		ulog.Fatal(logger, "failed to use sockets passed by systemd", ulog.Error(err))
+	}
+
+	instance, err := newInstanceInfo(cfg.StateDir)
+	if err != nil {
+		logger.Warn("failed to save instance ID; using a new one for this run", ulog.Error(err))
 	}
-	defer ln.Close()
 
+	silences, err := loadSilences(filepath.Join(cfg.StateDir, "silences.json"))
+	if err != nil {
+		ulog.Fatal(logger, "failed to load silences", ulog.Error(err))
+	}
+	history, err := loadHistory(filepath.Join(cfg.StateDir, "history.json"))
+	if err != nil {
+		ulog.Fatal(logger, "failed to load history", ulog.Error(err))
+	}
+	incidents, err := loadIncidents(filepath.Join(cfg.StateDir, "incidents.json"))
+	if err != nil {
+		ulog.Fatal(logger, "failed to load incidents", ulog.Error(err))
+	}
+
+	// Allow listeners long enough to finish in-flight requests when
+	// the tree is stopped.
 	supervisor := suture.New("upchek", suture.Spec{
 		EventHook: (&sutureslog.Handler{Logger: logger}).MustHook(),
+		Timeout:   removeTimeout + cfg.Shutdown.timeout(),
 	})
 
+	// Remotes get their own subtree, so that a misbehaving remote
+	// fetcher can't exhaust the top-level supervisor's failure budget.
+	remoteSupervisor := newRemoteSupervisor(logger)
+	supervisor.Add(remoteSupervisor)
+
+	// Set up the notification service
+	notifier := newNotifyService(logger.With(ulog.Component("notify")))
+	notifierToken := supervisor.Add(notifier)
+
+	// Set up the service that pushes results to central instances
+	pusher := newPushService(logger.With(ulog.Component("push")))
+	pusherToken := supervisor.Add(pusher)
+
 	// Set up healthcheck service
 	service := &service{
-		dir:           *flagDir,
-		logger:        logger.With(ulog.Component("runner")),
-		indexTemplate: registerTemplate(logger, "index.html.tmpl", embeddedIndex),
-		remoteAddrs:   *flagRemote,
-	}
-	supervisor.Add(service)
-
-	// If we have remote addresses to proxy from, set up a suture service
-	// for each of them.
-	//
-	// TODO: should this be in a separate supervisor with more specific
-	// timeouts?
-	for _, addr := range service.remoteAddrs {
-		supervisor.Add(&fetchRemoteResultService{
-			parent:   service,
-			addr:     addr,
-			interval: 30 * time.Second,
-			logger:   logger.With(ulog.Component("remote"), slog.String("addr", addr)),
-		})
+		logger:    logger.With(ulog.Component("runner")),
+		silences:  silences,
+		history:   history,
+		incidents: incidents,
+		notifier:  notifier,
+		pusher:    pusher,
+		instance:  instance,
+		wake:      make(chan struct{}, 1),
+	}
+	service.indexTemplate = registerTemplate(logger, service.customTemplateDir, "index.html.tmpl", embeddedIndex)
+	service.checkTemplate = registerTemplate(logger, service.customTemplateDir, "check.html.tmpl", embeddedCheck)
+	service.statusTemplate = registerTemplate(logger, service.customTemplateDir, "status.html.tmpl", embeddedStatus)
+	serviceToken := supervisor.Add(service)
+
+	// Tell systemd when we're ready, and ping its watchdog, if it
+	// started us with Type=notify.
+	sdNotifier, err := newSDNotifier(logger.With(ulog.Component("systemd")), service)
+	if err != nil {
+		ulog.Fatal(logger, "failed to set up systemd notifications", ulog.Error(err))
+	}
+	var sdNotifierToken *suture.ServiceToken
+	if sdNotifier != nil {
+		token := supervisor.Add(sdNotifier)
+		sdNotifierToken = &token
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("GET /{$}", service.handleIndex)
-	mux.HandleFunc("GET /api/v1/results", service.handleResultsAPI)
-	mux.HandleFunc("GET /healthz", service.handleHealthz)
-	mux.Handle("/debug/vars", expvar.Handler())
+	app := &app{
+		logger:           logger,
+		configPath:       *flagConfig,
+		baseConfig:       baseConfig,
+		supervisor:       supervisor,
+		remoteSupervisor: remoteSupervisor,
+		service:          service,
+		notifier:         notifier,
+		pusher:           pusher,
+		serviceToken:     serviceToken,
+		notifierToken:    notifierToken,
+		pusherToken:      pusherToken,
+		sdNotifierToken:  sdNotifierToken,
+		activated:        activated,
+	}
 
-	// Add the listener service
-	server := suturehttp.New(ln, mux)
-	server.Logger = logger.With(ulog.Component("http"))
-	supervisor.Add(server)
+	// Add listeners and remotes as per our configuration.
+	if err := app.apply(cfg); err != nil {
+		ulog.Fatal(logger, "failed to apply configuration", ulog.Error(err))
+	}
 
 	// Publish metrics from our service to expvar; only call once at the
 	// top level to avoid duplicate metric panics.
 	service.PublishMetrics()
 
 	// Now that we've set up our supervision tree, we can start it.
-	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	sigctx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Reload the configuration on SIGHUP.
+	hupc := make(chan os.Signal, 1)
+	signal.Notify(hupc, syscall.SIGHUP)
+	go func() {
+		for range hupc {
+			if err := app.reload(); err != nil {
+				logger.Error("failed to reload configuration; keeping previous configuration", ulog.Error(err))
+			}
+		}
+	}()
+
 	errc := supervisor.ServeBackground(ctx)
-	logger.Info("supervisor started", slog.String("addr", ln.Addr().String()))
-	err = <-errc
+	logger.Info("supervisor started")
+	select {
+	case err = <-errc:
+	case <-sigctx.Done():
+		// A second signal stops us straight away.
+		stopSignals()
+		app.shutdown()
+		cancel()
+		err = <-errc
+	}
 	if err != nil && !errors.Is(err, context.Canceled) {
 		logger.Error("supervisor exited with error", ulog.Error(err))
 		os.Exit(1)
@@ -158,29 +326,184 @@ func main() {
 	logger.Info("supervisor exited cleanly")
 }
 
+// routes returns the handler for a set of upchek's HTTP endpoints, which are
+// described in openapi.json. Each set includes those below it, apart from
+// routesStatus, all of whose endpoints are included in routesAll.
+func (a *app) routes(set routeSet) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", a.service.handleHealthz)
+	if set == routesHealth {
+		return mux
+	}
+
+	// The status page is public, so never requires a token.
+	mux.HandleFunc("GET /api/v1/status", a.service.handleStatusAPI)
+	if set == routesStatus {
+		mux.HandleFunc("GET /status", a.service.handleStatusPage)
+		mux.Handle("GET /static/{path...}", staticHandler(a.service.customTemplateDir))
+		return mux
+	}
+
+	mux.HandleFunc("GET /api/openapi.json", handleOpenAPI)
+	mux.HandleFunc("GET /api/v1/results", a.service.requireRole(roleRead, a.service.handleResultsAPI))
+	mux.HandleFunc("GET /api/v2/instance", a.service.requireRole(roleRead, a.service.handleInstanceAPI))
+	mux.HandleFunc("GET /api/v2/results", a.service.requireRole(roleRead, a.service.handleResultsAPIv2))
+	mux.HandleFunc("GET /api/v1/silences", a.service.requireRole(roleRead, a.service.handleListSilences))
+	mux.HandleFunc("POST /api/v1/silences", a.service.requireRole(roleAdmin, a.service.handleCreateSilence))
+	mux.HandleFunc("DELETE /api/v1/silences/{id}", a.service.requireRole(roleAdmin, a.service.handleExpireSilence))
+	mux.HandleFunc("GET /api/v1/availability", a.service.requireRole(roleRead, a.service.handleAvailability))
+	mux.HandleFunc("GET /api/v1/availability/{month}", a.service.requireRole(roleRead, a.service.handleAvailabilityReport))
+	mux.HandleFunc("GET /api/v1/incidents", a.service.requireRole(roleRead, a.service.handleListIncidents))
+	mux.HandleFunc("POST /api/v1/incidents", a.service.requireRole(roleAdmin, a.service.handleCreateIncident))
+	mux.HandleFunc("POST /api/v1/incidents/{id}/updates", a.service.requireRole(roleAdmin, a.service.handleUpdateIncident))
+	mux.HandleFunc("DELETE /api/v1/incidents/{id}", a.service.requireRole(roleAdmin, a.service.handleDeleteIncident))
+	mux.HandleFunc("POST /api/v1/push", a.service.requireRole(rolePush, a.service.handlePush))
+	mux.HandleFunc("POST /api/v1/admin/reload", a.service.requireRole(roleAdmin, a.handleReload))
+	if set == routesAPI {
+		return mux
+	}
+
+	mux.HandleFunc("GET /{$}", a.service.requireRole(roleRead, a.service.handleIndex))
+	mux.HandleFunc("GET /check/{name}", a.service.requireRole(roleRead, a.service.handleCheck))
+	mux.HandleFunc("GET /status", a.service.handleStatusPage)
+	mux.HandleFunc("GET /badge/instance.svg", a.service.requireRole(roleRead, a.service.handleBadge))
+	mux.HandleFunc("GET /badge/group/{group}", a.service.requireRole(roleRead, a.service.handleBadge))
+	mux.HandleFunc("GET /badge/{check}", a.service.requireRole(roleRead, a.service.handleBadge))
+	mux.Handle("GET /static/{path...}", staticHandler(a.service.customTemplateDir))
+	mux.Handle("/debug/vars", a.service.requireRole(roleRead, expvar.Handler().ServeHTTP))
+	return mux
+}
+
 type service struct {
 	logger *slog.Logger
-	dir    string
+
+	// checks holds per-script scheduling and state, keyed by script name.
+	// It is only accessed from the Serve goroutine.
+	checks map[string]*check
+
+	// alerting holds whether each check was alerting as of the last pass,
+	// for notifications. It is only accessed from the Serve goroutine.
+	alerting map[string]bool
+
+	// lastAvailability is when the availability metrics were last
+	// updated. It is only accessed from the Serve goroutine.
+	lastAvailability time.Time
+
+	// notifier is sent notifications when checks start or stop alerting;
+	// it may be nil.
+	notifier *notifyService
+
+	// pusher is sent the results of each pass, to push to central
+	// instances; it may be nil.
+	pusher *pushService
+
+	// instance identifies this instance in the v2 API.
+	instance instanceInfo
+
+	// wake is used to trigger a pass over the scripts before the next
+	// one is due, e.g. after a configuration change.
+	wake chan struct{}
+
+	// progress tracks whether the Serve goroutine is making progress,
+	// for the systemd watchdog.
+	progress progress
+
+	// statusPageCache holds the data for the public status page.
+	statusPageCache statusPageCache
 
 	// templates
-	indexTemplate func() *template.Template
+	indexTemplate  func() *template.Template
+	checkTemplate  func() *template.Template
+	statusTemplate func() *template.Template
 
 	// metrics
 	metricOnce              sync.Once
 	metricScriptLatency     *floatMap
 	metricScriptSuccess     *boolMap // map[string]bool
+	metricScriptState       *boolMap // confirmed state; map[string]bool
+	metricScriptFlapping    *boolMap // map[string]bool
 	metricLastRun           *expvar.Int
+	metricDirectoryErrors   *floatMap // failed reads of a script directory, by path
 	metricRemoteLatency     *floatMap
-	metricRemoteFetchStatus *boolMap // whether we can fetch from a remote
-	metricRemoteStatus      *boolMap // aggregate across all results of a remote
-
-	// remote instances
-	remoteAddrs []string
+	metricRemoteFetchStatus *boolMap  // whether we can fetch from a remote
+	metricRemoteStatus      *boolMap  // aggregate across all results of a remote
+	metricRemoteStale       *boolMap  // whether a remote's results are stale
+	metricRemoteClockSkew   *floatMap // estimated clock skew of a remote, in seconds
+	metricRemoteBytes       *floatMap // total bytes of responses fetched from a remote
+
+	// availability metrics, keyed by check or group; the availability
+	// and burn rate maps are keyed by the name of each rolling window
+	metricCheckAvailability map[string]*floatMap // ratio of time up
+	metricCheckBurnRate     map[string]*floatMap
+	metricCheckBudget       *floatMap // ratio of the SLO's error budget remaining
+	metricGroupAvailability map[string]*floatMap
+	metricGroupBurnRate     map[string]*floatMap
+	metricGroupBudget       *floatMap
+
+	// silences holds the silences that are applied to results when
+	// they're read; it may be nil.
+	silences *silenceStore
+
+	// history records the status of local checks over time, for the
+	// status page and availability reports; it may be nil.
+	history *historyStore
+
+	// incidents holds the incidents shown on the status page.
+	incidents *incidentStore
+
+	mu sync.RWMutex // protects following
+
+	// configuration
+	dirs            []directoryConfig
+	checkDefaults   checkConfig // for checks that don't override it with directives
+	runSettings     runSettings
+	templateDir     string
+	statusPage      statusPageConfig
+	slos            []sloConfig
+	auth            authState
+	pushPolicy      remotePolicy // for pushed sources, apart from StaleAfter
+	pushExpireAfter time.Duration
+	remoteAddrs     []string
+	remoteLabels    map[string]map[string]string // map[addr]labels
 
-	mu            sync.RWMutex // protects following
 	results       []serviceResult
 	remoteResults map[string][]serviceResult // map[addr][]serviceResult
 	remoteErrors  map[string]error           // map[addr]error
+	remoteStates  map[string]remoteState     // map[addr]remoteState
+	pushed        map[string]*pushedSource   // map[source]*pushedSource
+
+	// resultsVersion identifies the local results as served by the
+	// results API; see [service.localVersion].
+	resultsVersion resultsVersion
+}
+
+// check holds the scheduling and state information for a single script.
+type check struct {
+	// path is the full path to the script.
+	path string
+
+	// namespace is the namespace of the directory containing the script.
+	namespace string
+
+	// cfg is the configuration for the check, as of the last time the
+	// directory was scanned.
+	cfg checkConfig
+
+	// nextRun is the earliest time at which the check should next run.
+	nextRun time.Time
+
+	// state tracks the confirmed state of the check across runs.
+	state stateTracker
+
+	// result is the most recent result of the check, or nil if it has
+	// not yet run.
+	result *serviceResult
+
+	// subs are the sub-results reported by the check's script, keyed by
+	// their unqualified name, and subNames is the order in which they are
+	// shown; see [check.updateSubResults].
+	subs     map[string]*subCheck
+	subNames []string
 }
 
 func (s *service) Serve(ctx context.Context) error {
@@ -189,39 +512,160 @@ func (s *service) Serve(ctx context.Context) error {
 	}
 	s.initMetrics()
 
-	s.logger.Info("runner started", slog.String("dir", s.dir))
+	s.logger.Info("runner started")
 	defer s.logger.Info("runner stopped")
 
 	// Run scripts immediately on startup.
+	s.progress.expect(progressSlack)
 	if err := s.runScripts(ctx); err != nil {
 		return fmt.Errorf("initial run: %w", err)
 	}
+	s.progress.markReady()
 
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+	wait := s.nextWakeup(time.Now())
+	s.progress.expect(wait + progressSlack)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 
-		case <-ticker.C:
-			if err := s.runScripts(ctx); err != nil {
-				s.logger.Error("failed to run scripts", ulog.Error(err))
-			}
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
 		}
+
+		if err := s.runScripts(ctx); err != nil {
+			s.logger.Error("failed to run scripts", ulog.Error(err))
+		}
+		s.expirePushed(time.Now())
+		wait := s.nextWakeup(time.Now())
+		s.progress.expect(wait + progressSlack)
+		timer.Reset(wait)
 	}
-	return nil
+}
+
+// setConfig updates the service's configuration, and triggers a pass over
+// the scripts.
+func (s *service) setConfig(cfg config, auth authState) {
+	s.mu.Lock()
+	s.dirs = cfg.Directories
+	s.runSettings = runSettings{
+		cgroupParent: cfg.CgroupParent,
+		stateDir:     cfg.StateDir,
+		secretsDir:   cfg.SecretsDir,
+		gracePeriod:  time.Duration(cfg.Shutdown.GracePeriod),
+	}
+	s.checkDefaults = cfg.Defaults.checkConfig()
+	s.templateDir = cfg.TemplateDir
+	s.statusPage = cfg.StatusPage
+	s.slos = cfg.SLOs
+	s.auth = auth
+	s.pushPolicy = remotePolicy{
+		OnStale:      cmp.Or(cfg.Defaults.RemoteOnStale, staleActionFail),
+		MaxClockSkew: time.Duration(cfg.Defaults.RemoteMaxClockSkew),
+	}
+	s.pushExpireAfter = time.Duration(cfg.Defaults.PushExpireAfter)
+	s.mu.Unlock()
+	s.invalidateStatusPage()
+
+	// Wake the Serve goroutine without blocking; if a wakeup is already
+	// pending, that's good enough.
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// setRemotes updates the list of remotes, discarding results and errors from
+// any remotes that are no longer present.
+func (s *service) setRemotes(remotes []remoteConfig) {
+	addrs := make([]string, 0, len(remotes))
+	labels := make(map[string]map[string]string)
+	for _, r := range remotes {
+		addrs = append(addrs, r.Address)
+		if len(r.Labels) > 0 {
+			labels[r.Address] = r.Labels
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Pushed sources aren't configured, so are kept as-is.
+	keep := func(addr string) bool {
+		return slices.Contains(addrs, addr) || s.pushed[addr] != nil
+	}
+	for source := range s.pushed {
+		if l, ok := s.remoteLabels[source]; ok {
+			labels[source] = l
+		}
+	}
+	s.remoteAddrs = addrs
+	s.remoteLabels = labels
+	for addr := range s.remoteResults {
+		if !keep(addr) {
+			delete(s.remoteResults, addr)
+		}
+	}
+	for addr := range s.remoteErrors {
+		if !keep(addr) {
+			delete(s.remoteErrors, addr)
+		}
+	}
+	for addr := range s.remoteStates {
+		if !keep(addr) {
+			delete(s.remoteStates, addr)
+		}
+	}
+}
+
+// nextWakeup returns how long to wait before the next check is due to run.
+//
+// It is never longer than the default check interval, so that new scripts
+// are picked up in a timely manner.
+func (s *service) nextWakeup(now time.Time) time.Duration {
+	s.mu.RLock()
+	wait := s.checkDefaults.Interval
+	s.mu.RUnlock()
+	if wait <= 0 {
+		wait = time.Minute
+	}
+
+	for _, c := range s.checks {
+		wait = min(wait, c.nextRun.Sub(now))
+	}
+	return max(wait, 0)
 }
 
 func (s *service) initMetrics() {
 	s.metricOnce.Do(func() {
 		s.metricScriptLatency = newFloatMap()
 		s.metricScriptSuccess = newBoolMap()
+		s.metricScriptState = newBoolMap()
+		s.metricScriptFlapping = newBoolMap()
 		s.metricLastRun = new(expvar.Int)
+		s.metricDirectoryErrors = newFloatMap()
 		s.metricRemoteLatency = newFloatMap()
 		s.metricRemoteFetchStatus = newBoolMap()
 		s.metricRemoteStatus = newBoolMap()
+		s.metricRemoteStale = newBoolMap()
+		s.metricRemoteClockSkew = newFloatMap()
+		s.metricRemoteBytes = newFloatMap()
+		s.metricCheckAvailability = make(map[string]*floatMap)
+		s.metricCheckBurnRate = make(map[string]*floatMap)
+		s.metricCheckBudget = newFloatMap()
+		s.metricGroupAvailability = make(map[string]*floatMap)
+		s.metricGroupBurnRate = make(map[string]*floatMap)
+		s.metricGroupBudget = newFloatMap()
+		for _, w := range rollingWindows {
+			s.metricCheckAvailability[w.name] = newFloatMap()
+			s.metricCheckBurnRate[w.name] = newFloatMap()
+			s.metricGroupAvailability[w.name] = newFloatMap()
+			s.metricGroupBurnRate[w.name] = newFloatMap()
+		}
 	})
 }
 
@@ -231,49 +675,281 @@ func (s *service) PublishMetrics() {
 	const metricsPrefix = "upchek_"
 	expvar.Publish(metricsPrefix+"script_latency", s.metricScriptLatency)
 	expvar.Publish(metricsPrefix+"script_last_status", s.metricScriptSuccess)
+	expvar.Publish(metricsPrefix+"script_state", s.metricScriptState)
+	expvar.Publish(metricsPrefix+"script_flapping", s.metricScriptFlapping)
 	expvar.Publish(metricsPrefix+"last_run", s.metricLastRun)
+	expvar.Publish(metricsPrefix+"directory_errors", s.metricDirectoryErrors)
 	expvar.Publish(metricsPrefix+"remote_latency", s.metricRemoteLatency)
 	expvar.Publish(metricsPrefix+"remote_fetch_status", s.metricRemoteFetchStatus)
 	expvar.Publish(metricsPrefix+"remote_status", s.metricRemoteStatus)
+	expvar.Publish(metricsPrefix+"remote_stale", s.metricRemoteStale)
+	expvar.Publish(metricsPrefix+"remote_clock_skew", s.metricRemoteClockSkew)
+	expvar.Publish(metricsPrefix+"remote_bytes", s.metricRemoteBytes)
+	for _, w := range rollingWindows {
+		expvar.Publish(metricsPrefix+"check_availability_"+w.name, s.metricCheckAvailability[w.name])
+		expvar.Publish(metricsPrefix+"check_burn_rate_"+w.name, s.metricCheckBurnRate[w.name])
+		expvar.Publish(metricsPrefix+"group_availability_"+w.name, s.metricGroupAvailability[w.name])
+		expvar.Publish(metricsPrefix+"group_burn_rate_"+w.name, s.metricGroupBurnRate[w.name])
+	}
+	expvar.Publish(metricsPrefix+"check_error_budget_remaining", s.metricCheckBudget)
+	expvar.Publish(metricsPrefix+"group_error_budget_remaining", s.metricGroupBudget)
 }
 
+// runScripts runs every script in the configured directories that is due to
+// run, and updates the service's results.
+//
+// Checks are keyed by their qualified name; see [qualifiedName].
 func (s *service) runScripts(ctx context.Context) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.mu.RLock()
+	dirs := s.dirs
+	defaults := s.checkDefaults
+	rs := s.runSettings
+	s.mu.RUnlock()
 
-	// Start by listing all scripts in the directory.
-	dir, err := os.ReadDir(s.dir)
-	if err != nil {
-		return fmt.Errorf("reading directory: %w", err)
+	if s.checks == nil {
+		s.checks = make(map[string]*check)
 	}
 
-	s.results = s.results[:0]
-	for _, entry := range dir {
-		// Only run executable files.
-		fullPath := filepath.Join(s.dir, entry.Name())
-		if !isExecutable(fullPath) {
-			s.logger.Debug("skipping non-executable file", slog.String("name", entry.Name()))
+	// Collect all executable scripts along with their configuration.
+	var names []string
+	for _, d := range dirs {
+		// Start by listing all scripts in the directory. If it can't
+		// be read, keep the checks already known from it, rather than
+		// forgetting them and their state, and carry on with the other
+		// directories.
+		dir, err := os.ReadDir(d.Path)
+		if err != nil {
+			s.logger.Error("failed to read script directory",
+				slog.String("path", d.Path),
+				ulog.Error(err))
+			s.metricDirectoryErrors.Add(d.Path, 1)
+			for _, name := range slices.Sorted(maps.Keys(s.checks)) {
+				if filepath.Dir(s.checks[name].path) == filepath.Clean(d.Path) && !slices.Contains(names, name) {
+					names = append(names, name)
+				}
+			}
 			continue
 		}
+		dirDefaults := d.checkDefaults(defaults)
+
+		for _, entry := range dir {
+			// Only run executable files.
+			fullPath := filepath.Join(d.Path, entry.Name())
+			if !isExecutable(fullPath) {
+				s.logger.Debug("skipping non-executable file", slog.String("name", entry.Name()))
+				continue
+			}
+			name := qualifiedName(d.Namespace, entry.Name())
+			if slices.Contains(names, name) {
+				s.logger.Warn("skipping script with duplicate name",
+					slog.String("name", name),
+					slog.String("path", fullPath))
+				continue
+			}
+			names = append(names, name)
 
-		result, err := s.runScript(ctx, entry.Name(), fullPath)
-		if err != nil {
-			return fmt.Errorf("running script: %w", err)
+			c := s.checks[name]
+			if c == nil {
+				c = &check{}
+				s.checks[name] = c
+			}
+			c.path = fullPath
+			c.namespace = d.Namespace
+			c.cfg, err = parseDirectives(fullPath, dirDefaults)
+			if err != nil {
+				s.logger.Error("invalid directives in script; using defaults",
+					slog.String("name", name),
+					ulog.Error(err))
+			}
+			c.cfg.Depends = qualifyDependencies(d.Namespace, c.cfg.Depends)
+
+			// Otherwise, anyone who can write a script could choose to
+			// run it as root, or read secrets.
+			if ignored := privilegedDirectives(c.cfg, dirDefaults); len(ignored) > 0 && !isTrustedScript(fullPath) {
+				s.logger.Error("ignoring privileged directives in untrusted script",
+					slog.String("name", name),
+					slog.Any("directives", ignored))
+				c.cfg = dropPrivileged(c.cfg, dirDefaults)
+			}
+		}
+	}
+
+	// Forget about scripts that have been removed.
+	for name := range s.checks {
+		if !slices.Contains(names, name) {
+			delete(s.checks, name)
+		}
+	}
+
+	// Run scripts that are due, making sure that dependencies are run
+	// before the checks that depend on them so that suppression is
+	// evaluated against up-to-date results.
+	order, cycle := dependencyOrder(names, func(name string) []string {
+		return s.dependencyChecks(s.checks[name].cfg.Depends)
+	})
+	if len(cycle) > 0 {
+		s.logger.Warn("scripts have cyclic dependencies", slog.Any("names", cycle))
+	}
+	for _, name := range order {
+		c := s.checks[name]
+		failing := s.failingParents(c.cfg.Depends)
+
+		if !time.Now().Before(c.nextRun) {
+			if len(failing) > 0 && c.cfg.OnParentFailure == parentFailureSkip {
+				s.skipCheck(name, c, failing)
+			} else if err := s.runCheck(ctx, name, c, rs); err != nil {
+				return err
+			}
+		}
+
+		// Suppression is re-evaluated on every pass, even if the check
+		// didn't run, since a dependency may have changed state.
+		if c.result != nil {
+			c.result.DependsOn = c.cfg.Depends
+			c.result.Suppressed = len(failing) > 0
+			c.result.SuppressedBy = failing
+			c.result.Group = c.cfg.Group
+			c.result.Tags = c.cfg.Tags
+		}
+		// Sub-results share the dependencies of their check, but don't
+		// list them, so that they don't clutter the dependency tree.
+		for _, sc := range c.subs {
+			sc.result.Suppressed = len(failing) > 0
+			sc.result.SuppressedBy = failing
+			sc.result.Group = c.cfg.Group
+			sc.result.Tags = c.cfg.Tags
+		}
+	}
+
+	// Collect results in directory order.
+	var results []serviceResult
+	for _, name := range names {
+		if c := s.checks[name]; c.result != nil {
+			results = append(results, *c.result)
+			results = append(results, c.subResults()...)
+		}
+	}
+
+	s.mu.Lock()
+	if !reflect.DeepEqual(s.results, results) {
+		s.results = results
+		s.resultsVersion.changed(time.Now())
+	}
+	s.mu.Unlock()
+
+	s.notifyTransitions(results)
+	now := time.Now()
+	silenced := s.silences.apply(results, "", nil, now)
+	s.pusher.enqueue(silenced, now)
+	s.history.record(silenced, now)
+	if s.history.saveDue(now) {
+		if err := s.history.save(now); err != nil {
+			s.logger.Error("failed to persist history", ulog.Error(err))
 		}
-		s.results = append(s.results, result)
+	}
+	if now.Sub(s.lastAvailability) >= availabilityInterval {
+		s.lastAvailability = now
+		s.updateAvailabilityMetrics(now)
 	}
 
 	s.metricLastRun.Set(time.Now().Unix())
 	return nil
 }
 
-func (s *service) runScript(ctx context.Context, name, path string) (serviceResult, error) {
+// runCheck runs a single check and updates its state and result.
+//
+// If the script can't be run, the check fails with an error; runCheck only
+// returns an error if ctx is done.
+func (s *service) runCheck(ctx context.Context, name string, c *check, rs runSettings) error {
+	runCtx := ctx
+	if c.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, c.cfg.Timeout)
+		defer cancel()
+	}
+	// A script without a timeout may run for up to its interval before
+	// it counts as hung, so that one that never exits still stops the
+	// watchdog from being pinged.
+	s.progress.expect(cmp.Or(c.cfg.Timeout, c.cfg.Interval) + progressSlack)
+	defer s.progress.expect(progressSlack)
+
+	var result serviceResult
+	opts, err := c.runOptions(name, rs)
+	if err == nil {
+		result, err = s.runScript(runCtx, name, c.path, opts)
+	}
+	if ctx.Err() != nil {
+		// The script was stopped because we're shutting down, so its
+		// result says nothing about the check.
+		return fmt.Errorf("running script: %w", ctx.Err())
+	}
+	if err != nil {
+		s.logger.Error("failed to run script", slog.String("name", name), ulog.Error(err))
+		result = serviceResult{
+			Result:  &runner.Result{ExitCode: -1},
+			LastRun: time.Now(),
+			Error:   err.Error(),
+		}
+	}
+	result.Name = name
+	result.Namespace = c.namespace
+	result.TimedOut = !result.IsSuccess() && errors.Is(runCtx.Err(), context.DeadlineExceeded)
+
+	c.state.observeStatus(result.LastRun, result.runStatus(), c.cfg)
+	c.state.apply(&result)
+	c.result = &result
+
+	subs, err := c.cfg.OutputFormat.subResults(result.Result)
+	if err != nil {
+		s.logger.Warn("ignoring invalid sub-results from script", slog.String("name", name), ulog.Error(err))
+	}
+	c.updateSubResults(&result, subs)
+
+	if result.IsSoft() {
+		c.nextRun = result.LastRun.Add(c.cfg.RetryInterval)
+	} else {
+		c.nextRun = result.LastRun.Add(c.cfg.Interval)
+	}
+
+	s.metricScriptState.Set(name, result.IsHealthy())
+	s.metricScriptFlapping.Set(name, result.Flapping)
+	for _, sub := range c.subResults() {
+		s.metricScriptSuccess.Set(sub.Name, sub.IsSuccess())
+		s.metricScriptState.Set(sub.Name, sub.IsHealthy())
+		s.metricScriptFlapping.Set(sub.Name, sub.Flapping)
+	}
+	return nil
+}
+
+// skipCheck records that a check was not run because the provided
+// dependencies are failing. The check's previous result, if any, is kept.
+func (s *service) skipCheck(name string, c *check, failing []string) {
+	now := time.Now()
+	s.logger.Debug("skipping script with failing dependencies",
+		slog.String("name", name),
+		slog.Any("failing", failing))
+
+	if c.result == nil {
+		c.result = &serviceResult{
+			Result: &runner.Result{
+				Name:     name,
+				ExitCode: -1,
+				Stderr:   "not run: a dependency is failing\n",
+			},
+			LastRun:   now,
+			Namespace: c.namespace,
+		}
+	}
+	c.nextRun = now.Add(c.cfg.Interval)
+}
+
+func (s *service) runScript(ctx context.Context, name, path string, opts runner.Options) (serviceResult, error) {
 	t0 := time.Now()
-	result, err := runner.Run(ctx, path)
+	result, err := runner.Run(ctx, path, opts)
 
 	// Track metrics before we return.
 	s.metricScriptLatency.Set(name, float64(time.Since(t0).Seconds()))
-	s.metricScriptSuccess.Set(name, result.IsSuccess())
+	s.metricScriptSuccess.Set(name, err == nil && result.IsSuccess())
 
 	s.logger.Debug("ran script", slog.String("name", name), slog.Duration("duration", time.Since(t0)))
 
@@ -305,6 +981,44 @@ func (s *service) handleIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleCheck renders the detail page for a single local check.
+func (s *service) handleCheck(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	results := s.localResults()
+	i := slices.IndexFunc(results, func(r serviceResult) bool { return r.Name == name })
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := checkData{
+		serviceResult: results[i],
+		Availability:  s.checkAvailability(name, time.Now()),
+	}
+	for _, r := range results {
+		if r.Parent == name {
+			data.SubResults = append(data.SubResults, r)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := s.checkTemplate().Execute(w, data); err != nil {
+		s.logger.Error("failed to render check", slog.String("name", name), ulog.Error(err))
+	}
+}
+
+// checkData is the data for the detail page of a single check.
+type checkData struct {
+	serviceResult
+
+	// SubResults are the sub-results reported by the check's script.
+	SubResults []serviceResult
+
+	// Availability is the availability of the check over the rolling
+	// windows, or nil if it has no history.
+	Availability *availabilityReport
+}
+
 type indexData struct {
 	// Local results
 	Results []serviceResult
@@ -313,10 +1027,18 @@ type indexData struct {
 	RemoteAddrs   []string
 	RemoteResults map[string][]serviceResult
 	RemoteErrors  map[string]error
+	RemoteStates  map[string]remoteState
+	RemoteLabels  map[string]map[string]string
 
 	// Map of remote addresses to status
 	lazyRemoteStatus lazy.Value[map[string]bool]
 
+	// Silences that are active or pending
+	Silences []silenceJSON
+
+	// Tree of dependencies between local checks
+	lazyDependencyTree lazy.Value[[]*dependencyNode]
+
 	// Boolean status
 	lazyGlobalOk lazy.Value[bool] // all checks, local and remote
 	lazyLocalOk  lazy.Value[bool] // local checks only
@@ -332,7 +1054,7 @@ func (d *indexData) GlobalOk() bool {
 func (d *indexData) LocalOk() bool {
 	return d.lazyLocalOk.Get(func() bool {
 		for _, result := range d.Results {
-			if !result.IsSuccess() {
+			if result.IsAlerting() {
 				return false
 			}
 		}
@@ -351,55 +1073,113 @@ func (d *indexData) RemoteOk() bool {
 	})
 }
 
+// DependencyTree returns the tree of dependencies between local checks.
+func (d *indexData) DependencyTree() []*dependencyNode {
+	return d.lazyDependencyTree.Get(func() []*dependencyNode {
+		return dependencyTree(d.Results)
+	})
+}
+
+// GroupByNamespace groups the provided results by namespace, for display.
+func (d *indexData) GroupByNamespace(results []serviceResult) []namespaceGroup {
+	return groupByNamespace(results)
+}
+
+// GroupLocalByNamespace groups the local results by namespace, for display.
+func (d *indexData) GroupLocalByNamespace() []namespaceGroup {
+	groups := groupByNamespace(d.Results)
+	for i := range groups {
+		groups[i].Local = true
+	}
+	return groups
+}
+
 // RemoteStatus returns a map with one key per remote address, and a boolean
-// value indicating whether all checks from that remote are successful and the
-// remote could be scraped successfully..
+// value indicating whether the remote is healthy; see [remoteHealthy].
 func (d *indexData) RemoteStatus() map[string]bool {
 	return d.lazyRemoteStatus.Get(func() map[string]bool {
 		status := make(map[string]bool)
 		for _, addr := range d.RemoteAddrs {
-			status[addr] = true
-
-			for _, result := range d.RemoteResults[addr] {
-				if !result.IsSuccess() {
-					status[addr] = false
-					break
-				}
-			}
-			if err := d.RemoteErrors[addr]; err != nil {
-				status[addr] = false
-			}
+			status[addr] = remoteHealthy(d.RemoteStates[addr], d.RemoteResults[addr])
 		}
 		return status
 	})
 }
 
 func (s *service) getTemplateData() (data *indexData) {
+	now := time.Now()
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+
+	// Apply silences to all results as we read them, so that changes
+	// to silences take effect immediately.
+	remoteResults := make(map[string][]serviceResult, len(s.remoteResults))
+	for addr, results := range s.remoteResults {
+		remoteResults[addr] = s.silences.apply(results, addr, s.remoteLabels[addr], now)
+	}
+	remoteStates := make(map[string]remoteState, len(s.remoteStates))
+	for addr, st := range s.remoteStates {
+		st.Stale = st.isStale(now)
+		remoteStates[addr] = st
+	}
+
+	var silences []silenceJSON
+	if s.silences != nil {
+		for _, sl := range s.silences.list() {
+			if !sl.isExpired(now) {
+				silences = append(silences, silenceJSON{sl, sl.Status(now)})
+			}
+		}
+	}
+
 	return &indexData{
-		Results:       s.results,
-		RemoteAddrs:   s.remoteAddrs,
-		RemoteResults: s.remoteResults,
+		Results:       s.silences.apply(s.results, "", nil, now),
+		RemoteAddrs:   append(slices.Clip(s.remoteAddrs), s.pushedSources()...),
+		RemoteResults: remoteResults,
 		RemoteErrors:  s.remoteErrors,
+		RemoteStates:  remoteStates,
+		RemoteLabels:  s.remoteLabels,
+		Silences:      silences,
 	}
 }
 
-func (s *service) handleResultsAPI(w http.ResponseWriter, r *http.Request) {
+// localResults returns the current local results, with silences applied.
+func (s *service) localResults() []serviceResult {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	return s.silences.apply(s.results, "", nil, time.Now())
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	b, err := json.Marshal(s.results)
+func (s *service) handleResultsAPI(w http.ResponseWriter, r *http.Request) {
+	if s.checkNotModified(w, r) {
+		return
+	}
+	writeCompressedJSON(w, r, http.StatusOK, s.localResults())
+}
+
+// writeJSON writes v to w as JSON with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	b, err := marshalResponse(v)
 	if err != nil {
-		http.Error(w, "failed to marshal results", http.StatusInternalServerError)
+		http.Error(w, "failed to marshal response", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
 
+// marshalResponse marshals v as the JSON body of a response.
+func marshalResponse(v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
 	if buildtags.IsDev {
 		(*jsontext.Value)(&b).Indent() // indent for readability
 	}
-	w.Write(b)
+	return b, nil
 }
 
 func (s *service) handleHealthz(w http.ResponseWriter, r *http.Request) {
@@ -407,23 +1187,34 @@ func (s *service) handleHealthz(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "text/plain")
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
 	var (
 		ok   bool = true
 		body bytes.Buffer
 	)
-	for _, result := range s.results {
+	for _, result := range s.localResults() {
 		if isVerbose {
-			if result.IsSuccess() {
-				fmt.Fprintf(&body, "[+]%s ok\n", result.Name)
-			} else {
-				fmt.Fprintf(&body, "[-]%s failed\n", result.Name)
+			var suffix string
+			if result.IsSoft() {
+				suffix = " (soft)"
+			}
+			if result.Stale {
+				suffix += " (stale)"
+			}
+			switch {
+			case result.IsHealthy():
+				fmt.Fprintf(&body, "[+]%s ok%s\n", result.Name, suffix)
+			case result.Suppressed:
+				fmt.Fprintf(&body, "[~]%s suppressed%s\n", result.Name, suffix)
+			case result.Silenced:
+				fmt.Fprintf(&body, "[~]%s silenced%s\n", result.Name, suffix)
+			case result.IsError():
+				fmt.Fprintf(&body, "[-]%s error%s\n", result.Name, suffix)
+			default:
+				fmt.Fprintf(&body, "[-]%s failed%s\n", result.Name, suffix)
 			}
 		}
 
-		if !result.IsSuccess() {
+		if result.IsAlerting() {
 			ok = false
 		}
 	}
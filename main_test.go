@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/andrew-d/upchek/internal/runner"
+	"github.com/neilotoole/slogt"
 )
 
 func TestIndexData(t *testing.T) {
@@ -76,12 +84,31 @@ func TestIndexData(t *testing.T) {
 				t.Error("GlobalOk() should return false")
 			}
 		})
+		t.Run("Suppressed", func(t *testing.T) {
+			suppressed := errorResult
+			suppressed.Suppressed = true
+			data := indexData{
+				RemoteAddrs: []string{"localhost:0"},
+				RemoteResults: map[string][]serviceResult{
+					"localhost:0": {suppressed},
+				},
+			}
+			if !data.RemoteOk() {
+				t.Error("RemoteOk() should return true")
+			}
+			if !data.GlobalOk() {
+				t.Error("GlobalOk() should return true")
+			}
+		})
 		t.Run("Error", func(t *testing.T) {
 			data := indexData{
 				RemoteAddrs: []string{"localhost:0"},
 				RemoteErrors: map[string]error{
 					"localhost:0": fmt.Errorf("error"),
 				},
+				RemoteStates: map[string]remoteState{
+					"localhost:0": {LastAttempt: time.Now(), Stale: true},
+				},
 			}
 			if data.RemoteOk() {
 				t.Error("RemoteOk() should return false")
@@ -90,5 +117,161 @@ func TestIndexData(t *testing.T) {
 				t.Error("GlobalOk() should return false")
 			}
 		})
+		t.Run("ErrorWithFreshResults", func(t *testing.T) {
+			// The last good results are used until they're stale.
+			data := indexData{
+				RemoteAddrs: []string{"localhost:0"},
+				RemoteResults: map[string][]serviceResult{
+					"localhost:0": {successResult},
+				},
+				RemoteErrors: map[string]error{
+					"localhost:0": fmt.Errorf("error"),
+				},
+				RemoteStates: map[string]remoteState{
+					"localhost:0": {LastAttempt: time.Now(), LastSuccess: time.Now()},
+				},
+			}
+			if !data.RemoteOk() {
+				t.Error("RemoteOk() should return true")
+			}
+		})
+		t.Run("StaleIgnored", func(t *testing.T) {
+			data := indexData{
+				RemoteAddrs: []string{"localhost:0"},
+				RemoteResults: map[string][]serviceResult{
+					"localhost:0": {errorResult},
+				},
+				RemoteStates: map[string]remoteState{
+					"localhost:0": {Stale: true, policy: remotePolicy{OnStale: staleActionIgnore}},
+				},
+			}
+			if !data.RemoteOk() {
+				t.Error("RemoteOk() should return true")
+			}
+		})
 	})
 }
+
+func TestRunScriptsRunError(t *testing.T) {
+	okDir, badDir := t.TempDir(), t.TempDir()
+	for _, dir := range []string{okDir, badDir} {
+		if err := os.WriteFile(filepath.Join(dir, "check.sh"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &service{
+		logger: slogt.New(t),
+		dirs: []directoryConfig{
+			{Path: okDir},
+			{Path: badDir, Namespace: "bad", User: "no-such-user-upchek"},
+		},
+		checkDefaults: checkConfig{Interval: time.Minute},
+	}
+	s.initMetrics()
+	if err := s.runScripts(context.Background()); err != nil {
+		t.Fatalf("runScripts() error = %v", err)
+	}
+	if len(s.results) != 2 {
+		t.Fatalf("got %d results, want 2", len(s.results))
+	}
+	if r := s.results[0]; !r.IsHealthy() || r.Error != "" {
+		t.Errorf("check.sh = %+v, want healthy", r)
+	}
+	if r := s.results[1]; !r.IsError() || r.Error == "" || r.Name != "bad:check.sh" {
+		t.Errorf("bad:check.sh = %+v, want error state", r)
+	}
+}
+
+func TestRunScriptsUnreadableDirectory(t *testing.T) {
+	goodDir, badDir := t.TempDir(), filepath.Join(t.TempDir(), "bad")
+	if err := os.Mkdir(badDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{goodDir, badDir} {
+		if err := os.WriteFile(filepath.Join(dir, "check.sh"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &service{
+		logger: slogt.New(t),
+		dirs: []directoryConfig{
+			{Path: badDir, Namespace: "bad"},
+			{Path: goodDir},
+		},
+		checkDefaults: checkConfig{Interval: time.Minute},
+	}
+	s.initMetrics()
+	if err := s.runScripts(context.Background()); err != nil {
+		t.Fatalf("runScripts() error = %v", err)
+	}
+
+	// Once the directory can't be read, its checks are kept and the
+	// others still run.
+	if err := os.RemoveAll(badDir); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range s.checks {
+		c.nextRun = time.Time{}
+	}
+	if err := s.runScripts(context.Background()); err != nil {
+		t.Fatalf("runScripts() error = %v", err)
+	}
+	if _, ok := s.checks["bad:check.sh"]; !ok {
+		t.Error("check from unreadable directory was forgotten")
+	}
+	if len(s.results) != 2 || s.results[1].Name != "check.sh" || !s.results[1].IsHealthy() {
+		t.Errorf("results = %+v, want check.sh to have run", s.results)
+	}
+	if got := s.metricDirectoryErrors.Get(badDir).String(); got != "1" {
+		t.Errorf("directory errors metric = %s, want 1", got)
+	}
+}
+
+func TestHandleCheck(t *testing.T) {
+	logger := slogt.New(t)
+	s := &service{
+		logger:        logger,
+		indexTemplate: registerTemplate(logger, nil, "index.html.tmpl", embeddedIndex),
+		checkTemplate: registerTemplate(logger, nil, "check.html.tmpl", embeddedCheck),
+		results: []serviceResult{{
+			Result: &runner.Result{
+				Name:   "ops:disk.sh",
+				Stdout: "\x1b[31mdisk <full>\x1b[0m\n",
+				Output: []runner.OutputLine{
+					{Time: time.Unix(100, 0), Stream: runner.StreamStderr, Text: "warning: \x1b[1mlow\x1b[0m"},
+				},
+			},
+			Namespace: "ops",
+		}},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.handleIndex)
+	mux.HandleFunc("GET /check/{name}", s.handleCheck)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := get("/")
+	if body := w.Body.String(); !strings.Contains(body, `<a href="/check/ops:disk.sh">`) ||
+		!strings.Contains(body, `<span style="color:#cd0000">disk &lt;full&gt;</span>`) {
+		t.Errorf("index doesn't link to the check or render its colours:\n%s", body)
+	}
+
+	w = get("/check/ops:disk.sh")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /check/ops:disk.sh = %d, want 200", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `warning: <span style="font-weight:bold">low</span>`) ||
+		!strings.Contains(body, `class="stream-stderr"`) {
+		t.Errorf("detail page doesn't show the interleaved output:\n%s", body)
+	}
+
+	if w := get("/check/missing.sh"); w.Code != http.StatusNotFound {
+		t.Errorf("GET /check/missing.sh = %d, want 404", w.Code)
+	}
+}
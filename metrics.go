@@ -34,6 +34,20 @@ func (m *floatMap) Add(key string, delta float64) {
 	m.Map.Set(key, fv)
 }
 
+// Retain deletes every key for which keep returns false.
+func (m *floatMap) Retain(keep func(key string) bool) {
+	// Keys can't be deleted from within Do, which holds the map's lock.
+	var stale []string
+	m.Do(func(kv expvar.KeyValue) {
+		if !keep(kv.Key) {
+			stale = append(stale, kv.Key)
+		}
+	})
+	for _, key := range stale {
+		m.Delete(key)
+	}
+}
+
 type boolMap struct {
 	*expvar.Map
 }
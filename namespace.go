@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// namespaceSep separates a check's namespace from its script name in the
+// qualified name of a check, e.g. "ops:disk.sh".
+const namespaceSep = ":"
+
+// qualifiedName returns the name of a check in the given namespace. Checks in
+// the empty namespace are just named after their script.
+func qualifiedName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + namespaceSep + name
+}
+
+// validateNamespace returns an error if ns cannot be used as a namespace.
+func validateNamespace(ns string) error {
+	if strings.ContainsAny(ns, namespaceSep+"/= \t\n") {
+		return fmt.Errorf("namespace %q must not contain %q, '/', '=' or whitespace", ns, namespaceSep)
+	}
+	return nil
+}
+
+// qualifyDependencies returns deps with every local dependency resolved
+// relative to the given namespace, so that checks can refer to other checks
+// from the same directory by their script name. A dependency that is already
+// qualified is kept as-is, and one with a leading separator (e.g. ":disk.sh")
+// refers to a check in the empty namespace.
+func qualifyDependencies(namespace string, deps []string) []string {
+	if len(deps) == 0 {
+		return deps
+	}
+	ret := make([]string, 0, len(deps))
+	for _, dep := range deps {
+		if addr, _ := splitDependency(dep); addr == "" {
+			if rest, ok := strings.CutPrefix(dep, namespaceSep); ok {
+				dep = rest
+			} else if !strings.Contains(dep, namespaceSep) {
+				dep = qualifiedName(namespace, dep)
+			}
+		}
+		ret = append(ret, dep)
+	}
+	return ret
+}
+
+// parseDirectoryFlag parses a --directory flag value, which is either a path
+// or of the form "namespace=path".
+func parseDirectoryFlag(s string) directoryConfig {
+	if ns, path, ok := strings.Cut(s, "="); ok {
+		return directoryConfig{Path: path, Namespace: ns}
+	}
+	return directoryConfig{Path: s}
+}
+
+// namespaceGroup is a set of results from a single namespace, for display.
+type namespaceGroup struct {
+	Namespace string
+	Results   []serviceResult
+
+	// Local is whether the results are from local checks, which have a
+	// detail page.
+	Local bool
+}
+
+// groupByNamespace groups results by their namespace, preserving the order in
+// which namespaces first appear.
+func groupByNamespace(results []serviceResult) []namespaceGroup {
+	var groups []namespaceGroup
+	index := make(map[string]int)
+	for _, r := range results {
+		i, ok := index[r.Namespace]
+		if !ok {
+			i = len(groups)
+			index[r.Namespace] = i
+			groups = append(groups, namespaceGroup{Namespace: r.Namespace})
+		}
+		groups[i].Results = append(groups[i].Results, r)
+	}
+	return groups
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/neilotoole/slogt"
+)
+
+func TestQualifyDependencies(t *testing.T) {
+	deps := []string{"local.sh", "ops:other.sh", ":root.sh", "10.0.0.1:8080/remote.sh"}
+
+	got := qualifyDependencies("pkg", deps)
+	want := []string{"pkg:local.sh", "ops:other.sh", "root.sh", "10.0.0.1:8080/remote.sh"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("qualifyDependencies() mismatch (-want +got):\n%s", diff)
+	}
+
+	got = qualifyDependencies("", deps)
+	want = []string{"local.sh", "ops:other.sh", "root.sh", "10.0.0.1:8080/remote.sh"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("qualifyDependencies() in empty namespace mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseDirectoryFlag(t *testing.T) {
+	tests := []struct {
+		in   string
+		want directoryConfig
+	}{
+		{"/etc/upchek", directoryConfig{Path: "/etc/upchek"}},
+		{"ops=/etc/upchek", directoryConfig{Path: "/etc/upchek", Namespace: "ops"}},
+		{"=/etc/upchek", directoryConfig{Path: "/etc/upchek"}},
+	}
+	for _, tt := range tests {
+		if got := parseDirectoryFlag(tt.in); !cmp.Equal(got, tt.want) {
+			t.Errorf("parseDirectoryFlag(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestGroupByNamespace(t *testing.T) {
+	result := func(ns, name string) serviceResult {
+		r := serviceResult{Result: successResult(), Namespace: ns}
+		r.Name = qualifiedName(ns, name)
+		return r
+	}
+	results := []serviceResult{
+		result("", "a.sh"),
+		result("ops", "b.sh"),
+		result("", "c.sh"),
+	}
+
+	var got [][]string
+	for _, g := range groupByNamespace(results) {
+		names := []string{g.Namespace}
+		for _, r := range g.Results {
+			names = append(names, r.Name)
+		}
+		got = append(got, names)
+	}
+	want := [][]string{{"", "a.sh", "c.sh"}, {"ops", "ops:b.sh"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("groupByNamespace() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunScriptsNamespaces(t *testing.T) {
+	writeScript := func(dir, name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootDir, opsDir := t.TempDir(), t.TempDir()
+	writeScript(rootDir, "check.sh", "#!/bin/sh\nexit 0\n")
+	writeScript(opsDir, "check.sh", "#!/bin/sh\nexit 1\n")
+	writeScript(opsDir, "child.sh", "#!/bin/sh\n# upchek: depends=check.sh\nexit 1\n")
+	writeScript(opsDir, "slow.sh", "#!/bin/sh\nexec sleep 10\n")
+
+	s := &service{
+		logger: slogt.New(t),
+		dirs: []directoryConfig{
+			{Path: rootDir},
+			{Path: opsDir, Namespace: "ops", Timeout: duration(100 * time.Millisecond)},
+		},
+		checkDefaults: checkConfig{Interval: time.Minute},
+	}
+	s.initMetrics()
+	if err := s.runScripts(context.Background()); err != nil {
+		t.Fatalf("runScripts() error = %v", err)
+	}
+
+	byName := make(map[string]serviceResult)
+	for _, r := range s.results {
+		byName[r.Name] = r
+	}
+	if r := byName["check.sh"]; !r.IsHealthy() || r.Namespace != "" {
+		t.Errorf("check.sh = %+v, want healthy in empty namespace", r)
+	}
+	if r := byName["ops:check.sh"]; r.IsHealthy() || r.Namespace != "ops" {
+		t.Errorf("ops:check.sh = %+v, want failing in namespace ops", r)
+	}
+	if r := byName["ops:child.sh"]; !r.Suppressed {
+		t.Errorf("ops:child.sh: Suppressed = false, want suppressed by ops:check.sh")
+	}
+	if r := byName["ops:slow.sh"]; !r.TimedOut || r.IsHealthy() {
+		t.Errorf("ops:slow.sh: TimedOut = %v, IsHealthy() = %v; want timed out", r.TimedOut, r.IsHealthy())
+	}
+}
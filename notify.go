@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-json-experiment/json"
+
+	"github.com/andrew-d/upchek/internal/ulog"
+)
+
+// notification is sent when a check starts or stops alerting; see
+// [serviceResult.IsAlerting].
+type notification struct {
+	// Check is the name of the check.
+	Check string
+
+	// Alerting is whether the check is now alerting.
+	Alerting bool
+
+	// Result is the result of the check that caused the notification.
+	Result serviceResult
+
+	// Time is the time at which the change was observed.
+	Time time.Time
+}
+
+// notifier delivers notifications to some external system.
+type notifier interface {
+	notify(ctx context.Context, n notification) error
+	String() string
+}
+
+// newNotifier creates a notifier from its configuration, which must have
+// been validated.
+func newNotifier(cfg notifierConfig) notifier {
+	timeout := time.Duration(cfg.Timeout)
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	switch cfg.Type {
+	case "webhook":
+		return &webhookNotifier{
+			url:    cfg.URL,
+			client: &http.Client{Timeout: timeout},
+		}
+	default:
+		panic(fmt.Sprintf("unknown notifier type %q", cfg.Type))
+	}
+}
+
+// webhookNotifier delivers notifications by POSTing them as JSON to a URL.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (wn *webhookNotifier) notify(ctx context.Context, n notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("marshaling notification: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", wn.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (wn *webhookNotifier) String() string {
+	return fmt.Sprintf("webhook(%s)", wn.url)
+}
+
+// notifyQueueSize is the number of notifications that can be queued before
+// new notifications are dropped.
+const notifyQueueSize = 100
+
+// notifyService is a [suture.Service] that delivers queued notifications to
+// the configured notifiers.
+type notifyService struct {
+	logger *slog.Logger
+	queue  chan notification
+
+	mu        sync.RWMutex // protects following
+	notifiers []notifier
+}
+
+func newNotifyService(logger *slog.Logger) *notifyService {
+	return &notifyService{
+		logger: logger,
+		queue:  make(chan notification, notifyQueueSize),
+	}
+}
+
+// setNotifiers replaces the set of notifiers that notifications are
+// delivered to.
+func (ns *notifyService) setNotifiers(notifiers []notifier) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.notifiers = notifiers
+}
+
+// enqueue queues a notification for delivery. If the queue is full, the
+// notification is dropped. It is safe to call enqueue on a nil
+// notifyService.
+func (ns *notifyService) enqueue(n notification) {
+	if ns == nil {
+		return
+	}
+	select {
+	case ns.queue <- n:
+	default:
+		ns.logger.Warn("notification queue full; dropping notification", slog.String("check", n.Check))
+	}
+}
+
+func (ns *notifyService) Serve(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case n := <-ns.queue:
+			ns.deliver(ctx, n)
+		}
+	}
+}
+
+// flush delivers the notifications that are still queued, until the queue is
+// empty or ctx is done. It must not be called while Serve is running.
+func (ns *notifyService) flush(ctx context.Context) {
+	for ctx.Err() == nil {
+		select {
+		case n := <-ns.queue:
+			ns.deliver(ctx, n)
+		default:
+			return
+		}
+	}
+	if n := len(ns.queue); n > 0 {
+		ns.logger.Warn("dropping undelivered notifications", slog.Int("count", n))
+	}
+}
+
+func (ns *notifyService) String() string {
+	return "notifyService"
+}
+
+// deliver sends a single notification to every notifier.
+func (ns *notifyService) deliver(ctx context.Context, n notification) {
+	ns.mu.RLock()
+	notifiers := ns.notifiers
+	ns.mu.RUnlock()
+
+	for _, nt := range notifiers {
+		if err := nt.notify(ctx, n); err != nil {
+			ns.logger.Error("failed to send notification",
+				slog.String("notifier", nt.String()),
+				slog.String("check", n.Check),
+				ulog.Error(err))
+		}
+	}
+}
+
+// notifyTransitions sends notifications for local checks that have started
+// or stopped alerting since the previous pass. A check without a previous
+// result counts as not alerting, so one that is alerting from its first
+// result is notified about.
+//
+// This must only be called from the Serve goroutine.
+func (s *service) notifyTransitions(results []serviceResult) {
+	if s.alerting == nil {
+		s.alerting = make(map[string]bool)
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool, len(results))
+	for _, r := range s.silences.apply(results, "", nil, now) {
+		seen[r.Name] = true
+		alerting := r.IsAlerting()
+		prev := s.alerting[r.Name]
+		s.alerting[r.Name] = alerting
+		if prev == alerting {
+			continue
+		}
+
+		s.logger.Info("check alerting state changed",
+			slog.String("name", r.Name),
+			slog.Bool("alerting", alerting))
+		s.notifier.enqueue(notification{
+			Check:    r.Name,
+			Alerting: alerting,
+			Result:   r,
+			Time:     now,
+		})
+	}
+
+	for name := range s.alerting {
+		if !seen[name] {
+			delete(s.alerting, name)
+		}
+	}
+}
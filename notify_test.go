@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/neilotoole/slogt"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	received := make(chan notification, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		if err := json.UnmarshalRead(r.Body, &n); err != nil {
+			t.Errorf("unmarshaling notification: %v", err)
+		}
+		received <- n
+	}))
+	defer srv.Close()
+
+	nt := newNotifier(notifierConfig{Type: "webhook", URL: srv.URL})
+	err := nt.notify(context.Background(), notification{
+		Check:    "bad.sh",
+		Alerting: true,
+		Result:   serviceResult{Result: failureResult()},
+		Time:     time.Unix(1741397010, 0),
+	})
+	if err != nil {
+		t.Fatalf("notify() error = %v", err)
+	}
+
+	n := <-received
+	if n.Check != "bad.sh" || !n.Alerting || n.Result.ExitCode != 1 {
+		t.Errorf("received notification = %+v", n)
+	}
+}
+
+func TestWebhookNotifierError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	nt := newNotifier(notifierConfig{Type: "webhook", URL: srv.URL})
+	if err := nt.notify(context.Background(), notification{Check: "bad.sh"}); err == nil {
+		t.Error("notify() error = nil, want error")
+	}
+}
+
+func TestNotifyServiceFlush(t *testing.T) {
+	var received atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	defer srv.Close()
+
+	ns := newNotifyService(slogt.New(t))
+	ns.setNotifiers([]notifier{newNotifier(notifierConfig{Type: "webhook", URL: srv.URL})})
+	for _, check := range []string{"a.sh", "b.sh", "c.sh"} {
+		ns.enqueue(notification{Check: check, Alerting: true})
+	}
+
+	// Nothing is delivered once the context is done.
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	ns.flush(ctx)
+	if got := received.Load(); got != 0 {
+		t.Errorf("delivered %d notifications after context done, want 0", got)
+	}
+
+	ns.flush(t.Context())
+	if got := received.Load(); got != 3 {
+		t.Errorf("delivered %d notifications, want 3", got)
+	}
+	if len(ns.queue) != 0 {
+		t.Errorf("%d notifications left in queue, want 0", len(ns.queue))
+	}
+}
+
+func TestNotifyTransitions(t *testing.T) {
+	logger := slogt.New(t)
+	ns := newNotifyService(logger)
+	s := &service{logger: logger, notifier: ns}
+
+	ok := serviceResult{Result: successResult()}
+	bad := serviceResult{Result: failureResult()}
+	bad.Name = ok.Name
+
+	// A check that passes on its first result doesn't notify.
+	other := serviceResult{Result: successResult()}
+	other.Name = "other.sh"
+	s.notifyTransitions([]serviceResult{other})
+	if len(ns.queue) != 0 {
+		t.Fatalf("got %d notifications for first passing result, want 0", len(ns.queue))
+	}
+
+	// One that fails on its first result does.
+	s.notifyTransitions([]serviceResult{bad})
+	if len(ns.queue) != 1 {
+		t.Fatalf("got %d notifications for first failing result, want 1", len(ns.queue))
+	}
+	if n := <-ns.queue; !n.Alerting || n.Check != bad.Name {
+		t.Errorf("notification = %+v, want failure of %q", n, bad.Name)
+	}
+
+	// No change, no notification.
+	s.notifyTransitions([]serviceResult{bad})
+	if len(ns.queue) != 0 {
+		t.Fatalf("got %d notifications without a change, want 0", len(ns.queue))
+	}
+
+	// Recovery notifies.
+	s.notifyTransitions([]serviceResult{ok})
+	if len(ns.queue) != 1 {
+		t.Fatalf("got %d notifications after recovery, want 1", len(ns.queue))
+	}
+	if n := <-ns.queue; n.Alerting || n.Check != ok.Name {
+		t.Errorf("notification = %+v, want recovery of %q", n, ok.Name)
+	}
+
+	// A suppressed failure doesn't notify.
+	suppressed := bad
+	suppressed.Suppressed = true
+	s.notifyTransitions([]serviceResult{suppressed})
+	if len(ns.queue) != 0 {
+		t.Fatalf("got %d notifications for suppressed failure, want 0", len(ns.queue))
+	}
+}
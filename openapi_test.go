@@ -0,0 +1,421 @@
+package main
+
+import (
+	"cmp"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/neilotoole/slogt"
+
+	"github.com/andrew-d/upchek/internal/must"
+	"github.com/andrew-d/upchek/internal/runner"
+)
+
+// openAPIDoc is a parsed OpenAPI document, with just enough structure to
+// validate responses against it.
+type openAPIDoc struct {
+	raw map[string]any
+}
+
+func loadOpenAPI(t *testing.T) *openAPIDoc {
+	t.Helper()
+	var raw map[string]any
+	if err := json.Unmarshal(openAPISpec, &raw); err != nil {
+		t.Fatalf("parsing openapi.json: %v", err)
+	}
+	return &openAPIDoc{raw: raw}
+}
+
+// lookup returns the value at a JSON pointer such as
+// "#/components/schemas/Result".
+func (d *openAPIDoc) lookup(ref string) (map[string]any, error) {
+	var cur any = d.raw
+	for part := range strings.SplitSeq(strings.TrimPrefix(ref, "#/"), "/") {
+		part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: %q is not an object", ref, part)
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, fmt.Errorf("%s: %q not found", ref, part)
+		}
+	}
+	m, ok := cur.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an object", ref)
+	}
+	return m, nil
+}
+
+// resolve follows obj's $ref, if it has one.
+func (d *openAPIDoc) resolve(obj map[string]any) (map[string]any, error) {
+	for {
+		ref, ok := obj["$ref"].(string)
+		if !ok {
+			return obj, nil
+		}
+		var err error
+		if obj, err = d.lookup(ref); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// response returns the documented response to an operation with a status
+// code.
+func (d *openAPIDoc) response(method, path string, status int) (map[string]any, error) {
+	op, err := d.lookup("#/paths/" + strings.ReplaceAll(path, "/", "~1") + "/" + strings.ToLower(method))
+	if err != nil {
+		return nil, err
+	}
+	responses, _ := op["responses"].(map[string]any)
+	resp, ok := responses[strconv.Itoa(status)].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s %s: status %d is not documented", method, path, status)
+	}
+	return d.resolve(resp)
+}
+
+// validate checks v, as decoded from JSON, against a subset of JSON Schema:
+// $ref, type, enum, format (for date-time), properties, required,
+// additionalProperties and items. It returns a description of each
+// mismatch.
+func (d *openAPIDoc) validate(schema map[string]any, v any, at string) []string {
+	schema, err := d.resolve(schema)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok && !slices.Contains(enum, v) {
+		return []string{fmt.Sprintf("%s: %v is not one of %v", at, v, enum)}
+	}
+
+	var errs []string
+	switch typ, _ := schema["type"].(string); typ {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s: got %T, want object", at, v)}
+		}
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required property %q", at, name))
+			}
+		}
+		props, _ := schema["properties"].(map[string]any)
+		for name, val := range obj {
+			if prop, ok := props[name].(map[string]any); ok {
+				errs = append(errs, d.validate(prop, val, at+"."+name)...)
+				continue
+			}
+			switch ap := schema["additionalProperties"].(type) {
+			case bool:
+				if !ap {
+					errs = append(errs, fmt.Sprintf("%s: undocumented property %q", at, name))
+				}
+			case map[string]any:
+				errs = append(errs, d.validate(ap, val, at+"."+name)...)
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s: got %T, want array", at, v)}
+		}
+		items, _ := schema["items"].(map[string]any)
+		for i, val := range arr {
+			errs = append(errs, d.validate(items, val, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s: got %T, want string", at, v)}
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a date-time", at, s))
+			}
+		}
+	case "integer":
+		if f, ok := v.(float64); !ok || f != float64(int64(f)) {
+			errs = append(errs, fmt.Sprintf("%s: got %v, want integer", at, v))
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			errs = append(errs, fmt.Sprintf("%s: got %T, want number", at, v))
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			errs = append(errs, fmt.Sprintf("%s: got %T, want boolean", at, v))
+		}
+	case "":
+	default:
+		errs = append(errs, fmt.Sprintf("%s: unsupported type %q in schema", at, typ))
+	}
+	return errs
+}
+
+// validateJSON checks a JSON document against schema.
+func (d *openAPIDoc) validateJSON(t *testing.T, schema map[string]any, data []byte, what string) {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Errorf("%s: invalid JSON: %v", what, err)
+		return
+	}
+	for _, err := range d.validate(schema, v, what) {
+		t.Error(err)
+	}
+}
+
+// fillValue sets every exported field reachable from v to a non-zero value,
+// so that fields omitted when empty appear in its JSON encoding.
+func fillValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		fillValue(v.Elem())
+	case reflect.Struct:
+		if v.Type() == reflect.TypeFor[time.Time]() {
+			v.Set(reflect.ValueOf(time.Now()))
+			return
+		}
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				fillValue(v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillValue(v.Index(0))
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		key := reflect.New(v.Type().Key()).Elem()
+		elem := reflect.New(v.Type().Elem()).Elem()
+		fillValue(key)
+		fillValue(elem)
+		m.SetMapIndex(key, elem)
+		v.Set(m)
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(time.Second))
+	}
+}
+
+// fullResult returns a result with every field set.
+func fullResult(name string) serviceResult {
+	var r serviceResult
+	fillValue(reflect.ValueOf(&r).Elem())
+	r.Name = name
+	r.State = statusOK
+	r.StateType = stateHard
+	r.Output[0].Stream = runner.StreamStdout
+	return r
+}
+
+// Verify that every operation in the OpenAPI document is routed to a handler
+// registered for exactly that method and path.
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := loadOpenAPI(t)
+	mux := (&app{service: &service{}}).routes(routesAll)
+
+	paths, _ := doc.raw["paths"].(map[string]any)
+	if len(paths) == 0 {
+		t.Fatal("no paths in openapi.json")
+	}
+	for path, item := range paths {
+		for method := range item.(map[string]any) {
+			method = strings.ToUpper(method)
+			req := httptest.NewRequest(method, strings.NewReplacer("{", "", "}", "").Replace(path), nil)
+			_, pattern := mux.Handler(req)
+			pattern = strings.NewReplacer("{$}", "", "...}", "}").Replace(pattern)
+			if pattern != method+" "+path && pattern != path {
+				t.Errorf("%s %s is routed to %q", method, path, pattern)
+			}
+		}
+	}
+}
+
+// Verify that the responses of the handlers match the OpenAPI document.
+func TestOpenAPIResponses(t *testing.T) {
+	doc := loadOpenAPI(t)
+
+	silences, err := loadSilences("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := loadHistory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	incidents, err := loadIncidents("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slogt.New(t)
+	s := &service{
+		logger:         logger,
+		indexTemplate:  registerTemplate(logger, nil, "index.html.tmpl", embeddedIndex),
+		checkTemplate:  registerTemplate(logger, nil, "check.html.tmpl", embeddedCheck),
+		statusTemplate: registerTemplate(logger, nil, "status.html.tmpl", embeddedStatus),
+		silences:       silences,
+		history:        history,
+		incidents:      incidents,
+		instance:       instanceInfo{Hostname: "host", ID: "id", Version: "v1.0.0", StartTime: time.Now()},
+		results:        []serviceResult{fullResult("a.sh"), fullResult("b.sh")},
+		statusPage: statusPageConfig{
+			Components: []componentConfig{{Name: "API", Description: "x", Checks: []string{"a.sh"}}},
+		},
+		slos: []sloConfig{{Check: "a.sh", Target: 99.9}, {Group: "*", Target: 99}},
+		auth: authState{tokens: map[string]tokenConfig{"secret": {Name: "ops", Role: roleAdmin}}},
+	}
+	s.initMetrics()
+	history.record(s.results, time.Now().Add(-time.Hour))
+	history.record(s.results, time.Now())
+	incident, err := incidents.add(newIncident{Title: "x", Components: []string{"API"}, incidentUpdate: incidentUpdate{Message: "x"}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := incidents.add(newIncident{Title: "x", incidentUpdate: incidentUpdate{Status: incidentResolved, Message: "x", CreatedBy: "x"}}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	mux := (&app{logger: logger, service: s}).routes(routesAll)
+
+	newSilence := `{
+		"Matchers": [{"Label": "check", "Pattern": "a.sh"}],
+		"EndsAt": "` + time.Now().Add(time.Hour).Format(time.RFC3339) + `",
+		"Recurrence": {"Start": "02:00", "Duration": "1h", "Weekdays": ["mon"]},
+		"CreatedBy": "alice",
+		"Comment": "testing"
+	}`
+	doc.validateJSON(t, must.Get(doc.lookup("#/components/schemas/NewSilence")), []byte(newSilence), "NewSilence")
+
+	newIncident := `{"Title": "API errors", "Components": ["API"], "Status": "identified", "Message": "x", "CreatedBy": "alice"}`
+	doc.validateJSON(t, must.Get(doc.lookup("#/components/schemas/NewIncident")), []byte(newIncident), "NewIncident")
+	incidentUpdate := `{"Status": "resolved", "Message": "x", "CreatedBy": "alice"}`
+	doc.validateJSON(t, must.Get(doc.lookup("#/components/schemas/NewIncidentUpdate")), []byte(incidentUpdate), "NewIncidentUpdate")
+
+	var batch pushBatch
+	fillValue(reflect.ValueOf(&batch).Elem())
+	batch.Source = "agent"
+	batch.Labels = map[string]string{"dc": "ams"}
+	batch.Snapshots[0].Results = []serviceResult{fullResult("c.sh")}
+	pushBody, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.validateJSON(t, must.Get(doc.lookup("#/components/schemas/PushBatch")), pushBody, "PushBatch")
+
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		method, path string // path as in the document
+		target       string // defaults to path
+		header       http.Header
+		body         string
+		want         int
+	}{
+		{method: "GET", path: "/", want: http.StatusOK},
+		{method: "GET", path: "/check/{name}", target: "/check/a.sh", want: http.StatusOK},
+		{method: "GET", path: "/check/{name}", target: "/check/nonexistent", want: http.StatusNotFound},
+		{method: "GET", path: "/healthz", target: "/healthz?verbose", want: http.StatusOK},
+		{method: "GET", path: "/api/openapi.json", want: http.StatusOK},
+		{method: "GET", path: "/api/v1/results", want: http.StatusOK},
+		{method: "GET", path: "/api/v1/results", header: http.Header{"Accept-Encoding": {"gzip"}}, want: http.StatusOK},
+		{method: "GET", path: "/api/v1/results", header: http.Header{"If-Modified-Since": {future}}, want: http.StatusNotModified},
+		{method: "GET", path: "/api/v2/instance", want: http.StatusOK},
+		{method: "GET", path: "/api/v2/results", target: "/api/v2/results?limit=1", want: http.StatusOK},
+		{method: "GET", path: "/api/v2/results", target: "/api/v2/results?sort=bogus", want: http.StatusBadRequest},
+		{method: "GET", path: "/api/v2/results", header: http.Header{"If-Modified-Since": {future}}, want: http.StatusNotModified},
+		{method: "POST", path: "/api/v1/silences", body: newSilence, want: http.StatusCreated},
+		{method: "POST", path: "/api/v1/silences", body: `{}`, want: http.StatusBadRequest},
+		{method: "GET", path: "/api/v1/silences", want: http.StatusOK},
+		{method: "DELETE", path: "/api/v1/silences/{id}", target: "/api/v1/silences/nonexistent", want: http.StatusNotFound},
+		{method: "GET", path: "/badge/instance.svg", want: http.StatusOK},
+		{method: "GET", path: "/badge/group/{group}", target: "/badge/group/x.svg?uptime=7d", want: http.StatusOK},
+		{method: "GET", path: "/badge/group/{group}", target: "/badge/group/nonexistent.svg", want: http.StatusNotFound},
+		{method: "GET", path: "/badge/{check}", target: "/badge/a.sh.svg?label=A&color=blue", want: http.StatusOK},
+		{method: "GET", path: "/badge/{check}", target: "/badge/a.sh.svg?uptime=forever", want: http.StatusBadRequest},
+		{method: "GET", path: "/badge/{check}", target: "/badge/nonexistent.svg", want: http.StatusNotFound},
+		{method: "GET", path: "/status", want: http.StatusOK},
+		{method: "GET", path: "/api/v1/status", want: http.StatusOK},
+		{method: "GET", path: "/api/v1/availability", want: http.StatusOK},
+		{method: "GET", path: "/api/v1/availability/{month}", target: "/api/v1/availability/" + time.Now().Format("2006-01"), want: http.StatusOK},
+		{method: "GET", path: "/api/v1/availability/{month}", target: "/api/v1/availability/" + time.Now().Format("2006-01") + "?format=csv", want: http.StatusOK},
+		{method: "GET", path: "/api/v1/availability/{month}", target: "/api/v1/availability/june", want: http.StatusBadRequest},
+		{method: "GET", path: "/api/v1/incidents", want: http.StatusOK},
+		{method: "POST", path: "/api/v1/incidents", body: newIncident, want: http.StatusCreated},
+		{method: "POST", path: "/api/v1/incidents", body: `{}`, want: http.StatusBadRequest},
+		{method: "POST", path: "/api/v1/incidents/{id}/updates", target: "/api/v1/incidents/" + incident.ID + "/updates", body: incidentUpdate, want: http.StatusOK},
+		{method: "POST", path: "/api/v1/incidents/{id}/updates", target: "/api/v1/incidents/nonexistent/updates", body: incidentUpdate, want: http.StatusNotFound},
+		{method: "DELETE", path: "/api/v1/incidents/{id}", target: "/api/v1/incidents/" + incident.ID, want: http.StatusNoContent},
+		{method: "DELETE", path: "/api/v1/incidents/{id}", target: "/api/v1/incidents/nonexistent", want: http.StatusNotFound},
+		{method: "POST", path: "/api/v1/push", body: string(pushBody), want: http.StatusNoContent},
+		{method: "POST", path: "/api/v1/push", body: `{}`, want: http.StatusBadRequest},
+		{method: "POST", path: "/api/v1/admin/reload", want: http.StatusBadRequest},
+		{method: "GET", path: "/debug/vars", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		target := cmp.Or(tt.target, tt.path)
+		t.Run(tt.method+" "+target, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, target, strings.NewReader(tt.body))
+			if tt.method != "GET" {
+				req.Header.Set("Authorization", "Bearer secret")
+			}
+			maps.Copy(req.Header, tt.header)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+
+			resp, err := doc.response(tt.method, tt.path, rec.Code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := resp["content"].(map[string]any)
+			if len(content) == 0 {
+				if rec.Body.Len() > 0 && rec.Code != http.StatusNotFound {
+					t.Errorf("undocumented response body: %s", rec.Body)
+				}
+				return
+			}
+			mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+			media, ok := content[mediaType].(map[string]any)
+			if !ok {
+				t.Fatalf("Content-Type %q is not documented", mediaType)
+			}
+			if mediaType == "application/json" {
+				body := rec.Body.Bytes()
+				if rec.Header().Get("Content-Encoding") == "gzip" {
+					gr, err := gzip.NewReader(rec.Body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if body, err = io.ReadAll(gr); err != nil {
+						t.Fatal(err)
+					}
+				}
+				schema, _ := media["schema"].(map[string]any)
+				doc.validateJSON(t, schema, body, "response")
+			}
+		})
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-json-experiment/json"
+
+	"github.com/andrew-d/upchek/internal/ulog"
+)
+
+const (
+	// Defaults for the corresponding fields of [pushConfig].
+	defaultPushBatchInterval = 5 * time.Second
+	defaultPushTTL           = 5 * time.Minute
+	defaultPushTimeout       = 10 * time.Second
+
+	// maxPushBatch is the most snapshots sent in a single push.
+	maxPushBatch = 50
+
+	// maxSpooled is the most snapshots kept for a central instance that
+	// can't be reached; the oldest are dropped beyond this.
+	maxSpooled = 1000
+
+	// pushTick is how often the push service looks for snapshots that
+	// are due to be sent.
+	pushTick = time.Second
+)
+
+// pushSnapshot is the local results at a point in time.
+type pushSnapshot struct {
+	Time    time.Time
+	Results []serviceResult
+}
+
+// pushBatch is the body of a request to a central instance's push endpoint.
+type pushBatch struct {
+	// Source is the name of the pushing instance; see
+	// [pushConfig.Source].
+	Source string
+
+	// Labels are attached to the source's results.
+	Labels map[string]string `json:",omitzero"`
+
+	// TTL is how long the results are current for.
+	TTL time.Duration
+
+	// SentAt is when the batch was sent, according to the source's
+	// clock.
+	SentAt time.Time
+
+	// Snapshots are the results being pushed, oldest first.
+	Snapshots []pushSnapshot
+}
+
+// validatePushSource returns an error if source can't be used as the name of
+// a pushing instance. Names can't contain ':', so that they never collide
+// with the address of a remote, or '/', so that they can be used in
+// dependencies.
+func validatePushSource(source string) error {
+	if source == "" || strings.ContainsAny(source, ":/ \t\n") {
+		return fmt.Errorf("invalid source name %q: must be non-empty and not contain ':', '/' or whitespace", source)
+	}
+	return nil
+}
+
+// validate checks that the push configuration is well-formed.
+func (p pushConfig) validate() error {
+	var errs []error
+	if u, err := url.Parse(p.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		errs = append(errs, fmt.Errorf("URL must be an http or https URL, not %q", p.URL))
+	}
+	if p.Source != "" {
+		if err := validatePushSource(p.Source); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if p.Token != "" && p.TokenFile != "" {
+		errs = append(errs, errors.New("at most one of Token and TokenFile may be set"))
+	}
+	if p.BatchInterval < 0 || p.TTL < 0 || p.Timeout < 0 {
+		errs = append(errs, errors.New("batch interval, TTL and timeout must not be negative"))
+	}
+	if err := validateLabels(p.Labels); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// pushTarget is a central instance that results are pushed to.
+type pushTarget struct {
+	key      string // URL and source; identifies the target across reloads
+	cfg      pushConfig
+	source   string
+	token    string
+	spoolDir string // if empty, snapshots are only queued in memory
+	logger   *slog.Logger
+
+	// The following are protected by pushService.mu.
+	queue       []pushSnapshot // oldest first
+	lastStates  []string       // see [resultStates]
+	lastQueued  time.Time
+	nextAttempt time.Time
+	failures    int
+}
+
+// newPushTarget creates a pushTarget from its configuration, which must have
+// been validated. Snapshots are spooled under stateDir, if it is set.
+func newPushTarget(cfg pushConfig, stateDir string, logger *slog.Logger) (*pushTarget, error) {
+	t := &pushTarget{cfg: cfg, source: cfg.Source, token: cfg.Token}
+	if t.source == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("getting hostname for push source: %w", err)
+		}
+		t.source = hostname
+	}
+	if err := validatePushSource(t.source); err != nil {
+		return nil, err
+	}
+	if cfg.TokenFile != "" {
+		data, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("push token: %w", err)
+		}
+		t.token = strings.TrimSpace(string(data))
+	}
+
+	t.key = cfg.URL + "\x00" + t.source
+	t.logger = logger.With(slog.String("url", cfg.URL), slog.String("source", t.source))
+	if stateDir != "" {
+		sum := sha256.Sum256([]byte(t.key))
+		t.spoolDir = filepath.Join(stateDir, "push-spool", hex.EncodeToString(sum[:8]))
+	}
+	return t, nil
+}
+
+func (t *pushTarget) batchInterval() time.Duration {
+	return cmp.Or(time.Duration(t.cfg.BatchInterval), defaultPushBatchInterval)
+}
+
+func (t *pushTarget) ttl() time.Duration {
+	return cmp.Or(time.Duration(t.cfg.TTL), defaultPushTTL)
+}
+
+// spoolPath returns the path of the file that snap is spooled to.
+func (t *pushTarget) spoolPath(snap pushSnapshot) string {
+	return filepath.Join(t.spoolDir, fmt.Sprintf("%020d.json", snap.Time.UnixNano()))
+}
+
+// loadSpool queues the snapshots spooled by a previous run. Snapshots that
+// can't be read are discarded.
+func (t *pushTarget) loadSpool() {
+	entries, err := os.ReadDir(t.spoolDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			t.logger.Warn("failed to read push spool", ulog.Error(err))
+		}
+		return
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(t.spoolDir, e.Name())
+		data, err := os.ReadFile(path)
+		var snap pushSnapshot
+		if err == nil {
+			err = json.Unmarshal(data, &snap)
+		}
+		if err != nil {
+			t.logger.Warn("discarding unreadable spooled results", slog.String("path", path), ulog.Error(err))
+			os.Remove(path)
+			continue
+		}
+		t.queue = append(t.queue, snap)
+	}
+	if len(t.queue) > 0 {
+		t.logger.Info("loaded spooled results", slog.Int("count", len(t.queue)))
+	}
+	t.trimQueue()
+}
+
+// spool writes snap to disk, so that it is pushed even if upchek restarts
+// first.
+func (t *pushTarget) spool(snap pushSnapshot) {
+	if t.spoolDir == "" {
+		return
+	}
+	data, err := json.Marshal(snap)
+	if err == nil {
+		err = writeFileAtomic(t.spoolPath(snap), data)
+	}
+	if err != nil {
+		t.logger.Warn("failed to spool results", ulog.Error(err))
+	}
+}
+
+// unspool removes the spooled copies of snaps from disk.
+func (t *pushTarget) unspool(snaps []pushSnapshot) {
+	for _, snap := range snaps {
+		if t.spoolDir != "" {
+			if err := os.Remove(t.spoolPath(snap)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				t.logger.Warn("failed to remove spooled results", ulog.Error(err))
+			}
+		}
+	}
+}
+
+// trimQueue drops the oldest snapshots beyond [maxSpooled].
+func (t *pushTarget) trimQueue() {
+	over := len(t.queue) - maxSpooled
+	if over <= 0 {
+		return
+	}
+	t.logger.Warn("push spool full; dropping oldest results", slog.Int("dropped", over))
+	t.unspool(t.queue[:over])
+	t.queue = slices.Delete(t.queue, 0, over)
+}
+
+// push sends a batch of snapshots to the central instance.
+func (t *pushTarget) push(ctx context.Context, snaps []pushSnapshot) error {
+	body, err := json.Marshal(pushBatch{
+		Source:    t.source,
+		Labels:    t.cfg.Labels,
+		TTL:       t.ttl(),
+		SentAt:    time.Now(),
+		Snapshots: snaps,
+	})
+	if err != nil {
+		return fmt.Errorf("marshaling results: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(time.Duration(t.cfg.Timeout), defaultPushTimeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(t.cfg.URL, "/")+"/api/v1/push", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("making request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// resultStates summarizes the states of results, for deciding whether they
+// have changed since the last push.
+func resultStates(results []serviceResult) []string {
+	states := make([]string, 0, len(results))
+	for _, r := range results {
+		states = append(states, fmt.Sprintf("%s %s silenced=%t suppressed=%t stale=%t", r.Name, r.State, r.Silenced, r.Suppressed, r.Stale))
+	}
+	return states
+}
+
+// pushService is a [suture.Service] that pushes local results to central
+// instances. Results are queued by [pushService.enqueue] after each run, and
+// sent in batches; while a central instance can't be reached, they are
+// spooled to disk and retried with backoff.
+type pushService struct {
+	logger *slog.Logger
+
+	mu      sync.Mutex // protects following, and the mutable fields of each target
+	targets []*pushTarget
+}
+
+func newPushService(logger *slog.Logger) *pushService {
+	return &pushService{logger: logger}
+}
+
+// newPushTargets creates a pushTarget for each configuration, which must
+// have been validated.
+func newPushTargets(cfgs []pushConfig, stateDir string, logger *slog.Logger) ([]*pushTarget, error) {
+	var targets []*pushTarget
+	for _, cfg := range cfgs {
+		t, err := newPushTarget(cfg, stateDir, logger)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// setTargets replaces the set of central instances that results are pushed
+// to. Targets with the same URL and source as an existing target keep its
+// queue; new targets load any snapshots spooled by a previous run.
+func (ps *pushService) setTargets(targets []*pushTarget) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	existing := make(map[string]*pushTarget, len(ps.targets))
+	for _, t := range ps.targets {
+		existing[t.key] = t
+	}
+	for _, t := range targets {
+		if old, ok := existing[t.key]; ok {
+			// Keep the queue, but pick up the new settings. A push
+			// in progress to the old target may be repeated, which
+			// the central instance ignores.
+			t.queue, t.lastStates, t.lastQueued = slices.Clone(old.queue), old.lastStates, old.lastQueued
+			t.nextAttempt, t.failures = old.nextAttempt, old.failures
+		} else {
+			t.loadSpool()
+		}
+	}
+	ps.targets = targets
+}
+
+// enqueue queues results to be pushed to every target; targets with OnChange
+// set skip results whose states haven't changed, unless a third of their TTL
+// has passed since they last queued results. It is safe to call enqueue on a
+// nil pushService.
+func (ps *pushService) enqueue(results []serviceResult, now time.Time) {
+	if ps == nil {
+		return
+	}
+	states := resultStates(results)
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, t := range ps.targets {
+		if t.cfg.OnChange && slices.Equal(states, t.lastStates) && now.Sub(t.lastQueued) < t.ttl()/3 {
+			continue
+		}
+		t.lastStates, t.lastQueued = states, now
+
+		snap := pushSnapshot{Time: now, Results: results}
+		t.queue = append(t.queue, snap)
+		t.spool(snap)
+		t.trimQueue()
+	}
+}
+
+func (ps *pushService) Serve(ctx context.Context) error {
+	ticker := time.NewTicker(pushTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		ps.pushAll(ctx, time.Now())
+	}
+}
+
+func (ps *pushService) String() string {
+	return "pushService"
+}
+
+// pushAll sends a batch of queued snapshots to every target that is due.
+func (ps *pushService) pushAll(ctx context.Context, now time.Time) {
+	ps.pushBatches(ctx, now, func(t *pushTarget) bool { return !now.Before(t.nextAttempt) })
+}
+
+// flush pushes everything that is queued, without waiting for the next batch
+// to be due, until ctx is done. Targets that are backing off after a failure
+// are skipped; their queues are spooled for the next run. It must not be
+// called while Serve is running.
+func (ps *pushService) flush(ctx context.Context) {
+	for ctx.Err() == nil && ps.pushBatches(ctx, time.Now(), func(t *pushTarget) bool { return t.failures == 0 }) {
+	}
+}
+
+// pushBatches sends a batch of queued snapshots to every target for which
+// isDue returns true, and reports whether any were sent successfully.
+func (ps *pushService) pushBatches(ctx context.Context, now time.Time, isDue func(*pushTarget) bool) bool {
+	type due struct {
+		target *pushTarget
+		batch  []pushSnapshot
+	}
+	var pending []due
+	ps.mu.Lock()
+	for _, t := range ps.targets {
+		if len(t.queue) > 0 && isDue(t) {
+			pending = append(pending, due{t, slices.Clone(t.queue[:min(len(t.queue), maxPushBatch)])})
+		}
+	}
+	ps.mu.Unlock()
+
+	sent := false
+	for _, d := range pending {
+		t := d.target
+		err := t.push(ctx, d.batch)
+		if ctx.Err() != nil {
+			return sent
+		}
+
+		ps.mu.Lock()
+		if err != nil {
+			t.failures++
+			wait := remoteBackoff(t.batchInterval(), t.failures, rand.Float64())
+			t.nextAttempt = now.Add(wait)
+			t.logger.Error("failed to push results",
+				slog.Int("failures", t.failures),
+				slog.Int("queued", len(t.queue)),
+				slog.Duration("retry_in", wait),
+				ulog.Error(err))
+		} else {
+			if t.failures > 0 {
+				t.logger.Info("pushed results after failures", slog.Int("failures", t.failures))
+			}
+			t.failures = 0
+			t.nextAttempt = now.Add(t.batchInterval())
+
+			// The queue may have been trimmed while we were pushing,
+			// so remove what was sent by time rather than position.
+			last := d.batch[len(d.batch)-1].Time
+			n := 0
+			for n < len(t.queue) && !t.queue[n].Time.After(last) {
+				n++
+			}
+			t.unspool(t.queue[:n])
+			t.queue = slices.Delete(t.queue, 0, n)
+			sent = true
+		}
+		ps.mu.Unlock()
+	}
+	return sent
+}
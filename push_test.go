@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/neilotoole/slogt"
+
+	"github.com/andrew-d/upchek/internal/runner"
+)
+
+// Verify that results are spooled to disk while the central instance is
+// unreachable, survive a restart, and are then pushed in a single batch.
+func TestPushServiceSpool(t *testing.T) {
+	var (
+		up       atomic.Bool
+		mu       sync.Mutex
+		received []pushBatch
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != "/api/v1/push" || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var batch pushBatch
+		if err := json.UnmarshalRead(r.Body, &batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, batch)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	logger := slogt.New(t)
+	stateDir := t.TempDir()
+	cfg := pushConfig{URL: srv.URL, Source: "agent-1", Token: "secret", Labels: map[string]string{"dc": "ams"}}
+	newService := func() *pushService {
+		ps := newPushService(logger)
+		targets, err := newPushTargets([]pushConfig{cfg}, stateDir, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps.setTargets(targets)
+		return ps
+	}
+	spooled := func(ps *pushService) int {
+		entries, err := os.ReadDir(ps.targets[0].spoolDir)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	ps := newService()
+	now := time.Unix(1741397010, 0)
+	results := []serviceResult{{Result: &runner.Result{Name: "disk.sh"}, LastRun: now}}
+	ps.enqueue(results, now)
+	ps.enqueue(results, now.Add(time.Second))
+
+	ps.pushAll(t.Context(), now.Add(time.Second))
+	if got := spooled(ps); got != 2 {
+		t.Fatalf("spooled %d snapshots after failed push, want 2", got)
+	}
+	if ps.targets[0].failures != 1 || !ps.targets[0].nextAttempt.After(now.Add(time.Second)) {
+		t.Errorf("target after failure = %d failures, next attempt %v; want backoff", ps.targets[0].failures, ps.targets[0].nextAttempt)
+	}
+
+	// A restarted service picks up the spool, and pushes it all at once.
+	ps = newService()
+	if got := len(ps.targets[0].queue); got != 2 {
+		t.Fatalf("loaded %d spooled snapshots, want 2", got)
+	}
+	up.Store(true)
+	ps.pushAll(t.Context(), now.Add(2*time.Second))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 {
+		t.Fatalf("received %d batches, want 1", len(received))
+	}
+	b := received[0]
+	if b.Source != "agent-1" || b.TTL != defaultPushTTL || len(b.Snapshots) != 2 || b.Labels["dc"] != "ams" {
+		t.Errorf("batch = %+v, want both snapshots from agent-1", b)
+	}
+	if got := spooled(ps); got != 0 {
+		t.Errorf("spooled %d snapshots after successful push, want 0", got)
+	}
+	if len(ps.targets[0].queue) != 0 {
+		t.Errorf("queue has %d snapshots after successful push, want 0", len(ps.targets[0].queue))
+	}
+}
+
+// Verify that flushing pushes queued results without waiting for the next
+// batch, but doesn't retry targets that are backing off.
+func TestPushServiceFlush(t *testing.T) {
+	var pushed atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushed.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	ps := newPushService(slogt.New(t))
+	targets, err := newPushTargets([]pushConfig{
+		{URL: srv.URL, Source: "agent-1", BatchInterval: duration(time.Hour)},
+		{URL: down.URL, Source: "agent-1"},
+	}, "", ps.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.setTargets(targets)
+
+	now := time.Now()
+	results := []serviceResult{{Result: &runner.Result{Name: "disk.sh"}, LastRun: now}}
+	ps.enqueue(results, now)
+	ps.pushAll(t.Context(), now)
+	ps.enqueue(results, now.Add(time.Second))
+	ps.pushAll(t.Context(), now.Add(time.Second))
+	if got := pushed.Load(); got != 1 {
+		t.Fatalf("pushed %d batches before flush, want 1", got)
+	}
+
+	ps.flush(t.Context())
+	if got := pushed.Load(); got != 2 {
+		t.Errorf("pushed %d batches after flush, want 2", got)
+	}
+	if n := len(ps.targets[0].queue); n != 0 {
+		t.Errorf("%d snapshots left queued for the working target, want 0", n)
+	}
+	if n := len(ps.targets[1].queue); n != 2 {
+		t.Errorf("%d snapshots left queued for the failing target, want 2", n)
+	}
+}
+
+func TestPushOnChange(t *testing.T) {
+	ps := newPushService(slogt.New(t))
+	targets, err := newPushTargets([]pushConfig{{URL: "http://central:8080", Source: "agent-1", OnChange: true, TTL: duration(3 * time.Minute)}}, "", ps.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.setTargets(targets)
+
+	now := time.Unix(1741397010, 0)
+	ok := []serviceResult{{Result: &runner.Result{Name: "disk.sh"}, State: statusOK}}
+	failing := []serviceResult{{Result: &runner.Result{Name: "disk.sh", ExitCode: 1}, State: statusFailing}}
+
+	ps.enqueue(ok, now)
+	ps.enqueue(ok, now.Add(10*time.Second))      // unchanged
+	ps.enqueue(failing, now.Add(20*time.Second)) // changed
+	ps.enqueue(failing, now.Add(81*time.Second)) // heartbeat after TTL/3
+	if got := len(ps.targets[0].queue); got != 3 {
+		t.Errorf("queued %d snapshots, want 3", got)
+	}
+}
@@ -12,4 +12,106 @@ type serviceResult struct {
 	*runner.Result
 	// LastRun is the time the check was last run.
 	LastRun time.Time `json:",format:unix"`
+
+	// Namespace is the namespace of the directory that the check's
+	// script is in; the Name of the result is qualified with it.
+	Namespace string `json:",omitzero"`
+	// TimedOut is whether the check was killed for exceeding its
+	// timeout.
+	TimedOut bool `json:",omitzero"`
+	// Error is set if the check's script could not be run at all, e.g.
+	// because the user it should run as doesn't exist or its sandbox
+	// couldn't be set up; such runs have the status statusError.
+	Error string `json:",omitzero"`
+
+	// State is the confirmed ("hard") state of the check. It only changes
+	// after enough consecutive runs disagree with it; see [checkConfig].
+	State checkStatus `json:",omitzero"`
+	// StateType is whether the most recent run agrees with State ("hard")
+	// or is counting towards a state change ("soft").
+	StateType stateType `json:",omitzero"`
+	// Attempt is the number of consecutive runs with the same result as
+	// the most recent run.
+	Attempt int `json:",omitzero"`
+	// Flapping is whether the check has changed state too often recently.
+	Flapping bool `json:",omitzero"`
+
+	// DependsOn is the list of checks that this check depends on.
+	DependsOn []string `json:",omitzero"`
+	// Suppressed is whether one or more of this check's dependencies are
+	// failing. A suppressed check does not count towards the overall
+	// health; see [serviceResult.IsAlerting].
+	Suppressed bool `json:",omitzero"`
+	// SuppressedBy is the list of failing dependencies that caused this
+	// check to be suppressed.
+	SuppressedBy []string `json:",omitzero"`
+
+	// Group is the group that the check belongs to, if any.
+	Group string `json:",omitzero"`
+	// Tags are the check's tags, if any.
+	Tags []string `json:",omitzero"`
+	// Silenced is whether the check is matched by an active silence. Like
+	// a suppressed check, a silenced check does not count towards the
+	// overall health.
+	Silenced bool `json:",omitzero"`
+	// SilencedBy is the list of IDs of the silences matching this check.
+	SilencedBy []string `json:",omitzero"`
+
+	// Parent is set for sub-results reported by a check's script, and is
+	// the name of that check; see [subResultSep].
+	Parent string `json:",omitzero"`
+	// Stale is whether this sub-result was not reported by the most
+	// recent run of its parent's script. Stale sub-results are ok, unless
+	// the parent's OnStale is staleActionFail.
+	Stale bool `json:",omitzero"`
+	// Skipped is whether this sub-result is for a test that was skipped;
+	// skipped tests are ok.
+	Skipped bool `json:",omitzero"`
+	// Message is a short explanation of a sub-result's status, such as a
+	// test's failure message.
+	Message string `json:",omitzero"`
+	// Duration is how long a sub-result's test took, if known.
+	Duration time.Duration `json:",omitzero"`
+}
+
+// IsHealthy returns true if the confirmed state of the check is ok.
+//
+// Results without a State, such as those scraped from an older upchek, fall
+// back to the exit code of the most recent run.
+func (r serviceResult) IsHealthy() bool {
+	if r.State == "" {
+		return r.IsSuccess()
+	}
+	return r.State == statusOK
+}
+
+// IsError returns true if the confirmed state of the check is that its
+// script can't be run.
+func (r serviceResult) IsError() bool {
+	return r.State == statusError
+}
+
+// runStatus returns the status of the most recent run.
+func (r serviceResult) runStatus() checkStatus {
+	switch {
+	case r.Error != "":
+		return statusError
+	case r.IsSuccess():
+		return statusOK
+	default:
+		return statusFailing
+	}
+}
+
+// IsSoft returns true if the most recent run disagrees with the confirmed
+// state of the check.
+func (r serviceResult) IsSoft() bool {
+	return r.StateType == stateSoft
+}
+
+// IsAlerting returns true if the check is failing and should count towards
+// the overall health; that is, it is not healthy, not suppressed and not
+// silenced.
+func (r serviceResult) IsAlerting() bool {
+	return !r.IsHealthy() && !r.Suppressed && !r.Silenced
 }
@@ -1,45 +1,411 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/go-json-experiment/json"
+	"github.com/klauspost/compress/zstd"
 
 	"github.com/andrew-d/upchek/internal/ulog"
 )
 
+// staleAction is whether a remote whose results are stale, or a sub-result
+// that is no longer reported, counts as failing.
+type staleAction string
+
+const (
+	// staleActionFail counts a stale remote or sub-result as failing.
+	staleActionFail staleAction = "fail"
+
+	// staleActionIgnore shows that a remote or sub-result is stale, but
+	// doesn't count it towards the overall health.
+	staleActionIgnore staleAction = "ignore"
+)
+
+// validate returns an error if a is not a known action; the zero value is
+// valid.
+func (a staleAction) validate() error {
+	switch a {
+	case "", staleActionFail, staleActionIgnore:
+		return nil
+	}
+	return fmt.Errorf("OnStale must be %q or %q", staleActionFail, staleActionIgnore)
+}
+
+// remotePolicy holds the settings that decide how the health of a remote is
+// judged.
+type remotePolicy struct {
+	// StaleAfter is how long after the last successful fetch the
+	// remote's results are considered stale.
+	StaleAfter time.Duration
+
+	// OnStale is whether a stale remote counts as failing.
+	OnStale staleAction
+
+	// MaxClockSkew is the largest tolerated clock skew; zero disables
+	// the check.
+	MaxClockSkew time.Duration
+}
+
+// remoteState tracks fetches from a single remote.
+type remoteState struct {
+	// LastAttempt and LastSuccess are the times of the most recent
+	// fetch, and the most recent successful one.
+	LastAttempt time.Time
+	LastSuccess time.Time
+
+	// ClockSkew is how far the remote's clock was estimated to be ahead
+	// of ours (or behind, if negative) at the last successful fetch; see
+	// [estimateClockSkew].
+	ClockSkew time.Duration
+
+	// Stale is whether the remote's results are stale, as of when the
+	// state was read; see [remoteState.isStale].
+	Stale bool
+
+	// Instance identifies the remote, if it supports the v2 API.
+	Instance instanceInfo
+
+	// Pushed is whether the results were pushed to us, rather than
+	// fetched; for pushed sources, LastAttempt is the time of the last
+	// push, and LastSuccess is the time of the newest results.
+	Pushed bool
+
+	policy remotePolicy
+}
+
+// isStale returns whether the remote's results are stale at time now: that
+// is, the remote has never been fetched from successfully despite trying, or
+// the last successful fetch was longer ago than the policy allows.
+func (st remoteState) isStale(now time.Time) bool {
+	if st.LastSuccess.IsZero() {
+		return !st.LastAttempt.IsZero()
+	}
+	return now.Sub(st.LastSuccess) > st.policy.StaleAfter
+}
+
+// ClockSkewed returns whether the remote's clock skew exceeds the maximum
+// allowed by its policy.
+func (st remoteState) ClockSkewed() bool {
+	return st.policy.MaxClockSkew > 0 && st.ClockSkew.Abs() > st.policy.MaxClockSkew
+}
+
+// ClockSkewDescription describes the remote's clock skew, e.g. "1m0s
+// behind".
+func (st remoteState) ClockSkewDescription() string {
+	if st.ClockSkew < 0 {
+		return (-st.ClockSkew).String() + " behind"
+	}
+	return st.ClockSkew.String() + " ahead"
+}
+
+// IgnoreStale returns whether the remote doesn't count as failing while it is
+// stale.
+func (st remoteState) IgnoreStale() bool {
+	return st.policy.OnStale == staleActionIgnore
+}
+
+// remoteHealthy returns whether a remote is healthy given its state and its
+// results, with silences already applied. A stale remote is healthy only if
+// its policy ignores staleness; otherwise, it is healthy if none of its
+// results are alerting, even if the most recent fetch failed.
+func remoteHealthy(st remoteState, results []serviceResult) bool {
+	if st.Stale {
+		return st.IgnoreStale()
+	}
+	for _, result := range results {
+		if result.IsAlerting() {
+			return false
+		}
+	}
+	return true
+}
+
+// estimateClockSkew estimates how far the clock of a remote is ahead of ours,
+// from the Date header of its response to a request made between start and
+// end, and the times at which its checks last ran; see [clockSkew].
+//
+// The Date header only has a resolution of a second, so it is compared with
+// the middle of the request truncated to a second.
+func estimateClockSkew(date string, start, end time.Time, results []serviceResult) time.Duration {
+	t, _ := http.ParseTime(date) // zero if missing or invalid
+	mid := start.Add(end.Sub(start) / 2)
+	return clockSkew(t, mid.Truncate(time.Second), end, results)
+}
+
+// clockSkew estimates how far the clock of a remote is ahead of ours, given
+// that its clock read remote when ours read local, and the results it sent
+// us, which we received at end. remote may be zero if it isn't known.
+//
+// A LastRun in the future is a lower bound on how far the remote is ahead,
+// so it is used if it is larger.
+func clockSkew(remote, local, end time.Time, results []serviceResult) time.Duration {
+	var skew time.Duration
+	if !remote.IsZero() {
+		skew = remote.Sub(local)
+	}
+	for _, r := range results {
+		if ahead := r.LastRun.Sub(end); ahead > 0 {
+			skew = max(skew, ahead)
+		}
+	}
+	return skew
+}
+
+// maxRemoteBackoff is the longest that a remote that can't be fetched from
+// waits between attempts, unless its interval is longer.
+const maxRemoteBackoff = 5 * time.Minute
+
+// remoteBackoff returns how long to wait before fetching from a remote again
+// after the given number of consecutive failed fetches: the interval,
+// doubling with each failure up to [maxRemoteBackoff].
+//
+// jitter, in [0, 1), spreads the waits of remotes that failed together over
+// the upper half of the wait, so that they don't all retry at once.
+func remoteBackoff(interval time.Duration, failures int, jitter float64) time.Duration {
+	wait := interval
+	for range failures - 1 {
+		if wait >= maxRemoteBackoff {
+			break
+		}
+		wait *= 2
+	}
+	wait = min(wait, max(maxRemoteBackoff, interval))
+	return wait/2 + time.Duration(jitter*float64(wait/2))
+}
+
 type fetchRemoteResultService struct {
 	parent   *service
 	logger   *slog.Logger
 	addr     string
 	interval time.Duration
+	timeout  time.Duration
+	policy   remotePolicy
+	token    string // bearer token, if any
+
+	// v1Since is when the remote was found not to support the v2 API,
+	// or zero if it does (or we haven't tried yet).
+	v1Since time.Time
+
+	// etag is the entity tag of the last results fetched, if the remote
+	// sent one, to make the next fetch conditional on them changing.
+	etag string
 }
 
+// Serve fetches from the remote every interval, backing off while it can't be
+// fetched from. Failures are recorded rather than returned, so that an
+// unreachable remote doesn't cause the service to be restarted repeatedly.
 func (fr *fetchRemoteResultService) Serve(ctx context.Context) error {
 	fr.parent.initMetrics()
 
-	// Fetch once immediately.
-	if err := fr.fetch(ctx, fr.addr); err != nil {
-		return fmt.Errorf("initial fetch: %w", err)
-	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 
-	ticker := time.NewTicker(fr.interval)
-	defer ticker.Stop()
+	var failures int
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-timer.C:
+		}
+
+		wait := fr.interval
+		if err := fr.fetch(ctx, fr.addr); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			failures++
+			wait = remoteBackoff(fr.interval, failures, rand.Float64())
+			fr.logger.Error("failed to fetch remote result",
+				slog.Int("failures", failures),
+				slog.Duration("retry_in", wait),
+				ulog.Error(err))
+		} else {
+			failures = 0
+		}
+		timer.Reset(wait)
+	}
+}
+
+// renegotiateInterval is how often the v2 API is retried for a remote that
+// didn't support it, in case it has since been upgraded.
+const renegotiateInterval = time.Hour
+
+// maxResultPages is the most pages fetched from a remote's v2 API in one
+// fetch, to guard against a remote that returns cursors forever.
+const maxResultPages = 100
+
+// errNoV2 is returned by [fetchResultsV2] if the remote doesn't support the
+// v2 API, or a version of its result schema that we understand.
+var errNoV2 = errors.New("v2 API not supported")
+
+// httpStatusError is returned for responses with an unexpected status code.
+type httpStatusError int
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", int(e))
+}
+
+// fetchResponse describes the response to a request made by [getJSON].
+type fetchResponse struct {
+	header http.Header
 
-		case <-ticker.C:
-			if err := fr.fetch(ctx, fr.addr); err != nil {
-				fr.logger.Error("failed to fetch remote result", ulog.Error(err))
+	// notModified is set if the remote responded with 304 Not Modified,
+	// in which case nothing was unmarshaled.
+	notModified bool
+
+	// bytes is the size of the response body as transferred, before
+	// decompression.
+	bytes int64
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// getJSON makes a GET request to url and unmarshals its JSON response into v.
+// If token is set, it is sent as a bearer token. If etag is set, the request
+// is conditional on the response having changed since the one with that
+// entity tag.
+//
+// Compression is requested explicitly, rather than leaving it to
+// [http.Transport], so that the bytes transferred can be counted.
+func getJSON(ctx context.Context, url, token, etag string, v any) (ret fetchResponse, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return ret, fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Accept-Encoding", encodingZstd+", "+encodingGzip)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ret, fmt.Errorf("making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	ret.header = resp.Header
+	body := &countingReader{r: resp.Body}
+	defer func() { ret.bytes = body.n }()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && etag != "":
+		ret.notModified = true
+		return ret, nil
+	case resp.StatusCode != http.StatusOK:
+		return ret, httpStatusError(resp.StatusCode)
+	}
+
+	var r io.Reader = body
+	switch resp.Header.Get("Content-Encoding") {
+	case encodingZstd:
+		zr, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return ret, fmt.Errorf("decompressing response: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	case encodingGzip:
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			return ret, fmt.Errorf("decompressing response: %w", err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+	if err := json.UnmarshalRead(r, v); err != nil {
+		return ret, fmt.Errorf("unmarshaling response: %w", err)
+	}
+	return ret, nil
+}
+
+// fetchResultsV1 fetches the results of the remote at addr from its v1 API,
+// authenticating with token if it is set, unless they haven't changed since
+// the response with the given entity tag.
+func fetchResultsV1(ctx context.Context, addr, token, etag string) ([]serviceResult, fetchResponse, error) {
+	var results []serviceResult
+	resp, err := getJSON(ctx, fmt.Sprintf("http://%s/api/v1/results", addr), token, etag, &results)
+	return results, resp, err
+}
+
+// fetchResultsV2 fetches the results of the remote at addr from its v2 API,
+// following cursors until every page has been fetched and authenticating
+// with token if it is set, unless they haven't changed since the response
+// with the given entity tag. The response
+// returned is that of the first page, with the bytes of every page. If the
+// remote doesn't support the v2 API, an error wrapping errNoV2 is returned.
+func fetchResultsV2(ctx context.Context, addr, token, etag string) ([]serviceResult, instanceInfo, fetchResponse, error) {
+	var (
+		results []serviceResult
+		first   fetchResponse
+		cursor  string
+	)
+	for page := range maxResultPages {
+		u := fmt.Sprintf("http://%s/api/v2/results?limit=%d", addr, maxPageSize)
+		if cursor != "" {
+			u += "&cursor=" + url.QueryEscape(cursor)
+		}
+		var resp resultsResponse
+		fr, err := getJSON(ctx, u, token, etag, &resp)
+		first.bytes += fr.bytes
+		if code := httpStatusError(0); errors.As(err, &code) && (code == http.StatusNotFound || code == http.StatusMethodNotAllowed) {
+			return nil, instanceInfo{}, first, fmt.Errorf("%w: %w", errNoV2, err)
+		} else if err != nil {
+			return nil, instanceInfo{}, first, err
+		}
+		if page == 0 {
+			fr.bytes = first.bytes
+			first = fr
+			if fr.notModified {
+				return nil, instanceInfo{}, first, nil
 			}
+			// Only the first page is conditional; later pages
+			// are fetched in full.
+			etag = ""
+		}
+		if resp.SchemaVersion > resultSchemaVersion {
+			return nil, instanceInfo{}, first, fmt.Errorf("%w: remote uses result schema version %d", errNoV2, resp.SchemaVersion)
 		}
+		results = append(results, resp.Results...)
+		if resp.NextCursor == "" {
+			return results, resp.Instance, first, nil
+		}
+		cursor = resp.NextCursor
 	}
+	return nil, instanceInfo{}, first, fmt.Errorf("more than %d pages of results", maxResultPages)
+}
+
+// setRemoteMetrics updates the metrics for the remote or pushed source with
+// the given address or name.
+//
+// s.mu must be held.
+func (s *service) setRemoteMetrics(addr string, st remoteState, now time.Time) {
+	s.metricRemoteStale.Set(addr, st.Stale)
+	s.metricRemoteClockSkew.Set(addr, st.ClockSkew.Seconds())
+	s.metricRemoteStatus.Set(addr, remoteHealthy(st, s.silences.apply(s.remoteResults[addr], addr, s.remoteLabels[addr], now)))
 }
 
 func (fr *fetchRemoteResultService) String() string {
@@ -47,65 +413,108 @@ func (fr *fetchRemoteResultService) String() string {
 }
 
 func (fr *fetchRemoteResultService) fetch(ctx context.Context, addr string) (retErr error) {
-	// Store errors from this fetch
+	// Store errors from this fetch, and work out whether the remote is
+	// healthy even if it failed.
 	s := fr.parent
+	var (
+		results     []serviceResult
+		instance    instanceInfo
+		skew        time.Duration
+		notModified bool
+	)
 	defer func() {
+		now := time.Now()
+
 		s.mu.Lock()
 		defer s.mu.Unlock()
 		if s.remoteErrors == nil {
 			s.remoteErrors = make(map[string]error)
 		}
+		if s.remoteResults == nil {
+			s.remoteResults = make(map[string][]serviceResult)
+		}
+		if s.remoteStates == nil {
+			s.remoteStates = make(map[string]remoteState)
+		}
 		s.remoteErrors[addr] = retErr
+
+		// Keep the last good results if this fetch failed, or if
+		// they haven't changed.
+		st := s.remoteStates[addr]
+		st.policy = fr.policy
+		st.LastAttempt = now
+		if retErr == nil {
+			st.LastSuccess = now
+			st.ClockSkew = skew
+			if !notModified {
+				st.Instance = instance
+				s.remoteResults[addr] = results
+			}
+		}
+		st.Stale = st.isStale(now)
+		s.remoteStates[addr] = st
+
 		s.metricRemoteFetchStatus.Set(addr, retErr == nil)
+		s.setRemoteMetrics(addr, st, now)
 	}()
 
-	// Make a request to the remote instance's JSON endpoint.
-	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/api/v1/results", addr), nil)
-	if err != nil {
-		return fmt.Errorf("creating request: %w", err)
+	if fr.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, fr.timeout)
+		defer cancel()
 	}
-	req.Header.Set("Accept", "application/json")
 
+	// Prefer the v2 API, falling back to v1 for older remotes. Entity
+	// tags are only reused with the API that they came from.
 	t0 := time.Now()
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("making request: %w", err)
+	var (
+		fetched []serviceResult
+		resp    fetchResponse
+		err     error
+	)
+	if fr.v1Since.IsZero() || t0.Sub(fr.v1Since) > renegotiateInterval {
+		if !fr.v1Since.IsZero() {
+			fr.etag = ""
+		}
+		fetched, instance, resp, err = fetchResultsV2(ctx, addr, fr.token, fr.etag)
+		if errors.Is(err, errNoV2) {
+			fr.logger.Info("remote doesn't support the v2 API; using v1", ulog.Error(err))
+			fr.v1Since = t0
+			fr.etag = ""
+		} else {
+			fr.v1Since = time.Time{}
+		}
 	}
-	defer resp.Body.Close()
-
-	// Expect a 200 OK response.
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	if !fr.v1Since.IsZero() {
+		var v1resp fetchResponse
+		fetched, v1resp, err = fetchResultsV1(ctx, addr, fr.token, fr.etag)
+		v1resp.bytes += resp.bytes
+		resp = v1resp
 	}
-
-	// Unmarshal into a slice of serviceResult.
-	var results []serviceResult
-	if err := json.UnmarshalRead(resp.Body, &results); err != nil {
-		return fmt.Errorf("unmarshaling response: %w", err)
+	s.metricRemoteBytes.Add(addr, float64(resp.bytes))
+	if err != nil {
+		return err
+	}
+	t1 := time.Now()
+	results = fetched
+	notModified = resp.notModified
+	if !notModified {
+		fr.etag = resp.header.Get("ETag")
 	}
 
 	// Update metrics
-	s.metricRemoteLatency.Set(addr, float64(time.Since(t0).Seconds()))
+	s.metricRemoteLatency.Set(addr, float64(t1.Sub(t0).Seconds()))
 
-	ok := true
-	for _, result := range results {
-		if !result.IsSuccess() {
-			ok = false
-			break
-		}
+	skew = estimateClockSkew(resp.header.Get("Date"), t0, t1, results)
+	if fr.policy.MaxClockSkew > 0 && skew.Abs() > fr.policy.MaxClockSkew {
+		fr.logger.Warn("remote clock is skewed", slog.Duration("skew", skew))
 	}
-	s.metricRemoteStatus.Set(addr, ok)
 
 	fr.logger.Debug("fetched remote results",
-		slog.Duration("duration", time.Since(t0)),
+		slog.Duration("duration", t1.Sub(t0)),
 		slog.Int("count", len(results)),
+		slog.Bool("not_modified", notModified),
+		slog.Int64("bytes", resp.bytes),
 	)
-
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.remoteResults == nil {
-		s.remoteResults = make(map[string][]serviceResult)
-	}
-	s.remoteResults[addr] = results
 	return nil
 }
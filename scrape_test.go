@@ -2,21 +2,34 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/go-json-experiment/json"
+	"github.com/google/go-cmp/cmp"
 	"github.com/neilotoole/slogt"
 
 	"github.com/andrew-d/upchek/internal/runner"
 )
 
+// newV1Server returns a server that, like an older upchek, only serves the
+// v1 results API, with h.
+func newV1Server(h http.HandlerFunc) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/results", h)
+	return httptest.NewServer(mux)
+}
+
 func TestScrape(t *testing.T) {
 	// Launch a http server that serves a JSON response.
 	fakeNow := time.Unix(1741397010, 0)
-	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	srv := newV1Server(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
 		sr := []serviceResult{{
@@ -28,7 +41,7 @@ func TestScrape(t *testing.T) {
 			LastRun: fakeNow,
 		}}
 		json.MarshalWrite(w, sr)
-	}))
+	})
 	defer srv.Close()
 
 	addr := srv.Listener.Addr().String()
@@ -53,14 +66,48 @@ func TestScrape(t *testing.T) {
 	}
 }
 
+// Verify that a remote's token is sent as a bearer token.
+func TestScrapeToken(t *testing.T) {
+	srv := newV1Server(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.MarshalWrite(w, []serviceResult{})
+	})
+	defer srv.Close()
+
+	addr := srv.Listener.Addr().String()
+	s := &service{
+		logger:      slogt.New(t),
+		remoteAddrs: []string{addr},
+	}
+	s.initMetrics()
+	fr := &fetchRemoteResultService{
+		parent: s,
+		addr:   addr,
+		logger: s.logger,
+	}
+
+	ctx := context.Background()
+	if err := fr.fetch(ctx, addr); err == nil {
+		t.Error("fetch() without a token: error = nil, want error")
+	}
+	fr.token = "secret"
+	if err := fr.fetch(ctx, addr); err != nil {
+		t.Errorf("fetch() with a token: error = %v", err)
+	}
+}
+
 // Verify that scraping a page that 500s results in an error.
 func TestScrapeError(t *testing.T) {
 	// Launch a http server that serves a JSON response.
-	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	srv := newV1Server(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.MarshalWrite(w, []serviceResult{})
-	}))
+	})
 	defer srv.Close()
 
 	addr := srv.Listener.Addr().String()
@@ -92,3 +139,398 @@ func TestScrapeError(t *testing.T) {
 		t.Fatalf("expected fetch status for %q to be %q, got %q", addr, want, got)
 	}
 }
+
+// Verify that a failed fetch keeps the last good results until they become
+// stale.
+func TestScrapeStale(t *testing.T) {
+	var fail atomic.Bool
+	srv := newV1Server(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.MarshalWrite(w, []serviceResult{{
+			Result:  &runner.Result{Name: "foo", ExitCode: 1},
+			LastRun: time.Now(),
+		}})
+	})
+	defer srv.Close()
+
+	addr := srv.Listener.Addr().String()
+	s := &service{
+		logger:      slogt.New(t),
+		remoteAddrs: []string{addr},
+	}
+	s.initMetrics()
+	fr := &fetchRemoteResultService{
+		parent: s,
+		addr:   addr,
+		logger: s.logger,
+		policy: remotePolicy{StaleAfter: time.Hour, OnStale: staleActionIgnore},
+	}
+
+	ctx := context.Background()
+	if err := fr.fetch(ctx, addr); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fail.Store(true)
+	if err := fr.fetch(ctx, addr); err == nil {
+		t.Fatal("expected error")
+	}
+
+	st := s.remoteStates[addr]
+	if st.LastSuccess.IsZero() || !st.LastAttempt.After(st.LastSuccess) || st.Stale {
+		t.Errorf("state = %+v, want a fresh success before the last attempt", st)
+	}
+	if got := len(s.remoteResults[addr]); got != 1 {
+		t.Errorf("got %d results, want the last good result", got)
+	}
+	if got := s.metricRemoteStatus.Get(addr).String(); got != "0" {
+		t.Errorf("remote status = %s, want failing from the last good result", got)
+	}
+
+	// Once stale, the remote's policy decides its health.
+	if !st.isStale(st.LastSuccess.Add(2 * time.Hour)) {
+		t.Error("isStale() = false after StaleAfter")
+	}
+	st.Stale = true
+	if !remoteHealthy(st, s.remoteResults[addr]) {
+		t.Error("remoteHealthy() = false for ignored stale remote")
+	}
+}
+
+func TestEstimateClockSkew(t *testing.T) {
+	start := time.Unix(1741397010, 0)
+	end := start.Add(200 * time.Millisecond)
+	ahead := func(d time.Duration) string {
+		return start.Add(d).UTC().Format(http.TimeFormat)
+	}
+	tests := []struct {
+		name    string
+		date    string
+		lastRun time.Duration // relative to end
+		want    time.Duration
+	}{
+		{"in_sync", ahead(0), -time.Minute, 0},
+		{"ahead", ahead(time.Minute), -time.Minute, time.Minute},
+		{"behind", ahead(-time.Minute), -time.Minute, -time.Minute},
+		{"behind_recent_run", ahead(-time.Minute), -time.Second, -time.Minute},
+		{"last_run_in_future", ahead(time.Minute), 90 * time.Second, 90 * time.Second},
+		{"no_date", "", 5 * time.Second, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := []serviceResult{{Result: &runner.Result{Name: "foo"}, LastRun: end.Add(tt.lastRun)}}
+			if got := estimateClockSkew(tt.date, start, end, results); got != tt.want {
+				t.Errorf("estimateClockSkew() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	now := time.Now()
+	results := []serviceResult{{Result: &runner.Result{Name: "foo"}, LastRun: now.Add(-time.Minute)}}
+	if got := clockSkew(now.Add(1500*time.Millisecond), now, now, results); got != 1500*time.Millisecond {
+		t.Errorf("clockSkew() = %v, want 1.5s", got)
+	}
+	if got := clockSkew(time.Time{}, now, now, results); got != 0 {
+		t.Errorf("clockSkew() without a remote time = %v, want 0", got)
+	}
+}
+
+func TestRemoteBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		failures int
+		want     time.Duration // with maximum jitter
+	}{
+		{"first_failure", time.Minute, 1, time.Minute},
+		{"doubles", time.Minute, 3, 4 * time.Minute},
+		{"capped", time.Minute, 10, maxRemoteBackoff},
+		{"long_interval", time.Hour, 3, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := remoteBackoff(tt.interval, tt.failures, 1); got != tt.want {
+				t.Errorf("remoteBackoff(jitter=1) = %v, want %v", got, tt.want)
+			}
+			if got := remoteBackoff(tt.interval, tt.failures, 0); got != tt.want/2 {
+				t.Errorf("remoteBackoff(jitter=0) = %v, want %v", got, tt.want/2)
+			}
+		})
+	}
+}
+
+// Verify that a fetch that takes longer than the remote's timeout fails.
+func TestScrapeTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	addr := srv.Listener.Addr().String()
+	s := &service{
+		logger:      slogt.New(t),
+		remoteAddrs: []string{addr},
+	}
+	s.initMetrics()
+	fr := &fetchRemoteResultService{
+		parent:  s,
+		addr:    addr,
+		timeout: 50 * time.Millisecond,
+		logger:  s.logger,
+	}
+
+	start := time.Now()
+	if err := fr.fetch(t.Context(), addr); err == nil {
+		t.Fatal("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("fetch took %v, want it to time out", elapsed)
+	}
+}
+
+// Verify that an unreachable remote doesn't stop the fetcher, which keeps
+// retrying and records the error.
+func TestScrapeUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	addr := srv.Listener.Addr().String()
+	srv.Close()
+
+	s := &service{
+		logger:      slogt.New(t),
+		remoteAddrs: []string{addr},
+	}
+	s.initMetrics()
+	fr := &fetchRemoteResultService{
+		parent:   s,
+		addr:     addr,
+		interval: 10 * time.Millisecond,
+		timeout:  time.Second,
+		logger:   s.logger,
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 200*time.Millisecond)
+	defer cancel()
+	if err := fr.Serve(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Serve() = %v, want it to run until the context is done", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.remoteErrors[addr] == nil {
+		t.Error("no error recorded for unreachable remote")
+	}
+}
+
+// Verify that the v2 API is used when the remote supports it, following
+// cursors across pages.
+func TestScrapeV2(t *testing.T) {
+	var v1Calls atomic.Int32
+	s := &service{
+		logger: slogt.New(t),
+		instance: instanceInfo{
+			Hostname: "remote-host",
+			ID:       "abc123",
+			Version:  "v1.2.3",
+		},
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		s.results = append(s.results, serviceResult{
+			Result:  &runner.Result{Name: name},
+			LastRun: time.Now(),
+		})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/results", func(w http.ResponseWriter, r *http.Request) {
+		v1Calls.Add(1)
+		s.handleResultsAPI(w, r)
+	})
+	mux.HandleFunc("GET /api/v2/results", func(w http.ResponseWriter, r *http.Request) {
+		// Force small pages.
+		q := r.URL.Query()
+		q.Set("limit", "2")
+		r.URL.RawQuery = q.Encode()
+		s.handleResultsAPIv2(w, r)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	addr := srv.Listener.Addr().String()
+	local := &service{
+		logger:      slogt.New(t),
+		remoteAddrs: []string{addr},
+	}
+	local.initMetrics()
+	fr := &fetchRemoteResultService{
+		parent: local,
+		addr:   addr,
+		logger: local.logger,
+	}
+	if err := fr.fetch(t.Context(), addr); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var names []string
+	for _, r := range local.remoteResults[addr] {
+		names = append(names, r.Name)
+	}
+	if diff := cmp.Diff([]string{"a", "b", "c"}, names); diff != "" {
+		t.Errorf("results mismatch (-want +got):\n%s", diff)
+	}
+	if got := local.remoteStates[addr].Instance; got.ID != "abc123" || got.Version != "v1.2.3" {
+		t.Errorf("instance = %+v, want the remote's", got)
+	}
+	if v1Calls.Load() != 0 || !fr.v1Since.IsZero() {
+		t.Error("fell back to the v1 API for a remote supporting v2")
+	}
+}
+
+// Verify that the v1 API is used for older remotes, and that v2 isn't tried
+// again until it's time to renegotiate.
+func TestScrapeV1Fallback(t *testing.T) {
+	var v2Calls atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/results", func(w http.ResponseWriter, r *http.Request) {
+		json.MarshalWrite(w, []serviceResult{{Result: &runner.Result{Name: "foo"}, LastRun: time.Now()}})
+	})
+	mux.HandleFunc("/api/v2/", func(w http.ResponseWriter, r *http.Request) {
+		v2Calls.Add(1)
+		http.NotFound(w, r)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	addr := srv.Listener.Addr().String()
+	s := &service{
+		logger:      slogt.New(t),
+		remoteAddrs: []string{addr},
+	}
+	s.initMetrics()
+	fr := &fetchRemoteResultService{
+		parent: s,
+		addr:   addr,
+		logger: s.logger,
+	}
+	for range 2 {
+		if err := fr.fetch(t.Context(), addr); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if got := len(s.remoteResults[addr]); got != 1 {
+		t.Errorf("got %d results, want 1", got)
+	}
+	if got := v2Calls.Load(); got != 1 {
+		t.Errorf("v2 API tried %d times, want once", got)
+	}
+
+	fr.v1Since = fr.v1Since.Add(-renegotiateInterval - time.Minute)
+	if err := fr.fetch(t.Context(), addr); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := v2Calls.Load(); got != 2 {
+		t.Errorf("v2 API tried %d times after renegotiate interval, want twice", got)
+	}
+}
+
+// Verify that unchanged results are fetched with a conditional request, and
+// that the bytes fetched are counted.
+func TestScrapeNotModified(t *testing.T) {
+	remote := &service{
+		logger:   slogt.New(t),
+		instance: instanceInfo{ID: "abc123", StartTime: time.Now()},
+		results: []serviceResult{{
+			Result:  &runner.Result{Name: "foo", Stdout: strings.Repeat("all is well\n", 200)},
+			LastRun: time.Now(),
+		}},
+	}
+	var (
+		notModified atomic.Int32
+		gzipOnly    atomic.Bool
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v2/results", func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Accept-Encoding"), "zstd, gzip"; got != want {
+			t.Errorf("Accept-Encoding = %q, want %q", got, want)
+		}
+		// Older instances only support gzip.
+		if gzipOnly.Load() {
+			r.Header.Set("Accept-Encoding", "gzip")
+		}
+		rec := httptest.NewRecorder()
+		remote.handleResultsAPIv2(rec, r)
+		if rec.Code == http.StatusNotModified {
+			notModified.Add(1)
+		}
+		maps.Copy(w.Header(), rec.Header())
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	addr := srv.Listener.Addr().String()
+	s := &service{
+		logger:      slogt.New(t),
+		remoteAddrs: []string{addr},
+	}
+	s.initMetrics()
+	fr := &fetchRemoteResultService{
+		parent: s,
+		addr:   addr,
+		logger: s.logger,
+	}
+	fetch := func() {
+		t.Helper()
+		if err := fr.fetch(t.Context(), addr); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := len(s.remoteResults[addr]); got != 1 {
+			t.Fatalf("got %d results, want 1", got)
+		}
+		if got := s.remoteStates[addr].Instance.ID; got != "abc123" {
+			t.Fatalf("instance ID = %q, want %q", got, "abc123")
+		}
+	}
+	bytes := func() float64 {
+		return s.metricRemoteBytes.Get(addr).(*expvar.Float).Value()
+	}
+
+	fetch()
+	full := bytes()
+	if full == 0 || full > 1000 {
+		t.Errorf("fetched %v bytes, want a compressed response", full)
+	}
+
+	fetch()
+	if got := notModified.Load(); got != 1 {
+		t.Errorf("got %d 304 responses, want 1", got)
+	}
+	if got := bytes() - full; got != 0 {
+		t.Errorf("fetched %v bytes for unchanged results, want 0", got)
+	}
+
+	remote.mu.Lock()
+	remote.resultsVersion.changed(time.Now())
+	remote.mu.Unlock()
+	fetch()
+	if got := notModified.Load(); got != 1 {
+		t.Errorf("got %d 304 responses after results changed, want 1", got)
+	}
+
+	// gzip is still understood from remotes that don't support zstd.
+	gzipOnly.Store(true)
+	remote.mu.Lock()
+	remote.resultsVersion.changed(time.Now())
+	remote.mu.Unlock()
+	before := bytes()
+	fetch()
+	if got := bytes() - before; got == 0 || got > 1000 {
+		t.Errorf("fetched %v bytes from a gzip-only remote, want a compressed response", got)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// isTrustedScript returns whether the file at path may use privileged
+// directives; it is always false on this platform.
+func isTrustedScript(path string) bool {
+	return false
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrew-d/upchek/internal/ulog"
+)
+
+// sdNotifier reports upchek's state to systemd over the notify socket, for
+// services with Type=notify; see sd_notify(3).
+//
+// It sends READY=1 once the first pass over the scripts has finished, STATUS=
+// lines summarising the local results, and, if the unit has WatchdogSec= set,
+// WATCHDOG=1 pings for as long as the scheduler loop is making progress.
+type sdNotifier struct {
+	logger *slog.Logger
+
+	// addr is the address of the notify socket.
+	addr string
+
+	// watchdog is the watchdog timeout, or zero if the watchdog is
+	// disabled.
+	watchdog time.Duration
+
+	// service is the service whose progress and results are reported.
+	service *service
+}
+
+// sdStatusInterval is how often the STATUS= line is updated if the watchdog
+// is disabled; otherwise, it's updated with every watchdog ping.
+const sdStatusInterval = 10 * time.Second
+
+// parseNotifyEnv returns the notify socket address and watchdog timeout for
+// the process with the given PID, from the NOTIFY_SOCKET, WATCHDOG_USEC and
+// WATCHDOG_PID environment variables as looked up by getenv. The address is
+// empty if upchek wasn't started by systemd with Type=notify.
+func parseNotifyEnv(pid int, getenv func(string) string) (addr string, watchdog time.Duration, err error) {
+	addr = getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return "", 0, nil
+	}
+
+	usec := getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return addr, 0, nil
+	}
+	if p := getenv("WATCHDOG_PID"); p != "" && p != strconv.Itoa(pid) {
+		// The watchdog is meant for some other process.
+		return addr, 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return "", 0, fmt.Errorf("invalid WATCHDOG_USEC %q", usec)
+	}
+	return addr, time.Duration(n) * time.Microsecond, nil
+}
+
+// newSDNotifier returns a notifier for the notify socket passed to upchek by
+// systemd, or nil if there isn't one. It removes the environment variables
+// describing the socket, so that they aren't passed on to checks, and so must
+// only be called once.
+func newSDNotifier(logger *slog.Logger, service *service) (*sdNotifier, error) {
+	addr, watchdog, err := parseNotifyEnv(os.Getpid(), os.Getenv)
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	if err != nil || addr == "" {
+		return nil, err
+	}
+	return &sdNotifier{
+		logger:   logger,
+		addr:     addr,
+		watchdog: watchdog,
+		service:  service,
+	}, nil
+}
+
+// notify sends a message to systemd, made up of newline-separated
+// "VARIABLE=value" assignments.
+func (n *sdNotifier) notify(state ...string) error {
+	// An address starting with "@" is in the abstract namespace, which
+	// the net package handles for us.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: n.addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(state, "\n")))
+	return err
+}
+
+// Serve implements the suture.Service interface.
+func (n *sdNotifier) Serve(ctx context.Context) error {
+	if n.logger == nil {
+		n.logger = slog.Default()
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.service.progress.readyc():
+	}
+
+	status := "STATUS=" + n.service.statusSummary()
+	if err := n.notify("READY=1", status); err != nil {
+		n.logger.Warn("failed to notify systemd", ulog.Error(err))
+	}
+
+	// Ping the watchdog at half its timeout, as sd_watchdog_enabled(3)
+	// recommends.
+	interval := sdStatusInterval
+	if n.watchdog > 0 {
+		interval = n.watchdog / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	wedged := false
+	for {
+		select {
+		case <-ctx.Done():
+			if err := n.notify("STOPPING=1"); err != nil {
+				n.logger.Warn("failed to notify systemd", ulog.Error(err))
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		var msg []string
+		if s := "STATUS=" + n.service.statusSummary(); s != status {
+			status = s
+			msg = append(msg, s)
+		}
+		if n.watchdog > 0 {
+			// Let systemd restart us if the scheduler is wedged,
+			// rather than keep pinging from this goroutine.
+			if n.service.progress.ok(time.Now()) {
+				msg = append(msg, "WATCHDOG=1")
+				wedged = false
+			} else if !wedged {
+				n.logger.Error("scripts are not being run; no longer pinging the systemd watchdog")
+				wedged = true
+			}
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		if err := n.notify(msg...); err != nil {
+			n.logger.Warn("failed to notify systemd", ulog.Error(err))
+		}
+	}
+}
+
+// progressSlack is how long the scheduler loop may take to do anything other
+// than run a script or wait for the next one to be due.
+const progressSlack = 30 * time.Second
+
+// progress tracks whether the scheduler loop is making progress, for the
+// systemd watchdog.
+//
+// The zero value is ready to use.
+type progress struct {
+	// deadline is the time, in Unix nanoseconds, by which the loop must
+	// next make progress, or zero if there is no deadline.
+	deadline atomic.Int64
+
+	mu        sync.Mutex
+	ready     chan struct{} // closed after the first pass; created lazily
+	readyOnce sync.Once
+}
+
+// expect records that the scheduler loop will make progress within d.
+func (p *progress) expect(d time.Duration) {
+	p.deadline.Store(time.Now().Add(d).UnixNano())
+}
+
+// ok reports whether the scheduler loop is on schedule as of now.
+func (p *progress) ok(now time.Time) bool {
+	d := p.deadline.Load()
+	return d == 0 || now.UnixNano() < d
+}
+
+// readyc returns a channel that is closed once the first pass over the
+// scripts has finished.
+func (p *progress) readyc() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ready == nil {
+		p.ready = make(chan struct{})
+	}
+	return p.ready
+}
+
+// markReady records that the first pass over the scripts has finished.
+func (p *progress) markReady() {
+	p.readyOnce.Do(func() {
+		p.readyc()
+		close(p.ready)
+	})
+}
+
+// statusSummary summarises the local results for systemd, e.g. "12 ok, 1
+// failing".
+func (s *service) statusSummary() string {
+	counts := make(map[string]int)
+	for _, r := range s.localResults() {
+		switch {
+		case r.IsHealthy():
+			counts["ok"]++
+		case r.Suppressed:
+			counts["suppressed"]++
+		case r.Silenced:
+			counts["silenced"]++
+		case r.IsError():
+			counts["error"]++
+		default:
+			counts["failing"]++
+		}
+	}
+
+	var parts []string
+	for _, label := range []string{"ok", "failing", "error", "silenced", "suppressed"} {
+		if n := counts[label]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, label))
+		}
+	}
+	if len(parts) == 0 {
+		return "no checks"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+
+	"github.com/andrew-d/upchek/internal/runner"
+)
+
+func TestParseNotifyEnv(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantAddr     string
+		wantWatchdog time.Duration
+		wantErr      bool
+	}{
+		{
+			name: "not_notify",
+			env:  map[string]string{"WATCHDOG_USEC": "1000000"},
+		},
+		{
+			name:     "no_watchdog",
+			env:      map[string]string{"NOTIFY_SOCKET": "/run/systemd/notify"},
+			wantAddr: "/run/systemd/notify",
+		},
+		{
+			name:         "watchdog",
+			env:          map[string]string{"NOTIFY_SOCKET": "@notify", "WATCHDOG_USEC": "30000000", "WATCHDOG_PID": "42"},
+			wantAddr:     "@notify",
+			wantWatchdog: 30 * time.Second,
+		},
+		{
+			name:     "other_process_watchdog",
+			env:      map[string]string{"NOTIFY_SOCKET": "@notify", "WATCHDOG_USEC": "30000000", "WATCHDOG_PID": "7"},
+			wantAddr: "@notify",
+		},
+		{
+			name:    "bad_watchdog",
+			env:     map[string]string{"NOTIFY_SOCKET": "@notify", "WATCHDOG_USEC": "soon"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, watchdog, err := parseNotifyEnv(42, func(k string) string { return tt.env[k] })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNotifyEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if addr != tt.wantAddr || watchdog != tt.wantWatchdog {
+				t.Errorf("parseNotifyEnv() = %q, %v; want %q, %v", addr, watchdog, tt.wantAddr, tt.wantWatchdog)
+			}
+		})
+	}
+}
+
+func TestSDNotifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	sock, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	// next returns the next message sent to the socket, or "" if there
+	// isn't one within timeout.
+	next := func(timeout time.Duration) string {
+		t.Helper()
+		buf := make([]byte, 1024)
+		sock.SetReadDeadline(time.Now().Add(timeout))
+		n, err := sock.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return ""
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+	want := func(msg string) {
+		t.Helper()
+		if got := next(5 * time.Second); got != msg {
+			t.Fatalf("got message %q, want %q", got, msg)
+		}
+	}
+
+	s := &service{
+		logger:  slogt.New(t),
+		results: []serviceResult{{Result: &runner.Result{Name: "good.sh"}}, {Result: failureResult()}},
+	}
+	n := &sdNotifier{
+		logger:   slogt.New(t),
+		addr:     path,
+		watchdog: 40 * time.Millisecond,
+		service:  s,
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	errc := make(chan error, 1)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		errc <- n.Serve(ctx)
+	}()
+	// Don't let Serve log after the test has finished.
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	// Nothing is sent until the first pass has finished.
+	if msg := next(100 * time.Millisecond); msg != "" {
+		t.Fatalf("got message %q before first pass", msg)
+	}
+	s.progress.expect(time.Minute)
+	s.progress.markReady()
+	want("READY=1\nSTATUS=1 ok, 1 failing")
+	want("WATCHDOG=1")
+
+	// The status is only sent when it changes.
+	s.mu.Lock()
+	s.results = append(s.results, serviceResult{Result: &runner.Result{Name: "error.sh", ExitCode: -1}, State: statusError})
+	s.mu.Unlock()
+	want("STATUS=1 ok, 1 failing, 1 error\nWATCHDOG=1")
+
+	// Pings stop while the scheduler is behind, and resume once it
+	// catches up.
+	s.progress.expect(-time.Second)
+	for next(60*time.Millisecond) != "" {
+	}
+	if msg := next(200 * time.Millisecond); msg != "" {
+		t.Errorf("got message %q while scheduler is wedged", msg)
+	}
+	s.progress.expect(time.Minute)
+	want("WATCHDOG=1")
+
+	cancel()
+	for {
+		if msg := next(5 * time.Second); msg != "WATCHDOG=1" {
+			if msg != "STOPPING=1" {
+				t.Errorf("got message %q, want STOPPING=1", msg)
+			}
+			break
+		}
+	}
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("Serve() = %v, want context.Canceled", err)
+	}
+}
+
+func TestProgressHungScript(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hang.sh"), []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := &service{
+		logger:        slogt.New(t),
+		dirs:          []directoryConfig{{Path: dir}},
+		checkDefaults: checkConfig{Interval: time.Minute},
+	}
+	s.initMetrics()
+	s.progress.expect(-time.Hour)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runScripts(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Wait for the script to start.
+	for start := time.Now(); !s.progress.ok(time.Now()); {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("script didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The script has no timeout, so it counts as progress for its
+	// interval, but no longer.
+	if s.progress.ok(time.Now().Add(time.Minute + progressSlack + time.Second)) {
+		t.Error("progress ok after a script without a timeout has run for longer than its interval")
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-json-experiment/json"
+
+	"github.com/andrew-d/upchek/internal/ulog"
+)
+
+// Labels that a silence can match on.
+const (
+	labelCheck     = "check"     // the qualified name of the check
+	labelNamespace = "namespace" // the namespace of the check, if any
+	labelGroup     = "group"     // the group of the check, if any
+	labelRemote    = "remote"    // the remote address, or "local" for local checks
+)
+
+// localRemote is the value of the "remote" label for local checks.
+const localRemote = "local"
+
+// silenceRetention is how long an expired silence is kept before it is
+// removed entirely.
+const silenceRetention = 7 * 24 * time.Hour
+
+// silence suppresses the effect of matching checks on the overall health
+// for a period of time, e.g. during planned maintenance.
+//
+// Silenced checks continue to run and show their real result, but do not
+// count towards /healthz or the overall status.
+type silence struct {
+	// ID uniquely identifies the silence.
+	ID string
+
+	// Matchers are the conditions that a check must satisfy to be
+	// silenced; all matchers must match.
+	Matchers []silenceMatcher
+
+	// StartsAt is the time from which the silence is in effect.
+	StartsAt time.Time
+	// EndsAt is the time at which the silence stops being in effect. It
+	// may be zero for recurring silences that never end.
+	EndsAt time.Time `json:",omitzero"`
+
+	// Recurrence, if set, restricts the silence to a daily window
+	// between StartsAt and EndsAt.
+	Recurrence *recurrence `json:",omitzero"`
+
+	// CreatedBy is the author of the silence.
+	CreatedBy string
+	// Comment describes why the silence was created.
+	Comment string
+	// CreatedAt is the time that the silence was created.
+	CreatedAt time.Time
+}
+
+// silenceMatcher matches a single label of a check against a glob pattern,
+// using the syntax of [path.Match].
+type silenceMatcher struct {
+	Label   string
+	Pattern string
+}
+
+// recurrence is a daily window during which a silence is in effect.
+type recurrence struct {
+	// Start is the time of day at which the window starts, in "15:04"
+	// format and the server's local time zone.
+	Start string
+
+	// Duration is the length of the window, as parsed by
+	// [time.ParseDuration]; at most 24h.
+	Duration string
+
+	// Weekdays restricts the window to the given days, named by their
+	// three-letter abbreviation (e.g. "mon"); if empty, the window
+	// applies every day. The day is that on which the window starts.
+	Weekdays []string `json:",omitzero"`
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// validate checks that the silence is well-formed.
+func (sl *silence) validate() error {
+	if len(sl.Matchers) == 0 {
+		return errors.New("at least one matcher is required")
+	}
+	for _, m := range sl.Matchers {
+		switch m.Label {
+		case labelCheck, labelNamespace, labelGroup, labelRemote:
+		default:
+			name, ok := strings.CutPrefix(m.Label, remoteLabelPrefix)
+			if !ok || validateLabelName(name) != nil {
+				return fmt.Errorf("unknown matcher label %q", m.Label)
+			}
+		}
+		if _, err := path.Match(m.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q for label %q: %w", m.Pattern, m.Label, err)
+		}
+	}
+	if sl.CreatedBy == "" {
+		return errors.New("CreatedBy is required")
+	}
+	if sl.Comment == "" {
+		return errors.New("Comment is required")
+	}
+	if sl.Recurrence == nil && sl.EndsAt.IsZero() {
+		return errors.New("EndsAt is required for non-recurring silences")
+	}
+	if !sl.EndsAt.IsZero() && !sl.EndsAt.After(sl.StartsAt) {
+		return errors.New("EndsAt must be after StartsAt")
+	}
+	if r := sl.Recurrence; r != nil {
+		if _, err := time.Parse("15:04", r.Start); err != nil {
+			return fmt.Errorf("invalid recurrence start %q: %w", r.Start, err)
+		}
+		d, err := time.ParseDuration(r.Duration)
+		if err != nil {
+			return fmt.Errorf("invalid recurrence duration %q: %w", r.Duration, err)
+		}
+		if d <= 0 || d > 24*time.Hour {
+			return fmt.Errorf("recurrence duration must be between 0 and 24h, got %v", d)
+		}
+		for _, day := range r.Weekdays {
+			if _, ok := weekdayNames[day]; !ok {
+				return fmt.Errorf("invalid weekday %q", day)
+			}
+		}
+	}
+	return nil
+}
+
+// isActive returns whether the silence is in effect at time now.
+func (sl *silence) isActive(now time.Time) bool {
+	if now.Before(sl.StartsAt) {
+		return false
+	}
+	if !sl.EndsAt.IsZero() && !now.Before(sl.EndsAt) {
+		return false
+	}
+
+	r := sl.Recurrence
+	if r == nil {
+		return true
+	}
+
+	// Errors are ignored here since the silence has been validated.
+	start, _ := time.Parse("15:04", r.Start)
+	dur, _ := time.ParseDuration(r.Duration)
+
+	// The window that contains now either started today or, if it
+	// crosses midnight, yesterday.
+	local := now.Local()
+	for _, daysAgo := range []int{0, 1} {
+		day := local.AddDate(0, 0, -daysAgo)
+		windowStart := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), 0, 0, time.Local)
+		if len(r.Weekdays) > 0 && !slices.ContainsFunc(r.Weekdays, func(name string) bool {
+			return weekdayNames[name] == windowStart.Weekday()
+		}) {
+			continue
+		}
+		if !now.Before(windowStart) && now.Before(windowStart.Add(dur)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExpired returns whether the silence will never be in effect again.
+func (sl *silence) isExpired(now time.Time) bool {
+	return !sl.EndsAt.IsZero() && !now.Before(sl.EndsAt)
+}
+
+// Status returns a human-readable status of the silence at time now: one of
+// "active", "pending" or "expired".
+func (sl *silence) Status(now time.Time) string {
+	switch {
+	case sl.isExpired(now):
+		return "expired"
+	case sl.isActive(now):
+		return "active"
+	default:
+		return "pending"
+	}
+}
+
+// matches returns whether all of the silence's matchers match the given
+// labels.
+func (sl *silence) matches(labels map[string]string) bool {
+	for _, m := range sl.Matchers {
+		if ok, _ := path.Match(m.Pattern, labels[m.Label]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// resultLabels returns the labels of a result that silences can match on,
+// including the labels of its remote prefixed with "remote.". The remote
+// address is empty for local results.
+func resultLabels(r *serviceResult, remote string, remoteLabels map[string]string) map[string]string {
+	if remote == "" {
+		remote = localRemote
+	}
+	labels := map[string]string{
+		labelCheck:     r.Name,
+		labelNamespace: r.Namespace,
+		labelGroup:     r.Group,
+		labelRemote:    remote,
+	}
+	for name, value := range remoteLabels {
+		labels[remoteLabelPrefix+name] = value
+	}
+	return labels
+}
+
+// silenceStore holds the set of silences, and persists them to disk.
+type silenceStore struct {
+	// path is the file that silences are persisted to; if empty,
+	// silences are not persisted.
+	path string
+
+	mu       sync.RWMutex // protects following
+	silences []*silence
+}
+
+// loadSilences returns a silenceStore persisted at the given path. It is not
+// an error for the file to not exist.
+func loadSilences(path string) (*silenceStore, error) {
+	st := &silenceStore{path: path}
+	if path == "" {
+		return st, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading silences: %w", err)
+	}
+	if err := json.Unmarshal(data, &st.silences); err != nil {
+		return nil, fmt.Errorf("parsing silences from %q: %w", path, err)
+	}
+	return st, nil
+}
+
+// save persists the silences to disk. The caller must hold st.mu.
+func (st *silenceStore) save() error {
+	if st.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(st.silences)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(st.path, data)
+}
+
+// list returns a copy of all silences.
+func (st *silenceStore) list() []silence {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	ret := make([]silence, 0, len(st.silences))
+	for _, sl := range st.silences {
+		ret = append(ret, *sl)
+	}
+	return ret
+}
+
+// active returns the IDs of the silences in effect at time now.
+//
+// It is safe to call active on a nil silenceStore.
+func (st *silenceStore) active(now time.Time) []string {
+	if st == nil {
+		return nil
+	}
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	var ids []string
+	for _, sl := range st.silences {
+		if sl.isActive(now) {
+			ids = append(ids, sl.ID)
+		}
+	}
+	return ids
+}
+
+// add validates and adds a new silence, assigning it an ID, and returns it.
+func (st *silenceStore) add(sl silence, now time.Time) (silence, error) {
+	sl.ID = newID()
+	sl.CreatedAt = now
+	if sl.StartsAt.IsZero() {
+		sl.StartsAt = now
+	}
+	if err := sl.validate(); err != nil {
+		return silence{}, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	// Drop silences that expired long ago while we're here.
+	st.silences = slices.DeleteFunc(st.silences, func(old *silence) bool {
+		return old.isExpired(now.Add(-silenceRetention))
+	})
+	st.silences = append(st.silences, &sl)
+	return sl, st.save()
+}
+
+// expire ends the silence with the given ID at time now. It returns false if
+// no such silence exists.
+func (st *silenceStore) expire(id string, now time.Time) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	i := slices.IndexFunc(st.silences, func(sl *silence) bool { return sl.ID == id })
+	if i < 0 {
+		return false, nil
+	}
+	if sl := st.silences[i]; !sl.isExpired(now) {
+		sl.EndsAt = now
+		if sl.StartsAt.After(now) {
+			sl.StartsAt = now
+		}
+	}
+	return true, st.save()
+}
+
+// apply marks the results that are matched by an active silence, returning
+// a copy of results. The remote address and labels are empty for local
+// results.
+//
+// It is safe to call apply on a nil silenceStore.
+func (st *silenceStore) apply(results []serviceResult, remote string, remoteLabels map[string]string, now time.Time) []serviceResult {
+	if st == nil {
+		return results
+	}
+
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	ret := slices.Clone(results)
+	for i := range ret {
+		r := &ret[i]
+		labels := resultLabels(r, remote, remoteLabels)
+		for _, sl := range st.silences {
+			if sl.isActive(now) && sl.matches(labels) {
+				r.Silenced = true
+				r.SilencedBy = append(slices.Clip(r.SilencedBy), sl.ID)
+			}
+		}
+	}
+	return ret
+}
+
+// newID returns a new random ID, for silences and incidents.
+func newID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// writeFileAtomic writes data to the file at path, by writing to a
+// temporary file and then renaming it into place.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op after a successful rename
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// silenceJSON is the representation of a silence in the API, which
+// includes its current status.
+type silenceJSON struct {
+	silence
+	Status string
+}
+
+func (s *service) handleListSilences(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	var ret []silenceJSON
+	for _, sl := range s.silences.list() {
+		if r.URL.Query().Has("active") && !sl.isActive(now) {
+			continue
+		}
+		ret = append(ret, silenceJSON{sl, sl.Status(now)})
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+func (s *service) handleCreateSilence(w http.ResponseWriter, r *http.Request) {
+	var sl silence
+	if err := json.UnmarshalRead(r.Body, &sl); err != nil {
+		http.Error(w, fmt.Sprintf("invalid silence: %v", err), http.StatusBadRequest)
+		return
+	}
+	if sl.CreatedBy == "" {
+		sl.CreatedBy = authTokenName(r.Context())
+	}
+
+	now := time.Now()
+	created, err := s.silences.add(sl, now)
+	if err != nil && created.ID == "" {
+		http.Error(w, fmt.Sprintf("invalid silence: %v", err), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		s.logger.Error("failed to persist silences", ulog.Error(err))
+	}
+
+	s.logger.Info("created silence",
+		slog.String("id", created.ID),
+		slog.String("created_by", created.CreatedBy),
+		slog.String("comment", created.Comment))
+	writeJSON(w, http.StatusCreated, silenceJSON{created, created.Status(now)})
+}
+
+func (s *service) handleExpireSilence(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	found, err := s.silences.expire(id, time.Now())
+	if err != nil {
+		s.logger.Error("failed to persist silences", ulog.Error(err))
+	}
+	if !found {
+		http.Error(w, "silence not found", http.StatusNotFound)
+		return
+	}
+
+	s.logger.Info("expired silence", slog.String("id", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// FormatMatchers returns a human-readable representation of the silence's
+// matchers, for display in the web interface.
+func (sl *silence) FormatMatchers() string {
+	parts := make([]string, 0, len(sl.Matchers))
+	for _, m := range sl.Matchers {
+		parts = append(parts, fmt.Sprintf("%s=%q", m.Label, m.Pattern))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/neilotoole/slogt"
+)
+
+func TestSilenceIsActive(t *testing.T) {
+	at := func(day, hour, min int) time.Time {
+		// 2025-03-03 is a Monday.
+		return time.Date(2025, 3, day, hour, min, 0, 0, time.Local)
+	}
+
+	oneOff := &silence{
+		StartsAt: at(3, 10, 0),
+		EndsAt:   at(3, 12, 0),
+	}
+	nightly := &silence{
+		StartsAt:   at(1, 0, 0),
+		Recurrence: &recurrence{Start: "23:30", Duration: "1h"},
+	}
+	weekdays := &silence{
+		StartsAt:   at(1, 0, 0),
+		Recurrence: &recurrence{Start: "02:00", Duration: "1h", Weekdays: []string{"mon", "tue"}},
+	}
+
+	tests := []struct {
+		name    string
+		silence *silence
+		now     time.Time
+		want    bool
+	}{
+		{"one_off_before", oneOff, at(3, 9, 59), false},
+		{"one_off_during", oneOff, at(3, 10, 0), true},
+		{"one_off_after", oneOff, at(3, 12, 0), false},
+		{"nightly_before", nightly, at(3, 23, 29), false},
+		{"nightly_during", nightly, at(3, 23, 45), true},
+		{"nightly_after_midnight", nightly, at(4, 0, 15), true},
+		{"nightly_after", nightly, at(4, 0, 30), false},
+		{"weekdays_monday", weekdays, at(3, 2, 30), true},
+		{"weekdays_wednesday", weekdays, at(5, 2, 30), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.silence.isActive(tt.now); got != tt.want {
+				t.Errorf("isActive(%v) = %v, want %v", tt.now, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSilenceValidate(t *testing.T) {
+	now := time.Now()
+	valid := silence{
+		Matchers:  []silenceMatcher{{Label: labelCheck, Pattern: "backup-*"}},
+		StartsAt:  now,
+		EndsAt:    now.Add(time.Hour),
+		CreatedBy: "alice",
+		Comment:   "planned maintenance",
+	}
+	if err := valid.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*silence)
+	}{
+		{"no_matchers", func(sl *silence) { sl.Matchers = nil }},
+		{"bad_label", func(sl *silence) { sl.Matchers[0].Label = "bogus" }},
+		{"bad_remote_label", func(sl *silence) { sl.Matchers[0].Label = "remote.data-center" }},
+		{"bad_pattern", func(sl *silence) { sl.Matchers[0].Pattern = "[" }},
+		{"no_author", func(sl *silence) { sl.CreatedBy = "" }},
+		{"no_comment", func(sl *silence) { sl.Comment = "" }},
+		{"no_end", func(sl *silence) { sl.EndsAt = time.Time{} }},
+		{"end_before_start", func(sl *silence) { sl.EndsAt = now.Add(-time.Hour) }},
+		{"bad_recurrence_start", func(sl *silence) { sl.Recurrence = &recurrence{Start: "25:00", Duration: "1h"} }},
+		{"bad_recurrence_duration", func(sl *silence) { sl.Recurrence = &recurrence{Start: "02:00", Duration: "25h"} }},
+		{"bad_weekday", func(sl *silence) {
+			sl.Recurrence = &recurrence{Start: "02:00", Duration: "1h", Weekdays: []string{"monday"}}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sl := valid
+			sl.Matchers = []silenceMatcher{valid.Matchers[0]}
+			tt.modify(&sl)
+			if err := sl.validate(); err == nil {
+				t.Error("validate() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestSilenceStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "silences.json")
+	st, err := loadSilences(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	created, err := st.add(silence{
+		Matchers: []silenceMatcher{
+			{Label: labelRemote, Pattern: "db-*"},
+			{Label: labelGroup, Pattern: "backups"},
+		},
+		EndsAt:    now.Add(time.Hour),
+		CreatedBy: "alice",
+		Comment:   "migrating backups",
+	}, now)
+	if err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+
+	results := []serviceResult{
+		{Result: failureResult(), Group: "backups"},
+		{Result: failureResult(), Group: "web"},
+	}
+
+	// Only results from a matching remote and group should be silenced.
+	got := st.apply(results, "db-1:8080", nil, now)
+	if !got[0].Silenced || got[1].Silenced {
+		t.Errorf("apply() silenced = [%v, %v], want [true, false]", got[0].Silenced, got[1].Silenced)
+	}
+	if got[0].IsAlerting() {
+		t.Error("silenced result should not be alerting")
+	}
+	if results[0].Silenced {
+		t.Error("apply() modified its input")
+	}
+	if got := st.apply(results, "", nil, now); got[0].Silenced {
+		t.Error("local result should not match remote matcher")
+	}
+
+	// Silences should survive a reload.
+	st2, err := loadSilences(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := st2.list(); len(got) != 1 || got[0].ID != created.ID {
+		t.Fatalf("reloaded silences = %+v, want one silence with ID %q", got, created.ID)
+	}
+
+	// Expiring a silence should stop it from applying.
+	if found, err := st2.expire(created.ID, now.Add(time.Minute)); !found || err != nil {
+		t.Fatalf("expire() = %v, %v", found, err)
+	}
+	if got := st2.apply(results, "db-1:8080", nil, now.Add(2*time.Minute)); got[0].Silenced {
+		t.Error("expired silence should not apply")
+	}
+	if found, _ := st2.expire("nonexistent", now); found {
+		t.Error("expire() of nonexistent silence returned true")
+	}
+}
+
+func TestSilenceAPI(t *testing.T) {
+	st, err := loadSilences("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &service{
+		logger:   slogt.New(t),
+		silences: st,
+		results:  []serviceResult{{Result: failureResult()}},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/silences", s.handleListSilences)
+	mux.HandleFunc("POST /api/v1/silences", s.handleCreateSilence)
+	mux.HandleFunc("DELETE /api/v1/silences/{id}", s.handleExpireSilence)
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("GET", "/healthz", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("healthz before silence = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	// Invalid silences are rejected.
+	if rec := do("POST", "/api/v1/silences", `{"Matchers": []}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("create invalid silence = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	endsAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	rec := do("POST", "/api/v1/silences", `{
+		"Matchers": [{"Label": "check", "Pattern": "bad.sh"}],
+		"EndsAt": "`+endsAt+`",
+		"CreatedBy": "alice",
+		"Comment": "testing"
+	}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create silence = %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	var created silenceJSON
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Status != "active" {
+		t.Errorf("created silence status = %q, want %q", created.Status, "active")
+	}
+
+	if rec := do("GET", "/healthz?verbose", ""); rec.Code != http.StatusOK {
+		t.Fatalf("healthz with silence = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	} else if !strings.Contains(rec.Body.String(), "[~]bad.sh silenced") {
+		t.Errorf("healthz body missing silenced check:\n%s", rec.Body)
+	}
+
+	var listed []silenceJSON
+	if err := json.Unmarshal(do("GET", "/api/v1/silences?active", "").Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != created.ID {
+		t.Errorf("listed silences = %+v, want [%s]", listed, created.ID)
+	}
+
+	if rec := do("DELETE", "/api/v1/silences/"+created.ID, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expire silence = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec := do("DELETE", "/api/v1/silences/nonexistent", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expire nonexistent silence = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := do("GET", "/healthz", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("healthz after expiry = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestSilenceRemoteLabels(t *testing.T) {
+	st := &silenceStore{}
+	now := time.Now()
+	if _, err := st.add(silence{
+		Matchers:  []silenceMatcher{{Label: "remote.dc", Pattern: "ams"}},
+		EndsAt:    now.Add(time.Hour),
+		CreatedBy: "alice",
+		Comment:   "network maintenance in ams",
+	}, now); err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+
+	results := []serviceResult{{Result: failureResult()}}
+	if got := st.apply(results, "web-1:8080", map[string]string{"dc": "ams"}, now); !got[0].Silenced {
+		t.Error("result from remote with matching label should be silenced")
+	}
+	if got := st.apply(results, "web-1:8080", map[string]string{"dc": "fra"}, now); got[0].Silenced {
+		t.Error("result from remote with other label should not be silenced")
+	}
+	if got := st.apply(results, "", nil, now); got[0].Silenced {
+		t.Error("local result should not be silenced")
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"cmp"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// sloWindow is the rolling window over which SLOs are evaluated.
+const sloWindow = 30 * 24 * time.Hour
+
+// rollingWindows are the rolling windows, ending now, over which
+// availability is reported. The last is [sloWindow].
+var rollingWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", sloWindow},
+}
+
+// availabilityInterval is how often the availability metrics are updated.
+const availabilityInterval = time.Minute
+
+// reportWindow is a period over which availability is reported.
+type reportWindow struct {
+	// Name identifies the window: the length of a rolling window, such
+	// as "7d", or a calendar month, such as "2025-03".
+	Name       string
+	Start, End time.Time
+}
+
+// rollingReportWindows returns the rolling windows ending at now.
+func rollingReportWindows(now time.Time) []reportWindow {
+	var windows []reportWindow
+	for _, w := range rollingWindows {
+		windows = append(windows, reportWindow{Name: w.name, Start: now.Add(-w.d), End: now})
+	}
+	return windows
+}
+
+// monthWindow returns the window for the calendar month starting at month,
+// which ends at now if the month isn't over yet.
+func monthWindow(month, now time.Time) reportWindow {
+	end := month.AddDate(0, 1, 0)
+	if end.After(now) {
+		end = now
+	}
+	return reportWindow{Name: month.Format("2006-01"), Start: month, End: end}
+}
+
+// validate checks that the SLO configuration is well-formed.
+func (slo sloConfig) validate() error {
+	if (slo.Check == "") == (slo.Group == "") {
+		return errors.New("exactly one of Check or Group is required")
+	}
+	p := cmp.Or(slo.Check, slo.Group)
+	if _, err := path.Match(p, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", p, err)
+	}
+	if slo.Target <= 0 || slo.Target >= 100 {
+		return errors.New("Target must be between 0 and 100, exclusive")
+	}
+	return nil
+}
+
+// sloTarget returns the target of the first of slos that applies to the
+// named check, or group if isGroup is true, or zero if none do.
+func sloTarget(slos []sloConfig, name string, isGroup bool) float64 {
+	for _, slo := range slos {
+		pattern := slo.Check
+		if isGroup {
+			pattern = slo.Group
+		}
+		if ok, _ := path.Match(pattern, name); ok && pattern != "" {
+			return slo.Target
+		}
+	}
+	return 0
+}
+
+// availabilityResponse is the response of the availability API.
+type availabilityResponse struct {
+	// Checks are the local checks with history, and Groups the groups
+	// of those checks, sorted by name.
+	Checks []availabilityReport
+	Groups []availabilityReport
+}
+
+// availabilityReport is the availability of a check or group over a set of
+// windows. Like on the status page, time during which a check was silenced,
+// or for which there is no history, counts as neither up nor down, and a
+// group is down whenever any of its checks are.
+type availabilityReport struct {
+	// Name is the name of the check or group.
+	Name string
+
+	// Group is the group of a check, if any.
+	Group string `json:",omitzero"`
+
+	// Windows are the windows that availability is reported over; the
+	// SLO is evaluated over the last.
+	Windows []windowAvailability
+
+	// SLO is the objective for the check or group, if there is one.
+	SLO *sloStatus `json:",omitzero"`
+}
+
+// windowAvailability is the availability of a check or group over a single
+// window.
+type windowAvailability struct {
+	// Window is the name of the window; see [reportWindow].
+	Window     string
+	Start, End time.Time
+
+	// Uptime is the percentage of time that was up, or nil if there is
+	// no history for the window.
+	Uptime *float64 `json:",omitzero"`
+
+	// Up and Down are how long the check or group was up and down.
+	Up, Down time.Duration
+
+	// BurnRate is how fast the SLO's error budget was spent during the
+	// window, as a multiple of the rate that would spend exactly all of
+	// it; nil if there is no SLO or history.
+	BurnRate *float64 `json:",omitzero"`
+}
+
+// sloStatus is the state of a service level objective.
+type sloStatus struct {
+	// Target is the percentage of time that must be up.
+	Target float64
+
+	// BudgetRemaining is the percentage of the error budget, the downtime
+	// allowed by the target, that is left over the last window. It is
+	// negative once the SLO has been missed, and nil if there is no
+	// history.
+	BudgetRemaining *float64 `json:",omitzero"`
+}
+
+// newAvailabilityReport returns the report for a check or group with the
+// given SLO target, or zero for none, where spans returns the history of
+// each of its checks over a window.
+func newAvailabilityReport(name, group string, target float64, windows []reportWindow, spans func(reportWindow) [][]historySpan) availabilityReport {
+	rep := availabilityReport{Name: name, Group: group}
+	for _, w := range windows {
+		up, down := availability(timeline(spans(w)))
+		wa := windowAvailability{
+			Window: w.Name,
+			Start:  w.Start,
+			End:    w.End,
+			Uptime: uptimePercent(up, down),
+			Up:     up,
+			Down:   down,
+		}
+		if target > 0 && up+down > 0 {
+			rate := float64(down) / float64(up+down) / (1 - target/100)
+			wa.BurnRate = &rate
+		}
+		rep.Windows = append(rep.Windows, wa)
+	}
+	if target > 0 {
+		rep.SLO = &sloStatus{Target: target}
+		if rate := rep.Windows[len(rep.Windows)-1].BurnRate; rate != nil {
+			remaining := 100 * (1 - *rate)
+			rep.SLO.BudgetRemaining = &remaining
+		}
+	}
+	return rep
+}
+
+// availabilityReports returns the availability of every check with history,
+// and of every group of them, over each of the windows.
+func (s *service) availabilityReports(windows []reportWindow) availabilityResponse {
+	s.mu.RLock()
+	slos := s.slos
+	s.mu.RUnlock()
+
+	resp := availabilityResponse{Checks: []availabilityReport{}, Groups: []availabilityReport{}}
+	groups := s.history.groups()
+	members := make(map[string][]string)
+	for _, name := range slices.Sorted(maps.Keys(groups)) {
+		group := groups[name]
+		if group != "" {
+			members[group] = append(members[group], name)
+		}
+		resp.Checks = append(resp.Checks, newAvailabilityReport(name, group, sloTarget(slos, name, false), windows, func(w reportWindow) [][]historySpan {
+			return [][]historySpan{s.history.spans(name, w.Start, w.End)}
+		}))
+	}
+	for _, group := range slices.Sorted(maps.Keys(members)) {
+		resp.Groups = append(resp.Groups, newAvailabilityReport(group, "", sloTarget(slos, group, true), windows, func(w reportWindow) [][]historySpan {
+			var spans [][]historySpan
+			for _, name := range members[group] {
+				spans = append(spans, s.history.spans(name, w.Start, w.End))
+			}
+			return spans
+		}))
+	}
+	return resp
+}
+
+// checkAvailability returns the availability of the named check over the
+// rolling windows ending at now, or nil if it has no history.
+func (s *service) checkAvailability(name string, now time.Time) *availabilityReport {
+	group, ok := s.history.groups()[name]
+	if !ok {
+		return nil
+	}
+	s.mu.RLock()
+	slos := s.slos
+	s.mu.RUnlock()
+
+	rep := newAvailabilityReport(name, group, sloTarget(slos, name, false), rollingReportWindows(now), func(w reportWindow) [][]historySpan {
+		return [][]historySpan{s.history.spans(name, w.Start, w.End)}
+	})
+	return &rep
+}
+
+// updateAvailabilityMetrics sets the availability metrics as of now, and
+// removes those of checks, groups and SLOs that no longer have values.
+func (s *service) updateAvailabilityMetrics(now time.Time) {
+	resp := s.availabilityReports(rollingReportWindows(now))
+	set := func(reps []availabilityReport, avail, burn map[string]*floatMap, budget *floatMap) {
+		updated := make(map[*floatMap]map[string]bool)
+		setValue := func(m *floatMap, name string, value float64) {
+			m.Set(name, value)
+			if updated[m] == nil {
+				updated[m] = make(map[string]bool)
+			}
+			updated[m][name] = true
+		}
+		for _, rep := range reps {
+			for _, w := range rep.Windows {
+				if w.Uptime != nil {
+					setValue(avail[w.Window], rep.Name, *w.Uptime/100)
+				}
+				if w.BurnRate != nil {
+					setValue(burn[w.Window], rep.Name, *w.BurnRate)
+				}
+			}
+			if rep.SLO != nil && rep.SLO.BudgetRemaining != nil {
+				setValue(budget, rep.Name, *rep.SLO.BudgetRemaining/100)
+			}
+		}
+		retain := func(m *floatMap) {
+			m.Retain(func(name string) bool { return updated[m][name] })
+		}
+		for _, w := range rollingWindows {
+			retain(avail[w.name])
+			retain(burn[w.name])
+		}
+		retain(budget)
+	}
+	set(resp.Checks, s.metricCheckAvailability, s.metricCheckBurnRate, s.metricCheckBudget)
+	set(resp.Groups, s.metricGroupAvailability, s.metricGroupBurnRate, s.metricGroupBudget)
+}
+
+func (s *service) handleAvailability(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.availabilityReports(rollingReportWindows(time.Now())))
+}
+
+// handleAvailabilityReport returns the availability of every check and group
+// over a calendar month in the server's local time zone, as JSON or, with
+// "format=csv", as CSV.
+func (s *service) handleAvailabilityReport(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	month, err := time.ParseInLocation("2006-01", r.PathValue("month"), now.Location())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid month %q: must be formatted like 2006-01", r.PathValue("month")), http.StatusBadRequest)
+		return
+	}
+	if month.After(now) {
+		http.Error(w, fmt.Sprintf("month %s hasn't started", r.PathValue("month")), http.StatusBadRequest)
+		return
+	}
+
+	window := monthWindow(month, now)
+	resp := s.availabilityReports([]reportWindow{window})
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		writeJSON(w, http.StatusOK, resp)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="upchek-availability-%s.csv"`, window.Name))
+		writeAvailabilityCSV(w, resp)
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+	}
+}
+
+// availabilityCSVHeader is the header row of availability reports in CSV.
+var availabilityCSVHeader = []string{
+	"kind", "name", "group", "start", "end",
+	"uptime_percent", "up_seconds", "down_seconds",
+	"slo_target_percent", "slo_budget_remaining_percent",
+}
+
+// writeAvailabilityCSV writes a report with a single window as CSV, with one
+// row per check and group. Values that aren't known are empty.
+func writeAvailabilityCSV(w http.ResponseWriter, resp availabilityResponse) {
+	formatFloat := func(f *float64) string {
+		if f == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*f, 'f', -1, 64)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write(availabilityCSVHeader)
+	for _, section := range []struct {
+		kind string
+		reps []availabilityReport
+	}{{"check", resp.Checks}, {"group", resp.Groups}} {
+		for _, rep := range section.reps {
+			win := rep.Windows[0]
+			var target, remaining *float64
+			if rep.SLO != nil {
+				target, remaining = &rep.SLO.Target, rep.SLO.BudgetRemaining
+			}
+			cw.Write([]string{
+				section.kind, rep.Name, rep.Group,
+				win.Start.Format(time.RFC3339), win.End.Format(time.RFC3339),
+				formatFloat(win.Uptime),
+				strconv.FormatFloat(win.Up.Seconds(), 'f', -1, 64),
+				strconv.FormatFloat(win.Down.Seconds(), 'f', -1, 64),
+				formatFloat(target), formatFloat(remaining),
+			})
+		}
+	}
+	cw.Flush()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/neilotoole/slogt"
+
+	"github.com/andrew-d/upchek/internal/runner"
+)
+
+func TestSLOTarget(t *testing.T) {
+	slos := []sloConfig{
+		{Check: "db-*.sh", Target: 99.5},
+		{Check: "*", Target: 99},
+		{Group: "api", Target: 99.9},
+	}
+	tests := []struct {
+		name    string
+		isGroup bool
+		want    float64
+	}{
+		{"db-1.sh", false, 99.5},
+		{"web.sh", false, 99},
+		{"api", true, 99.9},
+		{"web", true, 0},
+	}
+	for _, tt := range tests {
+		if got := sloTarget(slos, tt.name, tt.isGroup); got != tt.want {
+			t.Errorf("sloTarget(%q, %v) = %v, want %v", tt.name, tt.isGroup, got, tt.want)
+		}
+	}
+}
+
+func TestMonthWindow(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	month := time.Date(2025, time.February, 1, 0, 0, 0, 0, loc)
+
+	now := time.Date(2025, time.June, 10, 0, 0, 0, 0, loc)
+	want := reportWindow{Name: "2025-02", Start: month, End: time.Date(2025, time.March, 1, 0, 0, 0, 0, loc)}
+	if got := monthWindow(month, now); got != want {
+		t.Errorf("monthWindow() = %+v, want %+v", got, want)
+	}
+
+	// The current month ends now.
+	now = time.Date(2025, time.February, 10, 12, 0, 0, 0, loc)
+	if got := monthWindow(month, now); !got.End.Equal(now) {
+		t.Errorf("monthWindow() of current month ends at %v, want %v", got.End, now)
+	}
+}
+
+func TestAvailabilityReports(t *testing.T) {
+	history, err := loadHistory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &service{
+		logger:  slogt.New(t),
+		history: history,
+		slos:    []sloConfig{{Check: "api-*.sh", Target: 99}, {Group: "api", Target: 90}},
+	}
+
+	result := func(name, group string, ok bool) serviceResult {
+		r := serviceResult{Result: &runner.Result{Name: name}, Group: group, State: statusOK}
+		if !ok {
+			r.ExitCode = 1
+			r.State = statusFailing
+		}
+		return r
+	}
+
+	// Over the last ten hours, api-1.sh was down for the first hour and
+	// api-2.sh for the second.
+	now := time.Now()
+	at := func(hours int) time.Time { return now.Add(time.Duration(hours-10) * time.Hour) }
+	history.record([]serviceResult{result("api-1.sh", "api", false), result("api-2.sh", "api", true), result("db.sh", "", true)}, at(0))
+	history.record([]serviceResult{result("api-1.sh", "api", true), result("api-2.sh", "api", false), result("db.sh", "", true)}, at(1))
+	history.record([]serviceResult{result("api-1.sh", "api", true), result("api-2.sh", "api", true), result("db.sh", "", true)}, at(2))
+	history.record([]serviceResult{result("api-1.sh", "api", true), result("api-2.sh", "api", true), result("db.sh", "", true)}, at(10))
+
+	resp := s.availabilityReports(rollingReportWindows(now))
+	if len(resp.Checks) != 3 || len(resp.Groups) != 1 {
+		t.Fatalf("got %d checks and %d groups, want 3 and 1", len(resp.Checks), len(resp.Groups))
+	}
+
+	api1 := resp.Checks[0]
+	if api1.Name != "api-1.sh" || api1.Group != "api" || len(api1.Windows) != len(rollingWindows) {
+		t.Fatalf("first check = %+v", api1)
+	}
+	for _, w := range api1.Windows {
+		if *w.Uptime != 90 || w.Down != time.Hour || w.Up != 9*time.Hour {
+			t.Errorf("api-1.sh over %s: uptime %v, up %v, down %v; want 90%%, 9h, 1h", w.Window, *w.Uptime, w.Up, w.Down)
+		}
+		// 10% down against a budget of 1% is ten times too fast.
+		if got := *w.BurnRate; got < 9.999 || got > 10.001 {
+			t.Errorf("api-1.sh burn rate over %s = %v, want 10", w.Window, got)
+		}
+	}
+	if got := *api1.SLO.BudgetRemaining; got < -900.1 || got > -899.9 {
+		t.Errorf("api-1.sh budget remaining = %v, want -900", got)
+	}
+
+	// The group is down whenever either check is.
+	api := resp.Groups[0]
+	if w := api.Windows[0]; *w.Uptime != 80 || w.Down != 2*time.Hour {
+		t.Errorf("api group over %s: uptime %v, down %v; want 80%%, 2h", w.Window, *w.Uptime, w.Down)
+	}
+	if api.SLO == nil || api.SLO.Target != 90 {
+		t.Fatalf("api group SLO = %+v", api.SLO)
+	}
+	if got := *api.SLO.BudgetRemaining; got < -100.1 || got > -99.9 {
+		t.Errorf("api group budget remaining = %v, want -100", got)
+	}
+
+	db := resp.Checks[2]
+	if db.SLO != nil || db.Windows[0].BurnRate != nil || *db.Windows[0].Uptime != 100 {
+		t.Errorf("db.sh = %+v, want 100%% uptime and no SLO", db)
+	}
+
+	if got := s.checkAvailability("api-2.sh", now); got == nil || *got.Windows[0].Uptime != 90 {
+		t.Errorf("checkAvailability(api-2.sh) = %+v", got)
+	}
+	if got := s.checkAvailability("nonexistent", now); got != nil {
+		t.Errorf("checkAvailability(nonexistent) = %+v, want nil", got)
+	}
+
+	s.initMetrics()
+	s.updateAvailabilityMetrics(now)
+	if got := s.metricCheckAvailability["24h"].Get("api-1.sh").String(); got != "0.9" {
+		t.Errorf("24h availability metric of api-1.sh = %s, want 0.9", got)
+	}
+	if got := s.metricGroupAvailability["7d"].Get("api").String(); got != "0.8" {
+		t.Errorf("7d availability metric of api = %s, want 0.8", got)
+	}
+	if got := s.metricCheckBudget.Get("db.sh"); got != nil {
+		t.Errorf("budget metric of db.sh without an SLO = %s", got)
+	}
+
+	// Metrics of SLOs that are removed disappear on the next update.
+	s.slos = []sloConfig{{Check: "api-2.sh", Target: 99}}
+	s.updateAvailabilityMetrics(now)
+	if got := s.metricCheckBudget.Get("api-1.sh"); got != nil {
+		t.Errorf("budget metric of api-1.sh after its SLO was removed = %s", got)
+	}
+	if got := s.metricGroupBurnRate["24h"].Get("api"); got != nil {
+		t.Errorf("burn rate metric of api after its SLO was removed = %s", got)
+	}
+	if got := s.metricCheckBudget.Get("api-2.sh"); got == nil {
+		t.Error("budget metric of api-2.sh is missing")
+	}
+	if got := s.metricCheckAvailability["24h"].Get("api-1.sh"); got == nil {
+		t.Error("availability metric of api-1.sh is missing")
+	}
+}
+
+func TestAvailabilityReportAPI(t *testing.T) {
+	history, err := loadHistory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &service{
+		logger:  slogt.New(t),
+		history: history,
+		slos:    []sloConfig{{Group: "*", Target: 99.5}},
+	}
+	// web.sh was up for an hour of last month.
+	now := time.Now()
+	y, m, _ := now.Date()
+	lastMonth := time.Date(y, m-1, 1, 0, 0, 0, 0, now.Location())
+	ok := serviceResult{Result: &runner.Result{Name: "web.sh"}, Group: "web", State: statusOK}
+	history.record([]serviceResult{ok}, lastMonth.Add(time.Hour))
+	history.record([]serviceResult{ok}, lastMonth.Add(2*time.Hour))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/availability/{month}", s.handleAvailabilityReport)
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec
+	}
+
+	month := lastMonth.Format("2006-01")
+	rec := get("/api/v1/availability/" + month + "?format=csv")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("CSV report = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Disposition"); !strings.Contains(got, "upchek-availability-"+month+".csv") {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, end := lastMonth.Format(time.RFC3339), lastMonth.AddDate(0, 1, 0).Format(time.RFC3339)
+	want := [][]string{
+		{"kind", "name", "group", "start", "end", "uptime_percent", "up_seconds", "down_seconds", "slo_target_percent", "slo_budget_remaining_percent"},
+		{"check", "web.sh", "web", start, end, "100", "3600", "0", "", ""},
+		{"group", "web", "", start, end, "100", "3600", "0", "99.5", "100"},
+	}
+	if diff := cmp.Diff(want, rows); diff != "" {
+		t.Errorf("CSV report mismatch (-want +got):\n%s", diff)
+	}
+
+	for target, want := range map[string]int{
+		"/api/v1/availability/" + now.Format("2006-01"):                  http.StatusOK,
+		"/api/v1/availability/" + month + "?format=xml":                  http.StatusBadRequest,
+		"/api/v1/availability/2025-13":                                   http.StatusBadRequest,
+		"/api/v1/availability/" + now.AddDate(0, 2, 0).Format("2006-01"): http.StatusBadRequest,
+	} {
+		if rec := get(target); rec.Code != want {
+			t.Errorf("GET %s = %d, want %d: %s", target, rec.Code, want, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"time"
+)
+
+// checkStatus is the status of a check, either as observed on a single run or
+// as the confirmed state of the check.
+type checkStatus string
+
+const (
+	statusOK      checkStatus = "ok"
+	statusFailing checkStatus = "failing"
+
+	// statusError means that the check's script couldn't be run at all,
+	// e.g. because its sandbox couldn't be set up.
+	statusError checkStatus = "error"
+)
+
+// stateType indicates whether a check's current state has been confirmed.
+type stateType string
+
+const (
+	// stateHard means that the most recent run agrees with the check's
+	// confirmed state.
+	stateHard stateType = "hard"
+
+	// stateSoft means that the most recent run disagrees with the check's
+	// confirmed state, but the check has not yet reached the threshold
+	// required to change it.
+	stateSoft stateType = "soft"
+)
+
+// stateTracker tracks the confirmed state of a single check across runs,
+// implementing the "fail after N" / "recover after M" thresholds and flap
+// detection.
+//
+// The zero value is ready to use, and starts in the ok state.
+type stateTracker struct {
+	// state is the confirmed ("hard") state of the check.
+	state checkStatus
+
+	// last is the status of the most recent run.
+	last checkStatus
+
+	// attempt is the number of consecutive runs that have returned the
+	// same status as last.
+	attempt int
+
+	// changes holds the times at which the status of a run differed from
+	// the run before it, for flap detection. It is pruned to the flap
+	// window on every observation.
+	changes []time.Time
+
+	// flapping is whether the check is currently considered flapping.
+	flapping bool
+}
+
+// observe records the result of a single run at time now, and updates the
+// tracker's state according to cfg.
+func (st *stateTracker) observe(now time.Time, success bool, cfg checkConfig) {
+	status := statusFailing
+	if success {
+		status = statusOK
+	}
+	st.observeStatus(now, status, cfg)
+}
+
+// observeStatus is like observe, but records an arbitrary status. Any status
+// other than statusOK counts towards cfg.FailAfter.
+func (st *stateTracker) observeStatus(now time.Time, status checkStatus, cfg checkConfig) {
+	if st.state == "" {
+		st.state = statusOK
+	}
+
+	if status == st.last {
+		st.attempt++
+	} else {
+		if st.last != "" {
+			st.changes = append(st.changes, now)
+		}
+		st.last = status
+		st.attempt = 1
+	}
+
+	// Transition the hard state once we've seen enough consecutive runs
+	// that disagree with it.
+	if status != st.state {
+		threshold := cfg.FailAfter
+		if status == statusOK {
+			threshold = cfg.RecoverAfter
+		}
+		if st.attempt >= max(threshold, 1) {
+			st.state = status
+		}
+	}
+
+	// Prune changes outside of the flap window and update whether we're
+	// flapping.
+	cutoff := now.Add(-cfg.FlapWindow)
+	i := 0
+	for i < len(st.changes) && !st.changes[i].After(cutoff) {
+		i++
+	}
+	st.changes = st.changes[i:]
+	st.flapping = cfg.FlapThreshold > 0 && len(st.changes) >= cfg.FlapThreshold
+}
+
+// stateType returns whether the tracker's state is soft or hard.
+func (st *stateTracker) stateType() stateType {
+	if st.last != "" && st.last != st.state {
+		return stateSoft
+	}
+	return stateHard
+}
+
+// apply copies the tracker's state into the given result.
+func (st *stateTracker) apply(r *serviceResult) {
+	r.State = st.state
+	r.StateType = st.stateType()
+	r.Attempt = st.attempt
+	r.Flapping = st.flapping
+}
+
+// nextAttempt returns the attempt number of the next run: 1 if the check is
+// in a hard state, or one more than the current attempt if it is retrying.
+func (st *stateTracker) nextAttempt() int {
+	if st.stateType() == stateSoft {
+		return st.attempt + 1
+	}
+	return 1
+}
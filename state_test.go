@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andrew-d/upchek/internal/runner"
+)
+
+func TestStateTracker(t *testing.T) {
+	cfg := checkConfig{
+		FailAfter:    3,
+		RecoverAfter: 2,
+		FlapWindow:   time.Hour,
+	}
+
+	type step struct {
+		success   bool
+		wantState checkStatus
+		wantType  stateType
+	}
+	steps := []step{
+		{true, statusOK, stateHard},
+		{false, statusOK, stateSoft},
+		{false, statusOK, stateSoft},
+		{false, statusFailing, stateHard},
+		{false, statusFailing, stateHard},
+		{true, statusFailing, stateSoft},
+		{false, statusFailing, stateHard},
+		{true, statusFailing, stateSoft},
+		{true, statusOK, stateHard},
+	}
+
+	var st stateTracker
+	now := time.Unix(1741397010, 0)
+	for i, step := range steps {
+		now = now.Add(time.Second)
+		st.observe(now, step.success, cfg)
+		if st.state != step.wantState {
+			t.Errorf("step %d: state = %q, want %q", i, st.state, step.wantState)
+		}
+		if got := st.stateType(); got != step.wantType {
+			t.Errorf("step %d: stateType = %q, want %q", i, got, step.wantType)
+		}
+	}
+}
+
+func TestStateTrackerDefaultThresholds(t *testing.T) {
+	// A zero config should behave like a threshold of 1.
+	var st stateTracker
+	now := time.Unix(1741397010, 0)
+
+	st.observe(now, false, checkConfig{})
+	if st.state != statusFailing {
+		t.Errorf("state = %q, want %q", st.state, statusFailing)
+	}
+	st.observe(now, true, checkConfig{})
+	if st.state != statusOK {
+		t.Errorf("state = %q, want %q", st.state, statusOK)
+	}
+}
+
+func TestStateTrackerError(t *testing.T) {
+	cfg := checkConfig{FailAfter: 2, RecoverAfter: 1}
+	var st stateTracker
+	now := time.Unix(1741397010, 0)
+
+	st.observeStatus(now, statusError, cfg)
+	if st.state != statusOK || st.stateType() != stateSoft {
+		t.Errorf("after one error: state = %q (%s), want soft ok", st.state, st.stateType())
+	}
+	st.observeStatus(now, statusError, cfg)
+	if st.state != statusError {
+		t.Errorf("after two errors: state = %q, want %q", st.state, statusError)
+	}
+	st.observeStatus(now, statusOK, cfg)
+	if st.state != statusOK {
+		t.Errorf("after recovery: state = %q, want %q", st.state, statusOK)
+	}
+}
+
+func TestStateTrackerFlapping(t *testing.T) {
+	cfg := checkConfig{
+		FailAfter:     1,
+		RecoverAfter:  1,
+		FlapWindow:    10 * time.Minute,
+		FlapThreshold: 3,
+	}
+
+	var st stateTracker
+	now := time.Unix(1741397010, 0)
+
+	// Alternate between success and failure; the 4th run is the third
+	// change, which should trigger flapping.
+	for i, success := range []bool{true, false, true, false} {
+		now = now.Add(time.Minute)
+		st.observe(now, success, cfg)
+		if want := i == 3; st.flapping != want {
+			t.Fatalf("run %d: flapping = %v, want %v", i, st.flapping, want)
+		}
+	}
+
+	// Once the changes age out of the window, the check should stop
+	// flapping.
+	now = now.Add(9 * time.Minute)
+	st.observe(now, false, cfg)
+	if st.flapping {
+		t.Errorf("flapping = true after changes aged out of window")
+	}
+}
+
+func TestServiceResultIsHealthy(t *testing.T) {
+	tests := []struct {
+		name   string
+		result serviceResult
+		want   bool
+	}{
+		{"no_state_success", serviceResult{Result: successResult()}, true},
+		{"no_state_failure", serviceResult{Result: failureResult()}, false},
+		{"soft_failure", serviceResult{Result: failureResult(), State: statusOK, StateType: stateSoft}, true},
+		{"soft_recovery", serviceResult{Result: successResult(), State: statusFailing, StateType: stateSoft}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.result.IsHealthy(); got != tt.want {
+				t.Errorf("IsHealthy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func successResult() *runner.Result {
+	return &runner.Result{Name: "good.sh", ExitCode: 0}
+}
+
+func failureResult() *runner.Result {
+	return &runner.Result{Name: "bad.sh", ExitCode: 1}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/andrew-d/upchek/internal/ulog"
+)
+
+// statusPageDays is the number of days of history shown on the status page.
+const statusPageDays = 90
+
+// statusPageMaxAge is how long clients and proxies may cache the status
+// page, which anyone can request, and how long the server reuses its data;
+// see [statusPageCache].
+const statusPageMaxAge = 30 * time.Second
+
+// componentState is the state of a component on the status page.
+type componentState string
+
+const (
+	// componentOperational means that none of the component's checks are
+	// failing.
+	componentOperational componentState = "operational"
+
+	// componentDegraded means that some, but not all, of the component's
+	// checks are failing.
+	componentDegraded componentState = "degraded"
+
+	// componentOutage means that all of the component's checks are
+	// failing.
+	componentOutage componentState = "outage"
+)
+
+// componentStateOf returns the state of a component with the given number of
+// checks that are up and down. Silenced checks count as neither, and a
+// component without any checks that count is operational.
+func componentStateOf(up, down int) componentState {
+	switch {
+	case down == 0:
+		return componentOperational
+	case up == 0:
+		return componentOutage
+	default:
+		return componentDegraded
+	}
+}
+
+// worse returns the more severe of two states; the empty state, for no data,
+// is the least severe.
+func worse(a, b componentState) componentState {
+	rank := func(s componentState) int {
+		return slices.Index([]componentState{componentOperational, componentDegraded, componentOutage}, s)
+	}
+	if rank(b) > rank(a) {
+		return b
+	}
+	return a
+}
+
+// validate checks that the component configuration is well-formed.
+func (c componentConfig) validate() error {
+	if len(c.Checks) == 0 && len(c.Groups) == 0 {
+		return errors.New("at least one of Checks or Groups is required")
+	}
+	for _, p := range slices.Concat(c.Checks, c.Groups) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// matches returns whether a check with the given qualified name and group
+// belongs to the component.
+func (c componentConfig) matches(name, group string) bool {
+	for _, p := range c.Checks {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	if group == "" {
+		return false
+	}
+	for _, p := range c.Groups {
+		if ok, _ := path.Match(p, group); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// statusPageData is the data for the status page, and the response of the
+// status API.
+type statusPageData struct {
+	// Title is the title of the page.
+	Title string
+
+	// State is the most severe state of any component.
+	State componentState
+
+	// Components are the configured components, in order.
+	Components []componentStatus
+
+	// Incidents are the ongoing incidents, and PastIncidents those that
+	// have been resolved, newest first.
+	Incidents     []incident `json:",omitzero"`
+	PastIncidents []incident `json:",omitzero"`
+
+	// Updated is the time that the page was generated.
+	Updated time.Time
+}
+
+// componentStatus is the state and history of a single component.
+type componentStatus struct {
+	Name        string
+	Description string `json:",omitzero"`
+
+	// State is the current state of the component.
+	State componentState
+
+	// Uptime is the percentage of the last statusPageDays days during
+	// which none of the component's checks were failing, or nil if there
+	// is no history.
+	Uptime *float64 `json:",omitzero"`
+
+	// Days summarises each of the last statusPageDays days, oldest
+	// first.
+	Days []componentDay
+}
+
+// componentDay summarises the history of a component over a single day, in
+// the server's local time zone.
+type componentDay struct {
+	// Date is the day, as "2006-01-02".
+	Date string
+
+	// State is the most severe state of the component during the day, or
+	// empty if there is no history for the day.
+	State componentState `json:",omitzero"`
+
+	// Uptime is the percentage of the day, out of the time for which
+	// there is history, during which none of the component's checks were
+	// failing; or nil if there is no history.
+	Uptime *float64 `json:",omitzero"`
+}
+
+// getStatusPageData returns the data for the status page as of time now, or
+// false if the status page is disabled.
+func (s *service) getStatusPageData(now time.Time) (statusPageData, bool) {
+	s.mu.RLock()
+	cfg := s.statusPage
+	s.mu.RUnlock()
+	if len(cfg.Components) == 0 {
+		return statusPageData{}, false
+	}
+
+	data := statusPageData{
+		Title:   cmp.Or(cfg.Title, "Status"),
+		State:   componentOperational,
+		Updated: now,
+	}
+
+	// Days start at local midnight; the last one is today, so far.
+	y, m, d := now.Date()
+	var days []time.Time
+	for i := statusPageDays - 1; i >= 0; i-- {
+		days = append(days, time.Date(y, m, d-i, 0, 0, 0, 0, now.Location()))
+	}
+
+	results := s.localResults()
+	groups := s.history.groups()
+	for _, comp := range cfg.Components {
+		var up, down int
+		for _, r := range results {
+			if !comp.matches(r.Name, r.Group) {
+				continue
+			}
+			switch historyStatusOf(r) {
+			case historyUp:
+				up++
+			case historyDown:
+				down++
+			}
+		}
+
+		var spans [][]historySpan
+		for name, group := range groups {
+			if comp.matches(name, group) {
+				spans = append(spans, s.history.spans(name, days[0], now))
+			}
+		}
+		segs := timeline(spans)
+
+		status := componentStatus{
+			Name:        comp.Name,
+			Description: comp.Description,
+			State:       componentStateOf(up, down),
+			Uptime:      uptimePercent(availability(segs)),
+		}
+		for i, start := range days {
+			end := now
+			if i+1 < len(days) {
+				end = days[i+1]
+			}
+			day := componentDay{Date: start.Format(time.DateOnly)}
+			daySegs := clipSegments(segs, start, end)
+			for _, seg := range daySegs {
+				if seg.Up+seg.Down > 0 {
+					day.State = worse(day.State, componentStateOf(seg.Up, seg.Down))
+				}
+			}
+			day.Uptime = uptimePercent(availability(daySegs))
+			status.Days = append(status.Days, day)
+		}
+		data.State = worse(data.State, status.State)
+		data.Components = append(data.Components, status)
+	}
+
+	for _, inc := range s.incidents.list() {
+		switch {
+		case inc.ResolvedAt.IsZero():
+			data.Incidents = append(data.Incidents, inc.public())
+		case now.Sub(inc.ResolvedAt) < incidentRetention:
+			data.PastIncidents = append(data.PastIncidents, inc.public())
+		}
+	}
+	return data, true
+}
+
+// statusPageCache holds the data for the status page. It's costly to
+// compute from the history, and anyone can request it, so it's computed at
+// most once every [statusPageMaxAge], unless the status page's
+// configuration or incidents change.
+type statusPageCache struct {
+	mu   sync.Mutex
+	data statusPageData
+	ok   bool
+	at   time.Time // when data was computed; zero if it must be recomputed
+}
+
+// cachedStatusPageData is like [service.getStatusPageData], but returns the
+// cached data if it was computed less than [statusPageMaxAge] before now.
+func (s *service) cachedStatusPageData(now time.Time) (statusPageData, bool) {
+	c := &s.statusPageCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.at.IsZero() || now.Before(c.at) || now.Sub(c.at) >= statusPageMaxAge {
+		c.data, c.ok = s.getStatusPageData(now)
+		c.at = now
+	}
+	return c.data, c.ok
+}
+
+// invalidateStatusPage discards the cached status page data, so that
+// changes to the configuration or incidents are shown at once.
+//
+// s.mu must not be held.
+func (s *service) invalidateStatusPage() {
+	s.statusPageCache.mu.Lock()
+	defer s.statusPageCache.mu.Unlock()
+	s.statusPageCache.at = time.Time{}
+}
+
+// validateComponents returns an error if any of names isn't the name of a
+// configured component.
+func (s *service) validateComponents(names []string) error {
+	s.mu.RLock()
+	components := s.statusPage.Components
+	s.mu.RUnlock()
+
+	for _, name := range names {
+		if !slices.ContainsFunc(components, func(c componentConfig) bool { return c.Name == name }) {
+			return fmt.Errorf("unknown component %q", name)
+		}
+	}
+	return nil
+}
+
+// handleStatusPage renders the public status page. It never requires a
+// token, so must not show anything about individual checks.
+func (s *service) handleStatusPage(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.cachedStatusPageData(time.Now())
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(statusPageMaxAge.Seconds())))
+	if err := s.statusTemplate().Execute(w, data); err != nil {
+		s.logger.Error("failed to render status page", ulog.Error(err))
+	}
+}
+
+// handleStatusAPI returns the data shown on the status page as JSON. Like
+// the page, it never requires a token.
+func (s *service) handleStatusAPI(w http.ResponseWriter, r *http.Request) {
+	data, ok := s.cachedStatusPageData(time.Now())
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(statusPageMaxAge.Seconds())))
+	writeJSON(w, http.StatusOK, data)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-json-experiment/json"
+	"github.com/neilotoole/slogt"
+
+	"github.com/andrew-d/upchek/internal/runner"
+)
+
+func TestComponentMatches(t *testing.T) {
+	comp := componentConfig{
+		Checks: []string{"db:*", "web.sh"},
+		Groups: []string{"api-*"},
+	}
+	tests := []struct {
+		name, group string
+		want        bool
+	}{
+		{"web.sh", "", true},
+		{"db:replication.sh", "", true},
+		{"web.sh@login", "", false},
+		{"api.sh", "api-eu", true},
+		{"api.sh", "api", false},
+		{"disk.sh", "", false},
+	}
+	for _, tt := range tests {
+		if got := comp.matches(tt.name, tt.group); got != tt.want {
+			t.Errorf("matches(%q, %q) = %v, want %v", tt.name, tt.group, got, tt.want)
+		}
+	}
+}
+
+func TestComponentStateOf(t *testing.T) {
+	tests := []struct {
+		up, down int
+		want     componentState
+	}{
+		{0, 0, componentOperational},
+		{2, 0, componentOperational},
+		{1, 1, componentDegraded},
+		{0, 2, componentOutage},
+	}
+	for _, tt := range tests {
+		if got := componentStateOf(tt.up, tt.down); got != tt.want {
+			t.Errorf("componentStateOf(%d, %d) = %q, want %q", tt.up, tt.down, got, tt.want)
+		}
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	history, err := loadHistory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	incidents, err := loadIncidents("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slogt.New(t)
+
+	result := func(name, group string, ok bool) serviceResult {
+		r := serviceResult{Result: &runner.Result{Name: name, Stdout: "secret output"}, Group: group, State: statusOK}
+		if !ok {
+			r.ExitCode = 1
+			r.State = statusFailing
+		}
+		return r
+	}
+	s := &service{
+		logger:         logger,
+		history:        history,
+		incidents:      incidents,
+		statusTemplate: registerTemplate(logger, nil, "status.html.tmpl", embeddedStatus),
+		results: []serviceResult{
+			result("api-1.sh", "api", true),
+			result("api-2.sh", "api", false),
+			result("db.sh", "", true),
+		},
+		auth: authState{
+			tokens:         map[string]tokenConfig{"secret": {Name: "ops", Role: roleRead}},
+			requireForRead: true,
+		},
+		statusPage: statusPageConfig{
+			Title: "Example status",
+			Components: []componentConfig{
+				{Name: "API", Groups: []string{"api"}},
+				{Name: "Database", Description: "Primary and replicas", Checks: []string{"db.sh"}},
+			},
+		},
+	}
+
+	// The API was down for the first hour of yesterday, and the database
+	// has no history.
+	now := time.Now()
+	y, m, d := now.Date()
+	yesterday := time.Date(y, m, d-1, 0, 0, 0, 0, time.Local)
+	history.record([]serviceResult{result("api-1.sh", "api", false)}, yesterday)
+	history.record([]serviceResult{result("api-1.sh", "api", true)}, yesterday.Add(time.Hour))
+	history.record([]serviceResult{result("api-1.sh", "api", true)}, yesterday.Add(4*time.Hour))
+
+	if _, err := incidents.add(newIncident{
+		Title:          "API errors",
+		Components:     []string{"API"},
+		incidentUpdate: incidentUpdate{Message: "Looking into it", CreatedBy: "alice"},
+	}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	data, ok := s.getStatusPageData(now)
+	if !ok {
+		t.Fatal("status page is disabled")
+	}
+	if data.State != componentDegraded {
+		t.Errorf("State = %q, want %q", data.State, componentDegraded)
+	}
+	api, db := data.Components[0], data.Components[1]
+	if api.State != componentDegraded || db.State != componentOperational {
+		t.Errorf("component states = %q, %q; want degraded, operational", api.State, db.State)
+	}
+	if len(api.Days) != statusPageDays {
+		t.Fatalf("got %d days, want %d", len(api.Days), statusPageDays)
+	}
+	day := api.Days[len(api.Days)-2]
+	if day.Date != yesterday.Format(time.DateOnly) || day.State != componentOutage || day.Uptime == nil || *day.Uptime != 75 {
+		t.Errorf("yesterday = %+v, want an outage with 75%% uptime", day)
+	}
+	if day := api.Days[0]; day.State != "" || day.Uptime != nil {
+		t.Errorf("first day = %+v, want no data", day)
+	}
+	if api.Uptime == nil || *api.Uptime != 75 {
+		t.Errorf("API uptime = %v, want 75", api.Uptime)
+	}
+	if db.Uptime != nil {
+		t.Errorf("database uptime = %v, want nil", *db.Uptime)
+	}
+	if len(data.Incidents) != 1 || data.Incidents[0].Updates[0].CreatedBy != "" {
+		t.Errorf("Incidents = %+v, want one incident without its author", data.Incidents)
+	}
+
+	// The status page and its API are public, even though reads require
+	// a token, and don't show anything about individual checks.
+	for _, set := range []routeSet{routesAll, routesStatus} {
+		mux := (&app{logger: logger, service: s}).routes(set)
+		get := func(path string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+			return rec
+		}
+		for _, path := range []string{"/status", "/api/v1/status"} {
+			rec := get(path)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s: GET %s = %d, want %d", set, path, rec.Code, http.StatusOK)
+			}
+			body := rec.Body.String()
+			for _, secret := range []string{"api-1.sh", "secret output", "alice"} {
+				if strings.Contains(body, secret) {
+					t.Errorf("%s: GET %s shows %q", set, path, secret)
+				}
+			}
+			if !strings.Contains(body, "Primary and replicas") {
+				t.Errorf("%s: GET %s doesn't show component description:\n%s", set, path, body)
+			}
+		}
+		if rec := get("/api/v1/results"); set == routesStatus && rec.Code != http.StatusNotFound {
+			t.Errorf("%s: GET /api/v1/results = %d, want %d", set, rec.Code, http.StatusNotFound)
+		} else if set == routesAll && rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: GET /api/v1/results = %d, want %d", set, rec.Code, http.StatusUnauthorized)
+		}
+	}
+
+	var got statusPageData
+	rec := httptest.NewRecorder()
+	s.handleStatusAPI(rec, httptest.NewRequest("GET", "/api/v1/status", nil))
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Example status" || len(got.Components) != 2 {
+		t.Errorf("status API = %+v", got)
+	}
+
+	// The data is cached, so a recovery isn't shown until it expires or
+	// is invalidated.
+	s.mu.Lock()
+	s.results[1] = result("api-2.sh", "api", true)
+	s.mu.Unlock()
+	if data, _ := s.cachedStatusPageData(time.Now()); data.State != componentDegraded {
+		t.Errorf("cached State = %q, want %q", data.State, componentDegraded)
+	}
+	if data, _ := s.cachedStatusPageData(time.Now().Add(statusPageMaxAge)); data.State != componentOperational {
+		t.Errorf("State after max age = %q, want %q", data.State, componentOperational)
+	}
+
+	// Without components, the status page is disabled.
+	s.statusPage = statusPageConfig{}
+	s.invalidateStatusPage()
+	rec = httptest.NewRecorder()
+	s.handleStatusPage(rec, httptest.NewRequest("GET", "/status", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /status without components = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
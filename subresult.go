@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/andrew-d/upchek/internal/runner"
+	"github.com/go-json-experiment/json"
+)
+
+// subResultSep separates the name of a check from the name of one of its
+// sub-results, e.g. "raid.sh@md0".
+const subResultSep = "@"
+
+// maxSubResults is the maximum number of sub-results that a single run of a
+// check can report; any more are ignored.
+const maxSubResults = 1000
+
+// staleSubResultTTL is how long a stale sub-result is kept after it was last
+// reported, before it is forgotten.
+const staleSubResultTTL = 24 * time.Hour
+
+// outputFormat is the format of a check's standard output, which determines
+// whether sub-results are parsed from it. Sub-results are always parsed from
+// the metadata file descriptor, regardless of the format.
+type outputFormat string
+
+const (
+	// formatText is plain text output; the zero value is the same.
+	formatText outputFormat = "text"
+
+	// formatJSONLines is output in which each line that starts with "{"
+	// is a sub-result; see [parseJSONLines].
+	formatJSONLines outputFormat = "jsonl"
+
+	// formatTAP is the Test Anything Protocol, in which each test is a
+	// sub-result; see [parseTAP].
+	formatTAP outputFormat = "tap"
+
+	// formatJUnit is a JUnit XML report, in which each test case is a
+	// sub-result; see [parseJUnit].
+	formatJUnit outputFormat = "junit"
+)
+
+// statusSkipped is the status of a sub-result for a test that was skipped.
+// It is only used for sub-results, and counts as ok.
+const statusSkipped checkStatus = "skipped"
+
+// subResult is a single named result reported by a check's script.
+type subResult struct {
+	Name   string      `json:"name"`
+	Status checkStatus `json:"status"`
+	Output string      `json:"output,omitzero"`
+
+	// Message is a short explanation of the status, such as a test's
+	// failure message.
+	Message string `json:"message,omitzero"`
+
+	// Duration is how long the test took, if known.
+	Duration time.Duration `json:"duration,omitzero"`
+}
+
+// subCheck tracks a sub-result of a check across runs of its script.
+type subCheck struct {
+	// state tracks the confirmed state of the sub-result.
+	state stateTracker
+
+	// result is the most recent result of the sub-result.
+	result *serviceResult
+
+	// lastSeen is when the sub-result was last reported by the script.
+	lastSeen time.Time
+}
+
+// subResults returns the sub-results reported by a run of a check: those
+// written to the metadata file descriptor, followed by those from stdout if
+// format says that it contains any. If the same name is reported more than
+// once, the last one wins.
+//
+// Invalid sub-results are skipped, and reported in the returned error.
+func (format outputFormat) subResults(result *runner.Result) ([]subResult, error) {
+	subs, err := parseJSONLines(result.Metadata)
+
+	var (
+		stdoutSubs []subResult
+		stdoutErr  error
+	)
+	switch format {
+	case formatJSONLines:
+		stdoutSubs, stdoutErr = parseJSONLines(result.Stdout)
+	case formatTAP:
+		stdoutSubs, stdoutErr = parseTAP(result.Stdout)
+	case formatJUnit:
+		stdoutSubs, stdoutErr = parseJUnit(result.Stdout)
+	}
+	subs = append(subs, stdoutSubs...)
+	err = errors.Join(err, stdoutErr)
+
+	// Deduplicate, keeping the position of the first.
+	index := make(map[string]int, len(subs))
+	var deduped []subResult
+	for _, sub := range subs {
+		if i, ok := index[sub.Name]; ok {
+			deduped[i] = sub
+			continue
+		}
+		if len(deduped) >= maxSubResults {
+			err = errors.Join(err, fmt.Errorf("more than %d sub-results; ignoring the rest", maxSubResults))
+			break
+		}
+		index[sub.Name] = len(deduped)
+		deduped = append(deduped, sub)
+	}
+	return deduped, err
+}
+
+// parseJSONLines parses sub-results from data, in which each line that starts
+// with "{" is a JSON object such as:
+//
+//	{"name": "md0", "status": "failing", "output": "degraded"}
+//
+// The status must be "ok", "failing" or "skipped". The optional "message" is a
+// short explanation of the status, and "duration" is a duration such as
+// "1.5s". Other lines are ignored, so that sub-results can be mixed with
+// ordinary output.
+func parseJSONLines(data string) ([]subResult, error) {
+	var (
+		subs []subResult
+		errs []error
+	)
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+
+		var sub subResult
+		if err := json.Unmarshal([]byte(line), &sub); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", i+1, err))
+			continue
+		}
+		if err := validateSubResultName(sub.Name); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", i+1, err))
+			continue
+		}
+		switch sub.Status {
+		case statusOK, statusFailing, statusSkipped:
+		default:
+			errs = append(errs, fmt.Errorf("line %d: status must be %q, %q or %q", i+1, statusOK, statusFailing, statusSkipped))
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	return subs, errors.Join(errs...)
+}
+
+// validateSubResultName returns an error if name can't be used as the name of
+// a sub-result, since it would be ambiguous in a qualified name or a
+// dependency.
+func validateSubResultName(name string) error {
+	if name == "" {
+		return fmt.Errorf("sub-result name must not be empty")
+	}
+	if strings.ContainsFunc(name, isInvalidSubResultRune) {
+		return fmt.Errorf("sub-result name %q must not contain spaces, %q, %q or %q", name, ":", "/", subResultSep)
+	}
+	return nil
+}
+
+// isInvalidSubResultRune reports whether r can't be used in the name of a
+// sub-result; see [validateSubResultName].
+func isInvalidSubResultRune(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(":/"+subResultSep, r)
+}
+
+// testNames returns subs with each name made into a valid sub-result name, by
+// replacing invalid characters with "_", and made unique by appending "_2",
+// "_3" and so on to repeated names. It is used for test names, which often
+// contain spaces or slashes.
+func testNames(subs []subResult) []subResult {
+	seen := make(map[string]bool, len(subs))
+	for i := range subs {
+		name := strings.Map(func(r rune) rune {
+			if isInvalidSubResultRune(r) {
+				return '_'
+			}
+			return r
+		}, subs[i].Name)
+		if name == "" {
+			name = "test_" + strconv.Itoa(i+1)
+		}
+		unique := name
+		for n := 2; seen[unique]; n++ {
+			unique = name + "_" + strconv.Itoa(n)
+		}
+		seen[unique] = true
+		subs[i].Name = unique
+	}
+	return subs
+}
+
+// cutSubResult splits the name of a sub-result into the name of its check and
+// the name of the sub-result. ok is false if name is not that of a
+// sub-result.
+func cutSubResult(name string) (parent, sub string, ok bool) {
+	i := strings.LastIndex(name, subResultSep)
+	if i < 0 {
+		return "", "", false
+	}
+	return name[:i], name[i+len(subResultSep):], true
+}
+
+// updateSubResults updates the check's sub-results from those reported by the
+// run with the provided result.
+//
+// Sub-results that were reported by an earlier run but not by this one are
+// kept and marked as stale, until they haven't been reported for
+// [staleSubResultTTL] and are forgotten. By default, a stale sub-result is ok,
+// so that renaming or removing a test doesn't alert; with the check's OnStale
+// set to staleActionFail, it is observed as failing instead, since whatever
+// it was checking may have disappeared.
+func (c *check) updateSubResults(parent *serviceResult, reported []subResult) {
+	if c.subs == nil {
+		c.subs = make(map[string]*subCheck)
+	}
+	now := parent.LastRun
+
+	var names []string
+	seen := make(map[string]bool, len(reported))
+	for _, sub := range reported {
+		sc := c.subs[sub.Name]
+		if sc == nil {
+			sc = &subCheck{}
+			c.subs[sub.Name] = sc
+		}
+		sc.lastSeen = now
+
+		exitCode := 0
+		if sub.Status == statusFailing {
+			exitCode = 1
+		}
+		result := serviceResult{
+			Result: &runner.Result{
+				Name:     parent.Name + subResultSep + sub.Name,
+				ExitCode: exitCode,
+				Stdout:   sub.Output,
+			},
+			LastRun:   now,
+			Namespace: parent.Namespace,
+			Parent:    parent.Name,
+			Skipped:   sub.Status == statusSkipped,
+			Message:   sub.Message,
+			Duration:  sub.Duration,
+		}
+		sc.state.observeStatus(now, result.runStatus(), c.cfg)
+		sc.state.apply(&result)
+		sc.result = &result
+
+		names = append(names, sub.Name)
+		seen[sub.Name] = true
+	}
+
+	for _, name := range c.subNames {
+		if seen[name] {
+			continue
+		}
+		sc := c.subs[name]
+		if now.Sub(sc.lastSeen) > staleSubResultTTL {
+			delete(c.subs, name)
+			continue
+		}
+
+		result := *sc.result
+		result.Result = &runner.Result{
+			Name:   result.Name,
+			Stdout: result.Stdout,
+			Stderr: fmt.Sprintf("not reported by %s since %s\n", parent.Name, sc.lastSeen.Format(time.DateTime)),
+		}
+		result.Stale = true
+		result.Skipped = false
+		if c.cfg.OnStale == staleActionFail {
+			result.ExitCode = -1
+			sc.state.observeStatus(now, statusFailing, c.cfg)
+		} else {
+			// Start over, so that a sub-result that was failing
+			// stops alerting straight away rather than after
+			// RecoverAfter runs.
+			sc.state = stateTracker{}
+			sc.state.observeStatus(now, statusOK, c.cfg)
+		}
+		sc.state.apply(&result)
+		sc.result = &result
+		names = append(names, name)
+	}
+	c.subNames = names
+}
+
+// subResults returns the most recent results of the check's sub-results, in
+// the order in which they were last reported, with stale sub-results last.
+func (c *check) subResults() []serviceResult {
+	var results []serviceResult
+	for _, name := range c.subNames {
+		results = append(results, *c.subs[name].result)
+	}
+	return results
+}
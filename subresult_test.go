@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andrew-d/upchek/internal/runner"
+	"github.com/google/go-cmp/cmp"
+	"github.com/neilotoole/slogt"
+)
+
+func TestParseJSONLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []subResult
+		wantErr bool
+	}{
+		{
+			name: "mixed_output",
+			data: "checking arrays\n" +
+				`{"name": "md0", "status": "ok"}` + "\n" +
+				`  {"name": "md1", "status": "failing", "output": "degraded", "extra": 1}` + "\n" +
+				"done\n",
+			want: []subResult{
+				{Name: "md0", Status: statusOK},
+				{Name: "md1", Status: statusFailing, Output: "degraded"},
+			},
+		},
+		{
+			name: "details",
+			data: `{"name": "backup", "status": "skipped", "message": "not configured", "duration": "1.5s"}`,
+			want: []subResult{
+				{Name: "backup", Status: statusSkipped, Message: "not configured", Duration: 1500 * time.Millisecond},
+			},
+		},
+		{
+			name:    "invalid_json",
+			data:    "{\"name\": \"md0\"\n" + `{"name": "md1", "status": "ok"}`,
+			want:    []subResult{{Name: "md1", Status: statusOK}},
+			wantErr: true,
+		},
+		{
+			name:    "bad_status",
+			data:    `{"name": "md0", "status": "warning"}`,
+			wantErr: true,
+		},
+		{
+			name:    "bad_name",
+			data:    `{"name": "a@b", "status": "ok"}` + "\n" + `{"name": "", "status": "ok"}`,
+			wantErr: true,
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseJSONLines(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseJSONLines() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("parseJSONLines() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUpdateSubResults(t *testing.T) {
+	c := &check{cfg: checkConfig{FailAfter: 1}}
+	start := time.Unix(1000, 0)
+	run := func(at time.Time, subs ...subResult) []serviceResult {
+		parent := &serviceResult{
+			Result:    &runner.Result{Name: "ns:raid.sh"},
+			LastRun:   at,
+			Namespace: "ns",
+		}
+		c.updateSubResults(parent, subs)
+		return c.subResults()
+	}
+	summary := func(results []serviceResult) []string {
+		var s []string
+		for _, r := range results {
+			state := string(r.State)
+			if r.Stale {
+				state += " stale"
+			}
+			s = append(s, r.Name+" "+state)
+		}
+		return s
+	}
+
+	got := run(start,
+		subResult{Name: "md0", Status: statusOK},
+		subResult{Name: "md1", Status: statusFailing, Output: "degraded"})
+	want := []string{"ns:raid.sh@md0 ok", "ns:raid.sh@md1 failing"}
+	if diff := cmp.Diff(want, summary(got)); diff != "" {
+		t.Errorf("first run mismatch (-want +got):\n%s", diff)
+	}
+	if got[1].Parent != "ns:raid.sh" || got[1].Namespace != "ns" || got[1].Stdout != "degraded" {
+		t.Errorf("sub-result = %+v, want parent, namespace and output set", got[1])
+	}
+
+	// Skipped tests are ok.
+	got = run(start, subResult{Name: "md0", Status: statusSkipped}, subResult{Name: "md1", Status: statusFailing})
+	if !got[0].IsHealthy() || !got[0].Skipped || got[1].Skipped {
+		t.Errorf("skipped sub-result: IsHealthy() = %v, Skipped = %v", got[0].IsHealthy(), got[0].Skipped)
+	}
+
+	// md1 disappears while failing, so it becomes stale, but stops
+	// alerting.
+	got = run(start.Add(time.Minute), subResult{Name: "md0", Status: statusOK})
+	want = []string{"ns:raid.sh@md0 ok", "ns:raid.sh@md1 ok stale"}
+	if diff := cmp.Diff(want, summary(got)); diff != "" {
+		t.Errorf("second run mismatch (-want +got):\n%s", diff)
+	}
+	if !got[1].LastRun.Equal(start) {
+		t.Errorf("stale LastRun = %v, want %v", got[1].LastRun, start)
+	}
+	if got[1].IsAlerting() {
+		t.Errorf("stale sub-result is alerting, want it to be ignored")
+	}
+
+	// It comes back failing, and then disappears again with on-stale=fail,
+	// so it fails.
+	c.cfg.OnStale = staleActionFail
+	run(start.Add(2*time.Minute), subResult{Name: "md1", Status: statusFailing})
+	got = run(start.Add(3*time.Minute), subResult{Name: "md0", Status: statusOK})
+	want = []string{"ns:raid.sh@md0 ok", "ns:raid.sh@md1 failing stale"}
+	if diff := cmp.Diff(want, summary(got)); diff != "" {
+		t.Errorf("third run mismatch (-want +got):\n%s", diff)
+	}
+	got = run(start.Add(4*time.Minute), subResult{Name: "md1", Status: statusOK})
+	want = []string{"ns:raid.sh@md1 ok", "ns:raid.sh@md0 failing stale"}
+	if diff := cmp.Diff(want, summary(got)); diff != "" {
+		t.Errorf("fourth run mismatch (-want +got):\n%s", diff)
+	}
+
+	// Once it's been gone long enough, it is forgotten.
+	got = run(start.Add(staleSubResultTTL+time.Hour), subResult{Name: "md1", Status: statusOK})
+	want = []string{"ns:raid.sh@md1 ok"}
+	if diff := cmp.Diff(want, summary(got)); diff != "" {
+		t.Errorf("fifth run mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRunScriptsSubResults(t *testing.T) {
+	dir := t.TempDir()
+	scripts := map[string]string{
+		// Reports one sub-result on the metadata file descriptor and
+		// another on stdout.
+		"multi.sh": `#!/bin/sh
+# upchek: output-format=jsonl
+echo '{"name": "disk", "status": "failing", "output": "full"}' >&3
+echo '{"name": "net", "status": "ok"}'
+`,
+		// Depends on a sub-result, and so must run after multi.sh
+		// despite sorting before it.
+		"a.sh": "#!/bin/sh\n# upchek: depends=multi.sh@disk\necho dependent\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &service{
+		logger:        slogt.New(t),
+		dirs:          []directoryConfig{{Path: dir}},
+		checkDefaults: checkConfig{Interval: time.Minute},
+	}
+	s.initMetrics()
+	if err := s.runScripts(t.Context()); err != nil {
+		t.Fatalf("runScripts() error = %v", err)
+	}
+
+	var names []string
+	for _, r := range s.results {
+		names = append(names, r.Name)
+	}
+	want := []string{"a.sh", "multi.sh", "multi.sh@disk", "multi.sh@net"}
+	if diff := cmp.Diff(want, names); diff != "" {
+		t.Fatalf("results mismatch (-want +got):\n%s", diff)
+	}
+
+	if r := s.results[0]; !r.Suppressed || !cmp.Equal(r.SuppressedBy, []string{"multi.sh@disk"}) {
+		t.Errorf("dependent: Suppressed = %v, SuppressedBy = %v; want suppressed by multi.sh@disk", r.Suppressed, r.SuppressedBy)
+	}
+	if r := s.results[2]; r.IsHealthy() || r.Parent != "multi.sh" || r.Stdout != "full" {
+		t.Errorf("disk = %+v, want failing with output", r)
+	}
+	if r := s.results[3]; !r.IsHealthy() {
+		t.Errorf("net = %+v, want healthy", r)
+	}
+}
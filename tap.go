@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseTAP parses the output of a test runner that speaks the Test Anything
+// Protocol, such as bats or prove, into one sub-result per test point:
+//
+//	TAP version 13
+//	1..3
+//	ok 1 - mounts are writable
+//	not ok 2 - disk has free space
+//	# (in test file disk.bats, line 12)
+//	ok 3 - backups are recent # SKIP no backups configured
+//
+// Test points with a SKIP directive are skipped, as are failing test points
+// with a TODO directive, since TAP doesn't count those as failures. Comment
+// lines following a test point are its message. A YAML diagnostic block
+// following a test point is its output, and its "message" and "duration_ms"
+// keys, if present, are its message and duration.
+//
+// Test descriptions are made into sub-result names with [testNames]. Indented
+// subtests are ignored, apart from their summary test point. An error is
+// returned if the output contains "Bail out!" or fewer test points than were
+// planned.
+func parseTAP(data string) ([]subResult, error) {
+	var (
+		subs    []subResult
+		planned = -1
+		errs    []error
+
+		inYAML     bool
+		yamlIndent string
+		yaml       []string
+	)
+	endYAML := func() {
+		inYAML = false
+		applyTAPYAML(&subs[len(subs)-1], yaml)
+	}
+
+	for line := range strings.SplitSeq(data, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+
+		if inYAML {
+			if trimmed == "..." {
+				endYAML()
+			} else {
+				yaml = append(yaml, strings.TrimPrefix(line, yamlIndent))
+			}
+			continue
+		}
+
+		switch {
+		case trimmed == "---" && line != trimmed && len(subs) > 0:
+			inYAML = true
+			yamlIndent = line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+			yaml = nil
+		case line != strings.TrimLeft(line, " \t"):
+			// Subtests and other indented lines.
+		case strings.HasPrefix(line, "#"):
+			if len(subs) > 0 {
+				sub := &subs[len(subs)-1]
+				comment := strings.TrimPrefix(strings.TrimPrefix(line, "#"), " ")
+				if sub.Message != "" {
+					sub.Message += "\n"
+				}
+				sub.Message += comment
+			}
+		case strings.HasPrefix(line, "Bail out!"):
+			errs = append(errs, fmt.Errorf("test run bailed out: %s", strings.TrimSpace(strings.TrimPrefix(line, "Bail out!"))))
+		case strings.HasPrefix(line, "1.."):
+			count, _, _ := strings.Cut(strings.TrimPrefix(line, "1.."), " ")
+			if n, err := strconv.Atoi(count); err == nil {
+				planned = n
+			}
+		default:
+			if sub, ok := parseTestPoint(line); ok {
+				subs = append(subs, sub)
+			}
+		}
+	}
+	if inYAML {
+		endYAML()
+	}
+
+	if planned >= 0 && len(subs) < planned {
+		errs = append(errs, fmt.Errorf("planned %d tests, but only %d ran", planned, len(subs)))
+	}
+	return testNames(subs), errors.Join(errs...)
+}
+
+// parseTestPoint parses a TAP test point line such as "not ok 2 - name # TODO
+// reason", returning false if line is not a test point.
+func parseTestPoint(line string) (subResult, bool) {
+	var sub subResult
+	rest, ok := strings.CutPrefix(line, "not ok")
+	if ok {
+		sub.Status = statusFailing
+	} else if rest, ok = strings.CutPrefix(line, "ok"); ok {
+		sub.Status = statusOK
+	} else {
+		return subResult{}, false
+	}
+	if rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+		return subResult{}, false
+	}
+
+	// The test number and the "-" before the description are optional.
+	rest = strings.TrimSpace(rest)
+	i := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(rest)
+	}
+	num := rest[:i]
+	rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest[i:]), "-"))
+
+	desc, directive, _ := strings.Cut(rest, "#")
+	sub.Name = strings.TrimSpace(desc)
+	if sub.Name == "" && num != "" {
+		sub.Name = "test_" + num
+	}
+
+	keyword, reason, _ := strings.Cut(strings.TrimSpace(directive), " ")
+	reason = strings.TrimSpace(reason)
+	switch keyword = strings.ToUpper(keyword); {
+	case strings.HasPrefix(keyword, "SKIP"):
+		sub.Status = statusSkipped
+		sub.Message = reason
+	case strings.HasPrefix(keyword, "TODO") && sub.Status == statusFailing:
+		sub.Status = statusSkipped
+		sub.Message = strings.TrimSpace("TODO " + reason)
+	}
+	return sub, true
+}
+
+// applyTAPYAML sets the output of sub to the lines of a YAML diagnostic block,
+// and its message and duration from the block's "message" and "duration_ms"
+// keys. Only simple top-level scalar values are understood.
+func applyTAPYAML(sub *subResult, lines []string) {
+	sub.Output = strings.Join(lines, "\n")
+	for _, line := range lines {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || key != strings.TrimSpace(key) {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		switch key {
+		case "message":
+			if value != "" && value != "|" && value != ">" {
+				sub.Message = value
+			}
+		case "duration_ms":
+			if ms, err := strconv.ParseFloat(value, 64); err == nil && ms >= 0 {
+				sub.Duration = time.Duration(ms * float64(time.Millisecond))
+			}
+		}
+	}
+}
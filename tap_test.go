@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseTAP(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []subResult
+		wantErr bool
+	}{
+		{
+			name: "bats",
+			data: "1..4\n" +
+				"ok 1 mounts are writable\n" +
+				"not ok 2 disk has free space\n" +
+				"# (in test file disk.bats, line 12)\n" +
+				"#   `[ \"$free\" -gt 10 ]' failed\n" +
+				"ok 3 backups are recent # skip no backups configured\n" +
+				"not ok 4 - flaky # TODO fix the network\n",
+			want: []subResult{
+				{Name: "mounts_are_writable", Status: statusOK},
+				{
+					Name:    "disk_has_free_space",
+					Status:  statusFailing,
+					Message: "(in test file disk.bats, line 12)\n  `[ \"$free\" -gt 10 ]' failed",
+				},
+				{Name: "backups_are_recent", Status: statusSkipped, Message: "no backups configured"},
+				{Name: "flaky", Status: statusSkipped, Message: "TODO fix the network"},
+			},
+		},
+		{
+			name: "yaml_diagnostics",
+			data: "TAP version 13\n" +
+				"1..2\n" +
+				"not ok 1 - GET /status\n" +
+				"  ---\n" +
+				"  message: 'status 500'\n" +
+				"  duration_ms: 12.5\n" +
+				"  ...\n" +
+				"    # Subtest: nested\n" +
+				"    ok 1 - ignored\n" +
+				"ok 2\n",
+			want: []subResult{
+				{
+					Name:     "GET__status",
+					Status:   statusFailing,
+					Output:   "message: 'status 500'\nduration_ms: 12.5",
+					Message:  "status 500",
+					Duration: 12500 * time.Microsecond,
+				},
+				{Name: "test_2", Status: statusOK},
+			},
+		},
+		{
+			name: "duplicate_names",
+			data: "ok 1 - same\nok 2 - same\n",
+			want: []subResult{
+				{Name: "same", Status: statusOK},
+				{Name: "same_2", Status: statusOK},
+			},
+		},
+		{
+			name:    "missing_tests",
+			data:    "1..3\nok 1 - first\n",
+			want:    []subResult{{Name: "first", Status: statusOK}},
+			wantErr: true,
+		},
+		{
+			name:    "bail_out",
+			data:    "1..2\nok 1 - first\nBail out! database is down\n",
+			want:    []subResult{{Name: "first", Status: statusOK}},
+			wantErr: true,
+		},
+		{
+			name: "not_tap",
+			data: "okay then\nhello\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTAP(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseTAP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("parseTAP() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -2,72 +2,213 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"html/template"
-	"io"
+	"io/fs"
 	"log/slog"
+	"math"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/andrew-d/upchek/internal/buildtags"
 	"github.com/andrew-d/upchek/internal/ulog"
 )
 
-// registerTemplate returns a function that will return a template. In dev
-// mode, the template will be reloaded from disk on every call; in prod, the
-// provided embedded template data will be used.
+// templateFuncs are the functions available to all templates, including
+// custom templates loaded from the template directory.
+var templateFuncs = template.FuncMap{
+	"ansi":        ansiToHTML,
+	"duration":    formatDuration,
+	"ago":         func(t time.Time) string { return relativeTime(t, time.Now()) },
+	"statusClass": statusClass,
+	"statusText":  statusText,
+	"join":        func(sep string, elems []string) string { return strings.Join(elems, sep) },
+	"percent":     formatPercent,
+	"number":      formatNumber,
+}
+
+// registerTemplate returns a function that will return the template with the
+// given name. If the directory returned by dir contains a file with that
+// name, the template is loaded from it, and reloaded whenever the file
+// changes; otherwise, the provided embedded template is used. In dev mode,
+// templates are loaded from the current directory if dir is nil or returns
+// "".
 //
-// If an error occurs when parsing the template, the returned function will
-// log an error and return the embedded template.
+// If an error occurs when reading or parsing the template from disk, the
+// returned function will log an error and return the embedded template.
 //
 // If the embedded template does not parse, this function will panic.
-func registerTemplate(log *slog.Logger, path string, embedded []byte) func() *template.Template {
+func registerTemplate(log *slog.Logger, dir func() string, name string, embedded []byte) func() *template.Template {
 	// Parse early so we can panic if the embedded template is
 	// invalid.
-	t, err := template.New(path).Parse(string(embedded))
+	t, err := template.New(name).Funcs(templateFuncs).Parse(string(embedded))
 	if err != nil {
-		log.Error("parsing embedded template", slog.String("path", path), ulog.Error(err))
+		log.Error("parsing embedded template", slog.String("name", name), ulog.Error(err))
 		panic(err)
 	}
 
-	if !buildtags.IsDev {
-		log.Debug("production mode, using embedded template")
-		return func() *template.Template { return t }
-	}
-
-	log.Debug("development mode, reloading template from disk")
-
 	var (
+		mu        sync.Mutex // protects following
+		lastPath  string
 		lastData  []byte
 		lastTdisk *template.Template
 	)
 	return func() *template.Template {
-		// Parse the template on every call so we can reload it from disk.
-		f, err := os.Open(path)
-		if err != nil {
-			log.Error("opening template file", slog.String("path", path), ulog.Error(err))
+		var d string
+		if dir != nil {
+			d = dir()
+		}
+		if d == "" && buildtags.IsDev {
+			d = "."
+		}
+		if d == "" {
 			return t
 		}
-		defer f.Close()
 
-		tdata, err := io.ReadAll(f)
-		if err != nil {
+		// Read the template on every call so we can reload it from disk.
+		path := filepath.Join(d, name)
+		tdata, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Not overridden.
+			return t
+		} else if err != nil {
 			log.Error("reading template file", slog.String("path", path), ulog.Error(err))
 			return t
 		}
-		if bytes.Equal(tdata, lastData) {
+
+		mu.Lock()
+		defer mu.Unlock()
+		if path == lastPath && bytes.Equal(tdata, lastData) {
 			return lastTdisk
 		}
 
-		tdisk, err := template.New(path).Parse(string(tdata))
+		tdisk, err := template.New(name).Funcs(templateFuncs).Parse(string(tdata))
 		if err != nil {
-			log.Error("parsing template file", slog.String("path", path), ulog.Error(err))
+			log.Error("parsing template file; using embedded template", slog.String("path", path), ulog.Error(err))
 			return t
 		}
 
 		if lastTdisk != nil {
-			log.Debug("reloaded template from disk", slog.String("path", path))
+			log.Info("reloaded template from disk", slog.String("path", path))
 		}
+		lastPath = path
 		lastData = tdata
 		lastTdisk = tdisk
 		return tdisk
 	}
 }
+
+// customTemplateDir returns the directory that templates and static assets
+// are loaded from, or "" if the built-in templates are used.
+func (s *service) customTemplateDir() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.templateDir
+}
+
+// staticHandler returns a handler that serves static assets, such as CSS
+// and images for custom templates, from the "static" subdirectory of the
+// directory returned by dir. Directory listings aren't served.
+func staticHandler(dir func() string) http.Handler {
+	return http.StripPrefix("/static/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := dir()
+		if d == "" || r.URL.Path == "" || strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		http.FileServer(http.Dir(filepath.Join(d, "static"))).ServeHTTP(w, r)
+	}))
+}
+
+// formatDuration formats d with a precision to suit its size, e.g. "850ms",
+// "12.3s", "4m10s" or "2h5m".
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	case d < time.Minute:
+		return d.Round(100 * time.Millisecond).String()
+	case d < time.Hour:
+		return d.Round(time.Second).String()
+	default:
+		return strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+	}
+}
+
+// relativeTime describes t relative to now in whole units, rounded down, e.g.
+// "5m ago" or "in 2h". The zero time is "never".
+func relativeTime(t, now time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	d := now.Sub(t)
+	future := d < 0
+	if future {
+		d = -d
+	}
+
+	var s string
+	switch {
+	case d < time.Second:
+		return "just now"
+	case d < time.Minute:
+		s = fmt.Sprintf("%ds", d/time.Second)
+	case d < time.Hour:
+		s = fmt.Sprintf("%dm", d/time.Minute)
+	case d < 24*time.Hour:
+		s = fmt.Sprintf("%dh", d/time.Hour)
+	default:
+		s = fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	if future {
+		return "in " + s
+	}
+	return s + " ago"
+}
+
+// formatPercent formats a percentage with up to two decimal places, rounding
+// down so that anything short of 100 isn't shown as "100%".
+func formatPercent(pct float64) string {
+	s := strconv.FormatFloat(math.Floor(pct*100+1e-9)/100, 'f', 2, 64)
+	return strings.TrimSuffix(s, ".00") + "%"
+}
+
+// formatNumber formats a number with up to two decimal places.
+func formatNumber(f float64) string {
+	s := strconv.FormatFloat(f, 'f', 2, 64)
+	return strings.TrimSuffix(s, ".00")
+}
+
+// statusClass returns the CSS class name that describes the state of a
+// result: "success", "suppressed", "silenced" or "error".
+func statusClass(r serviceResult) string {
+	switch {
+	case r.IsHealthy():
+		return "success"
+	case r.Suppressed:
+		return "suppressed"
+	case r.Silenced:
+		return "silenced"
+	default:
+		return "error"
+	}
+}
+
+// statusText returns the state of a result as shown to users: "ok",
+// "error" or "failing".
+func statusText(r serviceResult) string {
+	switch {
+	case r.IsHealthy():
+		return "ok"
+	case r.IsError():
+		return "error"
+	default:
+		return "failing"
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+)
+
+func TestRegisterTemplate(t *testing.T) {
+	var dir string
+	get := registerTemplate(slogt.New(t), func() string { return dir }, "page.html.tmpl", []byte("embedded"))
+	render := func() string {
+		t.Helper()
+		var sb strings.Builder
+		if err := get().Execute(&sb, nil); err != nil {
+			t.Fatal(err)
+		}
+		return sb.String()
+	}
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, "page.html.tmpl"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := render(); got != "embedded" {
+		t.Errorf("without template dir: got %q", got)
+	}
+
+	// A template directory that doesn't override this template.
+	dir = t.TempDir()
+	if got := render(); got != "embedded" {
+		t.Errorf("not overridden: got %q", got)
+	}
+
+	write(`custom {{duration 1500000000}}`)
+	if got := render(); got != "custom 1.5s" {
+		t.Errorf("overridden: got %q", got)
+	}
+
+	// Changes are picked up without a restart, and a template that
+	// doesn't parse falls back to the embedded one.
+	write(`changed`)
+	if got := render(); got != "changed" {
+		t.Errorf("after change: got %q", got)
+	}
+	write(`{{if}}`)
+	if got := render(); got != "embedded" {
+		t.Errorf("after parse error: got %q", got)
+	}
+}
+
+func TestStaticHandler(t *testing.T) {
+	var dir string
+	h := staticHandler(func() string { return dir })
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	if rec := get("/static/style.css"); rec.Code != http.StatusNotFound {
+		t.Errorf("without template dir: got %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	dir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "static", "img"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "static", "style.css"), []byte("body {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.html.tmpl"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := get("/static/style.css")
+	if rec.Code != http.StatusOK || rec.Body.String() != "body {}" || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/css") {
+		t.Errorf("style.css: got %d %q (%s)", rec.Code, rec.Body, rec.Header().Get("Content-Type"))
+	}
+	for _, path := range []string{"/static/", "/static/img/", "/static/../index.html.tmpl"} {
+		if rec := get(path); rec.Code == http.StatusOK {
+			t.Errorf("%s: got %d, want an error", path, rec.Code)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0s"},
+		{850*time.Millisecond + 300*time.Microsecond, "850ms"},
+		{12345 * time.Millisecond, "12.3s"},
+		{4*time.Minute + 10*time.Second + 400*time.Millisecond, "4m10s"},
+		{2*time.Hour + 5*time.Minute + 20*time.Second, "2h5m"},
+	}
+	for _, tt := range tests {
+		if got := formatDuration(tt.d); got != tt.want {
+			t.Errorf("formatDuration(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestRelativeTime(t *testing.T) {
+	now := time.Unix(1741397010, 0)
+	tests := []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Time{}, "never"},
+		{now.Add(-100 * time.Millisecond), "just now"},
+		{now.Add(-42 * time.Second), "42s ago"},
+		{now.Add(-5*time.Minute - 59*time.Second), "5m ago"},
+		{now.Add(-3 * time.Hour), "3h ago"},
+		{now.Add(-50 * time.Hour), "2d ago"},
+		{now.Add(2 * time.Hour), "in 2h"},
+	}
+	for _, tt := range tests {
+		if got := relativeTime(tt.t, now); got != tt.want {
+			t.Errorf("relativeTime(%v) = %q, want %q", tt.t, got, tt.want)
+		}
+	}
+}
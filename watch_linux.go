@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// watchFile returns a channel that receives a value whenever the file at path
+// may have changed, until ctx is done. The file's directory is watched rather
+// than the file itself, so that the file being created, deleted or replaced by
+// renaming another file over it, as editors and configuration management
+// tools do, is noticed. Any change in the directory counts, which also covers
+// files that are symlinks swapped out by a change elsewhere in the directory,
+// as in Kubernetes ConfigMap volumes.
+func watchFile(ctx context.Context, path string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("creating inotify instance: %w", err)
+	}
+	const mask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+	if _, err := syscall.InotifyAddWatch(fd, filepath.Dir(path), mask); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("watching %q: %w", filepath.Dir(path), err)
+	}
+
+	// The descriptor is non-blocking, so reads from f go through the
+	// runtime's poller, and closing f interrupts them.
+	f := os.NewFile(uintptr(fd), "inotify")
+	context.AfterFunc(ctx, func() { f.Close() })
+
+	changed := make(chan struct{}, 1)
+	go func() {
+		// The events themselves don't matter, only that there were
+		// some, including if the queue overflowed.
+		buf := make([]byte, 4096)
+		for {
+			if _, err := f.Read(buf); err != nil {
+				return
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changed, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// watchFile would watch the file at path for changes; it is not supported on
+// this platform, so files are only polled.
+func watchFile(ctx context.Context, path string) (<-chan struct{}, error) {
+	return nil, errors.New("watching files is not supported on this platform")
+}